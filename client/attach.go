@@ -0,0 +1,250 @@
+package cli
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/listen"
+	"github.com/spolu/warp/lib/plex"
+)
+
+// AttachPath returns the path of the attach unix socket of a detached warp.
+func AttachPath(
+	w string,
+) string {
+	return path.Join(
+		os.TempDir(),
+		fmt.Sprintf("_warp_%s.attach.sock", w),
+	)
+}
+
+// PidPath returns the path of the pidfile of a detached warp.
+func PidPath(
+	w string,
+) string {
+	return path.Join(
+		os.TempDir(),
+		fmt.Sprintf("_warp_%s.pid", w),
+	)
+}
+
+// LogPath returns the path of the file where the output of a detached warp
+// process is logged.
+func LogPath(
+	w string,
+) string {
+	return path.Join(
+		os.TempDir(),
+		fmt.Sprintf("_warp_%s.log", w),
+	)
+}
+
+// attachKeepAlive is the keep alive interval of the multiplexer used over
+// attach sockets.
+const attachKeepAlive = 2 * time.Second
+
+// AttachSrv serves the attach unix socket of a detached warp. At most one
+// terminal is attached at a time, a new attachment replacing the previous
+// one. The attached terminal opens two channels over a yamux session: a size
+// channel (gob encoded warp.Size) and a data channel.
+type AttachSrv struct {
+	warp string
+	path string
+
+	onData func([]byte)
+	onSize func(warp.Size)
+
+	mux   *yamux.Session
+	dataC net.Conn
+	mutex *sync.Mutex
+}
+
+// NewAttachSrv constructs an AttachSrv. onData is called with the data typed
+// in the attached terminal and onSize each time its size changes.
+func NewAttachSrv(
+	ctx context.Context,
+	w string,
+	onData func([]byte),
+	onSize func(warp.Size),
+) *AttachSrv {
+	return &AttachSrv{
+		warp:   w,
+		path:   AttachPath(w),
+		onData: onData,
+		onSize: onSize,
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// Run starts the attach server.
+func (s *AttachSrv) Run(
+	ctx context.Context,
+) error {
+	syscall.Unlink(s.path)
+
+	ln, err := net.Listen("unix", s.path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := listen.Accept(ctx, ln, nil)
+		if errors.Cause(err) == net.ErrClosed {
+			return nil
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		go func() {
+			s.handle(ctx, conn)
+		}()
+	}
+}
+
+// Write writes data to the attached terminal if any.
+func (s *AttachSrv) Write(
+	data []byte,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.dataC != nil {
+		s.dataC.Write(data)
+	}
+}
+
+// handle an attaching terminal.
+func (s *AttachSrv) handle(
+	ctx context.Context,
+	conn net.Conn,
+) error {
+	defer conn.Close()
+
+	mux, err := yamux.Server(conn, warp.MuxConfig(attachKeepAlive, ioutil.Discard))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer mux.Close()
+
+	sizeC, err := mux.Accept()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	dataC, err := mux.Accept()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Replace any previously attached terminal.
+	s.mutex.Lock()
+	if s.mux != nil {
+		s.mux.Close()
+	}
+	s.mux = mux
+	s.dataC = dataC
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		if s.mux == mux {
+			s.mux = nil
+			s.dataC = nil
+		}
+		s.mutex.Unlock()
+	}()
+
+	go func() {
+		sizeR := gob.NewDecoder(sizeC)
+		for {
+			var size warp.Size
+			if err := sizeR.Decode(&size); err != nil {
+				mux.Close()
+				return
+			}
+			s.onSize(size)
+		}
+	}()
+
+	plex.Run(ctx, s.onData, dataC)
+
+	return nil
+}
+
+// Attachment is a terminal attached to a detached warp.
+type Attachment struct {
+	mux   *yamux.Session
+	sizeC net.Conn
+	sizeW *gob.Encoder
+	dataC net.Conn
+	mutex *sync.Mutex
+}
+
+// Attach connects to the attach socket of a detached warp.
+func Attach(
+	ctx context.Context,
+	w string,
+) (*Attachment, error) {
+	conn, err := net.Dial("unix", AttachPath(w))
+	if err != nil {
+		return nil, errors.Trace(
+			errors.Newf("No detached warp running with ID %s: %v", w, err),
+		)
+	}
+
+	mux, err := yamux.Client(conn, warp.MuxConfig(attachKeepAlive, ioutil.Discard))
+	if err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	a := &Attachment{
+		mux:   mux,
+		mutex: &sync.Mutex{},
+	}
+
+	if a.sizeC, err = mux.Open(); err != nil {
+		mux.Close()
+		return nil, errors.Trace(err)
+	}
+	a.sizeW = gob.NewEncoder(a.sizeC)
+	if a.dataC, err = mux.Open(); err != nil {
+		mux.Close()
+		return nil, errors.Trace(err)
+	}
+
+	return a, nil
+}
+
+// DataC returns the data channel of the attachment.
+func (a *Attachment) DataC() net.Conn {
+	return a.dataC
+}
+
+// SendSize sends the size of the attached terminal.
+func (a *Attachment) SendSize(
+	size warp.Size,
+) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return errors.Trace(a.sizeW.Encode(size))
+}
+
+// Close closes the attachment, leaving the detached warp running.
+func (a *Attachment) Close() {
+	a.mux.Close()
+}
@@ -0,0 +1,172 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/spolu/warp"
+)
+
+// chatPrompt is the prompt of the input line of a ChatPrompt.
+const chatPrompt = "> "
+
+// ChatPrompt is the line editor of `warp chat`, run on a raw terminal. It
+// keeps the line being typed on the last row of the terminal and prints the
+// messages received above it, redrawing the line after each of them so that
+// typing is never disrupted by incoming messages.
+type ChatPrompt struct {
+	fd int
+	w  io.Writer
+
+	line []rune
+	// partial is the incomplete UTF-8 character ending the last input.
+	partial []byte
+	// state is the state of the parser skipping the escape sequences of the
+	// input (arrow keys...), ss3 set while skipping an SS3 sequence.
+	state escState
+	ss3   bool
+
+	mutex *sync.Mutex
+}
+
+// NewChatPrompt constructs a ChatPrompt drawing to w, fd being the file
+// descriptor of the local terminal used to retrieve its size.
+func NewChatPrompt(
+	fd int,
+	w io.Writer,
+) *ChatPrompt {
+	return &ChatPrompt{
+		fd:    fd,
+		w:     w,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Draw draws the input line.
+func (p *ChatPrompt) Draw() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.draw()
+}
+
+// draw redraws the input line. It expects the lock to be held.
+func (p *ChatPrompt) draw() {
+	line := p.line
+	// Only the end of lines longer than the terminal is displayed, so that
+	// the line never wraps.
+	if width, _, err := terminal.GetSize(p.fd); err == nil {
+		max := width - utf8.RuneCountInString(chatPrompt) - 1
+		if max > 0 && len(line) > max {
+			line = line[len(line)-max:]
+		}
+	}
+	fmt.Fprintf(p.w, "\r\033[K%s%s", chatPrompt, string(line))
+}
+
+// Print prints a message above the input line, notices from warpd being
+// dimmed.
+func (p *ChatPrompt) Print(
+	msg warp.ChatMessage,
+) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if msg.From == "" {
+		fmt.Fprintf(p.w, "\r\033[K\033[2m%s %s\033[0m\r\n",
+			msg.Time.Local().Format("15:04"), msg.Text,
+		)
+		p.draw()
+		return
+	}
+	host := ""
+	if msg.Host {
+		host = " (host)"
+	}
+	fmt.Fprintf(p.w, "\r\033[K%s \033[1m%s%s\033[0m: %s\r\n",
+		msg.Time.Local().Format("15:04"), msg.Username, host, msg.Text,
+	)
+	p.draw()
+}
+
+// Input processes the input of the local terminal, returning the lines
+// entered and whether the user asked to quit (Ctrl-C, or Ctrl-D on an empty
+// line). Backspace deletes the last character and Ctrl-U the line, other
+// control characters and escape sequences being ignored.
+func (p *ChatPrompt) Input(
+	data []byte,
+) ([]string, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	defer p.draw()
+
+	lines := []string{}
+	data = append(p.partial, data...)
+	p.partial = nil
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			p.partial = append([]byte{}, data...)
+			break
+		}
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+
+		switch p.state {
+		case escEscape:
+			p.state = escGround
+			if r == '[' {
+				p.state = escCSI
+			} else if r == 'O' {
+				p.ss3 = true
+			}
+			continue
+		case escCSI:
+			if r >= 0x40 && r <= 0x7e {
+				p.state = escGround
+			}
+			continue
+		}
+		if p.ss3 {
+			p.ss3 = false
+			continue
+		}
+
+		switch r {
+		case 0x1b:
+			p.state = escEscape
+		case 0x03:
+			return lines, true
+		case 0x04:
+			if len(p.line) == 0 {
+				return lines, true
+			}
+		case '\r', '\n':
+			if len(p.line) > 0 {
+				lines = append(lines, string(p.line))
+				p.line = nil
+			}
+		case 0x7f, 0x08:
+			if len(p.line) > 0 {
+				p.line = p.line[:len(p.line)-1]
+			}
+		case 0x15:
+			p.line = nil
+		default:
+			if !unicode.IsControl(r) && r != utf8.RuneError &&
+				len(p.line) < warp.MaxChatMessageLength {
+				p.line = append(p.line, r)
+			}
+		}
+	}
+	return lines, false
+}
+
+// Clear clears the input line, before the terminal is restored.
+func (p *ChatPrompt) Clear() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	fmt.Fprintf(p.w, "\r\033[K")
+}
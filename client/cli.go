@@ -2,10 +2,11 @@ package cli
 
 import (
 	"context"
-	"regexp"
+	"io"
 	"strings"
 
 	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
 )
 
 // CmdName represents a command name.
@@ -29,17 +30,97 @@ type Command interface {
 // Registrar is used to register command generators within the module.
 var Registrar = map[CmdName](func() Command){}
 
+// UsageError is returned by Run when a command is unknown or the arguments
+// passed to it are invalid (as opposed to errors encountered while executing
+// it).
+type UsageError struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (e *UsageError) Error() string {
+	return e.Err.Error()
+}
+
+// IsUsageError returns whether err is a UsageError.
+func IsUsageError(
+	err error,
+) bool {
+	_, ok := errors.Cause(err).(*UsageError)
+	return ok
+}
+
 // Cli represents a cli instance.
 type Cli struct {
 	Ctx   context.Context
 	Flags map[string]string
 	Args  []string
+	// Debug indicates that the full stack of errors should be reported
+	// (`--debug`, see errors.Details).
+	Debug bool
+}
+
+// ValueFlags are the flags taking a value, registered by each command (see
+// RegisterValueFlags). They can be passed as `--flag value` as well as
+// `--flag=value`. Other flags are boolean or take an optional value, which
+// must be passed as `--flag=value`.
+var ValueFlags = map[CmdName]map[string]bool{}
+
+// ShortFlags maps the single letter flags registered by each command (see
+// RegisterShortFlag) to their name. Boolean short flags can be combined
+// (`-df`).
+var ShortFlags = map[CmdName]map[string]string{}
+
+// RegisterValueFlags registers flags of a command as taking a value.
+func RegisterValueFlags(
+	cmd CmdName,
+	names ...string,
+) {
+	if ValueFlags[cmd] == nil {
+		ValueFlags[cmd] = map[string]bool{}
+	}
+	for _, n := range names {
+		ValueFlags[cmd][n] = true
+	}
 }
 
-// flagFilterRegexp filters out flags from arguments.
-var flagFilterRegexp = regexp.MustCompile("^-+")
+// RegisterShortFlag registers a single letter flag of a command standing for
+// the named flag.
+func RegisterShortFlag(
+	cmd CmdName,
+	letter string,
+	name string,
+) {
+	if ShortFlags[cmd] == nil {
+		ShortFlags[cmd] = map[string]string{}
+	}
+	ShortFlags[cmd][letter] = name
+}
 
-// New initializes a new Cli by parsing the passed arguments.
+// commandName returns the name of the command invoked by argv, its first
+// argument. Flags passed before it are global and boolean (`--debug`,
+// `--no-color`) so they can't take its place as a value.
+func commandName(
+	argv []string,
+) CmdName {
+	for i, a := range argv {
+		if a == "--" {
+			if i+1 < len(argv) {
+				return CmdName(strings.TrimSpace(argv[i+1]))
+			}
+			break
+		}
+		if !strings.HasPrefix(a, "-") || a == StdinArg {
+			return CmdName(strings.TrimSpace(a))
+		}
+	}
+	return ""
+}
+
+// New initializes a new Cli by parsing the passed arguments: `--flag`,
+// `--flag=value`, `--flag value` (for the ValueFlags of the command), `-f`,
+// `-f value` (for its ShortFlags) and arguments, `--` marking the end of
+// flags.
 func New(
 	argv []string,
 ) (*Cli, error) {
@@ -48,36 +129,136 @@ func New(
 	args := []string{}
 	flags := map[string]string{}
 
-	for _, a := range argv {
-		if flagFilterRegexp.MatchString(a) {
-			a = strings.Trim(a, "-")
-			s := strings.Split(a, "=")
+	cmd := commandName(argv)
+	valueFlags := ValueFlags[cmd]
+	shortFlags := ShortFlags[cmd]
+
+	for i := 0; i < len(argv); i++ {
+		a := argv[i]
+		switch {
+		case a == "--":
+			for _, a := range argv[i+1:] {
+				args = append(args, strings.TrimSpace(a))
+			}
+			i = len(argv)
+
+		case strings.HasPrefix(a, "--"):
+			s := strings.SplitN(a[2:], "=", 2)
+			if s[0] == "" {
+				return nil, errors.Trace(
+					errors.Newf("Malformed flag: %s", a),
+				)
+			}
 			if len(s) == 2 {
 				flags[s[0]] = s[1]
-			} else if len(s) == 1 {
+			} else if valueFlags[s[0]] {
+				if i+1 == len(argv) {
+					return nil, errors.Trace(
+						errors.Newf("Flag --%s requires a value.", s[0]),
+					)
+				}
+				i++
+				flags[s[0]] = argv[i]
+			} else {
 				flags[s[0]] = "true"
 			}
-		} else {
+
+		// StdinArg is an argument, not a flag.
+		case strings.HasPrefix(a, "-") && a != StdinArg:
+			letters := a[1:]
+			for j := 0; j < len(letters); j++ {
+				name, ok := shortFlags[letters[j:j+1]]
+				if !ok {
+					return nil, errors.Trace(
+						errors.Newf("Unknown flag: -%s", letters[j:j+1]),
+					)
+				}
+				if !valueFlags[name] {
+					flags[name] = "true"
+					continue
+				}
+				// The value of a short flag is the rest of the argument
+				// (`-tvalue`) or the next argument.
+				if j+1 < len(letters) {
+					flags[name] = letters[j+1:]
+				} else if i+1 < len(argv) {
+					i++
+					flags[name] = argv[i]
+				} else {
+					return nil, errors.Trace(
+						errors.Newf(
+							"Flag -%s requires a value.", letters[j:j+1],
+						),
+					)
+				}
+				break
+			}
+
+		default:
 			args = append(args, strings.TrimSpace(a))
 		}
 	}
 
+	_, debug := flags["debug"]
+
 	return &Cli{
 		Ctx:   ctx,
 		Args:  args,
 		Flags: flags,
+		Debug: debug,
 	}, nil
 }
 
-// Run the cli.
+// StdinArg is the argument standing for a value read from stdin.
+const StdinArg = "-"
+
+// maxArgLine is the maximum length of an argument read from stdin.
+const maxArgLine = 1024
+
+// ReadArgLine reads an argument from the first line of r (`-` argument),
+// trimming whitespace. It reads one byte at a time so that nothing past the
+// line is consumed and the rest of stdin can still be forwarded to a warp.
+func ReadArgLine(
+	r io.Reader,
+) (string, error) {
+	line := []byte{}
+	b := make([]byte, 1)
+	for len(line) < maxArgLine {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
+// Run the cli. If a panic occurs while the terminal is in raw mode, it is
+// restored before the panic resumes.
 func (c *Cli) Run() error {
+	defer RecoverTerminal()
+
 	if len(c.Args) == 0 {
 		c.Args = append(c.Args, "help")
 	}
 
+	// Global flags.
+	if _, ok := c.Flags["no-color"]; ok {
+		out.DisableColor()
+	}
+
 	var command Command
 	cmd, args := c.Args[0], c.Args[1:]
-	if r, ok := Registrar[CmdName(cmd)]; !ok {
+	r, known := Registrar[CmdName(cmd)]
+	if !known {
 		command = Registrar[CmdName("help")]()
 	} else {
 		command = r()
@@ -86,7 +267,7 @@ func (c *Cli) Run() error {
 	err := command.Parse(c.Ctx, args, c.Flags)
 	if err != nil {
 		command.Help(c.Ctx)
-		return errors.Trace(err)
+		return errors.Trace(&UsageError{Err: err})
 	}
 
 	err = command.Execute(c.Ctx)
@@ -94,5 +275,11 @@ func (c *Cli) Run() error {
 		return errors.Trace(err)
 	}
 
+	if !known {
+		return errors.Trace(&UsageError{
+			Err: errors.Newf("Unknown command: %s", cmd),
+		})
+	}
+
 	return nil
 }
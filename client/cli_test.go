@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"reflect"
+	"testing"
+)
+
+func init() {
+	RegisterValueFlags("test-open", "title", "record")
+	RegisterShortFlag("test-open", "d", "detach")
+	RegisterShortFlag("test-open", "t", "title")
+	RegisterShortFlag("test-open", "v", "verbose")
+	RegisterValueFlags("test-replay", "speed")
+}
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		name  string
+		argv  []string
+		args  []string
+		flags map[string]string
+		err   bool
+	}{{
+		name:  "equal value",
+		argv:  []string{"test-open", "--title=pairing", "goofy-dev"},
+		args:  []string{"test-open", "goofy-dev"},
+		flags: map[string]string{"title": "pairing"},
+	}, {
+		name:  "separate value",
+		argv:  []string{"test-open", "--title", "pairing", "goofy-dev"},
+		args:  []string{"test-open", "goofy-dev"},
+		flags: map[string]string{"title": "pairing"},
+	}, {
+		name: "missing value",
+		argv: []string{"test-open", "goofy-dev", "--title"},
+		err:  true,
+	}, {
+		name:  "boolean flag",
+		argv:  []string{"test-open", "--detach", "goofy-dev"},
+		args:  []string{"test-open", "goofy-dev"},
+		flags: map[string]string{"detach": "true"},
+	}, {
+		name:  "value flag of another command",
+		argv:  []string{"test-open", "--speed", "2", "goofy-dev"},
+		args:  []string{"test-open", "2", "goofy-dev"},
+		flags: map[string]string{"speed": "true"},
+	}, {
+		name:  "value flag of the command",
+		argv:  []string{"test-replay", "--speed", "2", "view.cast"},
+		args:  []string{"test-replay", "view.cast"},
+		flags: map[string]string{"speed": "2"},
+	}, {
+		name:  "combined short flags",
+		argv:  []string{"test-open", "-dv", "goofy-dev"},
+		args:  []string{"test-open", "goofy-dev"},
+		flags: map[string]string{"detach": "true", "verbose": "true"},
+	}, {
+		name: "combined short flags ending with a value flag",
+		argv: []string{"test-open", "-dt", "pairing", "goofy-dev"},
+		args: []string{"test-open", "goofy-dev"},
+		flags: map[string]string{
+			"detach": "true", "title": "pairing",
+		},
+	}, {
+		name:  "attached short flag value",
+		argv:  []string{"test-open", "-tpairing", "goofy-dev"},
+		args:  []string{"test-open", "goofy-dev"},
+		flags: map[string]string{"title": "pairing"},
+	}, {
+		name: "unknown short flag",
+		argv: []string{"test-open", "-x", "goofy-dev"},
+		err:  true,
+	}, {
+		name: "unknown combined short flag",
+		argv: []string{"test-open", "-dx", "goofy-dev"},
+		err:  true,
+	}, {
+		name: "short flag of another command",
+		argv: []string{"test-replay", "-d", "view.cast"},
+		err:  true,
+	}, {
+		name:  "global flag before the command",
+		argv:  []string{"--debug", "test-open", "--title", "pairing"},
+		args:  []string{"test-open"},
+		flags: map[string]string{"debug": "true", "title": "pairing"},
+	}, {
+		name:  "end of flags",
+		argv:  []string{"test-open", "--", "--title", "-d"},
+		args:  []string{"test-open", "--title", "-d"},
+		flags: map[string]string{},
+	}, {
+		name:  "stdin argument",
+		argv:  []string{"test-open", "-"},
+		args:  []string{"test-open", "-"},
+		flags: map[string]string{},
+	}}
+
+	for _, tc := range cases {
+		c, err := New(tc.argv)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.Args, tc.args) {
+			t.Errorf("%s: args: got %q, want %q", tc.name, c.Args, tc.args)
+		}
+		if !reflect.DeepEqual(c.Flags, tc.flags) {
+			t.Errorf("%s: flags: got %v, want %v", tc.name, c.Flags, tc.flags)
+		}
+	}
+}
@@ -1,21 +1,38 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/spolu/warp/client"
 	_ "github.com/spolu/warp/client/command"
+	"github.com/spolu/warp/lib/errors"
 	"github.com/spolu/warp/lib/out"
 )
 
+const (
+	// exitError is the exit code on errors encountered executing a command.
+	exitError = 1
+	// exitUsage is the exit code on unknown commands or invalid arguments.
+	exitUsage = 2
+)
+
 func main() {
-	cli, err := cli.New(os.Args[1:])
+	c, err := cli.New(os.Args[1:])
 	if err != nil {
 		out.Errof("[Error] %s\n", err.Error())
+		os.Exit(exitUsage)
 	}
 
-	err = cli.Run()
+	err = c.Run()
 	if err != nil {
 		out.Errof("[Error] %s\n", err.Error())
+		if c.Debug {
+			fmt.Fprintf(os.Stderr, "%s\n", errors.Details(err))
+		}
+		if cli.IsUsageError(err) {
+			os.Exit(exitUsage)
+		}
+		os.Exit(exitError)
 	}
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kr/pty"
+)
+
+// envRunMain makes the test binary run main with the arguments following
+// `--` instead of the tests (see runWarp).
+const envRunMain = "WARP_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envRunMain) != "" {
+		for i, a := range os.Args {
+			if a == "--" {
+				os.Args = append([]string{"warp"}, os.Args[i+1:]...)
+				break
+			}
+		}
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runWarp runs warp with the specified arguments in a subprocess and returns
+// its exit code along with what it printed to stderr.
+func runWarp(
+	t *testing.T,
+	args ...string,
+) (int, string) {
+	t.Helper()
+	var stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0], append([]string{"--"}, args...)...)
+	cmd.Env = append(os.Environ(), envRunMain+"=1", "WARP_NO_CONFIG=1")
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err == nil {
+		return 0, stderr.String()
+	}
+	if e, ok := err.(*exec.ExitError); ok {
+		return e.ExitCode(), stderr.String()
+	}
+	t.Fatalf("Failed to run warp: %v", err)
+	return -1, ""
+}
+
+// runWarpTerminal runs warp with the specified arguments in a subprocess
+// printing to a pseudo-terminal and returns its output.
+func runWarpTerminal(
+	t *testing.T,
+	args ...string,
+) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"--"}, args...)...)
+	cmd.Env = []string{envRunMain + "=1", "WARP_NO_CONFIG=1", "TERM=xterm"}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "NO_COLOR=") &&
+			!strings.HasPrefix(e, "TERM=") {
+			cmd.Env = append(cmd.Env, e)
+		}
+	}
+	f, err := pty.Start(cmd)
+	if err != nil {
+		t.Skipf("No pseudo-terminal available: %v", err)
+	}
+	defer f.Close()
+	// Reading the terminal fails (EIO) once the subprocess exits.
+	data, _ := ioutil.ReadAll(f)
+	cmd.Wait()
+	return string(data)
+}
+
+func TestNoColor(t *testing.T) {
+	if got := runWarpTerminal(t, "help"); !strings.Contains(got, "\x1b[") {
+		t.Errorf("Help not colored on a terminal: %q", got)
+	}
+	got := runWarpTerminal(t, "--no-color", "help")
+	if strings.Contains(got, "\x1b[") {
+		t.Errorf("Help colored with --no-color: %q", got)
+	}
+	if !strings.Contains(got, "warp help") {
+		t.Errorf("Help not printed: %q", got)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.cast")
+	cases := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"success", []string{"help"}, 0},
+		{"failing command", []string{"replay", missing}, exitError},
+		{"unknown command", []string{"bogus"}, exitUsage},
+		{"missing argument", []string{"connect"}, exitUsage},
+		{"unknown flag", []string{"connect", "-x", "goofy-dev"}, exitUsage},
+	}
+	for _, tc := range cases {
+		if code, _ := runWarp(t, tc.args...); code != tc.code {
+			t.Errorf("%s: exit code: got %d, want %d", tc.name, code, tc.code)
+		}
+	}
+}
+
+func TestDebugPrintsErrorStack(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.cast")
+
+	code, stderr := runWarp(t, "replay", missing)
+	if code != exitError {
+		t.Fatalf("Exit code: got %d, want %d", code, exitError)
+	}
+	if stderr != "" {
+		t.Errorf("Error stack printed without --debug: %q", stderr)
+	}
+
+	code, stderr = runWarp(t, "--debug", "replay", missing)
+	if code != exitError {
+		t.Fatalf("Exit code with --debug: got %d, want %d", code, exitError)
+	}
+	if !strings.Contains(stderr, "[error] Failed to open recording") ||
+		!strings.Contains(stderr, "[trace]") ||
+		!strings.Contains(stderr, "replay.go:") {
+		t.Errorf("Error stack not printed with --debug: %q", stderr)
+	}
+
+	// Successful commands print no stack.
+	if code, stderr := runWarp(t, "--debug", "help"); code != 0 ||
+		stderr != "" {
+		t.Errorf("Help with --debug: exit code %d, stderr %q", code, stderr)
+	}
+}
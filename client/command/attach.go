@@ -0,0 +1,158 @@
+package command
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+	"github.com/spolu/warp/lib/plex"
+)
+
+const (
+	// CmdNmAttach is the command name.
+	CmdNmAttach cli.CmdName = "attach"
+)
+
+func init() {
+	cli.Registrar[CmdNmAttach] = NewAttach
+}
+
+// Attach attaches the local terminal to a warp opened with `--detach`.
+type Attach struct {
+	warp string
+}
+
+// NewAttach constructs and initializes the command.
+func NewAttach() cli.Command {
+	return &Attach{}
+}
+
+// Name returns the command name.
+func (c *Attach) Name() cli.CmdName {
+	return CmdNmAttach
+}
+
+// Help prints out the help message for the command.
+func (c *Attach) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp attach <id>\n")
+	out.Normf("\n")
+	out.Normf("  Attaches the current terminal to a warp running in the background (opened\n")
+	out.Normf("  with `warp open --detach`). Closing the terminal detaches it again and leaves\n")
+	out.Normf("  the warp running.\n")
+	out.Normf("\n")
+	out.Normf("Arguments:\n")
+	out.Boldf("  id\n")
+	out.Normf("    The ID of the detached warp.\n")
+	out.Valuf("    goofy-dev\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp attach goofy-dev\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Attach) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if len(args) == 0 {
+		return errors.Trace(
+			errors.Newf("Warp ID required."),
+		)
+	} else {
+		c.warp = args[0]
+	}
+
+	if !warp.WarpRegexp.MatchString(c.warp) {
+		return errors.Trace(
+			errors.Newf("Malformed warp ID: %s", c.warp),
+		)
+	}
+
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Attach) Execute(
+	ctx context.Context,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stdin := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(stdin) {
+		return errors.Trace(
+			errors.Newf("Not running in a terminal."),
+		)
+	}
+
+	a, err := cli.Attach(ctx, c.warp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer a.Close()
+
+	restore, err := cli.MakeRawTerminal(ctx, cancel, stdin)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Unable to put terminal in raw mode: %v.", err),
+		)
+	}
+	defer restore()
+
+	// Forward window resizes to the detached warp.
+	go func() {
+		defer cli.RecoverTerminal()
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGWINCH)
+		defer signal.Stop(ch)
+		for {
+			cols, rows, err := terminal.GetSize(stdin)
+			if err != nil {
+				break
+			}
+			if err := a.SendSize(warp.Size{Rows: rows, Cols: cols}); err != nil {
+				break
+			}
+			select {
+			case <-ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+
+	// Multiplex Stdin to the detached warp.
+	go func() {
+		defer cli.RecoverTerminal()
+		plex.Run(ctx, func(data []byte) {
+			a.DataC().Write(data)
+		}, os.Stdin)
+		cancel()
+	}()
+
+	// Multiplex the detached warp to Stdout.
+	go func() {
+		defer cli.RecoverTerminal()
+		plex.Run(ctx, func(data []byte) {
+			os.Stdout.Write(data)
+		}, a.DataC())
+		cancel()
+	}()
+
+	<-ctx.Done()
+
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/client"
@@ -19,11 +20,14 @@ const (
 
 func init() {
 	cli.Registrar[CmdNmAuthorize] = NewAuthorize
+	cli.RegisterValueFlags(CmdNmAuthorize, "mode", "ttl")
 }
 
 // Authorize authorizes write access to a warp client.
 type Authorize struct {
 	usernameOrToken string
+	mode            warp.Mode
+	ttl             time.Duration
 }
 
 // NewAuthorize constructs and initializes the command.
@@ -41,9 +45,9 @@ func (c *Authorize) Help(
 	ctx context.Context,
 ) {
 	out.Normf("\nUsage: ")
-	out.Boldf("warp authorize <username_or_token>\n")
+	out.Boldf("warp authorize [--mode=<mode>] [--ttl=<duration>] <username_or_token>\n")
 	out.Normf("\n")
-	out.Normf("  Grants write access to a client of the current warp.\n")
+	out.Normf("  Grants write access (or the specified mode) to a client of the current warp.\n")
 	out.Normf("\n")
 	out.Errof("  Be extra careful!")
 	out.Normf(" Please make sure that the user you are granting write\n")
@@ -60,9 +64,19 @@ func (c *Authorize) Help(
 	out.Normf("    The username or token of a connected user.\n")
 	out.Valuf("    guest_JpJP50EIas9cOfwo goofy\n")
 	out.Normf("\n")
+	out.Normf("Flags:\n")
+	out.Boldf("  --mode\n")
+	out.Normf("    The mode to grant (defaults to `write`).\n")
+	out.Valuf("    write speak-read speak-write speak-muted\n")
+	out.Boldf("  --ttl\n")
+	out.Normf("    Revokes the authorization automatically after the specified duration.\n")
+	out.Valuf("    30s 5m 1h\n")
+	out.Normf("\n")
 	out.Normf("Examples:\n")
 	out.Valuf("  warp authorize goofy\n")
 	out.Valuf("  warp authorize guest_JpJP50EIas9cOfwo\n")
+	out.Valuf("  warp authorize --mode=write goofy\n")
+	out.Valuf("  warp authorize --ttl=5m goofy\n")
 	out.Normf("\n")
 }
 
@@ -80,9 +94,47 @@ func (c *Authorize) Parse(
 		c.usernameOrToken = args[0]
 	}
 
+	mode, err := parseModeFlag(flags)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.mode = mode
+
+	if t, ok := flags["ttl"]; ok {
+		ttl, err := time.ParseDuration(t)
+		if err != nil || ttl <= 0 {
+			return errors.Trace(
+				errors.Newf("Invalid authorization TTL: %s", t),
+			)
+		}
+		c.ttl = ttl
+	}
+
 	return nil
 }
 
+// parseModeFlag parses the `--mode` flag used by authorize and revoke,
+// defaulting to warp.ModeShellWrite. Read access can't be targeted as it is
+// granted to all clients.
+func parseModeFlag(
+	flags map[string]string,
+) (warp.Mode, error) {
+	name, ok := flags["mode"]
+	if !ok {
+		return warp.ModeShellWrite, nil
+	}
+	mode, err := warp.ParseMode(name)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if mode == warp.ModeShellRead {
+		return 0, errors.Trace(
+			errors.Newf("Read access is granted to all clients: %s", name),
+		)
+	}
+	return mode, nil
+}
+
 // Execute the command or return a human-friendly error.
 func (c *Authorize) Execute(
 	ctx context.Context,
@@ -100,12 +152,12 @@ func (c *Authorize) Execute(
 		return errors.Trace(err)
 	}
 
-	if result.Disconnected {
+	if result.SessionState.ReadOnly && c.mode&warp.ModeShellWrite != 0 {
 		return errors.Trace(
 			errors.Newf(
-				"The warp is currently disconnected. No client has access to " +
-					"it and all previously authorized users will be revoked " +
-					"upon reconnection.",
+				"The warp is read-only (opened with " +
+					"`--read-only-enforced`), users can't be authorized to " +
+					"write.",
 			),
 		)
 	}
@@ -144,7 +196,13 @@ func (c *Authorize) Execute(
 		)
 	}
 
-	out.Normf("You are about to authorize the following user to write to ")
+	out.Normf("You are about to authorize the following user (")
+	out.Boldf("%s", warp.ModeName(c.mode))
+	if c.ttl > 0 {
+		out.Normf(" for ")
+		out.Boldf("%s", c.ttl)
+	}
+	out.Normf(") on ")
 	out.Valuf("%s\n", os.Getenv(warp.EnvWarp))
 	out.Normf("  ID: ")
 	out.Boldf("%s", user)
@@ -164,6 +222,8 @@ func (c *Authorize) Execute(
 	result, err = cli.RunLocalCommand(ctx, warp.Command{
 		Type: warp.CmdTpAuthorize,
 		Args: args,
+		Mode: c.mode,
+		TTL:  c.ttl,
 	})
 	if err != nil {
 		return errors.Trace(err)
@@ -174,7 +234,9 @@ func (c *Authorize) Execute(
 	out.Boldf("warp revoke\n")
 	out.Normf("\n")
 
-	PrintSessionState(ctx, result.Disconnected, result.SessionState)
+	PrintSessionState(
+		ctx, result.Disconnected, result.SessionState, result.Grants,
+	)
 
 	return nil
 }
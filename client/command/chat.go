@@ -0,0 +1,291 @@
+package command
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"os/user"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+	"github.com/spolu/warp/lib/plex"
+	"github.com/spolu/warp/lib/token"
+)
+
+const (
+	// CmdNmChat is the command name.
+	CmdNmChat cli.CmdName = "chat"
+)
+
+func init() {
+	cli.Registrar[CmdNmChat] = NewChat
+	cli.RegisterValueFlags(CmdNmChat, cli.TLSFlags...)
+}
+
+// Chat opens a chat session to a warp, to exchange messages with the other
+// users chatting alongside it.
+type Chat struct {
+	address     string
+	noTLS       bool
+	insecureTLS bool
+	tlsConfig   *tls.Config
+
+	warp        string
+	credentials warp.Session
+	username    string
+
+	prompt *cli.ChatPrompt
+}
+
+// NewChat constructs and initializes the command.
+func NewChat() cli.Command {
+	return &Chat{}
+}
+
+// Name returns the command name.
+func (c *Chat) Name() cli.CmdName {
+	return CmdNmChat
+}
+
+// Help prints out the help message for the command.
+func (c *Chat) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp chat <id>\n")
+	out.Normf("\n")
+	out.Normf("  Opens a chat to exchange messages with the other users chatting alongside\n")
+	out.Normf("  a warp, without disrupting the warp itself. Run it in a terminal next to\n")
+	out.Normf("  the one connected to the warp.\n")
+	out.Normf("\n")
+	out.Normf("  Type a message and press Enter to send it, Ctrl-C (or Ctrl-D) to quit.\n")
+	out.Normf("  Messages of users muted by the host (`warp authorize --mode=speak-muted`)\n")
+	out.Normf("  are not delivered.\n")
+	out.Normf("\n")
+	out.Normf("Arguments:\n")
+	out.Boldf("  id\n")
+	out.Normf("    The ID of the warp to chat alongside.\n")
+	out.Valuf("    DJc3hR0PoyFmQIIY goofy-dev\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp chat goofy-dev\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Chat) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if len(args) == 0 {
+		return errors.Trace(
+			errors.Newf("Warp ID required."),
+		)
+	}
+	w, address, err := cli.NewResolver().Resolve(ctx, args[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !warp.WarpRegexp.MatchString(w) {
+		return errors.Trace(
+			errors.Newf("Malformed warp ID: %s", w),
+		)
+	}
+	c.warp = w
+	c.address = address
+
+	if _, ok := flags["insecure_tls"]; ok ||
+		os.Getenv("WARPD_INSECURE_TLS") != "" {
+		c.insecureTLS = true
+	}
+	if _, ok := flags["no_tls"]; ok ||
+		os.Getenv("WARPD_NO_TLS") != "" {
+		c.noTLS = true
+	}
+	tlsConfig, err := cli.TLSConfig(flags, c.insecureTLS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.tlsConfig = tlsConfig
+
+	user, err := user.Current()
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to retrieve current user: %v.", err),
+		)
+	}
+	c.username = user.Username
+
+	config, err := cli.RetrieveOrGenerateConfig(ctx)
+	if cli.IsConfigAccess(err) {
+		return errors.Trace(err)
+	} else if err != nil {
+		return errors.Trace(
+			errors.Newf("Error retrieving or generating config: %v", err),
+		)
+	}
+	c.credentials = warp.Session{
+		User:   config.Credentials.User,
+		Secret: config.Credentials.Secret,
+	}
+
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Chat) Execute(
+	ctx context.Context,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stdin := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(stdin) {
+		return errors.Trace(
+			errors.Newf("Not running in a terminal."),
+		)
+	}
+
+	address := c.address
+	for hops := 0; ; hops++ {
+		err := c.ChatSession(ctx, address)
+		if r, ok := errors.Cause(err).(*cli.RedirectError); ok &&
+			hops < warp.MaxRedirects {
+			address = r.Address
+			continue
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return nil
+	}
+}
+
+// ChatSession establishes a chat session to the warp at the specified
+// address and runs the chat until the user quits or the session is lost. It
+// returns the error received from warpd if any.
+func (c *Chat) ChatSession(
+	ctx context.Context,
+	address string,
+) error {
+	conn, err := c.Dial(address)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+
+	// This ctx can be canceled by the session or its parent context.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	session := c.credentials
+	session.Token = token.New("session")
+	ss, err := cli.NewSession(
+		ctx,
+		session,
+		c.warp,
+		warp.SsTpChatClient,
+		c.username,
+		cli.SessionOptions{},
+		cancel,
+		conn,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Close and reclaims all session related state.
+	defer ss.TearDown()
+
+	// Listen for errors.
+	errC := ss.WatchError(ctx)
+
+	// Wait for the notice of our joining (or an error, such as the warp
+	// being unknown) before putting the terminal in raw mode.
+	joined, err := ss.DecodeChat(ctx)
+	if err != nil {
+		// Receive the error sent by warpd, if any.
+		ss.TearDown()
+		if err := <-errC; err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(
+			errors.Newf("Chat closed by warpd (outdated warpd?)."),
+		)
+	}
+
+	restore, err := cli.MakeRawTerminal(ctx, cancel, int(os.Stdin.Fd()))
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Unable to put terminal in raw mode: %v", err),
+		)
+	}
+	// Restors the terminal once we're done.
+	defer restore()
+
+	c.prompt = cli.NewChatPrompt(int(os.Stdout.Fd()), os.Stdout)
+	// Clear the prompt before the terminal is restored.
+	defer c.prompt.Clear()
+	c.prompt.Print(*joined)
+
+	// Print incoming messages.
+	go func() {
+		defer cli.RecoverTerminal()
+		for {
+			msg, err := ss.DecodeChat(ctx)
+			if err != nil {
+				break
+			}
+			c.prompt.Print(*msg)
+		}
+		cancel()
+	}()
+
+	go func() {
+		defer cli.RecoverTerminal()
+		plex.Run(ctx, func(data []byte) {
+			lines, q := c.prompt.Input(data)
+			for _, l := range lines {
+				ss.SendChat(ctx, l)
+			}
+			if q {
+				cancel()
+			}
+		}, os.Stdin)
+		cancel()
+	}()
+
+	<-ctx.Done()
+	ss.TearDown()
+
+	return <-errC
+}
+
+// Dial opens a connection to warpd at the specified address.
+func (c *Chat) Dial(
+	address string,
+) (net.Conn, error) {
+	network, address := warp.AddressNetwork(address)
+	if c.noTLS {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, errors.Trace(
+				errors.Newf("Connection to warpd failed: %v.", err),
+			)
+		}
+		return conn, nil
+	}
+
+	conn, err := tls.Dial(network, address, c.tlsConfig)
+	if err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Connection to warpd failed: %v.", err),
+		)
+	}
+	return conn, nil
+}
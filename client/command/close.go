@@ -0,0 +1,86 @@
+package command
+
+import (
+	"context"
+	"os"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+const (
+	// CmdNmClose is the command name.
+	CmdNmClose cli.CmdName = "close"
+)
+
+func init() {
+	cli.Registrar[CmdNmClose] = NewClose
+}
+
+// Close closes the current warp (in-warp only).
+type Close struct {
+}
+
+// NewClose constructs and initializes the command.
+func NewClose() cli.Command {
+	return &Close{}
+}
+
+// Name returns the command name.
+func (c *Close) Name() cli.CmdName {
+	return CmdNmClose
+}
+
+// Help prints out the help message for the command.
+func (c *Close) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp close\n")
+	out.Normf("\n")
+	out.Normf("  Closes the current warp as exiting its shell would: the clients of the warp\n")
+	out.Normf("  are notified that you closed it and disconnected, and the `warp open`\n")
+	out.Normf("  process hosting it exits (terminating the shell). This command is only\n")
+	out.Normf("  available from inside a warp.\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp close\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Close) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Close) Execute(
+	ctx context.Context,
+) error {
+	err := cli.CheckEnvWarp(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = cli.RunLocalCommand(ctx, warp.Command{
+		Type: warp.CmdTpClose,
+		Args: []string{},
+	})
+	if err != nil {
+		// Disconnected warps are closed as well.
+		if _, ok := errors.Cause(err).(*cli.DisconnectedError); !ok {
+			return errors.Trace(err)
+		}
+	}
+
+	out.Normf("Closing warp: ")
+	out.Valuf("%s\n", os.Getenv(warp.EnvWarp))
+
+	return nil
+}
@@ -1,20 +1,34 @@
 package command
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"os/signal"
 	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/asciicast"
 	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/mouse"
 	"github.com/spolu/warp/lib/out"
 	"github.com/spolu/warp/lib/plex"
+	"github.com/spolu/warp/lib/sanitize"
+	"github.com/spolu/warp/lib/screen"
+	"github.com/spolu/warp/lib/tee"
 	"github.com/spolu/warp/lib/token"
 )
 
@@ -25,26 +39,159 @@ const (
 
 func init() {
 	cli.Registrar[CmdNmConnect] = NewConnect
+	cli.RegisterValueFlags(CmdNmConnect,
+		"record", "tee", "input", "input-delay", "since-scrollback",
+	)
+	cli.RegisterValueFlags(CmdNmConnect, cli.TLSFlags...)
+	cli.RegisterShortFlag(CmdNmConnect, "f", "follow")
 }
 
+// defaultScrollback is the default number of lines kept by `--scrollback`.
+const defaultScrollback = 10000
+
+// refreshKey is the key (Ctrl-L) used by clients who can't write to the warp
+// to request its screen to be redrawn.
+const refreshKey = 0x0c
+
+// requestKey is the key (Ctrl-R) used by clients who can't write to the warp
+// to request write access from the host.
+const requestKey = 0x12
+
+// pauseKey is the key (Ctrl-]) used by clients who can't write to the warp to
+// pause its output, to select text on a still screen, and resume it.
+const pauseKey = 0x1d
+
+// pauseNotice is displayed while the output of the warp is paused.
+const pauseNotice = "[warp: output paused, press Ctrl-] to resume]"
+
+// maxPausedOutput is the maximum size of the output buffered while paused.
+// Beyond it, the output is dropped and the screen redrawn on resume.
+const maxPausedOutput = 1024 * 1024
+
+// defaultWriteKey is the default key arming what is typed to be sent to the
+// warp (`--write-key`).
+const defaultWriteKey = "ctrl-g"
+
 // Connect connects to a shared terminal.
 type Connect struct {
 	noTLS       bool
 	insecureTLS bool
+	tlsConfig   *tls.Config
+	snapshot    bool
+	follow      bool
+	noReconnect bool
+	waitForHost bool
+	prefix      bool
+	sequence    bool
+	compress    bool
+	noRaw       bool
+	mouse       bool
+	legend      bool
+	stats       bool
+	scrollback  int
+	input       string
+	inputDelay  time.Duration
+	stay        bool
+	record      string
+	tee         string
+	// requested is the mode requested from the host (`--write`).
+	requested warp.Mode
+	// replay is the amount of scrollback replayed by warpd on connect
+	// (`--since-scrollback`, see warp.SessionHello).
+	replay int
 
+	// resolver determines the address of the warpd serving the warp
+	// (cli.NewResolver).
+	resolver cli.Resolver
 	address  string
 	warp     string
 	session  warp.Session
 	username string
 
-	ss *cli.Session
+	mutex *sync.Mutex
+	ss    *cli.Session
+
+	// stdout is where the output of the warp is written when neither paging
+	// nor drawing a status line, along with the escapes resizing the local
+	// terminal (os.Stdout).
+	stdout io.Writer
+
+	recordF *os.File
+	rec     *asciicast.Writer
+	recSize warp.Size
+
+	teeW *tee.Writer
+
+	// sanitizer, if set, filters the stream written to stdout.
+	sanitizer *sanitize.Filter
+
+	// mouseT, if set, tracks the mouse reporting modes of the warp (see
+	// updateMouse) and mouseS strips the mouse events of the input of users
+	// not authorized to write. mouseOn indicates whether the local terminal
+	// reports mouse events and is protected by the mutex.
+	mouseT  *mouse.Tracker
+	mouseS  *mouse.Stripper
+	mouseOn bool
+
+	// pager, if set, renders the output of the warp as a scrollable view
+	// (`--scrollback`). It is kept across reconnections.
+	pager *cli.Pager
+	// statusLine, if set, displays the legend of the users writing to the
+	// warp, the latency stats and whether typing is armed over the last row
+	// of the terminal (`--legend`, `--latency-stats` or `--write-key`
+	// without pager).
+	statusLine *cli.StatusLine
+	// received is the number of bytes received from the warp since the
+	// latency stats were last computed. It is protected by the mutex.
+	received int
+
+	// writeKey, if set, is the key arming what is typed to be sent to the
+	// warp (`--write-key`), named writeKeyName. armed indicates whether it is
+	// armed, until a line is sent or the key pressed again. It is protected
+	// by the mutex.
+	writeKey     byte
+	writeKeyName string
+	armed        bool
+
+	// waiting indicates that the client is waiting for the host to open the
+	// warp again (`--wait-for-host`). It is only accessed from ConnLoop.
+	waiting bool
+	// reconnecting indicates that the connection to warpd dropped and is
+	// being reestablished. It is only accessed from ConnLoop.
+	reconnecting bool
+
+	// paused indicates that the output of the warp is paused (see
+	// togglePause), the output received meanwhile being buffered in
+	// pausedOutput unless it overflowed maxPausedOutput. They are protected
+	// by the mutex.
+	paused       bool
+	pausedOutput []byte
+	overflowed   bool
+
+	// hostActive is the local time at which the host last produced output
+	// and heardAt the one at which warpd was last heard from (see heard).
+	// hostAway is set while the host is reconnecting and hostStatus is the
+	// status of the host displayed in the status line (see watchHost). They
+	// are protected by the mutex.
+	hostActive time.Time
+	heardAt    time.Time
+	hostAway   bool
+	hostStatus string
+
+	// promptC, if set, receives the next key pressed (see offerReconnect).
+	// It is protected by the mutex.
+	promptC chan byte
 
 	errC chan error
 }
 
 // NewConnect constructs and initializes the command.
 func NewConnect() cli.Command {
-	return &Connect{}
+	return &Connect{
+		mutex:    &sync.Mutex{},
+		stdout:   os.Stdout,
+		resolver: cli.NewResolver(),
+	}
 }
 
 // Name returns the command name.
@@ -57,21 +204,167 @@ func (c *Connect) Help(
 	ctx context.Context,
 ) {
 	out.Normf("\nUsage: ")
-	out.Boldf("warp connect <id>\n")
+	out.Boldf("warp connect [--follow] [--no-reconnect] [--wait-for-host] [--prefix] [--sequence] [--compress] [--no-raw] [--write] [--legend] [--latency-stats] [--write-key[=<key>]] [--scrollback[=<lines>]] [--since-scrollback=<bytes>] [--sanitize[=<classes>]] [--record=<file>] [--tee=<file>] [--snapshot] [--input=<file>] <id>\n")
 	out.Normf("\n")
 	out.Normf("  Connects to an existing warp (read-only).\n")
 	out.Normf("\n")
 	out.Normf("  If possible warp will attempt to resize the window it is running in to the\n")
 	out.Normf("  size of the host terminal.\n")
 	out.Normf("\n")
+	out.Normf("  If your screen gets corrupted while you can't write to the warp, press ")
+	out.Boldf("Ctrl-L")
+	out.Normf("\n")
+	out.Normf("  to have the host redraw it. Press ")
+	out.Boldf("Ctrl-]")
+	out.Normf(" to pause the output of the warp, to\n")
+	out.Normf("  select and copy text from a still screen, and again to resume it. Press\n")
+	out.Boldf("  Ctrl-R")
+	out.Normf(" to request write access from the host.\n")
+	out.Normf("\n")
 	out.Normf("Arguments:\n")
 	out.Boldf("  id\n")
-	out.Normf("    The ID of the warp to connect to.\n")
-	out.Valuf("    DJc3hR0PoyFmQIIY goofy-dev\n")
+	out.Normf("    The ID of the warp to connect to (`-` to read it from the first line of\n")
+	out.Normf("    stdin, the rest of stdin being left untouched). Use `<id>@<node>` for\n")
+	out.Normf("    warps opened on a specific warpd node.\n")
+	out.Valuf("    DJc3hR0PoyFmQIIY goofy-dev goofy-dev@eu1\n")
+	out.Normf("\n")
+	out.Normf("Flags:\n")
+	out.Boldf("  -f, --follow\n")
+	out.Normf("    Reconnects automatically when the connection to the warp drops, redrawing\n")
+	out.Normf("    the screen once reconnected. Without it, you are offered to reconnect\n")
+	out.Normf("    when warpd fails with an internal error (the host hosts the warp again).\n")
+	out.Normf("    Interactive clients reconnect when the connection drops by default.\n")
+	out.Boldf("  --no-reconnect\n")
+	out.Normf("    Exits when the connection to warpd drops instead of reconnecting.\n")
+	out.Boldf("  --exit-on-host-close\n")
+	out.Normf("    Exits when the host closes the warp (default).\n")
+	out.Boldf("  --wait-for-host\n")
+	out.Normf("    Waits for the host when it closes the warp (or if the warp does not\n")
+	out.Normf("    exist yet) and reattaches to the warp once opened again with the same ID,\n")
+	out.Normf("    to monitor hosts that restart.\n")
+	out.Boldf("  --prefix\n")
+	out.Normf("    Treats the ID as a prefix, resolved against the warps active on warpd.\n")
+	out.Normf("    Fails if the prefix is ambiguous. Requires warpd to allow it.\n")
+	out.Boldf("  --sequence\n")
+	out.Normf("    Has warpd number the data it relays (12 bytes per chunk) so that lost data\n")
+	out.Normf("    is detected. The screen is cleared when it happens instead of rendering\n")
+	out.Normf("    garbage.\n")
+	out.Boldf("  --compress\n")
+	out.Normf("    Compresses the data exchanged with warpd, to save bandwidth over slow\n")
+	out.Normf("    links. It only applies to your connection, not the host's.\n")
+	out.Boldf("  --no-raw\n")
+	out.Normf("    Leaves your terminal in line mode for environments where raw mode is not\n")
+	out.Normf("    available: what you type is sent to the warp once you press Enter and\n")
+	out.Normf("    control keys are not forwarded.\n")
+	out.Boldf("  --mouse\n")
+	out.Normf("    Forwards your mouse events to the applications of the warp that enable\n")
+	out.Normf("    mouse reporting (vim, htop, ...) while you are authorized to write to it.\n")
+	out.Normf("    Mouse reporting is left disabled in your terminal otherwise.\n")
+	out.Boldf("  --legend\n")
+	out.Normf("    Displays the users writing to the warp (each with a color, the same for\n")
+	out.Normf("    all viewers) on the last line of your terminal, to tell who is doing what.\n")
+	out.Normf("    The legend is always displayed in the status line of `--scrollback`,\n")
+	out.Normf("    which also tells how long the host has been idle (`host idle 12s`) or\n")
+	out.Normf("    that warpd stopped responding.\n")
+	out.Boldf("  --latency-stats\n")
+	out.Normf("    Displays the round-trip time to warpd and the throughput of the warp,\n")
+	out.Normf("    updated every second, at the bottom right of your terminal (or in the\n")
+	out.Normf("    status line of `--scrollback`), to diagnose lag.\n")
+	out.Boldf("  --write\n")
+	out.Normf("    Requests write access from the host as you connect. You still join\n")
+	out.Normf("    read-only until the host authorizes you (`warp authorize`) or declines\n")
+	out.Normf("    (`warp revoke`); hosts see the pending request in `warp state`.\n")
+	out.Boldf("  --write-key[=<key>]\n")
+	out.Normf("    Push to type: once authorized to write, what you type is only sent to\n")
+	out.Normf("    the warp after pressing the specified key (default: %s), until you\n", defaultWriteKey)
+	out.Normf("    press Enter or the key again, to avoid typing into the warp by accident.\n")
+	out.Normf("    Whether typing is armed is displayed at the bottom of your terminal.\n")
+	out.Valuf("    ctrl-t\n")
+	out.Boldf("  --scrollback[=<lines>]\n")
+	out.Normf("    Displays the warp in a scrollable view (like less) instead of streaming\n")
+	out.Normf(
+		"    it raw, keeping the specified number of lines (default: %d) so that\n",
+		defaultScrollback,
+	)
+	out.Normf("    you can scroll back while new output arrives: ")
+	out.Boldf("Up")
+	out.Normf("/")
+	out.Boldf("Down")
+	out.Normf(", ")
+	out.Boldf("PgUp")
+	out.Normf("/")
+	out.Boldf("PgDn")
+	out.Normf(",\n")
+	out.Normf("    ")
+	out.Boldf("Home")
+	out.Normf("/")
+	out.Boldf("End")
+	out.Normf(" to scroll and ")
+	out.Boldf("q")
+	out.Normf(" to quit. Your position is kept across\n")
+	out.Normf("    reconnections. Read-only: nothing you type is sent to the warp.\n")
+	out.Boldf("  --since-scrollback=<bytes>\n")
+	out.Normf("    Limits the recent output of the warp replayed by warpd when connecting\n")
+	out.Normf("    (by default, all it keeps) to the specified number of bytes. 0 replays\n")
+	out.Normf("    nothing, to jump straight to the live output over a slow link.\n")
+	out.Boldf("  --sanitize\n")
+	out.Normf("    Strips escape sequences that can be used to manipulate your terminal\n")
+	out.Normf("    (clipboard access, title changes, device control strings, ...) from what\n")
+	out.Normf("    you receive, for warps you don't fully trust. Optionally takes a\n")
+	out.Normf("    comma-separated list of classes to allow anyway: ")
+	for i, cls := range sanitize.Classes {
+		if i > 0 {
+			out.Normf(", ")
+		}
+		out.Valuf("%s", cls)
+	}
+	out.Normf(".\n")
+	out.Boldf("  --record\n")
+	out.Normf("    Records what you receive to the specified file (asciicast v2 format).\n")
+	out.Boldf("  --tee\n")
+	out.Normf("    Writes the raw stream you receive to the specified file as you watch it.\n")
+	out.Boldf("  --snapshot\n")
+	out.Normf("    Prints the screen currently displayed by the warp, rendered at its window\n")
+	out.Normf("    size, to stdout as plain text and exits (non-interactive).\n")
+	out.Boldf("  --input=<file>\n")
+	out.Normf("    Types the content of the file (or stdin if `-`) into the warp line by line,\n")
+	out.Normf("    printing what you receive to stdout, and exits once the output settles\n")
+	out.Normf("    (non-interactive). Requires the host to have authorized you to write.\n")
+	out.Boldf("  --input-delay=<duration>\n")
+	out.Normf("    Waits for the specified duration between lines sent with `--input`.\n")
+	out.Boldf("  --stay\n")
+	out.Normf("    Keeps printing what you receive once the input is sent, until the warp is\n")
+	out.Normf("    closed or you press Ctrl-C.\n")
+	out.Boldf("  --tls-cert=<file> --tls-key=<file>\n")
+	out.Normf("    Presents the specified client certificate to warpd, for warpd instances\n")
+	out.Normf("    requiring client certificates (also read from WARPD_TLS_CERT and\n")
+	out.Normf("    WARPD_TLS_KEY).\n")
+	out.Boldf("  --pin=<sha256>\n")
+	out.Normf("    Verifies the certificate of warpd against the specified SHA-256\n")
+	out.Normf("    fingerprint instead of the system CAs, for self-hosted warpd instances\n")
+	out.Normf("    with self-signed certificates (also read from WARPD_TLS_PIN). The\n")
+	out.Normf("    connection is refused (certificate_pin_mismatch) if it does not match.\n")
+	out.Valuf("    $(openssl x509 -in cert.pem -noout -fingerprint -sha256 | cut -d= -f2)\n")
 	out.Normf("\n")
 	out.Normf("Examples:\n")
 	out.Valuf("    warp connect goofy-dev\n")
 	out.Valuf("    warp connect DJc3hR0PoyFmQIIY\n")
+	out.Valuf("    echo goofy-dev | warp connect --snapshot -\n")
+	out.Valuf("    warp connect --prefix loadtest-run\n")
+	out.Valuf("    warp connect --no-raw goofy-dev\n")
+	out.Valuf("    warp connect --write goofy-dev\n")
+	out.Valuf("    warp connect --mouse goofy-dev\n")
+	out.Valuf("    warp connect --compress goofy-dev\n")
+	out.Valuf("    warp connect --legend goofy-dev\n")
+	out.Valuf("    warp connect --legend --latency-stats goofy-dev\n")
+	out.Valuf("    warp connect --write-key goofy-dev\n")
+	out.Valuf("    warp connect --follow --scrollback=50000 goofy-dev\n")
+	out.Valuf("    warp connect --since-scrollback=0 goofy-dev\n")
+	out.Valuf("    warp connect --wait-for-host goofy-dev\n")
+	out.Valuf("    warp connect --sanitize=title goofy-dev\n")
+	out.Valuf("    warp connect --record=view.cast goofy-dev\n")
+	out.Valuf("    warp connect --snapshot goofy-dev > screen.txt\n")
+	out.Valuf("    warp connect --input=commands.txt --input-delay=500ms goofy-dev\n")
 	out.Normf("\n")
 }
 
@@ -85,10 +378,26 @@ func (c *Connect) Parse(
 		return errors.Trace(
 			errors.Newf("Warp ID required."),
 		)
+	} else if args[0] == cli.StdinArg {
+		// Read before the terminal is put in raw mode.
+		w, err := cli.ReadArgLine(os.Stdin)
+		if err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to read warp ID from stdin: %v", err),
+			)
+		}
+		c.warp = w
 	} else {
 		c.warp = args[0]
 	}
 
+	// Determine the warpd serving the warp (designated as `<id>[@<node>]`).
+	id, address, err := c.resolver.Resolve(ctx, c.warp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.warp, c.address = id, address
+
 	if !warp.WarpRegexp.MatchString(c.warp) {
 		return errors.Trace(
 			errors.Newf("Malformed warp ID: %s", c.warp),
@@ -103,10 +412,198 @@ func (c *Connect) Parse(
 		os.Getenv("WARPD_NO_TLS") != "" {
 		c.noTLS = true
 	}
-
-	c.address = warp.DefaultAddress
-	if os.Getenv("WARPD_ADDRESS") != "" {
-		c.address = os.Getenv("WARPD_ADDRESS")
+	tlsConfig, err := cli.TLSConfig(flags, c.insecureTLS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.tlsConfig = tlsConfig
+	if _, ok := flags["snapshot"]; ok {
+		c.snapshot = true
+	}
+	if _, ok := flags["follow"]; ok {
+		c.follow = true
+	}
+	if _, ok := flags["no-reconnect"]; ok {
+		if c.follow {
+			return errors.Trace(
+				errors.Newf("--follow and --no-reconnect are exclusive."),
+			)
+		}
+		c.noReconnect = true
+	}
+	if _, ok := flags["wait-for-host"]; ok {
+		if _, ok := flags["exit-on-host-close"]; ok {
+			return errors.Trace(
+				errors.Newf(
+					"--wait-for-host and --exit-on-host-close are exclusive.",
+				),
+			)
+		}
+		if c.snapshot {
+			return errors.Trace(
+				errors.Newf("--wait-for-host can't be combined with --snapshot."),
+			)
+		}
+		c.waitForHost = true
+	}
+	if _, ok := flags["prefix"]; ok {
+		c.prefix = true
+	}
+	if _, ok := flags["sequence"]; ok {
+		c.sequence = true
+	}
+	if _, ok := flags["compress"]; ok {
+		c.compress = true
+	}
+	if _, ok := flags["no-raw"]; ok {
+		c.noRaw = true
+	}
+	if _, ok := flags["mouse"]; ok {
+		if c.noRaw || c.snapshot {
+			return errors.Trace(
+				errors.Newf("--mouse requires an interactive terminal."),
+			)
+		}
+		c.mouse = true
+		c.mouseT = mouse.NewTracker()
+		c.mouseS = mouse.NewStripper()
+	}
+	if s, ok := flags["sanitize"]; ok {
+		allow := []sanitize.Class{}
+		if s != "true" {
+			var err error
+			allow, err = sanitize.ParseClasses(s)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+		c.sanitizer = sanitize.NewFilter(allow)
+	}
+	if i, ok := flags["input"]; ok {
+		if i == "true" || i == "" {
+			return errors.Trace(
+				errors.Newf("Input file required: --input=<file>"),
+			)
+		}
+		if c.snapshot {
+			return errors.Trace(
+				errors.Newf("--input and --snapshot can't be combined."),
+			)
+		}
+		c.input = i
+	}
+	if d, ok := flags["input-delay"]; ok {
+		delay, err := time.ParseDuration(d)
+		if err != nil || delay < 0 {
+			return errors.Trace(
+				errors.Newf("Invalid input delay: %s", d),
+			)
+		}
+		c.inputDelay = delay
+	}
+	if r, ok := flags["since-scrollback"]; ok {
+		n, err := strconv.Atoi(r)
+		if err != nil || n < 0 {
+			return errors.Trace(
+				errors.Newf("Invalid scrollback replay: %s", r),
+			)
+		}
+		c.replay = n
+		if n == 0 {
+			c.replay = warp.ReplayNone
+		}
+	}
+	if _, ok := flags["stay"]; ok {
+		if c.input == "" {
+			return errors.Trace(
+				errors.Newf("--stay requires --input."),
+			)
+		}
+		c.stay = true
+	}
+	if r, ok := flags["record"]; ok {
+		if r == "true" || r == "" {
+			return errors.Trace(
+				errors.Newf("Recording file required: --record=<file>"),
+			)
+		}
+		c.record = r
+	}
+	if t, ok := flags["tee"]; ok {
+		if t == "true" || t == "" {
+			return errors.Trace(
+				errors.Newf("Tee file required: --tee=<file>"),
+			)
+		}
+		c.tee = t
+	}
+	if _, ok := flags["write"]; ok {
+		if c.snapshot || c.input != "" {
+			return errors.Trace(
+				errors.Newf(
+					"--write can't be combined with --snapshot or --input.",
+				),
+			)
+		}
+		c.requested = warp.ModeShellWrite
+	}
+	if _, ok := flags["legend"]; ok {
+		if c.noRaw || c.snapshot || c.input != "" {
+			return errors.Trace(
+				errors.Newf("--legend requires an interactive terminal."),
+			)
+		}
+		c.legend = true
+	}
+	if _, ok := flags["latency-stats"]; ok {
+		if c.noRaw || c.snapshot || c.input != "" {
+			return errors.Trace(
+				errors.Newf(
+					"--latency-stats requires an interactive terminal.",
+				),
+			)
+		}
+		c.stats = true
+	}
+	if s, ok := flags["scrollback"]; ok {
+		if c.noRaw || c.snapshot || c.input != "" || c.mouse {
+			return errors.Trace(
+				errors.Newf(
+					"--scrollback is for interactive read-only viewing and " +
+						"can't be combined with --no-raw, --snapshot, " +
+						"--input or --mouse.",
+				),
+			)
+		}
+		c.scrollback = defaultScrollback
+		if s != "true" {
+			lines, err := strconv.Atoi(s)
+			if err != nil || lines <= 0 {
+				return errors.Trace(
+					errors.Newf("Invalid scrollback: %s", s),
+				)
+			}
+			c.scrollback = lines
+		}
+	}
+	if k, ok := flags["write-key"]; ok {
+		if c.noRaw || c.snapshot || c.input != "" || c.scrollback > 0 {
+			return errors.Trace(
+				errors.Newf(
+					"--write-key requires an interactive terminal and " +
+						"can't be combined with --scrollback.",
+				),
+			)
+		}
+		if k == "true" {
+			k = defaultWriteKey
+		}
+		key, err := parseWriteKey(k)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		c.writeKey = key
+		c.writeKeyName = strings.ToLower(k)
 	}
 
 	user, err := user.Current()
@@ -118,7 +615,9 @@ func (c *Connect) Parse(
 	c.username = user.Username
 
 	config, err := cli.RetrieveOrGenerateConfig(ctx)
-	if err != nil {
+	if cli.IsConfigAccess(err) {
+		return errors.Trace(err)
+	} else if err != nil {
 		return errors.Trace(
 			errors.Newf("Error retrieving or generating config: %v", err),
 		)
@@ -137,6 +636,12 @@ func (c *Connect) Parse(
 func (c *Connect) Execute(
 	ctx context.Context,
 ) error {
+	if c.prefix {
+		if err := c.Resolve(ctx); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
 	if os.Getenv(warp.EnvWarp) == c.warp {
 		return errors.Trace(
 			errors.Newf(
@@ -148,65 +653,118 @@ func (c *Connect) Execute(
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	var conn net.Conn
-	var err error
+	if c.snapshot {
+		return c.ExecuteSnapshot(ctx)
+	}
+	if c.input != "" {
+		return c.ExecuteInput(ctx)
+	}
 
-	if c.noTLS {
-		conn, err = net.Dial("tcp", c.address)
+	conn, err := c.Dial(c.address)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if c.record != "" {
+		c.recordF, err = os.Create(c.record)
 		if err != nil {
+			conn.Close()
 			return errors.Trace(
-				errors.Newf("Connection to warpd failed: %v.", err),
+				errors.Newf("Failed to create recording file: %v", err),
 			)
 		}
-	} else {
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: c.insecureTLS,
-		}
+		// Flush the recording on teardown (after the terminal is restored).
+		defer func() {
+			c.mutex.Lock()
+			if c.rec != nil {
+				c.rec.Flush()
+			}
+			c.mutex.Unlock()
+			c.recordF.Close()
+		}()
+	}
 
-		conn, err = tls.Dial("tcp", c.address, tlsConfig)
+	if c.tee != "" {
+		f, err := os.Create(c.tee)
 		if err != nil {
+			conn.Close()
 			return errors.Trace(
-				errors.Newf("Connection to warpd failed: %v.", err),
+				errors.Newf("Failed to create tee file: %v", err),
 			)
 		}
+		c.teeW = tee.NewWriter(f)
+		// Flush and close the tee file on teardown.
+		defer func() {
+			c.teeW.Close()
+			f.Close()
+		}()
 	}
-	defer conn.Close()
-
-	c.ss, err = cli.NewSession(
-		ctx,
-		c.session,
-		c.warp,
-		warp.SsTpShellClient,
-		c.username,
-		cancel,
-		conn,
-	)
-	if err != nil {
-		return errors.Trace(err)
-	}
-	// Close and reclaims all session related state.
-	defer c.ss.TearDown()
 
 	out.Normf("Connected to warp: ")
 	out.Valuf("%s\n", c.warp)
+	if c.requested != 0 {
+		out.Normf("Requested write access, waiting for the host to authorize " +
+			"you.\n")
+	}
 
 	// Setup local term.
-	stdin := int(os.Stdin.Fd())
-	if !terminal.IsTerminal(stdin) {
-		return errors.Trace(
-			errors.Newf("Not running in a terminal."),
-		)
-	}
+	if c.noRaw {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		defer signal.Stop(ch)
+		go func() {
+			select {
+			case <-ch:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	} else {
+		stdin := int(os.Stdin.Fd())
+		if !terminal.IsTerminal(stdin) {
+			conn.Close()
+			return errors.Trace(
+				errors.Newf(
+					"Not running in a terminal " +
+						"(use `--no-raw` to connect in line mode).",
+				),
+			)
+		}
 
-	old, err := terminal.MakeRaw(stdin)
-	if err != nil {
-		return errors.Trace(
-			errors.Newf("Unable to put terminal in raw mode: %v.", err),
-		)
+		restore, err := cli.MakeRawTerminal(ctx, cancel, stdin)
+		if err != nil {
+			conn.Close()
+			return errors.Trace(
+				errors.Newf(
+					"Unable to put terminal in raw mode: %v "+
+						"(use `--no-raw` to connect in line mode).",
+					err,
+				),
+			)
+		}
+		// Restors the terminal once we're done.
+		defer restore()
+		if c.mouse {
+			defer os.Stdout.Write(mouse.Disable())
+		}
+		if c.scrollback > 0 {
+			// The warp size is set once the first state is received.
+			c.pager = cli.NewPager(
+				c.warp, warp.Size{Rows: 24, Cols: 80}, c.scrollback,
+				int(os.Stdout.Fd()), os.Stdout,
+			)
+			go c.pager.Run(ctx)
+			// Leave the pager before the terminal is restored.
+			defer c.pager.Close()
+		} else if c.legend || c.stats || c.writeKey != 0 {
+			c.statusLine = cli.NewStatusLine(int(os.Stdout.Fd()), os.Stdout)
+			go c.statusLine.Run(ctx)
+			// Clear the status line before the terminal is restored.
+			defer c.statusLine.Close()
+		}
 	}
-	// Restors the terminal once we're done.
-	defer terminal.Restore(stdin, old)
 
 	// Main loops.
 
@@ -221,59 +779,1504 @@ func (c *Connect) Execute(
 		cancel()
 	}()
 
-	// Listen for state updates.
-	go func() {
-	STATELOOP:
-		for {
-			if st, err := c.ss.DecodeState(ctx); err != nil {
-				break
-			} else {
-				if err := c.ss.UpdateState(*st, false); err != nil {
-					break
-				}
-				// Update the terminal size.
-				fmt.Printf("\033[8;%d;%dt", st.WindowSize.Rows, st.WindowSize.Cols)
-			}
-
-			select {
-			case <-ctx.Done():
-				break STATELOOP
-			default:
-			}
-		}
-		cancel()
-	}()
-
-	// Listen for errors.
+	// Launch the connection loop.
 	go func() {
-		if e, err := c.ss.DecodeError(ctx); err == nil {
-			c.errC <- errors.Newf(
-				"Received %s: %s", e.Code, e.Message,
-			)
-		}
+		defer cli.RecoverTerminal()
+		c.ConnLoop(ctx, conn)
+		// Errors are sent to the errC, no need to cancel.
 	}()
 
 	// Multiplex Stdin to dataC.
 	go func() {
+		defer cli.RecoverTerminal()
+		write := func(data []byte) {
+			ss := c.ClientSession()
+			if ss != nil {
+				ss.WriteDataC(data)
+			}
+		}
+		if c.noRaw {
+			// Lines are terminated by a carriage return as if Enter was
+			// pressed in raw mode.
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				write([]byte(scanner.Text() + "\r"))
+			}
+			// Keep viewing the warp once stdin is closed (as in CI).
+			return
+		}
 		plex.Run(ctx, func(data []byte) {
-			c.ss.DataC().Write(data)
+			if c.answerPrompt(data) {
+				return
+			}
+			ss := c.ClientSession()
+			if c.pager != nil {
+				// Keys are handled by the pager, nothing is sent to the
+				// warp.
+				if c.pager.Input(data) {
+					cancel()
+				}
+				if ss != nil && bytes.IndexByte(data, refreshKey) >= 0 {
+					ss.SendRefresh(ctx)
+				}
+				return
+			}
+			typing := ss != nil && c.canWrite(ss)
+			if typing && c.writeKey != 0 {
+				// Only what is typed while armed is sent, the rest is
+				// handled as if the user couldn't write.
+				armed, disarmed := c.pushToType(ss, data)
+				if len(armed) > 0 {
+					write(armed)
+				}
+				if len(disarmed) == 0 {
+					return
+				}
+				data, typing = disarmed, false
+			}
+			if bytes.IndexByte(data, pauseKey) >= 0 &&
+				(!typing || c.isPaused()) {
+				// Keys are not sent to the warp around the pause key.
+				c.togglePause(ctx, ss)
+				return
+			}
+			if c.mouse && !typing {
+				// Mouse events are only forwarded while authorized.
+				data = c.mouseS.Strip(data)
+				if len(data) == 0 {
+					return
+				}
+			}
+			if ss != nil && !typing &&
+				bytes.IndexByte(data, refreshKey) >= 0 {
+				// Users who can write get Ctrl-L to the shell, which
+				// redraws on its own.
+				ss.SendRefresh(ctx)
+			}
+			if ss != nil && !typing && !c.canWrite(ss) &&
+				bytes.IndexByte(data, requestKey) >= 0 {
+				c.requestWrite(ctx, ss)
+			}
+			if typing || c.writeKey == 0 {
+				write(data)
+			}
 		}, os.Stdin)
 		cancel()
 	}()
 
-	// Multiplex dataC to Stdout.
-	go func() {
-		plex.Run(ctx, func(data []byte) {
-			os.Stdout.Write(data)
-		}, c.ss.DataC())
-		c.errC <- errors.Newf(
-			"Lost connection to warpd. You can attempt to reconnect once you " +
-				"regain connetivity.",
-		)
-	}()
-
 	// Wait for cancellation to return and clean up everything.
 	<-ctx.Done()
 
 	return userErr
 }
+
+// Dial opens a connection to warpd at the specified address.
+func (c *Connect) Dial(
+	address string,
+) (net.Conn, error) {
+	network, address := warp.AddressNetwork(address)
+	if c.noTLS {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, errors.Trace(
+				errors.Newf("Connection to warpd failed: %v.", err),
+			)
+		}
+		return conn, nil
+	}
+
+	conn, err := tls.Dial(network, address, c.tlsConfig)
+	if cli.IsPinMismatch(err) {
+		return nil, errors.Trace(err)
+	}
+	if err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Connection to warpd failed: %v.", err),
+		)
+	}
+	return conn, nil
+}
+
+// Resolve resolves the warp ID prefix against the warps active on warpd,
+// following redirects, and replaces it with the matching warp ID.
+func (c *Connect) Resolve(
+	ctx context.Context,
+) error {
+	address := c.address
+	for hops := 0; ; hops++ {
+		if hops > warp.MaxRedirects {
+			return errors.Trace(
+				errors.Newf(
+					"Too many redirects from warpd (last to %s).", address,
+				),
+			)
+		}
+		res, err := c.resolveAt(ctx, address)
+		if r, ok := errors.Cause(err).(*cli.RedirectError); ok {
+			address = r.Address
+			continue
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		switch {
+		case len(res.Warps) == 0:
+			return errors.Trace(
+				errors.Newf("No warp matching prefix: %s", c.warp),
+			)
+		case len(res.Warps) > 1:
+			candidates := strings.Join(res.Warps, ", ")
+			if res.Truncated {
+				candidates += ", ..."
+			}
+			return errors.Trace(
+				errors.Newf(
+					"Ambiguous warp prefix %s, matching: %s",
+					c.warp, candidates,
+				),
+			)
+		}
+		c.warp = res.Warps[0]
+		return nil
+	}
+}
+
+// resolveAt connects to warpd at the specified address and resolves the warp
+// ID prefix.
+func (c *Connect) resolveAt(
+	ctx context.Context,
+	address string,
+) (*warp.Resolution, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn, err := c.Dial(address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer conn.Close()
+
+	ss, err := cli.NewSession(
+		ctx,
+		c.session,
+		c.warp,
+		warp.SsTpResolve,
+		c.username,
+		cli.SessionOptions{},
+		cancel,
+		conn,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// Close and reclaims all session related state.
+	defer ss.TearDown()
+
+	errC := ss.WatchError(ctx)
+
+	res, err := ss.DecodeResolution(ctx)
+	if err != nil {
+		ss.TearDown()
+		if err := <-errC; err != nil {
+			return nil, errors.Trace(err)
+		}
+		return nil, errors.Trace(
+			errors.Newf("Failed to resolve warp prefix: %v.", err),
+		)
+	}
+	return res, nil
+}
+
+// ClientSession returns the current client session. It can be nil while
+// reconnecting.
+func (c *Connect) ClientSession() *cli.Session {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ss
+}
+
+// ConnLoop manages the session over the initial connection and, if following
+// the warp, reconnects each time the connection drops. Redirects from warpd
+// are followed (up to warp.MaxRedirects consecutive ones) and reconnections
+// after a connection drop start from the original address. Transient failures
+// to establish the first session are retried with backoff. The first error
+// (or loss of connection if not following) is sent to c.errC, as are the
+// permanent errors (see permanent) received once following.
+func (c *Connect) ConnLoop(
+	ctx context.Context,
+	conn net.Conn,
+) {
+	first := true
+	address := c.address
+	hops := 0
+	retries := 0
+CONNLOOP:
+	for {
+		if conn == nil {
+			var err error
+			conn, err = c.Dial(address)
+			if err != nil {
+				if first {
+					c.errC <- err
+					break CONNLOOP
+				}
+				// Silently ignore and attempt a reconnect 500ms after.
+				address = c.address
+				select {
+				case <-ctx.Done():
+					break CONNLOOP
+				case <-time.After(500 * time.Millisecond):
+				}
+				continue
+			}
+		}
+
+		err := c.ManageSession(ctx, conn, !first)
+		conn.Close()
+		conn = nil
+
+		select {
+		case <-ctx.Done():
+			break CONNLOOP
+		default:
+		}
+
+		if r, ok := errors.Cause(err).(*cli.RedirectError); ok {
+			hops++
+			if hops > warp.MaxRedirects {
+				c.errC <- errors.Newf(
+					"Too many redirects from warpd (last to %s).", r.Address,
+				)
+				break CONNLOOP
+			}
+			address = r.Address
+			continue
+		}
+		if first && cli.IsTransient(err) && retries < cli.SessionRetries {
+			retries++
+			select {
+			case <-ctx.Done():
+				break CONNLOOP
+			case <-time.After(cli.SessionRetryDelay(retries)):
+			}
+			continue
+		}
+		hops = 0
+		address = c.address
+
+		// warpd failing with an internal error doesn't mean the warp is
+		// gone for good (its host rehosts it).
+		if cli.IsInternal(err) && (c.follow || c.offerReconnect(ctx, err)) {
+			first = false
+			select {
+			case <-ctx.Done():
+				break CONNLOOP
+			case <-time.After(500 * time.Millisecond):
+			}
+			continue
+		}
+
+		// The host closing the warp (or the warp not existing yet) is not
+		// final when waiting for the host.
+		if c.waitForHost && cli.IsHostClosed(err) {
+			if !c.waiting {
+				c.waiting = true
+				c.displayWaiting()
+			}
+			first = false
+			select {
+			case <-ctx.Done():
+				break CONNLOOP
+			case <-time.After(waitForHostInterval):
+			}
+			continue
+		}
+
+		// Interactive clients reconnect when the connection drops (without
+		// error from warpd), the terminal staying in raw mode meanwhile.
+		reconnect := c.follow ||
+			(err == nil && !c.noRaw && !c.noReconnect)
+		if !reconnect || (first && err != nil) || permanent(err) {
+			if err == nil {
+				err = errors.Newf(
+					"Lost connection to warpd. You can attempt to reconnect " +
+						"once you regain connetivity.",
+				)
+			}
+			c.errC <- err
+			break CONNLOOP
+		}
+		first = false
+		if err == nil && !c.reconnecting {
+			c.reconnecting = true
+			c.displayReconnecting()
+		}
+
+		select {
+		case <-ctx.Done():
+			break CONNLOOP
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// permanent returns whether reconnecting after err, returned by
+// ManageSession, is pointless: warpd rejected the session or the warp is gone
+// (as opposed to the connection dropping or warpd failing internally).
+func permanent(
+	err error,
+) bool {
+	return cli.IsRejected(err) || cli.IsHostClosed(err) ||
+		cli.IsKicked(err) || cli.IsPinMismatch(err) ||
+		cli.IsIncompatible(err)
+}
+
+// waitForHostInterval is the interval at which clients waiting for the host
+// attempt to reattach to the warp (`--wait-for-host`).
+const waitForHostInterval = 2 * time.Second
+
+// displayWaiting displays that the client is waiting for the host, until the
+// warp is reattached (see ManageSession).
+func (c *Connect) displayWaiting() {
+	if c.pager != nil {
+		c.pager.SetNotice("waiting for host...")
+		return
+	}
+	c.display([]byte(
+		"\r\n[warp: waiting for the host to open the warp...]\r\n",
+	))
+}
+
+// displayReconnecting displays that the connection to warpd dropped and is
+// being reestablished, until the session is resynchronized (see
+// ManageSession).
+func (c *Connect) displayReconnecting() {
+	if c.pager != nil {
+		c.pager.SetNotice("reconnecting...")
+		return
+	}
+	c.display([]byte("\r\n[warp: connection lost, reconnecting...]\r\n"))
+}
+
+// displayHostReconnecting displays that the host disconnected and warpd keeps
+// the warp open for it to reconnect, or that it did.
+func (c *Connect) displayHostReconnecting(
+	reconnecting bool,
+) {
+	if c.pager != nil {
+		if reconnecting {
+			c.pager.SetNotice("host reconnecting...")
+		} else {
+			c.pager.SetNotice("")
+		}
+		return
+	}
+	if reconnecting {
+		c.display([]byte(
+			"\r\n[warp: host disconnected, waiting for it to reconnect...]\r\n",
+		))
+	} else {
+		c.display([]byte("\r\n[warp: host reconnected]\r\n"))
+	}
+}
+
+// offerReconnect asks the user whether to reconnect after warpd failed with
+// an internal error and returns the answer. It is only offered in raw mode,
+// where keys are not forwarded to the warp while reconnecting.
+func (c *Connect) offerReconnect(
+	ctx context.Context,
+	err error,
+) bool {
+	if c.noRaw {
+		return false
+	}
+	promptC := make(chan byte, 1)
+	c.mutex.Lock()
+	c.promptC = promptC
+	c.mutex.Unlock()
+
+	c.display([]byte(fmt.Sprintf(
+		"\r\n[warp: %v]\r\n[warp: reconnect? [Y/n]]", err,
+	)))
+
+	select {
+	case <-ctx.Done():
+		return false
+	case key := <-promptC:
+		return key == 'y' || key == 'Y' || key == '\r' || key == '\n'
+	}
+}
+
+// answerPrompt sends the first key of data to the pending prompt, if any,
+// returning true if it did.
+func (c *Connect) answerPrompt(
+	data []byte,
+) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.promptC == nil || len(data) == 0 {
+		return false
+	}
+	c.promptC <- data[0]
+	c.promptC = nil
+	return true
+}
+
+// ManageSession creates and manages a client session until it drops. It
+// returns the error received from warpd if any. When reconnecting, the
+// screen is cleared once the session state is resynchronized so that the
+// data received afterwards is rendered on a clean screen.
+func (c *Connect) ManageSession(
+	ctx context.Context,
+	conn net.Conn,
+	reconnect bool,
+) error {
+	// This ctx can be canceled by the session or its parent context.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ss, err := cli.NewSession(
+		ctx,
+		c.session,
+		c.warp,
+		warp.SsTpShellClient,
+		c.username,
+		cli.SessionOptions{
+			Sequenced: c.sequence,
+			Requested: c.requested,
+			Compress:  c.compress,
+			Replay:    c.replay,
+		},
+		cancel,
+		conn,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Close and reclaims all session related state.
+	defer ss.TearDown()
+
+	// Listen for errors.
+	errC := ss.WatchError(ctx)
+
+	// Wait for a first state update from warpd.
+	st, err := ss.DecodeState(ctx)
+	if err != nil {
+		// Receive the error sent by warpd, if any.
+		ss.TearDown()
+		return <-errC
+	}
+	if err := ss.UpdateState(*st, false); err != nil {
+		return errors.Trace(err)
+	}
+	if reconnect {
+		// Clear the screen, the data that follows redraws it.
+		c.display([]byte("\033[2J\033[H"))
+	} else {
+		if notice := termNotice(st.Term, os.Getenv("TERM")); notice != "" {
+			c.display([]byte(notice))
+		}
+		if c.compress && !ss.Compressed() {
+			c.display([]byte(
+				"[warp: compression not supported by warpd]\r\n",
+			))
+		}
+	}
+	if c.waiting || c.reconnecting {
+		c.waiting = false
+		c.reconnecting = false
+		if c.pager != nil {
+			c.pager.SetNotice("")
+		}
+	}
+	if st.HostReconnecting {
+		c.displayHostReconnecting(true)
+	}
+	c.heard(st)
+	// Update the terminal size.
+	c.resizeTerminal(ss.WindowSize(), st.SizePolicy)
+	c.updateMouse(ss)
+	c.updateLegend(ss)
+
+	// The client session is ready.
+	c.mutex.Lock()
+	c.ss = ss
+	c.mutex.Unlock()
+
+	go c.reportSize(ctx, ss)
+	if c.stats {
+		go c.latencyStats(ctx, ss)
+	}
+	if ss.Heartbeats() && (c.pager != nil || c.statusLine != nil) {
+		go c.watchHost(ctx, ss)
+	}
+
+	// Listen for state updates.
+	go func() {
+		defer cli.RecoverTerminal()
+		typing := false
+		hostReconnecting := st.HostReconnecting
+	STATELOOP:
+		for {
+			if st, err := ss.DecodeState(ctx); err != nil {
+				break
+			} else {
+				if err := ss.UpdateState(*st, false); err != nil {
+					break
+				}
+				c.heard(st)
+				if st.HostReconnecting != hostReconnecting {
+					hostReconnecting = st.HostReconnecting
+					c.displayHostReconnecting(hostReconnecting)
+				}
+				if c.pager != nil {
+					if !hostReconnecting {
+						notice := ""
+						if len(st.Typing) > 0 {
+							notice = strings.Trim(
+								typingNotice(st.Typing), "\r\n[]",
+							)
+						}
+						c.pager.SetNotice(notice)
+					}
+				} else if len(st.Typing) > 0 && !typing {
+					os.Stdout.Write([]byte(typingNotice(st.Typing)))
+				}
+				typing = len(st.Typing) > 0
+				// Update the terminal size.
+				c.resizeTerminal(ss.WindowSize(), st.SizePolicy)
+				c.updateMouse(ss)
+				c.updateLegend(ss)
+			}
+
+			select {
+			case <-ctx.Done():
+				break STATELOOP
+			default:
+			}
+		}
+		cancel()
+	}()
+
+	// Multiplex dataC to Stdout.
+	go func() {
+		defer cli.RecoverTerminal()
+		ss.ReadData(ctx, func(data []byte) {
+			display := data
+			if c.mouse {
+				c.mutex.Lock()
+				on := c.mouseOn
+				c.mutex.Unlock()
+				display = c.mouseT.Output(display, !on)
+			}
+			if c.sanitizer != nil {
+				display = c.sanitizer.Filter(display)
+			}
+			c.display(display)
+			c.heard(nil)
+			if c.stats {
+				c.mutex.Lock()
+				c.received += len(data)
+				c.mutex.Unlock()
+			}
+			if c.teeW != nil {
+				c.teeW.Write(data)
+			}
+			c.recordData(data)
+		}, func(missing uint64) {
+			// The screen can't be trusted anymore, clear it and request
+			// a refresh to have it redrawn.
+			c.display([]byte(fmt.Sprintf(
+				"\033[2J\033[H[warp: lost %d chunks of data, the screen "+
+					"may be incomplete until redrawn]\r\n",
+				missing,
+			)))
+			ss.SendRefresh(ctx)
+		})
+		cancel()
+	}()
+
+	<-ctx.Done()
+	ss.TearDown()
+
+	c.mutex.Lock()
+	c.ss = nil
+	c.mutex.Unlock()
+
+	return <-errC
+}
+
+// display writes data received from the warp (or generated locally) to the
+// pager if paging, stdout otherwise.
+func (c *Connect) display(
+	data []byte,
+) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.paused {
+		if !c.overflowed &&
+			len(c.pausedOutput)+len(data) <= maxPausedOutput {
+			c.pausedOutput = append(c.pausedOutput, data...)
+		} else {
+			c.pausedOutput = nil
+			c.overflowed = true
+		}
+		return
+	}
+	c.write(data)
+}
+
+// write writes data to the pager if paging, stdout otherwise. It must be
+// called with the lock held (see display).
+func (c *Connect) write(
+	data []byte,
+) {
+	if c.pager != nil {
+		c.pager.Write(data)
+		return
+	}
+	if c.statusLine != nil {
+		c.statusLine.Write(data)
+		return
+	}
+	c.stdout.Write(data)
+}
+
+// resizeTerminal attempts to resize the local terminal to the warp window
+// size (as validated by the session state), unless the warp follows the size
+// of the clients terminals (warp.SizePolicyMin). If paging, the view of the
+// pager is resized instead.
+func (c *Connect) resizeTerminal(
+	size warp.Size,
+	policy warp.SizePolicy,
+) {
+	if !size.Valid() {
+		return
+	}
+	if c.pager != nil {
+		// The local terminal displays a view of the warp window.
+		c.pager.Resize(size)
+	} else if policy != warp.SizePolicyMin {
+		fmt.Fprintf(c.stdout, "\033[8;%d;%dt", size.Rows, size.Cols)
+	}
+	c.recordSize(size)
+}
+
+// reportSize reports the size of the local terminal to warpd, initially and
+// each time it is resized, until the context is canceled.
+func (c *Connect) reportSize(
+	ctx context.Context,
+	ss *cli.Session,
+) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+	defer signal.Stop(ch)
+	for {
+		cols, rows, err := terminal.GetSize(int(os.Stdout.Fd()))
+		if c.pager != nil || c.statusLine != nil {
+			// The last line is used by the status line.
+			rows--
+		}
+		if err == nil {
+			ss.SendWindowSize(ctx, warp.Size{Rows: rows, Cols: cols})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+		}
+	}
+}
+
+// recordSize records the window size if recording, starting the recording on
+// the first call.
+func (c *Connect) recordSize(
+	size warp.Size,
+) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.recordF == nil {
+		return
+	}
+	if c.rec == nil {
+		rec, err := asciicast.NewWriter(
+			c.recordF, size.Cols, size.Rows,
+			map[string]string{"TERM": os.Getenv("TERM")},
+		)
+		if err != nil {
+			return
+		}
+		c.rec = rec
+	} else if size != c.recSize {
+		c.rec.Resize(size.Cols, size.Rows)
+	}
+	c.recSize = size
+}
+
+// recordData records data received from the warp if recording.
+func (c *Connect) recordData(
+	data []byte,
+) {
+	c.mutex.Lock()
+	rec := c.rec
+	c.mutex.Unlock()
+	if rec != nil {
+		rec.Output(data)
+	}
+}
+
+const (
+	// snapshotSettle is the duration without data after which the screen is
+	// considered stable when taking a snapshot.
+	snapshotSettle = 500 * time.Millisecond
+	// snapshotTimeout bounds the time spent capturing a snapshot of a warp
+	// that never settles.
+	snapshotTimeout = 5 * time.Second
+)
+
+// ExecuteSnapshot connects to warpd, following redirects, and prints a
+// snapshot of the warp.
+func (c *Connect) ExecuteSnapshot(
+	ctx context.Context,
+) error {
+	return errors.Trace(c.withRedirects(ctx, c.snapshotAt))
+}
+
+// withRedirects calls fn with the address of warpd, calling it again with the
+// address warpd redirected to (up to warp.MaxRedirects times) each time it
+// returns a *cli.RedirectError.
+func (c *Connect) withRedirects(
+	ctx context.Context,
+	fn func(context.Context, string) error,
+) error {
+	address := c.address
+	for hops := 0; ; hops++ {
+		if hops > warp.MaxRedirects {
+			return errors.Trace(
+				errors.Newf(
+					"Too many redirects from warpd (last to %s).", address,
+				),
+			)
+		}
+		err := fn(ctx, address)
+		if r, ok := errors.Cause(err).(*cli.RedirectError); ok {
+			address = r.Address
+			continue
+		}
+		return errors.Trace(err)
+	}
+}
+
+// snapshotAt connects to warpd at the specified address and prints a snapshot
+// of the warp.
+func (c *Connect) snapshotAt(
+	ctx context.Context,
+	address string,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn, err := c.Dial(address)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+
+	c.ss, err = cli.NewSession(
+		ctx,
+		c.session,
+		c.warp,
+		warp.SsTpShellClient,
+		c.username,
+		cli.SessionOptions{Compress: c.compress, Replay: c.replay},
+		cancel,
+		conn,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Close and reclaims all session related state.
+	defer c.ss.TearDown()
+
+	return c.Snapshot(ctx)
+}
+
+// Snapshot waits for the initial state update, renders the data received
+// until the stream settles (the replayed output of the warp followed by its
+// live output) on a screen of the size of the warp and prints the rows of the
+// screen to stdout as plain text once. It does not require a terminal.
+func (c *Connect) Snapshot(
+	ctx context.Context,
+) error {
+	errC := c.ss.WatchError(ctx)
+
+	// Wait for a first state update from warpd.
+	st, err := c.ss.DecodeState(ctx)
+	if err != nil {
+		c.ss.TearDown()
+		if err := <-errC; err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(
+			errors.Newf("Failed to receive warp state: %v.", err),
+		)
+	}
+	if err := c.ss.UpdateState(*st, false); err != nil {
+		return errors.Trace(err)
+	}
+
+	dataC := make(chan []byte)
+	go func() {
+		plex.Run(ctx, func(data []byte) {
+			select {
+			case dataC <- data:
+			case <-ctx.Done():
+			}
+		}, c.ss.DataC())
+		close(dataC)
+	}()
+
+	size := st.WindowSize
+	if !size.Valid() {
+		size = warp.Size{Rows: 24, Cols: 80}
+	}
+	sc := screen.New(size.Cols, size.Rows, 0)
+
+	timeout := time.After(snapshotTimeout)
+SNAPLOOP:
+	for {
+		select {
+		case data, ok := <-dataC:
+			if !ok {
+				break SNAPLOOP
+			}
+			if c.sanitizer != nil {
+				data = c.sanitizer.Filter(data)
+			}
+			sc.Write(data)
+		case err := <-errC:
+			if err != nil {
+				return errors.Trace(err)
+			}
+			// The session was closed without error, print what was received.
+			errC = nil
+		case <-time.After(snapshotSettle):
+			break SNAPLOOP
+		case <-timeout:
+			break SNAPLOOP
+		}
+	}
+
+	if _, err := os.Stdout.Write(snapshotText(sc)); err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to write snapshot: %v", err),
+		)
+	}
+
+	return nil
+}
+
+// snapshotText returns the rows of the screen as plain text, without their
+// trailing blanks nor the blank rows at the bottom of the screen.
+func snapshotText(
+	sc *screen.Screen,
+) []byte {
+	_, rows := sc.Size()
+	lines := []string{}
+	for _, line := range sc.View(0, rows) {
+		runes := make([]rune, len(line))
+		for i, cell := range line {
+			runes[i] = cell.Rune
+		}
+		lines = append(lines, strings.TrimRight(string(runes), " "))
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+// ExecuteInput connects to warpd, following redirects, and types the input
+// file into the warp.
+func (c *Connect) ExecuteInput(
+	ctx context.Context,
+) error {
+	var lines []string
+	var err error
+	if c.input == "-" {
+		lines, err = readInputLines(os.Stdin)
+	} else {
+		f, ferr := os.Open(c.input)
+		if ferr != nil {
+			return errors.Trace(
+				errors.Newf("Failed to open input file: %v", ferr),
+			)
+		}
+		lines, err = readInputLines(f)
+		f.Close()
+	}
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to read input: %v", err),
+		)
+	}
+
+	return errors.Trace(c.withRedirects(ctx,
+		func(ctx context.Context, address string) error {
+			return c.inputAt(ctx, address, lines)
+		},
+	))
+}
+
+// readInputLines reads lines from r, terminating each of them with a carriage
+// return as if typed at a terminal.
+func readInputLines(
+	r io.Reader,
+) ([]string, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text()+"\r")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return lines, nil
+}
+
+// inputAt connects to warpd at the specified address, checks that the user is
+// authorized to write to the warp and types the input lines into it, printing
+// the data received to stdout. It returns once the output settles or, if
+// staying, when the warp is closed or the command interrupted.
+func (c *Connect) inputAt(
+	ctx context.Context,
+	address string,
+	lines []string,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn, err := c.Dial(address)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+
+	ss, err := cli.NewSession(
+		ctx,
+		c.session,
+		c.warp,
+		warp.SsTpShellClient,
+		c.username,
+		cli.SessionOptions{Compress: c.compress},
+		cancel,
+		conn,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Close and reclaims all session related state.
+	defer ss.TearDown()
+
+	errC := ss.WatchError(ctx)
+
+	// Wait for a first state update from warpd.
+	st, err := ss.DecodeState(ctx)
+	if err != nil {
+		ss.TearDown()
+		if err := <-errC; err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(
+			errors.Newf("Failed to receive warp state: %v.", err),
+		)
+	}
+	if err := ss.UpdateState(*st, false); err != nil {
+		return errors.Trace(err)
+	}
+	if !c.canWrite(ss) {
+		return errors.Trace(
+			errors.Newf(
+				"You are not authorized to write to warp %s. Ask its host "+
+					"to run `warp authorize %s` while you are connected.",
+				c.warp, c.username,
+			),
+		)
+	}
+
+	// Keep the state up to date to detect revocations.
+	go func() {
+		for {
+			st, err := ss.DecodeState(ctx)
+			if err != nil {
+				break
+			}
+			if err := ss.UpdateState(*st, false); err != nil {
+				break
+			}
+		}
+		cancel()
+	}()
+
+	// Print the data received, signaling activity on dataC.
+	dataC := make(chan struct{}, 1)
+	go func() {
+		ss.ReadData(ctx, func(data []byte) {
+			if c.sanitizer != nil {
+				data = c.sanitizer.Filter(data)
+			}
+			os.Stdout.Write(data)
+			select {
+			case dataC <- struct{}{}:
+			default:
+			}
+		}, nil)
+		cancel()
+	}()
+
+	for i, line := range lines {
+		if i > 0 && c.inputDelay > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.inputDelay):
+			}
+		}
+		select {
+		case <-ctx.Done():
+			ss.TearDown()
+			if err := <-errC; err != nil {
+				return errors.Trace(err)
+			}
+			return errors.Trace(
+				errors.Newf("Lost connection to warpd while sending input."),
+			)
+		default:
+		}
+		if !c.canWrite(ss) {
+			return errors.Trace(
+				errors.Newf(
+					"Your authorization to write to warp %s was revoked.",
+					c.warp,
+				),
+			)
+		}
+		ss.WriteDataC([]byte(line))
+	}
+
+	if c.stay {
+		<-ctx.Done()
+		ss.TearDown()
+		if err := <-errC; err != nil {
+			return errors.Trace(err)
+		}
+		return nil
+	}
+
+	// Wait for the output to settle.
+	for {
+		select {
+		case <-dataC:
+		case err := <-errC:
+			return errors.Trace(err)
+		case <-ctx.Done():
+			return nil
+		case <-time.After(snapshotSettle):
+			return nil
+		}
+	}
+}
+
+// canWrite returns whether the user is currently authorized to write to the
+// warp (and holds the write token in single-writer mode).
+func (c *Connect) canWrite(
+	ss *cli.Session,
+) bool {
+	return ss.CanWrite(c.session.User)
+}
+
+// requestWrite requests write access from the host, on requestKey.
+func (c *Connect) requestWrite(
+	ctx context.Context,
+	ss *cli.Session,
+) {
+	if ss.PendingRequest(c.session.User)&warp.ModeShellWrite != 0 {
+		c.display([]byte(
+			"\r\n[warp: write access already requested, waiting for the " +
+				"host]\r\n",
+		))
+		return
+	}
+	if !ss.Requests() {
+		c.display([]byte(
+			"\r\n[warp: warpd doesn't support write access requests, ask " +
+				"the host to authorize you]\r\n",
+		))
+		return
+	}
+	if err := ss.SendRequest(ctx, warp.ModeShellWrite); err != nil {
+		return
+	}
+	c.display([]byte(
+		"\r\n[warp: requested write access, waiting for the host to " +
+			"authorize you]\r\n",
+	))
+}
+
+// updateMouse enables mouse reporting in the local terminal, as requested by
+// the applications of the warp, while the user can write to the warp
+// (`--mouse`). It is disabled otherwise so that mouse events are not
+// reported for nothing and the terminal keeps its own mouse handling.
+func (c *Connect) updateMouse(
+	ss *cli.Session,
+) {
+	if !c.mouse {
+		return
+	}
+	c.mutex.Lock()
+	on := c.canWrite(ss) && !c.paused
+	changed := on != c.mouseOn
+	c.mouseOn = on
+	c.mutex.Unlock()
+	if !changed {
+		return
+	}
+	if on {
+		os.Stdout.Write(c.mouseT.Enable())
+	} else {
+		os.Stdout.Write(mouse.Disable())
+	}
+}
+
+// isPaused returns whether the output of the warp is paused.
+func (c *Connect) isPaused() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.paused
+}
+
+// togglePause pauses the output of the warp so that the viewer can select
+// text on a still screen, or resumes it. The local terminal stays in raw mode
+// meanwhile (keys are still read one by one, to catch the pause key again),
+// only the output is held. The pause is notified in the status line if any,
+// on the cursor line otherwise, saving and restoring the cursor around it so
+// as not to disturb the stream. On resume, the notice is cleared, the output
+// buffered meanwhile written (or the screen cleared if it overflowed) and a
+// refresh requested to redraw what the notice covered.
+func (c *Connect) togglePause(
+	ctx context.Context,
+	ss *cli.Session,
+) {
+	c.mutex.Lock()
+	if !c.paused {
+		if c.statusLine == nil {
+			c.write([]byte(
+				"\0337\r\033[2K\033[7m" + pauseNotice + "\033[0m\0338",
+			))
+		}
+		c.paused = true
+		c.mutex.Unlock()
+		if ss != nil {
+			c.updateLegend(ss)
+		}
+		return
+	}
+	c.paused = false
+	output, overflowed := c.pausedOutput, c.overflowed
+	c.pausedOutput = nil
+	c.overflowed = false
+	if c.statusLine == nil {
+		c.write([]byte("\0337\r\033[2K\0338"))
+	}
+	if overflowed {
+		c.write([]byte("\033[2J\033[H"))
+	} else {
+		c.write(output)
+	}
+	c.mutex.Unlock()
+
+	if ss != nil {
+		c.updateLegend(ss)
+		ss.SendRefresh(ctx)
+		c.updateMouse(ss)
+	}
+}
+
+// updateLegend updates the legend of the users writing to the warp displayed
+// in the status line, if any.
+func (c *Connect) updateLegend(
+	ss *cli.Session,
+) {
+	legend := cli.Legend(ss.ProtocolState())
+	if c.pager != nil {
+		c.pager.SetLegend(legend)
+	}
+	if c.statusLine != nil {
+		text, width := cli.RenderLegend(legend, "\033[0m")
+		canWrite := c.canWrite(ss)
+		c.mutex.Lock()
+		if !canWrite {
+			// Typing is disarmed once unauthorized.
+			c.armed = false
+		}
+		armed := c.armed
+		host := c.hostStatus
+		paused := c.paused
+		c.mutex.Unlock()
+		if host != "" {
+			if width > 0 {
+				text, width = " "+text, width+1
+			}
+			text = fmt.Sprintf("\033[7m %s \033[0m", host) + text
+			width += len(host) + 2
+		}
+		if c.writeKey != 0 && canWrite {
+			status := fmt.Sprintf("%s to type", c.writeKeyName)
+			if armed {
+				status = "typing"
+			}
+			if width > 0 {
+				text, width = " "+text, width+1
+			}
+			text = fmt.Sprintf("\033[7m %s \033[0m", status) + text
+			width += len(status) + 2
+		}
+		if paused {
+			if width > 0 {
+				text, width = " "+text, width+1
+			}
+			text = fmt.Sprintf("\033[7m%s\033[0m", pauseNotice) + text
+			width += len(pauseNotice)
+		}
+		c.statusLine.Set(text, width)
+	}
+}
+
+// parseWriteKey parses the key arming typing (`--write-key`): ctrl-<letter>,
+// except the keys of line endings and the ones used by connect itself.
+func parseWriteKey(
+	key string,
+) (byte, error) {
+	k := strings.ToLower(key)
+	if len(k) != 6 || !strings.HasPrefix(k, "ctrl-") ||
+		k[5] < 'a' || k[5] > 'z' || strings.IndexByte("hijlm", k[5]) >= 0 {
+		return 0, errors.Trace(
+			errors.Newf(
+				"Invalid write key (ctrl-<letter>, except h, i, j, l and "+
+					"m): %s",
+				key,
+			),
+		)
+	}
+	return k[5] - 'a' + 1, nil
+}
+
+// pushToType splits what the user typed between what is sent to the warp
+// (typed while armed) and the rest, arming and disarming typing as the write
+// key and Enter are pressed (`--write-key`).
+func (c *Connect) pushToType(
+	ss *cli.Session,
+	data []byte,
+) ([]byte, []byte) {
+	armed := []byte{}
+	disarmed := []byte{}
+	c.mutex.Lock()
+	was := c.armed
+	for _, b := range data {
+		switch {
+		case b == c.writeKey:
+			c.armed = !c.armed
+		case c.armed:
+			armed = append(armed, b)
+			if b == '\r' {
+				c.armed = false
+			}
+		default:
+			disarmed = append(disarmed, b)
+		}
+	}
+	changed := c.armed != was
+	c.mutex.Unlock()
+	if changed {
+		c.updateLegend(ss)
+	}
+	return armed, disarmed
+}
+
+// latencyStatsInterval is the interval at which the latency stats are
+// computed and displayed (`--latency-stats`).
+const latencyStatsInterval = time.Second
+
+// latencyStats displays the round-trip time to warpd and the throughput of the
+// warp every latencyStatsInterval until the context is canceled.
+func (c *Connect) latencyStats(
+	ctx context.Context,
+	ss *cli.Session,
+) {
+	c.mutex.Lock()
+	c.received = 0
+	c.mutex.Unlock()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(latencyStatsInterval):
+		}
+		rtt := "?"
+		if d, err := ss.Ping(); err == nil {
+			rtt = d.Round(time.Microsecond).String()
+		}
+		c.mutex.Lock()
+		received := c.received
+		c.received = 0
+		c.mutex.Unlock()
+		now := time.Now()
+		rate := float64(received) / now.Sub(last).Seconds()
+		last = now
+
+		stats := fmt.Sprintf("rtt %s %s", rtt, formatRate(rate))
+		if c.pager != nil {
+			c.pager.SetStats(stats)
+		}
+		if c.statusLine != nil {
+			c.statusLine.SetRight(stats, len(stats))
+		}
+	}
+}
+
+// hostIdleThreshold is the time after which the host is displayed as idle in
+// the status line.
+const hostIdleThreshold = 10 * time.Second
+
+// warpdSilenceThreshold is the time after which warpd is displayed as not
+// responding if neither data nor state was received from it, warpd sending
+// the state of idle warps every warp.HeartbeatInterval. The connection is
+// eventually reestablished if it is dead.
+const warpdSilenceThreshold = 2 * warp.HeartbeatInterval
+
+// heard records that a state (or data if st is nil) was received from warpd.
+// The time at which the host was last active is computed from the time
+// elapsed since then (warp.State.HostIdle) as the clock of warpd may differ
+// from the local one. States received while the host is reconnecting don't
+// reflect its activity.
+func (c *Connect) heard(
+	st *warp.State,
+) {
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.heardAt = now
+	if st == nil {
+		c.hostActive = now
+		return
+	}
+	c.hostAway = st.HostReconnecting
+	if !st.HostReconnecting {
+		c.hostActive = now.Add(-st.HostIdle)
+	}
+}
+
+// watchHost displays in the status line how long the host has been idle, or
+// how long warpd has not been responding, every second until the context is
+// canceled. The status is cleared once the host is reconnecting, warpd not
+// sending heartbeats meanwhile.
+func (c *Connect) watchHost(
+	ctx context.Context,
+	ss *cli.Session,
+) {
+	for {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		now := time.Now()
+		status := ""
+		c.mutex.Lock()
+		silence := now.Sub(c.heardAt)
+		idle := now.Sub(c.hostActive)
+		away := c.hostAway
+		c.mutex.Unlock()
+		switch {
+		case ctx.Err() != nil || away:
+		case silence >= warpdSilenceThreshold:
+			status = fmt.Sprintf(
+				"warpd not responding %s", silence.Truncate(time.Second),
+			)
+		case idle >= hostIdleThreshold:
+			status = fmt.Sprintf("host idle %s", idle.Truncate(time.Second))
+		}
+
+		c.mutex.Lock()
+		changed := status != c.hostStatus
+		c.hostStatus = status
+		c.mutex.Unlock()
+		if changed {
+			if c.pager != nil {
+				c.pager.SetHost(status)
+			}
+			if c.statusLine != nil {
+				c.updateLegend(ss)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// formatRate renders a throughput in bytes per second.
+func formatRate(
+	rate float64,
+) string {
+	switch {
+	case rate >= 1<<20:
+		return fmt.Sprintf("%.1fMB/s", rate/(1<<20))
+	case rate >= 1<<10:
+		return fmt.Sprintf("%.1fKB/s", rate/(1<<10))
+	}
+	return fmt.Sprintf("%dB/s", int(rate))
+}
+
+// termNotice returns the notice displayed when the terminal type of the warp
+// differs significantly from the local one (another family of terminals or
+// less colors), empty otherwise.
+func termNotice(
+	term string,
+	local string,
+) string {
+	if !warp.TermRegexp.MatchString(term) || term == local {
+		return ""
+	}
+	family := func(t string) string {
+		return strings.SplitN(t, "-", 2)[0]
+	}
+	if family(term) == family(local) &&
+		(!strings.Contains(term, "256color") ||
+			strings.Contains(local, "256color")) {
+		return ""
+	}
+	if local == "" {
+		local = "unset"
+	}
+	return fmt.Sprintf(
+		"\r\n[warp: the warp runs with TERM=%s but yours is %s, the display "+
+			"may be garbled]\r\n",
+		term, local,
+	)
+}
+
+// typingNotice returns the notice displayed when users type simultaneously.
+func typingNotice(
+	typing []string,
+) string {
+	return fmt.Sprintf(
+		"\r\n[warp: %d people are typing: %s]\r\n",
+		len(typing), strings.Join(typing, ", "),
+	)
+}
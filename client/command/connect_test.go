@@ -0,0 +1,485 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/screen"
+)
+
+func TestSnapshotText(t *testing.T) {
+	sc := screen.New(20, 5, 0)
+	// Output drawn, cleared and redrawn, the alternate screen being left
+	// before the snapshot is taken.
+	sc.Write([]byte("garbage\r\n\033[2J\033[Hhello  \r\nworld"))
+	sc.Write([]byte("\033[?1049hvim\033[?1049l\033[1;1HH"))
+
+	got := string(snapshotText(sc))
+	want := "Hello\nworld\n"
+	if got != want {
+		t.Errorf("snapshotText: got %q, want %q", got, want)
+	}
+}
+
+// fakeWarpd is a minimal warpd serving shell client sessions over a Unix
+// socket. Each session is sent a state followed by replay over its data
+// channel or, if code is set, an error with that code.
+type fakeWarpd struct {
+	ln     net.Listener
+	replay string
+	code   string
+
+	mutex  *sync.Mutex
+	conns  []net.Conn
+	errors []net.Conn
+}
+
+// startFakeWarpd starts a fakeWarpd listening at path.
+func startFakeWarpd(
+	t *testing.T,
+	path string,
+	replay string,
+	code string,
+) *fakeWarpd {
+	t.Helper()
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	d := &fakeWarpd{
+		ln:     ln,
+		replay: replay,
+		code:   code,
+		mutex:  &sync.Mutex{},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			d.mutex.Lock()
+			d.conns = append(d.conns, conn)
+			d.mutex.Unlock()
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+// kill stops the fakeWarpd, dropping the connections of its sessions.
+func (d *fakeWarpd) kill() {
+	d.ln.Close()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, c := range d.conns {
+		c.Close()
+	}
+}
+
+// fail sends an error with the specified code to the sessions being served,
+// as warpd failing mid-session would.
+func (d *fakeWarpd) fail(
+	code string,
+) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, c := range d.errors {
+		gob.NewEncoder(c).Encode(warp.Error{
+			Code:    code,
+			Message: "Failed by fake warpd.",
+		})
+	}
+	d.errors = nil
+}
+
+// serve serves a session over conn.
+func (d *fakeWarpd) serve(
+	conn net.Conn,
+) {
+	defer conn.Close()
+	if _, err := warp.ReadPreamble(conn); err != nil {
+		return
+	}
+	if err := warp.WritePreamble(conn, warp.ProtocolVersion); err != nil {
+		return
+	}
+	mux, err := yamux.Server(conn, warp.MuxConfig(
+		time.Second, ioutil.Discard,
+	))
+	if err != nil {
+		return
+	}
+	defer mux.Close()
+
+	channels := map[warp.ChannelType]net.Conn{}
+	var hello warp.SessionHello
+	for range warp.RequiredChannels {
+		c, err := mux.Accept()
+		if err != nil {
+			return
+		}
+		ct, err := warp.ReadChannelTag(c)
+		if err != nil {
+			return
+		}
+		channels[ct] = c
+		if ct == warp.ChannelUpdate {
+			if err := gob.NewDecoder(c).Decode(&hello); err != nil {
+				return
+			}
+		}
+	}
+
+	if d.code != "" {
+		gob.NewEncoder(channels[warp.ChannelError]).Encode(warp.Error{
+			Code:    d.code,
+			Message: "Rejected by fake warpd.",
+		})
+		// Wait for the client to close the session upon the error.
+		io.Copy(ioutil.Discard, channels[warp.ChannelError])
+		return
+	}
+
+	d.mutex.Lock()
+	d.errors = append(d.errors, channels[warp.ChannelError])
+	d.mutex.Unlock()
+
+	gob.NewEncoder(channels[warp.ChannelState]).Encode(warp.State{
+		Warp:       hello.Warp,
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+		SizePolicy: warp.SizePolicyMin,
+		Users: map[string]warp.User{
+			hello.From.User: {
+				Token:    hello.From.User,
+				Username: hello.Username,
+				Mode:     warp.DefaultUserMode,
+			},
+		},
+	})
+	channels[warp.ChannelData].Write([]byte(d.replay))
+	// Keep the session open until killed.
+	io.Copy(ioutil.Discard, channels[warp.ChannelData])
+}
+
+// syncBuffer is a buffer safe for concurrent use capturing the output of a
+// Connect.
+type syncBuffer struct {
+	buf   bytes.Buffer
+	mutex sync.Mutex
+}
+
+func (b *syncBuffer) Write(
+	p []byte,
+) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// waitFor waits for the captured output to contain s.
+func waitFor(
+	t *testing.T,
+	output *syncBuffer,
+	s string,
+) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(output.String(), s) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %q, got %q", s, output.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newFollowingConnect returns a Connect following the warp served at path,
+// writing its output to output.
+func newFollowingConnect(
+	path string,
+	output *syncBuffer,
+) *Connect {
+	c := NewConnect().(*Connect)
+	c.stdout = output
+	c.noTLS = true
+	c.noRaw = true
+	c.follow = true
+	c.address = warp.UnixAddressPrefix + path
+	c.warp = "goofy-dev"
+	c.session = warp.Session{Token: "tok", User: "usr", Secret: "sec"}
+	c.username = "stan"
+	c.errC = make(chan error, 1)
+	return c
+}
+
+func TestFollowReconnectClearsAndReplays(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warpd.sock")
+	output := &syncBuffer{}
+	d := startFakeWarpd(t, path, "screen-one", "")
+	c := newFollowingConnect(path, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.ConnLoop(ctx, nil)
+
+	waitFor(t, output, "screen-one")
+	if strings.Contains(output.String(), "\033[2J\033[H") {
+		t.Errorf("Screen cleared on the initial connect")
+	}
+
+	// Kill warpd mid-stream and restore it.
+	d.kill()
+	waitFor(t, output, "connection lost, reconnecting")
+	d = startFakeWarpd(t, path, "screen-two", "")
+	defer d.kill()
+
+	waitFor(t, output, "screen-two")
+	out := output.String()
+	lost := strings.Index(out, "connection lost")
+	clear := strings.LastIndex(out, "\033[2J\033[H")
+	replay := strings.Index(out, "screen-two")
+	if !(lost < clear && clear < replay) {
+		t.Errorf("Screen not cleared before the replay: %q", out)
+	}
+
+	select {
+	case err := <-c.errC:
+		t.Errorf("Unexpected error: %v", err)
+	default:
+	}
+}
+
+func TestFollowStopsOnPermanentError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warpd.sock")
+	output := &syncBuffer{}
+	d := startFakeWarpd(t, path, "screen-one", "")
+	c := newFollowingConnect(path, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.ConnLoop(ctx, nil)
+
+	waitFor(t, output, "screen-one")
+	d.kill()
+	d = startFakeWarpd(t, path, "", warp.ErrCodeUnauthorized)
+	defer d.kill()
+
+	select {
+	case err := <-c.errC:
+		if !cli.IsRejected(err) {
+			t.Errorf("Error: got %v, want a rejection", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Permanent error not surfaced while following")
+	}
+}
+
+func TestOfferReconnectOnInternalError(t *testing.T) {
+	for _, tc := range []struct {
+		answer    string
+		reconnect bool
+	}{
+		{"y", true},
+		{"\r", true},
+		{"n", false},
+	} {
+		path := filepath.Join(t.TempDir(), "warpd.sock")
+		output := &syncBuffer{}
+		d := startFakeWarpd(t, path, "screen-one", "")
+		defer d.kill()
+		c := newFollowingConnect(path, output)
+		c.follow = false
+		c.noRaw = false
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go c.ConnLoop(ctx, nil)
+
+		waitFor(t, output, "screen-one")
+		d.fail(warp.ErrCodeInternal)
+		waitFor(t, output, "reconnect? [Y/n]")
+		if !c.answerPrompt([]byte(tc.answer)) {
+			t.Fatalf("%q: prompt not answered", tc.answer)
+		}
+
+		if tc.reconnect {
+			deadline := time.Now().Add(5 * time.Second)
+			for strings.Count(output.String(), "screen-one") < 2 {
+				if time.Now().After(deadline) {
+					t.Fatalf("%q: not reconnected: %q",
+						tc.answer, output.String())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			select {
+			case err := <-c.errC:
+				t.Errorf("%q: unexpected error: %v", tc.answer, err)
+			default:
+			}
+			continue
+		}
+		select {
+		case err := <-c.errC:
+			if !cli.IsInternal(err) {
+				t.Errorf("%q: error: got %v, want an internal error",
+					tc.answer, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q: internal error not surfaced", tc.answer)
+		}
+	}
+}
+
+// fakeResolver resolves warps to the addresses of their designation.
+type fakeResolver map[string]string
+
+// Resolve implements cli.Resolver.
+func (r fakeResolver) Resolve(
+	ctx context.Context,
+	designation string,
+) (string, string, error) {
+	address, ok := r[designation]
+	if !ok {
+		return "", "", errors.Newf("No warpd found for %s", designation)
+	}
+	return strings.Split(designation, "@")[0], address, nil
+}
+
+func TestParseResolvesWarpd(t *testing.T) {
+	resolver := fakeResolver{
+		"goofy-dev":     "warpd1.warp.link:4242",
+		"goofy-dev@eu1": "eu1.warp.link:4343",
+	}
+	for _, tc := range []struct {
+		designation string
+		address     string
+		err         bool
+	}{
+		{"goofy-dev", "warpd1.warp.link:4242", false},
+		{"goofy-dev@eu1", "eu1.warp.link:4343", false},
+		{"goofy-dev@us1", "", true},
+	} {
+		connect := NewConnect().(*Connect)
+		connect.resolver = resolver
+		open := NewOpen().(*Open)
+		open.resolver = resolver
+		for _, c := range []struct {
+			cmd     cli.Command
+			warp    *string
+			address *string
+		}{
+			{connect, &connect.warp, &connect.address},
+			{open, &open.warp, &open.address},
+		} {
+			err := c.cmd.Parse(
+				context.Background(), []string{tc.designation},
+				map[string]string{},
+			)
+			if (err != nil) != tc.err {
+				t.Errorf("%s %s: error: got %v, want error %t",
+					c.cmd.Name(), tc.designation, err, tc.err)
+				continue
+			}
+			if !tc.err &&
+				(*c.warp != "goofy-dev" || *c.address != tc.address) {
+				t.Errorf("%s %s: got %s at %s, want goofy-dev at %s",
+					c.cmd.Name(), tc.designation,
+					*c.warp, *c.address, tc.address)
+			}
+		}
+	}
+}
+
+func TestResizeTerminalIgnoresInvalidSizes(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewConnect().(*Connect)
+	c.stdout = &buf
+	for _, size := range []warp.Size{
+		{},
+		{Rows: 24, Cols: 0},
+		{Rows: -1, Cols: 80},
+		{Rows: 24, Cols: warp.MaxWindowSize + 1},
+		{Rows: 1 << 20, Cols: 1 << 20},
+	} {
+		c.resizeTerminal(size, warp.SizePolicyHost)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("Resize escapes for invalid sizes: %q", buf.String())
+	}
+
+	c.resizeTerminal(warp.Size{Rows: 24, Cols: 80}, warp.SizePolicyHost)
+	if got := buf.String(); got != "\033[8;24;80t" {
+		t.Errorf("Resize escape: got %q", got)
+	}
+}
+
+// render returns the screen rendered from the output of a Connect along
+// with its text.
+func render(
+	output []byte,
+) (*screen.Screen, string) {
+	s := screen.New(80, 24, 0)
+	s.Write(output)
+	lines := []string{}
+	for _, line := range s.View(0, 24) {
+		l := ""
+		for _, cell := range line {
+			l += string(cell.Rune)
+		}
+		lines = append(lines, strings.TrimRight(l, " "))
+	}
+	return s, strings.Join(lines, "\n")
+}
+
+func TestPauseResumeLeavesNoNotice(t *testing.T) {
+	for _, overflow := range []bool{false, true} {
+		var buf bytes.Buffer
+		c := NewConnect().(*Connect)
+		c.stdout = &buf
+		c.display([]byte("$ top\r\nline one"))
+
+		c.togglePause(context.Background(), nil)
+		if _, text := render(buf.Bytes()); !strings.Contains(text, pauseNotice) {
+			t.Errorf("Pause not notified: %q", text)
+		}
+		c.display([]byte(" and more\r\nline two"))
+		if overflow {
+			c.display(make([]byte, maxPausedOutput))
+		}
+		c.togglePause(context.Background(), nil)
+
+		s, text := render(buf.Bytes())
+		if strings.Contains(text, "paused") {
+			t.Errorf("Pause notice left on screen: %q", text)
+		}
+		x, y, _ := s.Cursor()
+		if overflow {
+			if strings.TrimSpace(text) != "" || x != 0 || y != 0 {
+				t.Errorf("Screen not cleared on overflow: %q", text)
+			}
+			continue
+		}
+		// The output held is written from where the stream stopped.
+		if !strings.Contains(text, "line two") || x != 8 || y != 2 {
+			t.Errorf("Output resumed at %d,%d: %q", x, y, text)
+		}
+	}
+}
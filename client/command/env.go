@@ -0,0 +1,122 @@
+package command
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+const (
+	// CmdNmEnv is the command name.
+	CmdNmEnv cli.CmdName = "env"
+)
+
+func init() {
+	cli.Registrar[CmdNmEnv] = NewEnv
+}
+
+// Env prints the environment variables of a warp open on this machine.
+type Env struct {
+	warp string
+}
+
+// NewEnv constructs and initializes the command.
+func NewEnv() cli.Command {
+	return &Env{}
+}
+
+// Name returns the command name.
+func (c *Env) Name() cli.CmdName {
+	return CmdNmEnv
+}
+
+// Help prints out the help message for the command.
+func (c *Env) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp env [<id>]\n")
+	out.Normf("\n")
+	out.Normf("  Prints the commands exporting the environment variables of a warp open on\n")
+	out.Normf("  this machine. Evaluate them from shells that did not inherit them (such as\n")
+	out.Normf("  a pre-existing tmux or screen session) to run in-warp commands from there.\n")
+	out.Normf("\n")
+	out.Normf("Arguments:\n")
+	out.Boldf("  id\n")
+	out.Normf("    The ID of the warp. Optional if a single warp is open on this machine.\n")
+	out.Valuf("    goofy-dev\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  eval \"$(warp env)\"\n")
+	out.Valuf("  eval \"$(warp env goofy-dev)\"\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Env) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if len(args) > 0 {
+		c.warp = args[0]
+	} else {
+		c.warp = os.Getenv(warp.EnvWarp)
+	}
+
+	if c.warp != "" && !warp.WarpRegexp.MatchString(c.warp) {
+		return errors.Trace(
+			errors.Newf("Malformed warp ID: %s", c.warp),
+		)
+	}
+
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Env) Execute(
+	ctx context.Context,
+) error {
+	warps := cli.LocalWarps(ctx)
+
+	if c.warp == "" {
+		switch len(warps) {
+		case 0:
+			return errors.Trace(
+				errors.Newf("No warp is currently open on this machine."),
+			)
+		case 1:
+			c.warp = warps[0]
+		default:
+			return errors.Trace(
+				errors.Newf(
+					"Multiple warps are open on this machine, please "+
+						"specify one: %s",
+					strings.Join(warps, ", "),
+				),
+			)
+		}
+	}
+
+	found := false
+	for _, w := range warps {
+		if w == c.warp {
+			found = true
+		}
+	}
+	if !found {
+		return errors.Trace(
+			errors.Newf("Warp not open on this machine: %s", c.warp),
+		)
+	}
+
+	out.Normf("export %s=%s\n", warp.EnvWarp, c.warp)
+	out.Normf("export %s=%s\n", warp.EnvWarpStatus, cli.StatusPath(c.warp))
+
+	return nil
+}
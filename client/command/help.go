@@ -58,10 +58,34 @@ func (c *Help) Help(
 	out.Normf("    Creates a new warp.\n")
 	out.Valuf("    warp open\n")
 	out.Normf("\n")
+	out.Boldf("  attach <id>\n")
+	out.Normf("    Attaches to a warp opened in the background.\n")
+	out.Valuf("    warp attach goofy-dev\n")
+	out.Normf("\n")
 	out.Boldf("  connect <id>\n")
 	out.Normf("    Connects to an existing warp.\n")
 	out.Valuf("    warp connect goofy-dev\n")
 	out.Normf("\n")
+	out.Boldf("  watch <id> [<id> ...]\n")
+	out.Normf("    Watches multiple warps side by side (read-only).\n")
+	out.Valuf("    warp watch goofy-dev minnie-dev\n")
+	out.Normf("\n")
+	out.Boldf("  chat <id>\n")
+	out.Normf("    Chats with the other users of a warp.\n")
+	out.Valuf("    warp chat goofy-dev\n")
+	out.Normf("\n")
+	out.Boldf("  list\n")
+	out.Normf("    Lists the warps open on this machine.\n")
+	out.Valuf("    warp list\n")
+	out.Normf("\n")
+	out.Boldf("  replay <file>\n")
+	out.Normf("    Plays back a recording of a warp.\n")
+	out.Valuf("    warp replay pairing.cast\n")
+	out.Normf("\n")
+	out.Boldf("  env [<id>]\n")
+	out.Normf("    Prints the environment variables of a warp open on this machine.\n")
+	out.Valuf("    eval \"$(warp env goofy-dev)\"\n")
+	out.Normf("\n")
 	out.Boldf("  state\n")
 	out.Normf("    Displays the state of the current warp (in-warp only).\n")
 	out.Valuf("    warp state\n")
@@ -74,6 +98,35 @@ func (c *Help) Help(
 	out.Normf("    Revokes write access to one or all clients (in-warp only).\n")
 	out.Valuf("    warp revoke\n")
 	out.Normf("\n")
+	out.Boldf("  limit <max_clients>\n")
+	out.Normf("    Sets the maximum number of clients of the current warp (in-warp only).\n")
+	out.Valuf("    warp limit 5\n")
+	out.Normf("\n")
+	out.Boldf("  close\n")
+	out.Normf("    Closes the current warp, disconnecting its clients (in-warp only).\n")
+	out.Valuf("    warp close\n")
+	out.Normf("\n")
+	out.Normf("Flags:\n")
+	out.Boldf("  --no-color\n")
+	out.Normf("    Disables colors (also disabled when not printing to a terminal, if\n")
+	out.Normf("    `NO_COLOR` is set or if `TERM` is `dumb`).\n")
+	out.Boldf("  --debug\n")
+	out.Normf("    Prints the full stack of errors (where they were encountered and traced)\n")
+	out.Normf("    to stderr, to debug failures.\n")
+	out.Normf("\n")
+	out.Normf("  Flags taking a value can be passed as `--flag=value` or `--flag value`\n")
+	out.Normf("  (optional values only as `--flag=value`). `--` ends the flags, the\n")
+	out.Normf("  arguments that follow being taken as is.\n")
+	out.Normf("\n")
+	out.Normf("Environment:\n")
+	out.Boldf("  WARP_CONFIG_DIR\n")
+	out.Normf("    The directory where warp stores your credentials (default: ~/.warp).\n")
+	out.Boldf("  WARP_NO_CONFIG\n")
+	out.Normf("    If set, warp doesn't read nor store credentials and uses temporary ones\n")
+	out.Normf("    for each run, for read-only or restricted environments.\n")
+	out.Boldf("  WARPD_AUTH_TOKEN\n")
+	out.Normf("    The authentication token presented to warpd, if it requires one.\n")
+	out.Normf("\n")
 }
 
 // Parse parses the arguments passed to the command.
@@ -0,0 +1,116 @@
+package command
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+const (
+	// CmdNmLimit is the command name.
+	CmdNmLimit cli.CmdName = "limit"
+)
+
+func init() {
+	cli.Registrar[CmdNmLimit] = NewLimit
+}
+
+// Limit sets the maximum number of clients of the current warp (in-warp
+// only).
+type Limit struct {
+	max int
+}
+
+// NewLimit constructs and initializes the command.
+func NewLimit() cli.Command {
+	return &Limit{}
+}
+
+// Name returns the command name.
+func (c *Limit) Name() cli.CmdName {
+	return CmdNmLimit
+}
+
+// Help prints out the help message for the command.
+func (c *Limit) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp limit <max_clients>\n")
+	out.Normf("\n")
+	out.Normf("  Sets the maximum number of users who can connect to the current warp, as\n")
+	out.Normf("  `warp open --max-clients` does, to open or close the room while the warp is\n")
+	out.Normf("  open. Users connecting beyond the limit are refused and, if it is lowered\n")
+	out.Normf("  below the number of connected clients, the newest ones are disconnected.\n")
+	out.Normf("  warpd may enforce a lower limit. This command is only available from inside\n")
+	out.Normf("  a warp.\n")
+	out.Normf("\n")
+	out.Normf("Arguments:\n")
+	out.Boldf("  max_clients\n")
+	out.Normf("    The maximum number of clients, `none` to lift the limit.\n")
+	out.Valuf("    5 none\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp limit 5\n")
+	out.Valuf("  warp limit none\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Limit) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if len(args) == 0 {
+		return errors.Trace(
+			errors.Newf("Maximum number of clients required."),
+		)
+	}
+	if args[0] == "none" {
+		c.max = 0
+		return nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return errors.Trace(
+			errors.Newf("Invalid maximum number of clients: %s", args[0]),
+		)
+	}
+	c.max = n
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Limit) Execute(
+	ctx context.Context,
+) error {
+	err := cli.CheckEnvWarp(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = cli.RunLocalCommand(ctx, warp.Command{
+		Type: warp.CmdTpLimit,
+		Args: []string{strconv.Itoa(c.max)},
+	})
+	if err != nil {
+		// The limit applies once a disconnected warp reconnects.
+		if _, ok := errors.Cause(err).(*cli.DisconnectedError); !ok {
+			return errors.Trace(err)
+		}
+	}
+
+	if c.max == 0 {
+		out.Normf("Lifted the maximum number of clients.\n")
+	} else {
+		out.Normf("Set the maximum number of clients: ")
+		out.Valuf("%d\n", c.max)
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+const (
+	// CmdNmList is the command name.
+	CmdNmList cli.CmdName = "list"
+)
+
+func init() {
+	cli.Registrar[CmdNmList] = NewList
+}
+
+// List lists the warps open on this machine.
+type List struct {
+	clean bool
+}
+
+// NewList constructs and initializes the command.
+func NewList() cli.Command {
+	return &List{}
+}
+
+// Name returns the command name.
+func (c *List) Name() cli.CmdName {
+	return CmdNmList
+}
+
+// Help prints out the help message for the command.
+func (c *List) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp list [--clean]\n")
+	out.Normf("\n")
+	out.Normf("  Lists the warps open on this machine (hosted by a `warp open` process,\n")
+	out.Normf("  attached or in the background) along with their status and number of\n")
+	out.Normf("  clients. The current warp, if any, is marked with a `*`.\n")
+	out.Normf("\n")
+	out.Normf("Flags:\n")
+	out.Boldf("  --clean\n")
+	out.Normf("    Removes the files left behind by warps whose host process is not running\n")
+	out.Normf("    anymore (it crashed or was killed). They are skipped otherwise.\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp list\n")
+	out.Valuf("  warp list --clean\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *List) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if _, ok := flags["clean"]; ok {
+		c.clean = true
+	}
+	return nil
+}
+
+// listedWarp is a warp listed by the command.
+type listedWarp struct {
+	id           string
+	disconnected bool
+	clients      int
+	title        string
+}
+
+// Execute the command or return a human-friendly error.
+func (c *List) Execute(
+	ctx context.Context,
+) error {
+	warps := []listedWarp{}
+	width := len("ID")
+	for _, w := range cli.SocketWarps(ctx) {
+		result, err := cli.RunWarpCommand(ctx, w, warp.Command{
+			Type: warp.CmdTpState,
+			Args: []string{},
+		})
+		if _, ok := errors.Cause(err).(*cli.HostNotRunningError); ok {
+			if c.clean {
+				c.Clean(ctx, w)
+			}
+			continue
+		}
+		if _, ok := errors.Cause(err).(*cli.DisconnectedError); !ok &&
+			err != nil {
+			out.Warnf("[Warning] Failed to retrieve the state of %s: %v\n",
+				w, err,
+			)
+			continue
+		}
+
+		l := listedWarp{
+			id:           w,
+			disconnected: result.Disconnected,
+			title:        warp.SanitizeTitle(result.SessionState.Title),
+		}
+		for _, u := range result.SessionState.Users {
+			if !u.Hosting {
+				l.clients++
+			}
+		}
+		warps = append(warps, l)
+		if len(w) > width {
+			width = len(w)
+		}
+	}
+
+	if len(warps) == 0 {
+		out.Normf("No warp is currently open on this machine.\n")
+		return nil
+	}
+
+	current := os.Getenv(warp.EnvWarp)
+	out.Boldf("  %-*s  %-12s  %-7s  %s\n",
+		width, "ID", "STATUS", "CLIENTS", "TITLE",
+	)
+	for _, l := range warps {
+		if l.id == current {
+			out.Boldf("* ")
+		} else {
+			out.Normf("  ")
+		}
+		out.Valuf("%-*s  ", width, l.id)
+		if l.disconnected {
+			out.Errof("%-12s  ", "disconnected")
+			out.Normf("%-7s  ", "-")
+		} else {
+			out.Statf("%-12s  ", "connected")
+			out.Normf("%-7s  ", fmt.Sprintf("%d", l.clients))
+		}
+		out.Normf("%s\n", l.title)
+	}
+
+	return nil
+}
+
+// Clean removes the command server socket and status file of a warp whose
+// host process is not running anymore.
+func (c *List) Clean(
+	ctx context.Context,
+	w string,
+) {
+	for _, p := range []string{cli.SocketPath(w), cli.StatusPath(w)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			out.Warnf("[Warning] Failed to remove %s: %v\n", p, err)
+			continue
+		}
+	}
+	out.Normf("Cleaned up warp %s (host process not running).\n", w)
+}
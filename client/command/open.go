@@ -1,17 +1,24 @@
 package command
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
 	"os/user"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 	"unsafe"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -19,7 +26,10 @@ import (
 	"github.com/kr/pty"
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/asciicast"
 	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/eventlog"
+	"github.com/spolu/warp/lib/inputlog"
 	"github.com/spolu/warp/lib/out"
 	"github.com/spolu/warp/lib/plex"
 	"github.com/spolu/warp/lib/token"
@@ -32,36 +42,171 @@ const (
 
 func init() {
 	cli.Registrar[CmdNmOpen] = NewOpen
+	cli.RegisterValueFlags(CmdNmOpen,
+		"layout", "idle-quit", "max-clients", "title", "term", "event-log",
+		"log-input", "size-policy", "record", "shell", "exec",
+	)
+	cli.RegisterValueFlags(CmdNmOpen, cli.TLSFlags...)
+	cli.RegisterShortFlag(CmdNmOpen, "d", "detach")
+}
+
+// paneSwitchKey is the key (Ctrl-]) used by the host to switch to the next
+// pane when the warp has multiple panes.
+const paneSwitchKey = 0x1d
+
+// openTimeout is the time allowed to establish the warp on warpd before
+// failing to open it.
+const openTimeout = 30 * time.Second
+
+// outputCoalesceWindow is the maximum time the output of a pane is held to
+// coalesce bursts (full screen redraws) before being relayed to the clients.
+const outputCoalesceWindow = 5 * time.Millisecond
+
+// pane is a named pty running a command. A warp has a single pane running the
+// login shell unless opened with `--layout`.
+type pane struct {
+	name    string
+	command string
+	// argv, if set, is executed directly instead of the login shell or the
+	// command.
+	argv []string
+
+	cmd *exec.Cmd
+	pty *os.File
 }
 
 // Open spawns a new shared terminal.
 type Open struct {
 	noTLS       bool
 	insecureTLS bool
-	shell       *cli.Shell
-
+	tlsConfig   *tls.Config
+	// shell runs the panes and setShell is set if it was set with `--shell`
+	// rather than detected.
+	shell    *cli.Shell
+	setShell bool
+
+	// detach spawns the host in the background. detached is set on the
+	// background process itself.
+	detach   bool
+	detached bool
+	// tmux propagates the warp environment variables to tmux.
+	tmux   bool
+	flags  map[string]string
+	attach *cli.AttachSrv
+
+	// resolver determines the address of the warpd serving the warp
+	// (cli.NewResolver).
+	resolver cli.Resolver
 	address  string
 	warp     string
 	session  warp.Session
 	username string
 
-	cmd *exec.Cmd
-	pty *os.File
+	// panes is set at parse time. active is protected by the paneMutex which
+	// also serializes the output of the panes with pane switches.
+	panes     []*pane
+	active    int
+	paneMutex *sync.Mutex
+
 	srv *cli.Srv
 
 	mutex *sync.Mutex
 	size  warp.Size
 	ss    *cli.Session
 
+	// sizePolicy determines the window size of the warp from the size of
+	// the host terminal (size), fixedSize or clientsSize (the smallest size
+	// of the clients terminals as reported by warpd). clientsSize is
+	// protected by the mutex.
+	sizePolicy  warp.SizePolicy
+	fixedSize   warp.Size
+	clientsSize warp.Size
+
+	// idleQuit closes the warp after the specified duration without input
+	// (or output if idleCountsOutput is set). lastActivity and idled are
+	// protected by the mutex.
+	idleQuit         time.Duration
+	idleCountsOutput bool
+	lastActivity     time.Time
+	idled            bool
+
+	// once closes the warp onceGrace after the last client left, once a
+	// client connected. onceJoined, onceTimer and onced are protected by the
+	// mutex and onceC is closed when the warp should close.
+	once       bool
+	onceGrace  time.Duration
+	onceJoined bool
+	onceTimer  *time.Timer
+	onced      bool
+	onceC      chan struct{}
+
+	// singleWriter only lets the user holding the write token write to the
+	// warp (see warp.HostUpdate).
+	singleWriter bool
+	// maxClients is the maximum number of clients of the warp as opened, 0
+	// if unlimited (changed with `warp limit`, see cli.Srv).
+	maxClients int
+	// title is the sanitized title of the warp, empty if none.
+	title string
+	// term is the terminal type the panes run with (advertised to clients)
+	// and setTerm whether it was set with `--term` rather than inherited.
+	term    string
+	setTerm bool
+	// readOnly, if set, leaves the input of the warp unread by the panes
+	// (`--read-only-enforced`).
+	readOnly bool
+	// writeFromAll authorizes the users joining the warp to write to it
+	// (`--insecure-allow-write-from-all`). writeFromAllJoined are the users
+	// connected as of the last state, protected by the mutex, and statusLine
+	// displays the associated warning over the host terminal.
+	writeFromAll       bool
+	writeFromAllJoined map[string]bool
+	statusLine         *cli.StatusLine
+	// requests are the users whose pending requests (`warp connect
+	// --write`) were noticed, protected by the mutex.
+	requests map[string]bool
+	// users are the usernames of the clients of the warp, by token, as of
+	// the last state, protected by the mutex (see noticeUsers). bell rings
+	// the terminal bell when clients join (`--bell`).
+	users map[string]string
+	bell  bool
+
+	// rehostModes are the modes to restore to the users reconnecting to the
+	// warp until rehostDeadline, after warpd failed with an internal error
+	// (see rehost). They are protected by the mutex.
+	rehostModes    map[string]warp.Mode
+	rehostDeadline time.Time
+
+	// eventLog is the path of the event log (`--event-log`) and events its
+	// writer, nil if disabled.
+	eventLog string
+	events   *eventlog.Writer
+	// inputLog is the path of the input log (`--log-input`) and inputs its
+	// writer, nil if disabled.
+	inputLog string
+	inputs   *inputlog.Writer
+	// record is the path of the recording of the warp (`--record`), rec its
+	// writer (nil if disabled) and recSize the last window size recorded.
+	record  string
+	rec     *asciicast.Writer
+	recSize warp.Size
+	// compress compresses the data sent to and received from warpd
+	// (`--compress`), if supported.
+	compress bool
+
 	errC   chan error
 	initC  chan struct{}
 	inited bool
+	readyC chan struct{}
 }
 
 // NewOpen constructs and initializes the command.
 func NewOpen() cli.Command {
 	return &Open{
-		mutex: &sync.Mutex{},
+		mutex:     &sync.Mutex{},
+		paneMutex: &sync.Mutex{},
+		onceC:     make(chan struct{}),
+		resolver:  cli.NewResolver(),
 	}
 }
 
@@ -75,7 +220,7 @@ func (c *Open) Help(
 	ctx context.Context,
 ) {
 	out.Normf("\nUsage: ")
-	out.Boldf("warp open [<id>]\n")
+	out.Boldf("warp open [--detach] [--tmux] [--layout=<panes>] [--exec=<command>] [--idle-quit=<duration>] [--once[=<grace>]] [--single-writer] [--bell] [--max-clients=<n>] [--read-only-enforced] [--insecure-allow-write-from-all] [--title=<title>] [--shell=<shell>] [--term=<type>] [--event-log=<file>] [--log-input=<file>] [--record=<file>] [--compress] [--size-policy=<policy>] [<id>]\n")
 	out.Normf("\n")
 	out.Normf("  Creates a new warp with the specified ID and starts sharing your terminal\n")
 	out.Normf("  (read-only). If no ID is provided a (cryptographically secure) random one is\n")
@@ -85,14 +230,155 @@ func (c *Open) Help(
 	out.Boldf("connect")
 	out.Normf(" command.\n")
 	out.Normf("\n")
+	out.Normf("  The shell can read the number of connected clients from the status file\n")
+	out.Normf("  whose path is stored in `%s` (sourceable `clients=2` lines), for\n", warp.EnvWarpStatus)
+	out.Normf("  example to display it in the prompt.\n")
+	out.Normf("\n")
 	out.Normf("Arguments:\n")
 	out.Boldf("  id\n")
-	out.Normf("    The ID to assign to the new warp.\n")
-	out.Valuf("    goofy-dev\n")
+	out.Normf("    The ID to assign to the new warp (`-` to read it from the first line of\n")
+	out.Normf("    stdin). Use `<id>@<node>` to open the warp on a specific warpd node\n")
+	out.Normf("    (resolved using the SRV records of `WARPD_SRV_DOMAIN` if set).\n")
+	out.Valuf("    goofy-dev goofy-dev@eu1\n")
+	out.Normf("\n")
+	out.Normf("Flags:\n")
+	out.Boldf("  -d, --detach\n")
+	out.Normf("    Runs the warp in the background so that it survives the current terminal.\n")
+	out.Normf("    Use the ")
+	out.Boldf("attach")
+	out.Normf(" command to interact with it.\n")
+	out.Normf("\n")
+	out.Boldf("  --tmux\n")
+	out.Normf("    Propagates the warp environment to tmux so that in-warp commands work from\n")
+	out.Normf("    tmux panes. If already running inside tmux, the environment of the current\n")
+	out.Normf("    tmux session is updated for the duration of the warp. Otherwise the warp\n")
+	out.Normf("    runs a dedicated tmux session (`warp-<id>`), created or reattached to, and\n")
+	out.Normf("    closes when you detach from it.\n")
+	out.Normf("\n")
+	out.Boldf("  --layout=<panes>\n")
+	out.Normf("    Comma-separated list of named panes (`name:command`) to run instead of\n")
+	out.Normf("    your shell. Only the active pane is shared, press ")
+	out.Boldf("Ctrl-]")
+	out.Normf(" to switch to the\n")
+	out.Normf("    next one. The warp is closed as soon as any of its panes exits.\n")
+	out.Valuf("    editor:vim,logs:tail -f app.log\n")
+	out.Boldf("  --exec=<command>\n")
+	out.Normf("    Runs the specified command (split into arguments as a shell would, with\n")
+	out.Normf("    quotes and backslashes but no expansions) instead of your shell, to share\n")
+	out.Normf("    a single program. The warp is closed when it exits.\n")
+	out.Valuf("    \"python3 -i\" top\n")
+	out.Normf("\n")
+	out.Boldf("  --idle-quit=<duration>\n")
+	out.Normf("    Closes the warp once nobody (host or clients) typed anything for the\n")
+	out.Normf("    specified duration.\n")
+	out.Valuf("    10m\n")
+	out.Boldf("  --idle-counts-output\n")
+	out.Normf("    Also counts output from the shell (a running `top`) as activity for\n")
+	out.Normf("    `--idle-quit`.\n")
+	out.Normf("\n")
+	out.Boldf("  --once[=<grace>]\n")
+	out.Normf("    Closes the warp once the clients who connected to it left. Clients\n")
+	out.Normf("    reconnecting within the grace period (15s by default) keep it open.\n")
+	out.Valuf("    1m\n")
+	out.Normf("\n")
+	out.Boldf("  --single-writer\n")
+	out.Normf("    Only lets one authorized user write at a time: authorizing a user hands\n")
+	out.Normf("    them the write token, revoking them returns it to you.\n")
+	out.Normf("\n")
+	out.Boldf("  --bell\n")
+	out.Normf("    Rings your terminal bell when users join the warp, on top of the notice\n")
+	out.Normf("    displayed when they join or leave.\n")
+	out.Boldf("  --max-clients=<n>\n")
+	out.Normf("    Limits the number of users who can connect to the warp. Users connecting\n")
+	out.Normf("    beyond the limit are refused (or disconnected, newest first). It can be\n")
+	out.Normf("    changed from inside the warp with `warp limit`.\n")
+	out.Valuf("    2\n")
+	out.Boldf("  --read-only-enforced\n")
+	out.Normf("    Never writes what is received from the clients of the warp to its shell,\n")
+	out.Normf("    whatever their modes or the behavior of warpd, for broadcasts. Users can't\n")
+	out.Normf("    be authorized to write (only you can type in the warp).\n")
+	out.Boldf("  --insecure-allow-write-from-all\n")
+	out.Normf("    Authorizes every user connecting to the warp to write to it as they join,\n")
+	out.Normf("    without ")
+	out.Boldf("authorize")
+	out.Normf(", for fully trusted networks. A warning is displayed over\n")
+	out.Normf("    the last line of your terminal for as long as the warp is open.\n")
+	out.Errof("    Anyone knowing the ID of the warp can then type in your shell.\n")
+	out.Boldf("  --title=<title>\n")
+	out.Normf("    Describes what the warp is for. The title is shown to its users (`warp\n")
+	out.Normf("    state`) and operators (admin API), up to %d characters.\n", warp.MaxTitleLength)
+	out.Valuf("    \"deploy debugging\"\n")
+	out.Boldf("  --shell=<shell>\n")
+	out.Normf("    Runs the specified shell (a path or a command in your PATH) instead of\n")
+	out.Normf("    your login shell, also running the commands of `--layout`.\n")
+	out.Valuf("    zsh /usr/local/bin/demo-shell\n")
+	out.Boldf("  --term=<type>\n")
+	out.Normf("    Runs the warp with the specified terminal type (`TERM`) instead of yours,\n")
+	out.Normf("    to target a terminal type supported by all your users. The terminal type\n")
+	out.Normf("    is advertised to clients, which warn their users if theirs differs.\n")
+	out.Valuf("    xterm\n")
+	out.Boldf("  --event-log=<file>\n")
+	out.Normf("    Logs the events of the warp (connections to warpd, state updates, users\n")
+	out.Normf("    joining or leaving, mode changes, modes sent by warpd that were ignored\n")
+	out.Normf("    and resizes) to the specified file, as JSON lines.\n")
+	out.Valuf("    events.jsonl\n")
+	out.Boldf("  --log-input=<file>\n")
+	out.Normf("    Logs the input received from the users authorized to write to the warp,\n")
+	out.Normf("    with timestamps and the users it may come from, to the specified file\n")
+	out.Normf("    (appended to, readable by you only) for review after sharing write access.\n")
+	out.Errof("    It captures everything they type, including passwords.\n")
+	out.Valuf("    input.log\n")
+	out.Boldf("  --record=<file>\n")
+	out.Normf("    Records the output of the warp, as shared with its clients, to the\n")
+	out.Normf("    specified file (asciicast v2 format) for replay (`warp replay`).\n")
+	out.Valuf("    pairing.cast\n")
+	out.Boldf("  --compress\n")
+	out.Normf("    Compresses the output of the warp (and the input of its clients) sent\n")
+	out.Normf("    to warpd, to save bandwidth over slow links. Clients choose whether to\n")
+	out.Normf("    compress their own connection (`warp connect --compress`).\n")
+	out.Boldf("  --size-policy=<policy>\n")
+	out.Normf("    Determines the size of the warp: ")
+	out.Boldf("host")
+	out.Normf(" follows your terminal (default), ")
+	out.Boldf("min")
+	out.Normf("\n")
+	out.Normf("    shrinks it to the smallest terminal of the connected clients so that they\n")
+	out.Normf("    all see the whole screen (clients then stop resizing their terminal to the\n")
+	out.Normf("    size of the warp) and ")
+	out.Boldf("<cols>x<rows>")
+	out.Normf(" sets a fixed size.\n")
+	out.Valuf("    min 120x40\n")
+	out.Boldf("  --tls-cert=<file> --tls-key=<file>\n")
+	out.Normf("    Presents the specified client certificate to warpd, for warpd instances\n")
+	out.Normf("    requiring client certificates (also read from WARPD_TLS_CERT and\n")
+	out.Normf("    WARPD_TLS_KEY).\n")
+	out.Valuf("    ~/.warp/client.pem ~/.warp/client.key\n")
+	out.Boldf("  --pin=<sha256>\n")
+	out.Normf("    Verifies the certificate of warpd against the specified SHA-256\n")
+	out.Normf("    fingerprint instead of the system CAs, for self-hosted warpd instances\n")
+	out.Normf("    with self-signed certificates (also read from WARPD_TLS_PIN). The\n")
+	out.Normf("    connection is refused (certificate_pin_mismatch) if it does not match.\n")
+	out.Valuf("    $(openssl x509 -in cert.pem -noout -fingerprint -sha256 | cut -d= -f2)\n")
 	out.Normf("\n")
 	out.Normf("Examples:\n")
 	out.Valuf("  warp open\n")
 	out.Valuf("  warp open goofy-dev\n")
+	out.Valuf("  echo goofy-dev | warp open -\n")
+	out.Valuf("  warp open --detach goofy-dev\n")
+	out.Valuf("  warp open --tmux goofy-dev\n")
+	out.Valuf("  warp open --idle-quit=10m goofy-dev\n")
+	out.Valuf("  warp open --once goofy-dev\n")
+	out.Valuf("  warp open --single-writer goofy-dev\n")
+	out.Valuf("  warp open --max-clients=2 goofy-dev\n")
+	out.Valuf("  warp open --title=\"deploy debugging\" goofy-dev\n")
+	out.Valuf("  warp open --shell=zsh goofy-dev\n")
+	out.Valuf("  warp open --event-log=events.jsonl goofy-dev\n")
+	out.Valuf("  warp open --log-input=input.log goofy-dev\n")
+	out.Valuf("  warp open --record=pairing.cast goofy-dev\n")
+	out.Valuf("  warp open --compress goofy-dev\n")
+	out.Valuf("  warp open --size-policy=min goofy-dev\n")
+	out.Valuf("  warp open --layout=\"editor:vim,logs:tail -f app.log\" goofy-dev\n")
+	out.Valuf("  warp open --exec=\"python3 -i\" goofy-dev\n")
 	out.Normf("\n")
 }
 
@@ -103,11 +389,27 @@ func (c *Open) Parse(
 	flags map[string]string,
 ) error {
 	if len(args) == 0 {
-		c.warp = token.RandStr()
+		c.warp = token.ReadableStr()
+	} else if args[0] == cli.StdinArg {
+		// Read before the terminal is put in raw mode.
+		w, err := cli.ReadArgLine(os.Stdin)
+		if err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to read warp ID from stdin: %v", err),
+			)
+		}
+		c.warp = w
 	} else {
 		c.warp = args[0]
 	}
 
+	// Determine the warpd serving the warp (designated as `<id>[@<node>]`).
+	id, address, err := c.resolver.Resolve(ctx, c.warp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.warp, c.address = id, address
+
 	if !warp.WarpRegexp.MatchString(c.warp) {
 		return errors.Trace(
 			errors.Newf("Malformed warp ID: %s", c.warp),
@@ -122,22 +424,222 @@ func (c *Open) Parse(
 		os.Getenv("WARPD_NO_TLS") != "" {
 		c.noTLS = true
 	}
-
-	c.address = warp.DefaultAddress
-	if os.Getenv("WARPD_ADDRESS") != "" {
-		c.address = os.Getenv("WARPD_ADDRESS")
+	tlsConfig, err := cli.TLSConfig(flags, c.insecureTLS)
+	if err != nil {
+		return errors.Trace(err)
 	}
+	c.tlsConfig = tlsConfig
+
 	if os.Getenv("WARPD_NO_TLS") != "" {
 		c.noTLS = true
 	}
 
-	s, err := cli.DetectShell(ctx)
-	if err != nil {
-		return errors.Trace(
-			errors.Newf("Error detecting shell: %v", err),
-		)
+	if idle, ok := flags["idle-quit"]; ok {
+		d, err := time.ParseDuration(idle)
+		if err != nil || d <= 0 {
+			return errors.Trace(
+				errors.Newf("Invalid idle duration: %s", idle),
+			)
+		}
+		c.idleQuit = d
+	}
+	if _, ok := flags["idle-counts-output"]; ok {
+		c.idleCountsOutput = true
+	}
+	if _, ok := flags["bell"]; ok {
+		c.bell = true
+	}
+	if grace, ok := flags["once"]; ok {
+		c.once = true
+		c.onceGrace = onceGrace
+		if grace != "true" {
+			d, err := time.ParseDuration(grace)
+			if err != nil || d < 0 {
+				return errors.Trace(
+					errors.Newf("Invalid grace period: %s", grace),
+				)
+			}
+			c.onceGrace = d
+		}
+	}
+
+	if _, ok := flags["single-writer"]; ok {
+		c.singleWriter = true
+	}
+	if _, ok := flags["compress"]; ok {
+		c.compress = true
+	}
+	if max, ok := flags["max-clients"]; ok {
+		n, err := strconv.Atoi(max)
+		if err != nil || n <= 0 {
+			return errors.Trace(
+				errors.Newf("Invalid maximum number of clients: %s", max),
+			)
+		}
+		c.maxClients = n
+	}
+	if t, ok := flags["title"]; ok {
+		title := warp.SanitizeTitle(t)
+		if t == "true" || title == "" {
+			return errors.Trace(
+				errors.Newf("Title required: --title=<title>"),
+			)
+		}
+		if title != strings.Join(strings.Fields(t), " ") {
+			return errors.Trace(
+				errors.Newf(
+					"Invalid title (control characters or more than %d "+
+						"characters): %q",
+					warp.MaxTitleLength, t,
+				),
+			)
+		}
+		c.title = title
+	}
+	if _, ok := flags["read-only-enforced"]; ok {
+		c.readOnly = true
+	}
+	if _, ok := flags["insecure-allow-write-from-all"]; ok {
+		if c.readOnly || c.singleWriter {
+			return errors.Trace(
+				errors.Newf(
+					"The --insecure-allow-write-from-all flag can't be " +
+						"combined with --read-only-enforced or " +
+						"--single-writer.",
+				),
+			)
+		}
+		c.writeFromAll = true
+	}
+	c.term = os.Getenv("TERM")
+	if t, ok := flags["term"]; ok {
+		if !warp.TermRegexp.MatchString(t) || t == "true" {
+			return errors.Trace(
+				errors.Newf("Invalid terminal type: --term=<type>"),
+			)
+		}
+		c.term = t
+		c.setTerm = true
+	}
+	c.sizePolicy = warp.SizePolicyHost
+	if p, ok := flags["size-policy"]; ok {
+		switch warp.SizePolicy(p) {
+		case warp.SizePolicyHost, warp.SizePolicyMin:
+			c.sizePolicy = warp.SizePolicy(p)
+		default:
+			size, err := parseSize(p)
+			if err != nil {
+				return errors.Trace(
+					errors.Newf("Invalid size policy: %s", p),
+				)
+			}
+			c.sizePolicy = warp.SizePolicyFixed
+			c.fixedSize = size
+		}
+	}
+	if l, ok := flags["event-log"]; ok {
+		if l == "true" || l == "" {
+			return errors.Trace(
+				errors.Newf("Event log file required: --event-log=<file>"),
+			)
+		}
+		c.eventLog = l
+	}
+	if l, ok := flags["log-input"]; ok {
+		if l == "true" || l == "" {
+			return errors.Trace(
+				errors.Newf("Input log file required: --log-input=<file>"),
+			)
+		}
+		c.inputLog = l
+	}
+	if r, ok := flags["record"]; ok {
+		if r == "true" || r == "" {
+			return errors.Trace(
+				errors.Newf("Recording file required: --record=<file>"),
+			)
+		}
+		c.record = r
+	}
+
+	c.flags = flags
+	if _, ok := flags["detach"]; ok {
+		c.detach = true
+	}
+	if _, ok := flags["detached"]; ok {
+		c.detached = true
+		c.size = warp.Size{Rows: 24, Cols: 80}
+		if size, ok := flags["detached_size"]; ok {
+			if s, err := parseSize(size); err == nil {
+				c.size = s
+			}
+		}
+	}
+
+	c.panes = []*pane{&pane{name: "shell"}}
+	if layout, ok := flags["layout"]; ok {
+		panes, err := parseLayout(layout)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		c.panes = panes
+	}
+
+	if _, ok := flags["tmux"]; ok {
+		if _, ok := flags["layout"]; ok {
+			return errors.Trace(
+				errors.Newf("The --tmux and --layout flags can't be combined."),
+			)
+		}
+		if _, err := exec.LookPath("tmux"); err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to find tmux (required by --tmux): %v", err),
+			)
+		}
+		c.tmux = true
+	}
+
+	if command, ok := flags["exec"]; ok {
+		if _, ok := flags["layout"]; ok || c.tmux {
+			return errors.Trace(
+				errors.Newf(
+					"The --exec flag can't be combined with --layout or " +
+						"--tmux.",
+				),
+			)
+		}
+		argv, err := splitCommand(command)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		path, err := exec.LookPath(argv[0])
+		if err != nil {
+			return errors.Trace(
+				errors.Newf("Invalid command --exec=%s: %v", command, err),
+			)
+		}
+		argv[0] = path
+		c.panes[0].argv = argv
+	}
+
+	if sh, ok := flags["shell"]; ok {
+		s, err := cli.LookupShell(sh)
+		if err != nil {
+			return errors.Trace(
+				errors.Newf("Invalid shell --shell=%s: %v", sh, err),
+			)
+		}
+		c.shell = s
+		c.setShell = true
+	} else {
+		s, err := cli.DetectShell(ctx)
+		if err != nil {
+			return errors.Trace(
+				errors.Newf("Error detecting shell: %v", err),
+			)
+		}
+		c.shell = s
 	}
-	c.shell = s
 
 	user, err := user.Current()
 	if err != nil {
@@ -157,7 +659,9 @@ func (c *Open) Parse(
 	// os.Setenv("PROMPT", prompt)
 
 	config, err := cli.RetrieveOrGenerateConfig(ctx)
-	if err != nil {
+	if cli.IsConfigAccess(err) {
+		return errors.Trace(err)
+	} else if err != nil {
 		return errors.Trace(
 			errors.Newf("Error retrieving or generating config: %v", err),
 		)
@@ -172,6 +676,94 @@ func (c *Open) Parse(
 	return nil
 }
 
+// parseLayout parses a `--layout` flag value into a list of panes.
+func parseLayout(
+	layout string,
+) ([]*pane, error) {
+	panes := []*pane{}
+	names := map[string]bool{}
+	for _, spec := range strings.Split(layout, ",") {
+		s := strings.SplitN(spec, ":", 2)
+		if len(s) != 2 || strings.TrimSpace(s[1]) == "" {
+			return nil, errors.Trace(
+				errors.Newf("Malformed pane (expected name:command): %s", spec),
+			)
+		}
+		name := strings.TrimSpace(s[0])
+		if !warp.PaneRegexp.MatchString(name) {
+			return nil, errors.Trace(
+				errors.Newf("Malformed pane name: %s", name),
+			)
+		}
+		if names[name] {
+			return nil, errors.Trace(
+				errors.Newf("Duplicate pane name: %s", name),
+			)
+		}
+		names[name] = true
+		panes = append(panes, &pane{
+			name:    name,
+			command: strings.TrimSpace(s[1]),
+		})
+	}
+	return panes, nil
+}
+
+// splitCommand splits a `--exec` flag value into arguments, as a shell would
+// but without expansions: arguments are separated by whitespace, quotes group
+// and backslashes escape characters (except within single quotes).
+func splitCommand(
+	command string,
+) ([]string, error) {
+	argv := []string{}
+	var arg []rune
+	inArg := false
+	quote := rune(0)
+	escaped := false
+	for _, r := range command {
+		switch {
+		case escaped:
+			arg = append(arg, r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg = append(arg, r)
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				argv = append(argv, string(arg))
+				arg = nil
+				inArg = false
+			}
+		default:
+			arg = append(arg, r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.Trace(
+			errors.Newf("Malformed command (unterminated quote or escape): %s",
+				command,
+			),
+		)
+	}
+	if inArg {
+		argv = append(argv, string(arg))
+	}
+	if len(argv) == 0 {
+		return nil, errors.Trace(
+			errors.Newf("Command required: --exec=<command>"),
+		)
+	}
+	return argv, nil
+}
+
 // HostSession accessor is used by the local server to retrieve the current
 // host session. The host session can be nil if the warp is currently
 // disconnected from warpd. It is protected by a lock as the host session is
@@ -182,85 +774,347 @@ func (c *Open) HostSession() *cli.Session {
 	return c.ss
 }
 
-// WindowSize returns the current window size for the host terminal.
+// WindowSize returns the current window size of the warp (the size of its
+// ptys) given its size policy.
 func (c *Open) WindowSize() warp.Size {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch c.sizePolicy {
+	case warp.SizePolicyFixed:
+		return c.fixedSize
+	case warp.SizePolicyMin:
+		size := c.size
+		if c.clientsSize.Valid() {
+			if c.clientsSize.Rows < size.Rows {
+				size.Rows = c.clientsSize.Rows
+			}
+			if c.clientsSize.Cols < size.Cols {
+				size.Cols = c.clientsSize.Cols
+			}
+		}
+		return size
+	}
+	return c.size
+}
+
+// TerminalSize returns the current size of the host terminal.
+func (c *Open) TerminalSize() warp.Size {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	return c.size
 }
 
+// parseSize parses a `<cols>x<rows>` window size.
+func parseSize(
+	s string,
+) (warp.Size, error) {
+	parts := strings.Split(s, "x")
+	if len(parts) != 2 {
+		return warp.Size{}, errors.Trace(errors.Newf("Malformed size: %s", s))
+	}
+	cols, errC := strconv.Atoi(parts[0])
+	rows, errR := strconv.Atoi(parts[1])
+	size := warp.Size{Rows: rows, Cols: cols}
+	if errC != nil || errR != nil || !size.Valid() {
+		return warp.Size{}, errors.Trace(errors.Newf("Invalid size: %s", s))
+	}
+	return size, nil
+}
+
+// setEnv returns env with the variable key set to value, replacing its
+// previous value if any.
+func setEnv(
+	env []string,
+	key string,
+	value string,
+) []string {
+	res := []string{}
+	for _, e := range env {
+		if !strings.HasPrefix(e, key+"=") {
+			res = append(res, e)
+		}
+	}
+	return append(res, fmt.Sprintf("%s=%s", key, value))
+}
+
 // Warp returns the warp name
 func (c *Open) Warp() string {
 	return c.warp
 }
 
+// SetupTmux propagates the warp environment variables to tmux. If running
+// inside tmux, they are set on the current tmux session and the returned
+// cleanup function unsets them. Otherwise the shell pane is replaced by a
+// dedicated tmux session with the variables set.
+func (c *Open) SetupTmux(
+	ctx context.Context,
+) (func(), error) {
+	vars := [][2]string{
+		{warp.EnvWarp, c.warp},
+		{warp.EnvWarpStatus, cli.StatusPath(c.warp)},
+	}
+	tmux := func(args ...string) error {
+		if raw, err := exec.Command("tmux", args...).CombinedOutput(); err != nil {
+			return errors.Trace(
+				errors.Newf(
+					"Failed to run tmux %s: %v %s",
+					args[0], err, strings.TrimSpace(string(raw)),
+				),
+			)
+		}
+		return nil
+	}
+
+	if os.Getenv("TMUX") != "" {
+		for _, v := range vars {
+			if err := tmux("setenv", v[0], v[1]); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		return func() {
+			for _, v := range vars {
+				tmux("setenv", "-u", v[0])
+			}
+		}, nil
+	}
+
+	// tmux session names can't contain dots.
+	name := "warp-" + strings.Replace(c.warp, ".", "_", -1)
+	if exec.Command("tmux", "has-session", "-t", "="+name).Run() == nil {
+		// The session will be reattached to, let's update its environment
+		// as `-e` only applies to new sessions.
+		for _, v := range vars {
+			if err := tmux("setenv", "-t", "="+name, v[0], v[1]); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+	}
+	argv := []string{"tmux", "new-session", "-A", "-s", name}
+	for _, v := range vars {
+		argv = append(argv, "-e", fmt.Sprintf("%s=%s", v[0], v[1]))
+	}
+	c.panes[0].argv = argv
+
+	return func() {}, nil
+}
+
+// activePane returns the pane currently shared.
+func (c *Open) activePane() *pane {
+	c.paneMutex.Lock()
+	defer c.paneMutex.Unlock()
+	return c.panes[c.active]
+}
+
+// HostUpdate computes the host update to send to warpd from the current
+// window size, panes and the write token state of the session.
+func (c *Open) HostUpdate(
+	ss *cli.Session,
+) warp.HostUpdate {
+	update := warp.HostUpdate{
+		Warp:       c.warp,
+		From:       c.session,
+		WindowSize: c.WindowSize(),
+		MaxClients: ss.MaxClients(),
+		SizePolicy: c.sizePolicy,
+		Title:      c.title,
+		Term:       c.term,
+		ReadOnly:   c.readOnly,
+	}
+	update.SingleWriter, update.Writer = ss.SingleWriter()
+	if len(c.panes) > 1 {
+		c.paneMutex.Lock()
+		for _, p := range c.panes {
+			update.Panes = append(update.Panes, p.name)
+		}
+		update.Pane = c.panes[c.active].name
+		c.paneMutex.Unlock()
+	}
+	return update
+}
+
 // Execute the command or return a human-friendly error.
 func (c *Open) Execute(
 	ctx context.Context,
 ) error {
+	if c.detach {
+		return c.ExecuteDetach(ctx)
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	// Build the local command server.
 	c.srv = cli.NewSrv(ctx, c.warp)
-
-	// Setup local term.
-	stdin := int(os.Stdin.Fd())
-	if !terminal.IsTerminal(stdin) {
-		return errors.Trace(
-			errors.Newf("Not running in a terminal."),
-		)
+	c.srv.SetMaxClients(c.maxClients)
+	defer c.srv.Close()
+
+	if c.eventLog != "" {
+		f, err := os.Create(c.eventLog)
+		if err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to create event log: %v", err),
+			)
+		}
+		defer f.Close()
+		c.events = eventlog.NewWriter(f)
+		go c.EventLoop(ctx)
 	}
 
-	// Store initial size of the terminal.
-	cols, rows, err := terminal.GetSize(stdin)
-	if err != nil {
-		return errors.Trace(
-			errors.Newf("Failed to retrieve the terminal size: %v.", err),
+	if c.inputLog != "" {
+		f, err := os.OpenFile(
+			c.inputLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600,
 		)
+		if err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to open input log: %v", err),
+			)
+		}
+		defer f.Close()
+		// The input log may contain secrets, restrict an existing file.
+		if err := f.Chmod(0600); err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to restrict input log: %v", err),
+			)
+		}
+		c.inputs = inputlog.NewWriter(f)
 	}
-	c.mutex.Lock()
-	c.size = warp.Size{Rows: rows, Cols: cols}
-	c.mutex.Unlock()
-
-	// Display open message
-	out.Normf("Opened warp: ")
-	out.Valuf("%s\n", c.warp)
 
-	// Make the terminal raw.
-	old, err := terminal.MakeRaw(stdin)
-	if err != nil {
-		return errors.Trace(
-			errors.Newf("Unable to put terminal in raw mode: %v.", err),
+	stdin := int(os.Stdin.Fd())
+	if c.detached {
+		// Setup the attach server. The attached terminal, if any, acts as the
+		// local terminal.
+		c.attach = cli.NewAttachSrv(ctx, c.warp,
+			func(data []byte) {
+				c.input(ctx, data)
+			},
+			func(size warp.Size) {
+				if err := c.Resize(ctx, size); err != nil {
+					c.errC <- errors.Trace(err)
+				}
+			},
 		)
+		if err := ioutil.WriteFile(
+			cli.PidPath(c.warp), []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644,
+		); err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to write pid file: %v", err),
+			)
+		}
+		defer os.Remove(cli.PidPath(c.warp))
+	} else {
+		// Setup local term.
+		if !terminal.IsTerminal(stdin) {
+			return errors.Trace(
+				errors.Newf("Not running in a terminal."),
+			)
+		}
+
+		// Store initial size of the terminal.
+		cols, rows, err := terminal.GetSize(stdin)
+		if err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to retrieve the terminal size: %v.", err),
+			)
+		}
+		c.mutex.Lock()
+		c.size = warp.Size{Rows: rows, Cols: cols}
+		c.mutex.Unlock()
 	}
-	// Restores the terminal once we're done.
+
+	// Print the closure message once the terminal is restored.
 	defer func() {
-		terminal.Restore(stdin, old)
-		// Let's attempt to clean things up with a newline.
-		fmt.Printf("\n")
+		c.mutex.Lock()
+		idled := c.idled
+		c.mutex.Unlock()
+		if idled {
+			out.Normf("Closed warp after %s of inactivity: ", c.idleQuit)
+			out.Valuf("%s\n", c.warp)
+		}
+		c.mutex.Lock()
+		onced := c.onced
+		c.mutex.Unlock()
+		if onced {
+			out.Normf("Closed warp after its clients left: ")
+			out.Valuf("%s\n", c.warp)
+		}
 	}()
 
-	// Start shell.
-	c.cmd = exec.Command(c.shell.Command, "-l")
+	if c.record != "" {
+		f, err := os.Create(c.record)
+		if err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to create recording file: %v", err),
+			)
+		}
+		size := c.WindowSize()
+		if !size.Valid() {
+			size = warp.Size{Rows: 24, Cols: 80}
+		}
+		rec, err := asciicast.NewWriter(
+			f, size.Cols, size.Rows,
+			map[string]string{"TERM": c.term},
+		)
+		if err != nil {
+			f.Close()
+			return errors.Trace(
+				errors.Newf("Failed to write recording header: %v", err),
+			)
+		}
+		c.mutex.Lock()
+		c.rec = rec
+		c.recSize = size
+		c.mutex.Unlock()
+		// Flush the recording on teardown, once the panes stopped.
+		defer func() {
+			rec.Flush()
+			f.Close()
+		}()
+	}
 
-	// Set the warp env variable for the shell.
+	// Set the warp env variable for the panes.
 	env := os.Environ()
 	env = append(
 		env, fmt.Sprintf("%s=%s", warp.EnvWarp, c.warp),
+		fmt.Sprintf("%s=%s", warp.EnvWarpStatus, cli.StatusPath(c.warp)),
 	)
-	c.cmd.Env = env
+	if c.setTerm {
+		env = setEnv(env, "TERM", c.term)
+	}
+	if c.setShell {
+		env = setEnv(env, "SHELL", c.shell.Command)
+	}
 
-	// Setup pty.
-	c.pty, err = pty.Start(c.cmd)
-	if err != nil {
-		return errors.Trace(
-			errors.Newf("Failed to create pty: %v.", err),
-		)
+	if c.tmux {
+		cleanup, err := c.SetupTmux(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer cleanup()
+	}
+
+	// Start the shell (or layout panes) and their ptys.
+	for _, p := range c.panes {
+		if p.argv != nil {
+			p.cmd = exec.Command(p.argv[0], p.argv[1:]...)
+		} else if p.command == "" {
+			p.cmd = exec.Command(c.shell.Command, "-l")
+		} else {
+			p.cmd = exec.Command(c.shell.Command, "-c", p.command)
+		}
+		p.cmd.Env = env
+
+		var err error
+		p.pty, err = pty.Start(p.cmd)
+		if err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to create pty: %v.", err),
+			)
+		}
+		go func(p *pane) {
+			p.cmd.Wait()
+			cancel()
+		}(p)
 	}
-	go func() {
-		c.cmd.Wait()
-		cancel()
-	}()
 
 	// Main loops.
 
@@ -272,6 +1126,8 @@ func (c *Open) Execute(
 	// without error. It is used to start the local server after we got a
 	// chance to receive any error from warpd.
 	c.initC = make(chan struct{})
+	// c.readyC is closed once the warp was initialized.
+	c.readyC = make(chan struct{})
 
 	// Wait for an user facing error on the c.errC channel.
 	var userErr error
@@ -280,111 +1136,740 @@ func (c *Open) Execute(
 		cancel()
 	}()
 
-	// Launch the connection loop.
+	// Launch the connection loop. The session to warpd outlives ctx for
+	// warpd to be notified that the warp is closing (see below).
+	connCtx, connCancel := context.WithCancel(context.Background())
+	defer connCancel()
 	go func() {
-		c.ConnLoop(ctx)
+		defer cli.RecoverTerminal()
+		c.ConnLoop(connCtx)
 		// Errors are sent to the errC, no need to cancel.
 	}()
 
-	// Launch the local command server.
+	// Launch the local command server (and attach server if detached).
 	go func() {
+		defer cli.RecoverTerminal()
 		<-c.initC
 		c.inited = true
+		close(c.readyC)
+		if c.attach != nil {
+			go func() {
+				c.attach.Run(ctx)
+				cancel()
+			}()
+		}
 		c.srv.Run(ctx)
 		cancel()
 	}()
 
-	// Forward window resizes to pty and updateC.
-	go func() {
-		ch := make(chan os.Signal, 1)
-		signal.Notify(ch, syscall.SIGWINCH)
-		for {
-			ss := c.HostSession()
-			if ss != nil && ss.TornDown() {
-				break
-			}
-			cols, rows, err := terminal.GetSize(stdin)
-			if err != nil {
-				c.errC <- errors.Newf(
-					"Failed to retrieve the terminal size: %v", err,
-				)
-				break
-			}
-			if err := Setsize(c.pty, rows, cols); err != nil {
-				c.errC <- errors.Newf(
-					"Failed to set the pty size", err,
-				)
-				break
-			}
-			if err := syscall.Kill(
-				c.cmd.Process.Pid, syscall.SIGWINCH,
-			); err != nil {
-				c.errC <- errors.Newf(
-					"Failed to signal SIGWINCH", err,
-				)
-				break
-			}
-
-			c.mutex.Lock()
-			c.size = warp.Size{Rows: rows, Cols: cols}
-			c.mutex.Unlock()
-
-			ss = c.HostSession()
-			if ss != nil {
-				// Send an update and ignore errors.
-				ss.SendHostUpdate(ctx, warp.HostUpdate{
-					Warp:       c.warp,
-					From:       c.session,
-					WindowSize: c.size,
-				})
-			}
+	if c.writeFromAll && !c.detached {
+		c.statusLine = cli.NewStatusLine(int(os.Stdout.Fd()), os.Stdout)
+		c.statusLine.Set(writeFromAllBanner, len(writeFromAllWarning))
+	}
 
-			<-ch
+	if c.detached {
+		// Apply the initial size passed by the detaching process.
+		if err := c.Resize(ctx, c.TerminalSize()); err != nil {
+			return errors.Trace(err)
 		}
-		cancel()
-	}()
-
-	// Multiplex shell to dataC, Stdout.
-	go func() {
-		plex.Run(ctx, func(data []byte) {
-			os.Stdout.Write(data)
-			ss := c.HostSession()
-			if ss != nil {
-				ss.WriteDataC(data)
+	} else {
+		// Forward window resizes to pty and updateC.
+		go func() {
+			defer cli.RecoverTerminal()
+			ch := make(chan os.Signal, 1)
+			signal.Notify(ch, syscall.SIGWINCH)
+			for {
+				ss := c.HostSession()
+				if ss != nil && ss.TornDown() {
+					break
+				}
+				cols, rows, err := terminal.GetSize(stdin)
+				if err != nil {
+					c.errC <- errors.Newf(
+						"Failed to retrieve the terminal size: %v", err,
+					)
+					break
+				}
+				if c.statusLine != nil {
+					// The last line is used by the status line.
+					rows--
+				}
+				if err := c.Resize(
+					ctx, warp.Size{Rows: rows, Cols: cols},
+				); err != nil {
+					c.errC <- errors.Trace(err)
+					break
+				}
+
+				<-ch
 			}
-		}, c.pty)
-		cancel()
-	}()
+			cancel()
+		}()
+	}
+
+	// Wait for the warp to be established on warpd before declaring it open
+	// and going raw, so that a failure to set up the session (as a half-open
+	// one) is reported right away instead of presenting a dead terminal.
+	// warpd only sends the initial state once all the channels of the session
+	// were accepted and the warp created.
+	select {
+	case <-c.readyC:
+	case <-ctx.Done():
+		return errors.Trace(userErr)
+	case <-time.After(openTimeout):
+		return errors.Trace(
+			errors.Newf(
+				"Timed out waiting for warpd to set up the warp: %s.", c.warp,
+			),
+		)
+	}
+
+	// Display open message
+	out.Normf("Opened warp: ")
+	out.Valuf("%s\n", c.warp)
+	if c.writeFromAll {
+		out.Warnf("Warning: %s.\n", writeFromAllWarning)
+	}
+
+	if !c.detached {
+		// Make the terminal raw.
+		restore, err := cli.MakeRawTerminal(ctx, cancel, stdin)
+		if err != nil {
+			return errors.Trace(
+				errors.Newf("Unable to put terminal in raw mode: %v.", err),
+			)
+		}
+		// Restores the terminal once we're done.
+		defer func() {
+			restore()
+			// Let's attempt to clean things up with a newline.
+			fmt.Printf("\n")
+		}()
+		if c.statusLine != nil {
+			go c.statusLine.Run(ctx)
+			// Clear the status line before the terminal is restored.
+			defer c.statusLine.Close()
+		}
+	}
+
+	// Multiplex the active pane to dataC, Stdout (or the attached terminal).
+	for _, p := range c.panes {
+		go func(p *pane) {
+			defer cli.RecoverTerminal()
+			plex.RunCoalesced(ctx, func(data []byte) {
+				if c.idleCountsOutput {
+					c.touch()
+				}
+				c.paneMutex.Lock()
+				defer c.paneMutex.Unlock()
+				if c.panes[c.active] == p {
+					c.output(data)
+					c.recordData(data)
+				}
+			}, p.pty, outputCoalesceWindow)
+			cancel()
+		}(p)
+	}
+
+	if !c.detached {
+		// Multiplex Stdin to the active pane.
+		go func() {
+			defer cli.RecoverTerminal()
+			plex.Run(ctx, func(data []byte) {
+				c.input(ctx, data)
+			}, os.Stdin)
+			cancel()
+		}()
+	}
+
+	if c.idleQuit > 0 {
+		c.touch()
+		go func() {
+			defer cli.RecoverTerminal()
+			c.IdleLoop(ctx)
+			cancel()
+		}()
+	}
+
+	if c.once {
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-c.onceC:
+				c.paneMutex.Lock()
+				c.output([]byte("\r\n[warp closed after its clients left]\r\n"))
+				c.paneMutex.Unlock()
+				cancel()
+			}
+		}()
+	}
 
-	// Multiplex Stdin to pty.
 	go func() {
-		plex.Run(ctx, func(data []byte) {
-			c.pty.Write(data)
-		}, os.Stdin)
-		cancel()
+		select {
+		case <-ctx.Done():
+		case <-c.srv.Closed():
+			c.paneMutex.Lock()
+			c.output([]byte("\r\n[warp closed with `warp close`]\r\n"))
+			c.paneMutex.Unlock()
+			cancel()
+		}
 	}()
 
 	<-ctx.Done()
 
+	// Let warpd know that the warp is closing, for it not to keep it open
+	// waiting for the host to reconnect, before the session is torn down.
+	if ss := c.HostSession(); ss != nil {
+		update := c.HostUpdate(ss)
+		update.Closing = true
+		ss.SendHostUpdate(connCtx, update)
+	}
+	connCancel()
+
 	return errors.Trace(userErr)
 }
 
-// ReconnectLoop handles reconnecting the host to warpd. Each time the
-// connection drops, the associated Session is destroyed and another one is
-// created as a reconnection is attempted.
+// Resize applies a new host terminal size, resizing the ptys to the resulting
+// window size of the warp and sending the associated host update to warpd if
+// connected.
+func (c *Open) Resize(
+	ctx context.Context,
+	size warp.Size,
+) error {
+	if !size.Valid() {
+		// Ignore invalid sizes (as reported by a broken terminal or attached
+		// client).
+		return nil
+	}
+
+	c.mutex.Lock()
+	c.size = size
+	c.mutex.Unlock()
+	size = c.WindowSize()
+
+	for _, p := range c.panes {
+		if err := Setsize(p.pty, size.Rows, size.Cols); err != nil {
+			return errors.Newf(
+				"Failed to set the pty size: %v", err,
+			)
+		}
+		if err := syscall.Kill(
+			p.cmd.Process.Pid, syscall.SIGWINCH,
+		); err != nil {
+			return errors.Newf(
+				"Failed to signal SIGWINCH: %v", err,
+			)
+		}
+	}
+
+	c.events.Log(eventlog.Event{
+		Event: eventlog.Resized,
+		Warp:  c.warp,
+		Cols:  size.Cols,
+		Rows:  size.Rows,
+	})
+	c.recordSize(size)
+
+	ss := c.HostSession()
+	if ss != nil {
+		// Queue an update and ignore errors.
+		c.QueueHostUpdate(ctx, ss)
+	}
+
+	return nil
+}
+
+// SendHostUpdate sends the current host update to warpd, applying the panes
+// to the session state first as warpd does not send them back to the host.
+func (c *Open) SendHostUpdate(
+	ctx context.Context,
+	ss *cli.Session,
+) error {
+	update := c.HostUpdate(ss)
+	ss.SetPanes(update.Panes, update.Pane)
+	if err := ss.SendHostUpdate(ctx, update); err != nil {
+		return errors.Trace(err)
+	}
+	// Local subscribers are notified here as warpd does not send host
+	// updates back to the host.
+	c.srv.StateUpdated(ctx)
+	return nil
+}
+
+// QueueHostUpdate queues a host update to be sent to warpd, coalescing it
+// with the updates queued within warp.HostUpdateDebounce (as happens when
+// the terminal is being resized).
+func (c *Open) QueueHostUpdate(
+	ctx context.Context,
+	ss *cli.Session,
+) error {
+	update := c.HostUpdate(ss)
+	ss.SetPanes(update.Panes, update.Pane)
+	if err := ss.QueueHostUpdate(ctx, false); err != nil {
+		return errors.Trace(err)
+	}
+	c.srv.StateUpdated(ctx)
+	return nil
+}
+
+// ClientsResized applies the smallest size of the clients terminals reported
+// by warpd, resizing the warp if its size policy is warp.SizePolicyMin.
+func (c *Open) ClientsResized(
+	ctx context.Context,
+	size warp.Size,
+) {
+	if c.sizePolicy != warp.SizePolicyMin {
+		return
+	}
+	c.mutex.Lock()
+	changed := c.clientsSize != size
+	c.clientsSize = size
+	c.mutex.Unlock()
+	if changed {
+		c.Resize(ctx, c.TerminalSize())
+	}
+}
+
+// KickClients requests warpd to disconnect the specified users with the
+// specified error code.
+func (c *Open) KickClients(
+	ctx context.Context,
+	ss *cli.Session,
+	users []string,
+	code string,
+) error {
+	update := c.HostUpdate(ss)
+	for _, user := range users {
+		update.Kicks = append(update.Kicks, warp.Kick{
+			User: user,
+			Code: code,
+		})
+	}
+	if err := ss.SendHostUpdate(ctx, update); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// EventLoop logs the changes of the users of the warp (joining, leaving and
+// mode changes) to the event log until the context is canceled.
+// Errors writing the event log are ignored.
+func (c *Open) EventLoop(
+	ctx context.Context,
+) {
+	notifyC, unsubscribe := c.srv.Subscribe()
+	defer unsubscribe()
+
+	users := map[string]warp.User{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-notifyC:
+		}
+		ss := c.HostSession()
+		if ss == nil {
+			// warpd forgets the users of the warp when the host disconnects,
+			// they are logged again as they reconnect.
+			users = map[string]warp.User{}
+			continue
+		}
+		st := ss.ProtocolState()
+
+		tokens := []string{}
+		for token := range users {
+			tokens = append(tokens, token)
+		}
+		for token := range st.Users {
+			if _, ok := users[token]; !ok {
+				tokens = append(tokens, token)
+			}
+		}
+		sort.Strings(tokens)
+
+		for _, token := range tokens {
+			prev, was := users[token]
+			user, is := st.Users[token]
+			ev := eventlog.Event{
+				Warp:     c.warp,
+				User:     token,
+				Username: user.Username,
+				Mode:     user.Mode.String(),
+			}
+			switch {
+			case is && user.Hosting:
+				continue
+			case !was:
+				ev.Event = eventlog.Joined
+			case !is:
+				ev.Event = eventlog.Left
+				ev.Username = prev.Username
+				ev.Mode = prev.Mode.String()
+			case prev.Mode != user.Mode:
+				ev.Event = eventlog.ModeChanged
+				ev.PreviousMode = prev.Mode.String()
+			default:
+				continue
+			}
+			c.events.Log(ev)
+		}
+		users = st.Users
+	}
+}
+
+// touch records activity on the warp for `--idle-quit`.
+func (c *Open) touch() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lastActivity = time.Now()
+}
+
+// IdleLoop waits for the warp to be inactive for the idleQuit duration and
+// returns after notifying the local terminal and clients that the warp is
+// closing. It also returns if the context is canceled.
+func (c *Open) IdleLoop(
+	ctx context.Context,
+) {
+	for {
+		c.mutex.Lock()
+		remaining := c.idleQuit - time.Since(c.lastActivity)
+		c.mutex.Unlock()
+
+		if remaining <= 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(remaining):
+		}
+	}
+
+	c.mutex.Lock()
+	c.idled = true
+	c.mutex.Unlock()
+
+	c.paneMutex.Lock()
+	c.output([]byte(fmt.Sprintf(
+		"\r\n[warp closed after %s of inactivity]\r\n", c.idleQuit,
+	)))
+	c.paneMutex.Unlock()
+}
+
+// onceGrace is the default grace period of `--once`.
+const onceGrace = 15 * time.Second
+
+// ClientsUpdated is called with the number of clients connected to the warp
+// each time the state is updated. With `--once`, it schedules the closure of
+// the warp when the last client leaves (after a client connected) and cancels
+// it if a client connects during the grace period.
+func (c *Open) ClientsUpdated(
+	clients int,
+) {
+	if !c.once {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if clients > 0 {
+		c.onceJoined = true
+		if c.onceTimer != nil {
+			c.onceTimer.Stop()
+			c.onceTimer = nil
+		}
+		return
+	}
+	if !c.onceJoined || c.onceTimer != nil || c.onced {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(c.onceGrace, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.onceTimer != timer || c.onced {
+			// Canceled by a client connecting in the meantime.
+			return
+		}
+		c.onced = true
+		close(c.onceC)
+	})
+	c.onceTimer = timer
+}
+
+// output writes data from the active pane to the local terminal (or the
+// attached terminal) and to warpd if connected. It must be called with the
+// paneMutex held.
+func (c *Open) output(
+	data []byte,
+) {
+	if c.attach != nil {
+		c.attach.Write(data)
+	} else if c.statusLine != nil {
+		c.statusLine.Write(data)
+	} else {
+		os.Stdout.Write(data)
+	}
+	ss := c.HostSession()
+	if ss != nil {
+		ss.WriteDataC(data)
+	}
+}
+
+// recordData records output of the warp if recording.
+func (c *Open) recordData(
+	data []byte,
+) {
+	c.mutex.Lock()
+	rec := c.rec
+	c.mutex.Unlock()
+	if rec != nil {
+		rec.Output(data)
+	}
+}
+
+// recordSize records the window size of the warp if recording and it
+// changed.
+func (c *Open) recordSize(
+	size warp.Size,
+) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.rec != nil && size != c.recSize {
+		c.rec.Resize(size.Cols, size.Rows)
+		c.recSize = size
+	}
+}
+
+// notice writes a notice to the local terminal (or the attached terminal)
+// only.
+func (c *Open) notice(
+	msg string,
+) {
+	c.paneMutex.Lock()
+	defer c.paneMutex.Unlock()
+	if c.attach != nil {
+		c.attach.Write([]byte(msg))
+	} else if c.statusLine != nil {
+		c.statusLine.Write([]byte(msg))
+	} else {
+		os.Stdout.Write([]byte(msg))
+	}
+}
+
+// input writes data from the local terminal (or the attached terminal) to
+// the active pane, switching panes on paneSwitchKey if the warp has multiple
+// panes.
+func (c *Open) input(
+	ctx context.Context,
+	data []byte,
+) {
+	c.touch()
+	if len(c.panes) > 1 {
+		for {
+			i := bytes.IndexByte(data, paneSwitchKey)
+			if i < 0 {
+				break
+			}
+			c.activePane().pty.Write(data[:i])
+			c.SwitchPane(ctx)
+			data = data[i+1:]
+		}
+	}
+	if len(data) > 0 {
+		c.activePane().pty.Write(data)
+	}
+}
+
+// SwitchPane makes the next pane active. The switch is framed on the data
+// channel (see warp.PaneFrame) and the screen is cleared before the new pane
+// is signaled to redraw itself.
+func (c *Open) SwitchPane(
+	ctx context.Context,
+) {
+	c.paneMutex.Lock()
+	c.active = (c.active + 1) % len(c.panes)
+	p := c.panes[c.active]
+	c.output(append(warp.PaneFrame(p.name), []byte("\033[2J\033[H")...))
+	c.paneMutex.Unlock()
+
+	signalRedraw(p)
+
+	ss := c.HostSession()
+	if ss != nil {
+		// Queue an update and ignore errors.
+		c.QueueHostUpdate(ctx, ss)
+	}
+}
+
+// Refresh redraws the screen of the warp on a client request: the screen of
+// the clients (not the local terminal) is cleared and the active pane signaled
+// to redraw itself.
+func (c *Open) Refresh(
+	ctx context.Context,
+	ss *cli.Session,
+) {
+	c.paneMutex.Lock()
+	p := c.panes[c.active]
+	ss.WriteDataC([]byte("\033[2J\033[H"))
+	c.paneMutex.Unlock()
+
+	signalRedraw(p)
+}
+
+// signalRedraw signals the foreground process group of a pane so that
+// full-screen programs (not only the pane command itself) redraw.
+func signalRedraw(
+	p *pane,
+) {
+	pgrp, err := Getpgrp(p.pty)
+	if err != nil {
+		pgrp = p.cmd.Process.Pid
+	}
+	syscall.Kill(-pgrp, syscall.SIGWINCH)
+}
+
+// ExecuteDetach spawns the host process in the background (with the
+// `--detached` flag) and returns as soon as the warp is opened.
+func (c *Open) ExecuteDetach(
+	ctx context.Context,
+) error {
+	size := warp.Size{Rows: 24, Cols: 80}
+	stdin := int(os.Stdin.Fd())
+	if terminal.IsTerminal(stdin) {
+		if cols, rows, err := terminal.GetSize(stdin); err == nil {
+			size = warp.Size{Rows: rows, Cols: cols}
+		}
+	}
+
+	if _, err := os.Stat(cli.AttachPath(c.warp)); err == nil {
+		if conn, err := net.Dial("unix", cli.AttachPath(c.warp)); err == nil {
+			conn.Close()
+			return errors.Trace(
+				errors.Newf(
+					"A detached warp is already running with ID %s. You can "+
+						"attach to it with `warp attach %s`.",
+					c.warp, c.warp,
+				),
+			)
+		}
+	}
+	os.Remove(cli.AttachPath(c.warp))
+
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to locate the warp executable: %v", err),
+		)
+	}
+
+	args := []string{"open"}
+	for k, v := range c.flags {
+		if k == "detach" {
+			continue
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", k, v))
+	}
+	args = append(args,
+		"--detached",
+		fmt.Sprintf("--detached_size=%dx%d", size.Cols, size.Rows),
+		c.warp,
+	)
+
+	log, err := os.OpenFile(
+		cli.LogPath(c.warp), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600,
+	)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to create the detached warp log: %v", err),
+		)
+	}
+	defer log.Close()
+
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin = nil
+	cmd.Stdout = log
+	cmd.Stderr = log
+	// The warpd the warp was resolved to is passed as is, the detached
+	// process resolving the warp ID alone.
+	cmd.Env = setEnv(os.Environ(), "WARPD_ADDRESS", c.address)
+	cmd.Env = setEnv(cmd.Env, "WARPD_SRV_DOMAIN", "")
+	// Start a new session so that the detached process survives the
+	// termination of the current terminal.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to start the detached warp: %v", err),
+		)
+	}
+
+	exitC := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exitC)
+	}()
+
+	// Wait for the attach server to be up which indicates that the warp was
+	// successfully opened.
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case <-exitC:
+			raw, _ := ioutil.ReadFile(cli.LogPath(c.warp))
+			return errors.Trace(
+				errors.Newf(
+					"The detached warp exited: %s",
+					strings.TrimSpace(string(raw)),
+				),
+			)
+		case <-timeout:
+			return errors.Trace(
+				errors.Newf(
+					"Timed out waiting for the detached warp to open (see %s).",
+					cli.LogPath(c.warp),
+				),
+			)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if _, err := os.Stat(cli.AttachPath(c.warp)); err == nil {
+			break
+		}
+	}
+
+	out.Normf("Opened warp in the background: ")
+	out.Valuf("%s", c.warp)
+	out.Normf(" (pid %d)\n", cmd.Process.Pid)
+	out.Normf("Attach to it with: ")
+	out.Boldf("warp attach %s\n", c.warp)
+	if c.writeFromAll {
+		out.Warnf("Warning: %s.\n", writeFromAllWarning)
+	}
+
+	return nil
+}
+
+// ConnLoop handles reconnecting the host to warpd. Each time the connection
+// drops, the associated Session is destroyed and another one is created as a
+// reconnection is attempted. Redirects from warpd are followed (up to
+// warp.MaxRedirects consecutive ones) and reconnections after a connection
+// drop start from the original address. Transient failures to establish the
+// first session are retried with backoff.
 // Errors are returned during the first iteration of the reconnect loop. On
 // subsequent reconnect, only warpd generated errors are returned.
 func (c *Open) ConnLoop(
 	ctx context.Context,
 ) {
 	first := true
+	address := c.address
+	hops := 0
+	retries := 0
 CONNLOOP:
 	for {
 		var conn net.Conn
 		var err error
 
+		network, addr := warp.AddressNetwork(address)
 		if c.noTLS {
-			conn, err = net.Dial("tcp", c.address)
+			conn, err = net.Dial(network, addr)
 			if err != nil {
 				if first {
 					c.errC <- errors.Trace(
@@ -394,16 +1879,14 @@ CONNLOOP:
 				}
 				// Silentluy ignore and attempt a reconnect 500ms after.
 				time.Sleep(500 * time.Millisecond)
+				address = c.address
 				continue
 			}
 		} else {
-			tlsConfig := &tls.Config{
-				InsecureSkipVerify: c.insecureTLS,
-			}
-
-			conn, err = tls.Dial("tcp", c.address, tlsConfig)
+			conn, err = tls.Dial(network, addr, c.tlsConfig)
 			if err != nil {
-				if first {
+				// The certificate of warpd changing is not retried.
+				if first || cli.IsPinMismatch(err) {
 					c.errC <- errors.Trace(
 						errors.Newf("Connection error: %v", err),
 					)
@@ -411,73 +1894,137 @@ CONNLOOP:
 				}
 				// Silentluy ignore and attempt a reconnect.
 				time.Sleep(500 * time.Millisecond)
+				address = c.address
 				continue
 			}
 		}
 		defer conn.Close()
 
-		c.ManageSession(ctx, conn, !first)
-		first = false
+		redirect, err := c.ManageSession(ctx, conn, !first)
 
 		select {
 		case <-ctx.Done():
 			break CONNLOOP
 		default:
 		}
+
+		if first && err != nil {
+			if cli.IsTransient(err) && retries < cli.SessionRetries {
+				retries++
+				select {
+				case <-ctx.Done():
+					break CONNLOOP
+				case <-time.After(cli.SessionRetryDelay(retries)):
+				}
+				continue
+			}
+			c.errC <- errors.Newf(
+				"Failed to open session to warpd: %s", err,
+			)
+			break
+		}
+
+		if redirect != nil {
+			hops++
+			if hops > warp.MaxRedirects {
+				c.errC <- errors.Newf(
+					"Too many redirects from warpd (last to %s).",
+					redirect.Address,
+				)
+				break
+			}
+			address = redirect.Address
+			continue
+		}
+		first = false
+		hops = 0
+		address = c.address
 	}
 }
 
-// ManageSession creates an manage a session. It
+// ManageSession creates an manage a session. It returns a *cli.RedirectError
+// if warpd redirected the session to another warpd, or the error encountered
+// if the session could not be established.
 func (c *Open) ManageSession(
 	ctx context.Context,
 	conn net.Conn,
 	warpdErrOnly bool,
-) {
+) (*cli.RedirectError, error) {
 	// This ctx can be canceled by the session or its parent context.
 	ctx, cancel := context.WithCancel(ctx)
 
 	ss, err := cli.NewSession(
-		ctx, c.session, c.warp, warp.SsTpHost, c.username, cancel, conn,
+		ctx, c.session, c.warp, warp.SsTpHost, c.username,
+		cli.SessionOptions{Compress: c.compress}, cancel, conn,
 	)
 	if err != nil {
-		if !warpdErrOnly {
-			c.errC <- errors.Newf(
-				"Failed to open session to warpd: %s", err,
-			)
-		}
-		return
+		cancel()
+		return nil, errors.Trace(err)
 	}
 	// Close and reclaims all session related state.
 	defer ss.TearDown()
-
-	// Listen for errors.
+	if c.singleWriter {
+		ss.SetSingleWriter()
+	}
+	ss.SetMaxClients(c.srv.MaxClients())
+	ss.SetTitle(c.title)
+	ss.SetTerm(c.term)
+	if c.readOnly {
+		ss.SetReadOnly()
+	}
+	ss.SetHostUpdate(func() warp.HostUpdate {
+		return c.HostUpdate(ss)
+	})
+
+	// Listen for errors. received is set if an error was received from warpd,
+	// to be read once redirectC is closed.
+	redirectC := make(chan *cli.RedirectError, 1)
+	received := false
 	go func() {
+		defer cli.RecoverTerminal()
+		defer close(redirectC)
 		if e, err := ss.DecodeError(ctx); err == nil {
-			c.errC <- errors.Newf(
-				"Received %s: %s", e.Code, e.Message,
-			)
+			received = true
+			err := cli.SessionError(e)
+			if r, ok := err.(*cli.RedirectError); ok {
+				redirectC <- r
+			} else if cli.IsInternal(err) && c.HostSession() == ss {
+				// The session was established, reconnect to warpd (from
+				// ConnLoop) and host the warp again.
+				c.rehost(ctx)
+			} else {
+				c.errC <- err
+			}
+			// warpd closes the session after sending an error.
+			ss.TearDown()
 		}
 		cancel()
 	}()
 
-	if err := ss.SendHostUpdate(ctx, warp.HostUpdate{
-		Warp:       c.warp,
-		From:       c.session,
-		WindowSize: c.WindowSize(),
-	}); err != nil {
+	if err := c.SendHostUpdate(ctx, ss); err != nil {
 		if !warpdErrOnly {
 			c.errC <- errors.Trace(
 				errors.Newf("Failed to send initial host update: %v.", err),
 			)
 		}
-		return
+		return c.redirected(ss, redirectC), nil
 	}
 
 	// Wait for a first state update from warpd.
 	if st, err := ss.DecodeState(ctx); err != nil {
-		// Let's not print any error here as we should have received an error
-		// from the server.
-		return
+		// The error received from warpd, if any, was reported. warpd
+		// dropping the session without error (as a half-open one whose
+		// channels it failed to accept) is returned so that the warp fails
+		// to open right away.
+		redirect := c.redirected(ss, redirectC)
+		if redirect == nil && !received && !warpdErrOnly {
+			return nil, errors.Trace(
+				errors.Newf(
+					"connection lost before the warp was set up (%v)", err,
+				),
+			)
+		}
+		return redirect, nil
 	} else {
 		if err := ss.UpdateState(*st, true); err != nil {
 			if !warpdErrOnly {
@@ -487,18 +2034,26 @@ func (c *Open) ManageSession(
 					),
 				)
 			}
-			return
+			return nil, nil
 		} else {
 			c.mutex.Lock()
 			inited := c.inited
 			c.mutex.Unlock()
 			if !inited {
+				if c.compress && !ss.Compressed() {
+					c.notice("[warp: compression not supported by warpd]\r\n")
+				}
 				c.initC <- struct{}{}
 			}
 		}
 	}
 
 	// The host session is ready
+	c.events.Log(eventlog.Event{
+		Event:   eventlog.Connected,
+		Warp:    c.warp,
+		Session: c.session.Token,
+	})
 	c.mutex.Lock()
 	c.ss = ss
 	c.srv.SetSession(ctx, ss)
@@ -508,14 +2063,57 @@ func (c *Open) ManageSession(
 
 	// Listen for state updates.
 	go func() {
+		defer cli.RecoverTerminal()
+		typing := false
 	STATELOOP:
 		for {
 			if st, err := ss.DecodeState(ctx); err != nil {
 				break
 			} else {
+				if len(st.Typing) > 0 && !typing {
+					c.notice(typingNotice(st.Typing))
+				}
+				typing = len(st.Typing) > 0
+				if st.Refresh {
+					c.Refresh(ctx, ss)
+				}
 				if err := ss.UpdateState(*st, true); err != nil {
+					// The update was rejected as it attempted to alter modes
+					// or hosting: warpd can't be trusted anymore.
+					c.errC <- errors.Newf(
+						"Rejected warp state update from warpd: %v", err,
+					)
 					break
 				}
+				c.events.Log(eventlog.Event{
+					Event:   eventlog.State,
+					Warp:    c.warp,
+					Cols:    st.WindowSize.Cols,
+					Rows:    st.WindowSize.Rows,
+					Clients: ss.ClientCount(),
+				})
+				for _, m := range ss.IgnoredModes() {
+					c.events.Log(eventlog.Event{
+						Event:        eventlog.ModeIgnored,
+						Warp:         c.warp,
+						User:         m.User,
+						Username:     m.Username,
+						Mode:         m.Mode.String(),
+						ReceivedMode: m.Received.String(),
+					})
+				}
+				c.restoreModes(ctx, ss)
+				if excess := ss.ExcessClients(); len(excess) > 0 {
+					c.KickClients(ctx, ss, excess, warp.ErrCodeWarpFull)
+				}
+				c.srv.StateUpdated(ctx)
+				if c.writeFromAll {
+					c.grantWriteFromAll(ctx, ss)
+				}
+				c.noticeRequests(ss)
+				c.noticeUsers(ss)
+				c.ClientsUpdated(ss.ClientCount())
+				c.ClientsResized(ctx, st.ClientsSize)
 			}
 			select {
 			case <-ctx.Done():
@@ -526,11 +2124,20 @@ func (c *Open) ManageSession(
 		cancel()
 	}()
 
-	// Multiplex dataC to pty.
+	// Multiplex dataC to the active pane. Read-only warps never write it:
+	// the data is drained (so that warpd is not blocked) and discarded.
 	go func() {
+		defer cli.RecoverTerminal()
+		if c.readOnly {
+			plex.Run(ctx, func(data []byte) {}, ss.DataC())
+			ss.TearDown()
+			return
+		}
 		plex.Run(ctx, func(data []byte) {
 			if ss.HostCanReceiveWrite() {
-				c.pty.Write(data)
+				c.touch()
+				c.inputs.Log(inputSources(ss), data)
+				c.activePane().pty.Write(data)
 			}
 		}, ss.DataC())
 		ss.TearDown()
@@ -543,6 +2150,278 @@ func (c *Open) ManageSession(
 	c.ss = nil
 	c.srv.SetSession(ctx, nil)
 	c.mutex.Unlock()
+	c.events.Log(eventlog.Event{
+		Event:   eventlog.Disconnected,
+		Warp:    c.warp,
+		Session: c.session.Token,
+	})
+
+	return c.redirected(ss, redirectC), nil
+}
+
+// inputSources returns the users authorized to write to the warp, to whom the
+// input received from warpd is attributed in the input log. The host user is
+// only included if no other user is authorized as it only sends input through
+// warpd when also connected as a client (`warp connect`).
+func inputSources(
+	ss *cli.Session,
+) []inputlog.Source {
+	state := ss.ProtocolState()
+	sources := []inputlog.Source{}
+	hosts := []inputlog.Source{}
+	for token, u := range state.Users {
+		if !ss.CanWrite(token) {
+			continue
+		}
+		source := inputlog.Source{
+			User:     token,
+			Username: u.Username,
+		}
+		if u.Hosting {
+			hosts = append(hosts, source)
+		} else {
+			sources = append(sources, source)
+		}
+	}
+	if len(sources) == 0 {
+		sources = hosts
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].User < sources[j].User
+	})
+	return sources
+}
+
+// rehostGrace is the time given to users to reconnect to a rehosted warp for
+// their modes to be restored.
+const rehostGrace = time.Minute
+
+// rehost prepares the warp to be hosted again after warpd failed to serve the
+// established host session with an internal error, in which case the warp is
+// likely gone from warpd (unless kept open for the host to reconnect, `warpd
+// -host-grace`). The modes of the users (except time-limited ones) are kept
+// to be restored as they reconnect to the new warp (or right away).
+func (c *Open) rehost(
+	ctx context.Context,
+) {
+	modes := c.srv.Modes()
+	c.mutex.Lock()
+	c.rehostModes = modes
+	c.rehostDeadline = time.Now().Add(rehostGrace)
+	c.mutex.Unlock()
+	c.notice(
+		"\r\n[warp: warpd reported an internal error, hosting the warp " +
+			"again...]\r\n",
+	)
+}
+
+// restoreModes restores the modes the users had before the warp was rehosted
+// as they reconnect (see rehost).
+func (c *Open) restoreModes(
+	ctx context.Context,
+	ss *cli.Session,
+) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.rehostModes) == 0 {
+		return
+	}
+	if time.Now().After(c.rehostDeadline) {
+		c.rehostModes = nil
+		return
+	}
+	restored := false
+	for user, mode := range c.rehostModes {
+		if _, err := ss.GetMode(user); err != nil {
+			// Not reconnected yet.
+			continue
+		}
+		delete(c.rehostModes, user)
+		if mode != warp.DefaultUserMode && ss.SetMode(user, mode) == nil {
+			restored = true
+		}
+	}
+	if restored {
+		ss.QueueHostUpdate(ctx, true)
+	}
+}
+
+// noticeRequests notices the host of the users requesting a mode (`warp
+// connect --write` or Ctrl-R while connected), once per request (see
+// noticeAbove).
+func (c *Open) noticeRequests(
+	ss *cli.Session,
+) {
+	state := ss.ProtocolState()
+	c.mutex.Lock()
+	requests := map[string]bool{}
+	notices := []string{}
+	for token, user := range state.Users {
+		pending := ss.PendingRequest(token)
+		if pending == 0 {
+			continue
+		}
+		requests[token] = true
+		if !c.requests[token] {
+			designation := token
+			if uniqueUsername(state, user.Username) {
+				designation = user.Username
+			}
+			notices = append(notices, fmt.Sprintf(
+				"[warp: %s is requesting %s access (`warp authorize %s` "+
+					"to grant it, `warp revoke %s` to decline)]",
+				user.Username, warp.ModeName(pending), designation,
+				designation,
+			))
+		}
+	}
+	c.requests = requests
+	c.mutex.Unlock()
+	for _, n := range notices {
+		c.noticeAbove(n)
+	}
+}
+
+// noticeUsers notices the host of the clients joining or leaving the warp
+// since the last state (see noticeAbove), ringing the terminal bell when
+// clients join if enabled.
+func (c *Open) noticeUsers(
+	ss *cli.Session,
+) {
+	state := ss.ProtocolState()
+	c.mutex.Lock()
+	users := map[string]string{}
+	joined := []string{}
+	for token, user := range state.Users {
+		if user.Hosting {
+			continue
+		}
+		users[token] = warp.SanitizeTitle(user.Username)
+		if _, ok := c.users[token]; !ok {
+			joined = append(joined, users[token])
+		}
+	}
+	left := []string{}
+	for token, username := range c.users {
+		if _, ok := users[token]; !ok {
+			left = append(left, username)
+		}
+	}
+	c.users = users
+	c.mutex.Unlock()
+
+	sort.Strings(joined)
+	sort.Strings(left)
+	for _, username := range joined {
+		c.noticeAbove(fmt.Sprintf("[warp: %s joined]", username))
+	}
+	for _, username := range left {
+		c.noticeAbove(fmt.Sprintf("[warp: %s left]", username))
+	}
+	if c.bell && len(joined) > 0 {
+		c.notice("\a")
+	}
+}
+
+// noticeAbove writes a one-line notice to the local terminal (or the attached
+// terminal) above the line of the cursor, leaving the cursor where it was
+// relative to that line, so that the line being typed in the active pane is
+// not disrupted. Newlines first make room for the notice below the cursor
+// (scrolling the screen if needed) before returning to the line, which is
+// then moved down by inserting the lines of the notice above it.
+func (c *Open) noticeAbove(
+	msg string,
+) {
+	c.mutex.Lock()
+	cols := c.size.Cols
+	c.mutex.Unlock()
+	if cols <= 0 {
+		cols = 80
+	}
+	lines := (utf8.RuneCountInString(msg) + cols - 1) / cols
+	if lines < 1 {
+		lines = 1
+	}
+	c.notice(fmt.Sprintf(
+		"%s\033[%dA\0337\r\033[%dL\033[1m%s\033[0m\0338\033[%dB",
+		strings.Repeat("\n", lines), lines, lines, msg, lines,
+	))
+}
+
+// uniqueUsername returns whether a username designates a single client of
+// the warp, in which case in-warp commands accept it in place of the user
+// token.
+func uniqueUsername(
+	state warp.State,
+	username string,
+) bool {
+	count := 0
+	for _, u := range state.Users {
+		if !u.Hosting && u.Username == username {
+			count++
+		}
+	}
+	return count == 1
+}
+
+// writeFromAllWarning is the warning displayed to hosts of warps opened with
+// `--insecure-allow-write-from-all` and writeFromAllBanner its rendition in
+// the status line.
+const (
+	writeFromAllWarning = "anyone joining this warp can write to it " +
+		"(--insecure-allow-write-from-all)"
+	writeFromAllBanner = "\033[1;37;41m" + writeFromAllWarning
+)
+
+// grantWriteFromAll authorizes the users who joined the warp since the last
+// state to write to it (`--insecure-allow-write-from-all`). Users whose write
+// access is revoked once joined are left as is until they reconnect.
+func (c *Open) grantWriteFromAll(
+	ctx context.Context,
+	ss *cli.Session,
+) {
+	state := ss.ProtocolState()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	joined := map[string]bool{}
+	granted := false
+	for token, user := range state.Users {
+		if user.Hosting {
+			continue
+		}
+		joined[token] = true
+		if c.writeFromAllJoined[token] ||
+			user.Mode&warp.ModeShellWrite != 0 {
+			continue
+		}
+		mode := user.Mode | warp.ModeShellWrite
+		if ss.SetMode(token, mode) != nil {
+			continue
+		}
+		granted = true
+		c.events.Log(eventlog.Event{
+			Event:    eventlog.Granted,
+			Warp:     c.warp,
+			User:     token,
+			Username: user.Username,
+			Mode:     mode.String(),
+		})
+	}
+	c.writeFromAllJoined = joined
+	if granted {
+		ss.QueueHostUpdate(ctx, true)
+	}
+}
+
+// redirected tears down the session and returns the redirect received from
+// warpd if any. Tearing down the session ends the error listener once it
+// drained what warpd sent before the session dropped.
+func (c *Open) redirected(
+	ss *cli.Session,
+	redirectC chan *cli.RedirectError,
+) *cli.RedirectError {
+	ss.TearDown()
+	return <-redirectC
 }
 
 type winsize struct {
@@ -565,3 +2444,19 @@ func Setsize(f *os.File, rows, cols int) error {
 	}
 	return nil
 }
+
+// Getpgrp returns the foreground process group of the terminal associated
+// with the pty.
+func Getpgrp(f *os.File) (int, error) {
+	var pgrp int32
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		f.Fd(),
+		syscall.TIOCGPGRP,
+		uintptr(unsafe.Pointer(&pgrp)),
+	)
+	if errno != 0 {
+		return 0, syscall.Errno(errno)
+	}
+	return int(pgrp), nil
+}
@@ -0,0 +1,430 @@
+package command
+
+import (
+	"context"
+	"encoding/gob"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/kr/pty"
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// startPane starts a pane running sleep in a pseudo-terminal.
+func startPane(
+	t *testing.T,
+) *pane {
+	t.Helper()
+	return startPaneCommand(t, "sleep", "60")
+}
+
+// startPaneCommand starts a pane running a command in a pseudo-terminal.
+func startPaneCommand(
+	t *testing.T,
+	name string,
+	args ...string,
+) *pane {
+	t.Helper()
+	cmd := exec.Command(name, args...)
+	f, err := pty.Start(cmd)
+	if err != nil {
+		t.Skipf("No pseudo-terminal available: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		f.Close()
+	})
+	return &pane{name: "main", cmd: cmd, pty: f}
+}
+
+func TestResizeIgnoresInvalidSizes(t *testing.T) {
+	p := startPane(t)
+	c := NewOpen().(*Open)
+	c.sizePolicy = warp.SizePolicyHost
+	c.panes = []*pane{p}
+
+	ctx := context.Background()
+	if err := c.Resize(ctx, warp.Size{Rows: 24, Cols: 80}); err != nil {
+		t.Fatalf("Resize: %v", err)
+	}
+	for _, size := range []warp.Size{
+		{},
+		{Rows: 0, Cols: 80},
+		{Rows: -1, Cols: -1},
+		{Rows: 24, Cols: warp.MaxWindowSize + 1},
+		{Rows: 1 << 20, Cols: 1 << 20},
+	} {
+		if err := c.Resize(ctx, size); err != nil {
+			t.Errorf("Resize %+v: %v", size, err)
+		}
+		cols, rows, err := terminal.GetSize(int(p.pty.Fd()))
+		if err != nil {
+			t.Fatalf("GetSize: %v", err)
+		}
+		if rows != 24 || cols != 80 {
+			t.Errorf("Pty size after %+v: got %dx%d, want 80x24",
+				size, cols, rows)
+		}
+		if got := c.WindowSize(); got != (warp.Size{Rows: 24, Cols: 80}) {
+			t.Errorf("Window size after %+v: got %+v", size, got)
+		}
+	}
+}
+
+// hostSession is a host session served by a fakeHostWarpd.
+type hostSession struct {
+	hello   warp.SessionHello
+	updates chan warp.HostUpdate
+	stateW  *gob.Encoder
+	errorW  *gob.Encoder
+	dataC   net.Conn
+}
+
+// fakeHostWarpd is a minimal warpd serving host sessions over a Unix socket,
+// handing them over to the test on sessions. If dropData is set, it drops the
+// sessions as their data channel is opened instead.
+type fakeHostWarpd struct {
+	ln       net.Listener
+	dropData bool
+	sessions chan *hostSession
+}
+
+// startFakeHostWarpd starts a fakeHostWarpd listening at path.
+func startFakeHostWarpd(
+	t *testing.T,
+	path string,
+	dropData bool,
+) *fakeHostWarpd {
+	t.Helper()
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	d := &fakeHostWarpd{
+		ln:       ln,
+		dropData: dropData,
+		sessions: make(chan *hostSession, 4),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+// serve serves a host session over conn, forwarding the host updates it
+// receives until the session is closed.
+func (d *fakeHostWarpd) serve(
+	conn net.Conn,
+) {
+	defer conn.Close()
+	if _, err := warp.ReadPreamble(conn); err != nil {
+		return
+	}
+	if err := warp.WritePreamble(conn, warp.ProtocolVersion); err != nil {
+		return
+	}
+	mux, err := yamux.Server(conn, warp.MuxConfig(
+		time.Second, ioutil.Discard,
+	))
+	if err != nil {
+		return
+	}
+	defer mux.Close()
+
+	channels := map[warp.ChannelType]net.Conn{}
+	for range warp.RequiredChannels {
+		c, err := mux.Accept()
+		if err != nil {
+			return
+		}
+		ct, err := warp.ReadChannelTag(c)
+		if err != nil || (ct == warp.ChannelData && d.dropData) {
+			return
+		}
+		channels[ct] = c
+	}
+
+	updateR := gob.NewDecoder(channels[warp.ChannelUpdate])
+	s := &hostSession{
+		updates: make(chan warp.HostUpdate, 16),
+		stateW:  gob.NewEncoder(channels[warp.ChannelState]),
+		errorW:  gob.NewEncoder(channels[warp.ChannelError]),
+		dataC:   channels[warp.ChannelData],
+	}
+	if err := updateR.Decode(&s.hello); err != nil {
+		return
+	}
+	d.sessions <- s
+	defer close(s.updates)
+	for {
+		var update warp.HostUpdate
+		if err := updateR.Decode(&update); err != nil {
+			return
+		}
+		s.updates <- update
+	}
+}
+
+// nextSession returns the next host session served by d.
+func (d *fakeHostWarpd) nextSession(
+	t *testing.T,
+) *hostSession {
+	t.Helper()
+	select {
+	case s := <-d.sessions:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a host session")
+	}
+	return nil
+}
+
+// nextUpdate returns the next host update received on s satisfying match.
+func (s *hostSession) nextUpdate(
+	t *testing.T,
+	match func(warp.HostUpdate) bool,
+) warp.HostUpdate {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case update, ok := <-s.updates:
+			if !ok {
+				t.Fatalf("Host session closed waiting for an update")
+			}
+			if match(update) {
+				return update
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for a host update")
+		}
+	}
+}
+
+// hostState returns the state of the warp with the host and users.
+func hostState(
+	users ...warp.User,
+) warp.State {
+	st := warp.State{
+		Warp:       "goofy-dev",
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+		Users: map[string]warp.User{
+			"host": {
+				Token:    "host",
+				Username: "stan",
+				Mode:     warp.DefaultHostMode,
+				Hosting:  true,
+			},
+		},
+	}
+	for _, u := range users {
+		st.Users[u.Token] = u
+	}
+	return st
+}
+
+// newHost returns an Open hosting its warp on the warpd listening at path.
+func newHost(
+	t *testing.T,
+	ctx context.Context,
+	path string,
+) *Open {
+	c := NewOpen().(*Open)
+	c.noTLS = true
+	c.address = warp.UnixAddressPrefix + path
+	c.warp = "goofy-dev"
+	c.session = warp.Session{Token: "tok", User: "host", Secret: "sec"}
+	c.username = "stan"
+	c.panes = []*pane{startPane(t)}
+	c.srv = cli.NewSrv(ctx, c.warp)
+	c.errC = make(chan error, 1)
+	c.initC = make(chan struct{}, 4)
+	return c
+}
+
+func TestOpenFailsOnDroppedDataChannel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warpd.sock")
+	startFakeHostWarpd(t, path, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newHost(t, ctx, path)
+	doneC := make(chan struct{})
+	go func() {
+		c.ConnLoop(ctx)
+		close(doneC)
+	}()
+
+	select {
+	case err := <-c.errC:
+		if !strings.Contains(err.Error(), "Failed to open session to warpd") {
+			t.Errorf("Error: got %q", err)
+		}
+	case <-c.initC:
+		t.Fatalf("Warp initialized with a dropped data channel")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Half-open session not reported")
+	}
+	select {
+	case <-doneC:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Connection loop still running")
+	}
+}
+
+// waitForUser waits for user to join the warp hosted by c and returns the
+// host session.
+func waitForUser(
+	t *testing.T,
+	c *Open,
+	user string,
+) *cli.Session {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ss := c.HostSession(); ss != nil {
+			if _, err := ss.GetMode(user); err == nil {
+				return ss
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s to join", user)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRehostOnInternalError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warpd.sock")
+	d := startFakeHostWarpd(t, path, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newHost(t, ctx, path)
+	go c.ConnLoop(ctx)
+
+	any := func(warp.HostUpdate) bool { return true }
+	lurker := warp.User{
+		Token:    "lurker",
+		Username: "ada",
+		Mode:     warp.DefaultUserMode,
+	}
+	granted := warp.DefaultUserMode | warp.ModeShellWrite
+
+	// The host grants write access to a client of the warp.
+	s := d.nextSession(t)
+	s.nextUpdate(t, any)
+	s.stateW.Encode(hostState(lurker))
+	ss := waitForUser(t, c, "lurker")
+	ss.SetMode("lurker", granted)
+	ss.QueueHostUpdate(ctx, true)
+	s.nextUpdate(t, func(u warp.HostUpdate) bool {
+		return u.Modes["lurker"] == granted
+	})
+
+	// warpd fails mid-session, the warp being gone.
+	s.errorW.Encode(warp.Error{
+		Code:    warp.ErrCodeInternal,
+		Message: "Failed by fake warpd.",
+	})
+
+	// The host hosts the warp again, the client getting its mode back once
+	// reconnected.
+	s = d.nextSession(t)
+	if s.hello.Type != warp.SsTpHost || s.hello.Warp != "goofy-dev" {
+		t.Fatalf("Rehost hello: got %+v", s.hello)
+	}
+	if update := s.nextUpdate(t, any); update.Warp != "goofy-dev" {
+		t.Errorf("Initial host update: got %+v", update)
+	}
+	s.stateW.Encode(hostState())
+	s.stateW.Encode(hostState(lurker))
+	s.nextUpdate(t, func(u warp.HostUpdate) bool {
+		return u.Modes["lurker"] == granted
+	})
+
+	select {
+	case err := <-c.errC:
+		t.Errorf("Unexpected error: %v", err)
+	default:
+	}
+}
+
+func TestReadOnlyEnforcedDropsInput(t *testing.T) {
+	for _, readOnly := range []bool{false, true} {
+		t.Setenv("TMPDIR", t.TempDir())
+		path := filepath.Join(t.TempDir(), "warpd.sock")
+		input := filepath.Join(t.TempDir(), "input")
+		d := startFakeHostWarpd(t, path, false)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		c := newHost(t, ctx, path)
+		c.readOnly = readOnly
+		c.panes = []*pane{startPaneCommand(t, "sh", "-c", "cat > "+input)}
+		go c.srv.Run(ctx)
+		go c.ConnLoop(ctx)
+
+		s := d.nextSession(t)
+		if update := s.nextUpdate(t, func(warp.HostUpdate) bool {
+			return true
+		}); update.ReadOnly != readOnly {
+			t.Errorf("Read-only %t: host update read-only: got %t",
+				readOnly, update.ReadOnly)
+		}
+		s.stateW.Encode(hostState(warp.User{
+			Token:    "lurker",
+			Username: "ada",
+			Mode:     warp.DefaultUserMode,
+		}))
+
+		ss := waitForUser(t, c, "lurker")
+
+		// The host authorizing the lurker to write is refused.
+		_, err := cli.RunWarpCommand(ctx, "goofy-dev", warp.Command{
+			Type: warp.CmdTpAuthorize,
+			Args: []string{"lurker"},
+		})
+		if readOnly && (err == nil || !strings.Contains(
+			err.Error(), "read_only",
+		)) {
+			t.Fatalf("Authorize on a read-only warp: got %v", err)
+		}
+		if !readOnly && err != nil {
+			t.Fatalf("Authorize: %v", err)
+		}
+
+		// Even if the lurker gets write access (as warpd or a bug could
+		// grant it), its input never reaches the pane of a read-only warp.
+		ss.SetMode("lurker", warp.DefaultUserMode|warp.ModeShellWrite)
+		if _, err := s.dataC.Write([]byte("echo pwned\n")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+		data, _ := ioutil.ReadFile(input)
+		if readOnly && len(data) > 0 {
+			t.Errorf("Input written to a read-only warp: %q", data)
+		}
+		if !readOnly && !strings.Contains(string(data), "echo pwned") {
+			t.Errorf("Input not written to the warp: %q", data)
+		}
+		cancel()
+	}
+}
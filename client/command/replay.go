@@ -0,0 +1,270 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/asciicast"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+	"github.com/spolu/warp/lib/plex"
+)
+
+const (
+	// CmdNmReplay is the command name.
+	CmdNmReplay cli.CmdName = "replay"
+)
+
+func init() {
+	cli.Registrar[CmdNmReplay] = NewReplay
+	cli.RegisterValueFlags(CmdNmReplay, "speed")
+}
+
+// replayPauseKey is the key pausing and resuming a replay (space).
+const replayPauseKey = ' '
+
+// replayStep is the maximum time waited at once between two events of a
+// replay, for pauses and quitting to take effect promptly.
+const replayStep = 50 * time.Millisecond
+
+// Replay plays back a recording of a warp (`warp open --record`, `warp
+// connect --record`) to the local terminal.
+type Replay struct {
+	path  string
+	speed float64
+
+	// resumeC is set while the replay is paused and closed when it resumes.
+	resumeC chan struct{}
+	mutex   *sync.Mutex
+}
+
+// NewReplay constructs and initializes the command.
+func NewReplay() cli.Command {
+	return &Replay{
+		speed: 1.0,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Name returns the command name.
+func (c *Replay) Name() cli.CmdName {
+	return CmdNmReplay
+}
+
+// Help prints out the help message for the command.
+func (c *Replay) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp replay [--speed=<multiplier>] <file>\n")
+	out.Normf("\n")
+	out.Normf("  Plays back a recording of a warp (`warp open --record` or `warp connect\n")
+	out.Normf("  --record`, asciicast v2 format) to your terminal with its original timing,\n")
+	out.Normf("  resizing your terminal to the size of the warp. It does not require warpd.\n")
+	out.Normf("\n")
+	out.Normf("  Press space to pause and resume the replay, q (or Ctrl-C) to quit.\n")
+	out.Normf("\n")
+	out.Normf("Arguments:\n")
+	out.Boldf("  file\n")
+	out.Normf("    The recording to play back.\n")
+	out.Valuf("    pairing.cast\n")
+	out.Normf("\n")
+	out.Normf("Flags:\n")
+	out.Boldf("  --speed=<multiplier>\n")
+	out.Normf("    Plays the recording faster (or slower if lower than 1).\n")
+	out.Valuf("    2 0.5\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp replay pairing.cast\n")
+	out.Valuf("  warp replay --speed=4 pairing.cast\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Replay) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if len(args) == 0 {
+		return errors.Trace(
+			errors.Newf("Recording file required."),
+		)
+	}
+	c.path = args[0]
+
+	if s, ok := flags["speed"]; ok {
+		speed, err := strconv.ParseFloat(s, 64)
+		if err != nil || speed <= 0 {
+			return errors.Trace(
+				errors.Newf("Invalid speed: %s", s),
+			)
+		}
+		c.speed = speed
+	}
+
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Replay) Execute(
+	ctx context.Context,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to open recording: %v", err),
+		)
+	}
+	defer f.Close()
+
+	r, err := asciicast.NewReader(f)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to read recording: %v", err),
+		)
+	}
+
+	stdin := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(stdin) {
+		return errors.Trace(
+			errors.Newf("Not running in a terminal."),
+		)
+	}
+
+	restore, err := cli.MakeRawTerminal(ctx, cancel, stdin)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Unable to put terminal in raw mode: %v", err),
+		)
+	}
+	// Restores the terminal once we're done.
+	defer func() {
+		restore()
+		// Let's attempt to clean things up with a newline.
+		fmt.Printf("\n")
+	}()
+
+	go func() {
+		defer cli.RecoverTerminal()
+		plex.Run(ctx, func(data []byte) {
+			for _, b := range data {
+				switch b {
+				case 'q', 0x03:
+					cancel()
+				case replayPauseKey:
+					c.togglePause()
+				}
+			}
+		}, os.Stdin)
+		cancel()
+	}()
+
+	header := r.Header()
+	c.resize(warp.Size{Rows: header.Height, Cols: header.Width})
+
+	last := 0.0
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to read recording: %v", err),
+			)
+		}
+
+		delay := time.Duration((ev.Time - last) / c.speed * float64(time.Second))
+		if ev.Time > last {
+			last = ev.Time
+		}
+		if !c.wait(ctx, delay) {
+			return nil
+		}
+
+		switch ev.Code {
+		case "o":
+			os.Stdout.Write([]byte(ev.Data))
+		case "r":
+			var size warp.Size
+			if _, err := fmt.Sscanf(
+				ev.Data, "%dx%d", &size.Cols, &size.Rows,
+			); err == nil {
+				c.resize(size)
+			}
+		}
+	}
+
+	os.Stdout.Write([]byte("\r\n[warp: end of the recording]"))
+	return nil
+}
+
+// resize attempts to resize the local terminal to the window size of the
+// recording.
+func (c *Replay) resize(
+	size warp.Size,
+) {
+	if size.Valid() {
+		fmt.Printf("\033[8;%d;%dt", size.Rows, size.Cols)
+	}
+}
+
+// togglePause pauses or resumes the replay.
+func (c *Replay) togglePause() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.resumeC == nil {
+		c.resumeC = make(chan struct{})
+	} else {
+		close(c.resumeC)
+		c.resumeC = nil
+	}
+}
+
+// wait waits for the specified duration of the replay, which doesn't elapse
+// while paused, returning false if the context was canceled meanwhile.
+func (c *Replay) wait(
+	ctx context.Context,
+	d time.Duration,
+) bool {
+	for {
+		c.mutex.Lock()
+		resumeC := c.resumeC
+		c.mutex.Unlock()
+		if resumeC != nil {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-resumeC:
+			}
+			continue
+		}
+		if d <= 0 {
+			break
+		}
+		step := d
+		if step > replayStep {
+			step = replayStep
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(step):
+			d -= step
+		}
+	}
+	return ctx.Err() == nil
+}
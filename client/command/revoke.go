@@ -16,11 +16,15 @@ const (
 
 func init() {
 	cli.Registrar[CmdNmRevoke] = NewRevoke
+	cli.RegisterValueFlags(CmdNmRevoke, "mode")
 }
 
 // Revoke authorizes write access to a warp client.
 type Revoke struct {
 	usernameOrToken string
+	mode            warp.Mode
+	kick            bool
+	all             bool
 }
 
 // NewRevoke constructs and initializes the command.
@@ -38,20 +42,34 @@ func (c *Revoke) Help(
 	ctx context.Context,
 ) {
 	out.Normf("\nUsage: ")
-	out.Boldf("warp revoke [<username_or_token>]\n")
+	out.Boldf("warp revoke [--mode=<mode>] [--kick] [--all] [<username_or_token>]\n")
 	out.Normf("\n")
-	out.Normf("  Revokes write access to a client of the current warp. If no argument is\n")
-	out.Normf("  provided, it revokes write access to all connected clients.\n")
+	out.Normf("  Revokes write access (or the specified mode) to a client of the current warp.\n")
+	out.Normf("  If no argument is provided, it revokes it to all connected clients.\n")
+	out.Normf("  Pending requests for the mode (`warp connect --write`) are declined.\n")
 	out.Normf("\n")
 	out.Normf("Arguments:\n")
 	out.Boldf("  username_or_token\n")
 	out.Normf("    The username or token of a connected user.\n")
 	out.Valuf("    guest_JpJP50EIas9cOfwo goofy\n")
 	out.Normf("\n")
+	out.Normf("Flags:\n")
+	out.Boldf("  --mode\n")
+	out.Normf("    The mode to revoke (defaults to `write`).\n")
+	out.Valuf("    write speak-read speak-write speak-muted\n")
+	out.Boldf("  --kick\n")
+	out.Normf("    Also disconnects the client, at once with the revocation. Requires a\n")
+	out.Normf("    username or token, or --all.\n")
+	out.Boldf("  --all\n")
+	out.Normf("    Targets all connected clients, whatever their mode.\n")
+	out.Normf("\n")
 	out.Normf("Examples:\n")
 	out.Valuf("  warp revoke\n")
 	out.Valuf("  warp revoke goofy\n")
 	out.Valuf("  warp revoke guest_JpJP50EIas9cOfwo\n")
+	out.Valuf("  warp revoke --mode=speak-write goofy\n")
+	out.Valuf("  warp revoke --kick goofy\n")
+	out.Valuf("  warp revoke --kick --all\n")
 	out.Normf("\n")
 }
 
@@ -65,6 +83,32 @@ func (c *Revoke) Parse(
 		c.usernameOrToken = args[0]
 	}
 
+	mode, err := parseModeFlag(flags)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.mode = mode
+
+	if _, ok := flags["kick"]; ok {
+		c.kick = true
+	}
+	if _, ok := flags["all"]; ok {
+		c.all = true
+	}
+	if c.all && c.usernameOrToken != "" {
+		return errors.Trace(
+			errors.Newf("The --all flag does not take a username or token."),
+		)
+	}
+	if c.kick && !c.all && c.usernameOrToken == "" {
+		return errors.Trace(
+			errors.Newf(
+				"Username or token required to kick (or --all to kick all " +
+					"connected clients).",
+			),
+		)
+	}
+
 	return nil
 }
 
@@ -85,16 +129,6 @@ func (c *Revoke) Execute(
 		return errors.Trace(err)
 	}
 
-	if result.Disconnected {
-		return errors.Trace(
-			errors.Newf(
-				"The warp is currently disconnected. No client has access to " +
-					"it and all previously authorized users will be revoked " +
-					"upon reconnection.",
-			),
-		)
-	}
-
 	args := []string{}
 	match := false
 	for _, user := range result.SessionState.Users {
@@ -104,7 +138,8 @@ func (c *Revoke) Execute(
 				match = true
 				args = append(args, user.Token)
 			}
-			if c.usernameOrToken == "" && user.Mode&warp.ModeShellWrite != 0 {
+			if c.usernameOrToken == "" && (c.all ||
+				(user.Mode|user.Requested)&c.mode != 0) {
 				match = true
 				args = append(args, user.Token)
 			}
@@ -124,12 +159,24 @@ func (c *Revoke) Execute(
 	result, err = cli.RunLocalCommand(ctx, warp.Command{
 		Type: warp.CmdTpRevoke,
 		Args: args,
+		Mode: c.mode,
+		Kick: c.kick,
 	})
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	PrintSessionState(ctx, result.Disconnected, result.SessionState)
+	if c.kick {
+		// The state is only updated once warpd disconnected the kicked
+		// users, which is not reflected by the result yet.
+		for _, user := range args {
+			delete(result.SessionState.Users, user)
+		}
+	}
+
+	PrintSessionState(
+		ctx, result.Disconnected, result.SessionState, result.Grants,
+	)
 
 	return nil
 }
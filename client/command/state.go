@@ -1,7 +1,15 @@
 package command
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
 
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/client"
@@ -20,6 +28,13 @@ func init() {
 
 // State retrieve the state of the current warp (in-warp only).
 type State struct {
+	watch bool
+	json  bool
+
+	// usersOnly, authorizedOnly and hostsOnly filter the users printed.
+	usersOnly      bool
+	authorizedOnly bool
+	hostsOnly      bool
 }
 
 // NewState constructs and initializes the command.
@@ -37,14 +52,30 @@ func (c *State) Help(
 	ctx context.Context,
 ) {
 	out.Normf("\nUsage: ")
-	out.Boldf("warp state\n")
+	out.Boldf("warp state [--watch] [--json] [--users-only] [--authorized-only] [--hosts-only]\n")
 	out.Normf("\n")
 	out.Normf("  Displays the state of the current warp, including the list of connected users\n")
 	out.Normf("  and their authorization state. This command is only available from inside a\n")
 	out.Normf("  warp.\n")
 	out.Normf("\n")
+	out.Normf("Flags:\n")
+	out.Boldf("  --watch\n")
+	out.Normf("    Keeps the state displayed, redrawing it each time it changes (users\n")
+	out.Normf("    joining or leaving, authorizations granted or revoked). Exit with Ctrl-C.\n")
+	out.Boldf("  --json\n")
+	out.Normf("    Prints the state as JSON, for scripts.\n")
+	out.Boldf("  --users-only\n")
+	out.Normf("    Only lists the clients of the warp (one per line).\n")
+	out.Boldf("  --authorized-only\n")
+	out.Normf("    Only lists the clients authorized to write to the warp.\n")
+	out.Boldf("  --hosts-only\n")
+	out.Normf("    Only lists the users hosting the warp.\n")
+	out.Normf("\n")
 	out.Normf("Examples:\n")
 	out.Valuf("  warp state\n")
+	out.Valuf("  warp state --watch\n")
+	out.Valuf("  warp state --authorized-only\n")
+	out.Valuf("  warp state --users-only --json | jq -r '.users[].token'\n")
 	out.Normf("\n")
 }
 
@@ -54,9 +85,42 @@ func (c *State) Parse(
 	args []string,
 	flags map[string]string,
 ) error {
+	if _, ok := flags["watch"]; ok {
+		c.watch = true
+	}
+	if _, ok := flags["json"]; ok {
+		c.json = true
+	}
+	if _, ok := flags["users-only"]; ok {
+		c.usersOnly = true
+	}
+	if _, ok := flags["authorized-only"]; ok {
+		c.authorizedOnly = true
+	}
+	if _, ok := flags["hosts-only"]; ok {
+		if c.usersOnly || c.authorizedOnly {
+			return errors.Trace(
+				errors.Newf(
+					"--hosts-only can't be combined with --users-only or " +
+						"--authorized-only.",
+				),
+			)
+		}
+		c.hostsOnly = true
+	}
+	if c.watch && (c.json || c.filtered()) {
+		return errors.Trace(
+			errors.Newf("--watch can't be combined with --json or filters."),
+		)
+	}
 	return nil
 }
 
+// filtered returns whether the users printed are filtered.
+func (c *State) filtered() bool {
+	return c.usersOnly || c.authorizedOnly || c.hostsOnly
+}
+
 // Execute the command or return a human-friendly error.
 func (c *State) Execute(
 	ctx context.Context,
@@ -66,32 +130,257 @@ func (c *State) Execute(
 		return errors.Trace(err)
 	}
 
+	if c.watch {
+		return c.Watch(ctx)
+	}
+
 	result, err := cli.RunLocalCommand(ctx, warp.Command{
 		Type: warp.CmdTpState,
 		Args: []string{},
 	})
 	if err != nil {
-		return errors.Trace(err)
+		// The state of a disconnected warp is displayed as such.
+		if _, ok := errors.Cause(err).(*cli.DisconnectedError); !ok {
+			return errors.Trace(err)
+		}
 	}
 
-	PrintSessionState(ctx, result.Disconnected, result.SessionState)
+	if c.json {
+		return c.PrintJSON(result)
+	}
+	if c.filtered() {
+		for _, u := range c.Users(result.SessionState) {
+			out.Normf("ID: ")
+			out.Valuf("%s", u.Token)
+			out.Normf(" Username: ")
+			out.Valuf("%s", u.Username)
+			out.Normf(" Mode: ")
+			out.Valuf("%s\n", u.Mode)
+		}
+		return nil
+	}
 
+	PrintSessionState(
+		ctx, result.Disconnected, result.SessionState, result.Grants,
+	)
+
+	return nil
+}
+
+// Users returns the users of the state matching the filters, sorted by token.
+func (c *State) Users(
+	state warp.State,
+) []warp.User {
+	users := []warp.User{}
+	for _, u := range state.Users {
+		switch {
+		case c.hostsOnly && !u.Hosting:
+		case (c.usersOnly || c.authorizedOnly) && u.Hosting:
+		case c.authorizedOnly && u.Mode&warp.ModeShellWrite == 0:
+		default:
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Token < users[j].Token
+	})
+	return users
+}
+
+// jsonState is the state printed with `--json`.
+type jsonState struct {
+	Warp         string     `json:"warp"`
+	Title        string     `json:"title,omitempty"`
+	Disconnected bool       `json:"disconnected"`
+	Users        []jsonUser `json:"users"`
+}
+
+// jsonUser is a user printed with `--json`.
+type jsonUser struct {
+	Token    string `json:"token"`
+	Username string `json:"username"`
+	Mode     string `json:"mode"`
+	Write    bool   `json:"write"`
+	Hosting  bool   `json:"hosting"`
+	// Requested is the mode requested by the user pending the host's
+	// decision, if any.
+	Requested string `json:"requested,omitempty"`
+}
+
+// PrintJSON prints the state of the warp as JSON, listing the users matching
+// the filters.
+func (c *State) PrintJSON(
+	result *warp.CommandResult,
+) error {
+	state := jsonState{
+		Warp:         result.SessionState.Warp,
+		Title:        warp.SanitizeTitle(result.SessionState.Title),
+		Disconnected: result.Disconnected,
+		Users:        []jsonUser{},
+	}
+	for _, u := range c.Users(result.SessionState) {
+		user := jsonUser{
+			Token:    u.Token,
+			Username: u.Username,
+			Mode:     u.Mode.String(),
+			Write:    u.Mode&warp.ModeShellWrite != 0,
+			Hosting:  u.Hosting,
+		}
+		if pending := u.Requested &^ u.Mode; pending != 0 {
+			user.Requested = warp.ModeName(pending)
+		}
+		state.Users = append(state.Users, user)
+	}
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Fprintf(os.Stdout, "%s\n", raw)
 	return nil
 }
 
+// watchRefresh is the interval at which the state is redrawn while watching
+// (in the absence of changes) to keep the expiration of grants up to date.
+const watchRefresh = time.Second
+
+// Watch subscribes to the state of the warp and redraws it in place each time
+// it changes, until interrupted or the warp is closed.
+func (c *State) Watch(
+	ctx context.Context,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resultC, err := cli.SubscribeLocal(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Exit cleanly on Ctrl-C.
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigC)
+
+	// Draw on the alternate screen with the cursor hidden, restoring the
+	// terminal on exit.
+	w := eraseWriter{os.Stdout}
+	fmt.Fprintf(w, "\033[?1049h\033[?25l")
+	out.SetWriter(w)
+	defer func() {
+		out.SetWriter(os.Stdout)
+		fmt.Fprintf(os.Stdout, "\033[?25h\033[?1049l")
+	}()
+
+	var last *warp.CommandResult
+	ticker := time.NewTicker(watchRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sigC:
+			return nil
+		case result, ok := <-resultC:
+			if !ok {
+				return errors.Trace(
+					errors.Newf("The warp was closed."),
+				)
+			}
+			last = result
+		case <-ticker.C:
+			if last == nil || len(last.Grants) == 0 {
+				continue
+			}
+		}
+		if last == nil {
+			continue
+		}
+
+		// Redraw over the previous render (each line is cleared to its end
+		// as it is written) rather than clearing the screen, to avoid
+		// flickering.
+		fmt.Fprintf(w, "\033[H")
+		PrintSessionState(
+			ctx, last.Disconnected, last.SessionState, last.Grants,
+		)
+		out.Normf("\n")
+		out.Normf("Watching for changes, press Ctrl-C to exit.\n")
+		fmt.Fprintf(w, "\033[J")
+	}
+}
+
+// eraseWriter writes to a file, clearing each line to its end before moving
+// to the next one.
+type eraseWriter struct {
+	*os.File
+}
+
+// Write implements io.Writer.
+func (w eraseWriter) Write(
+	data []byte,
+) (int, error) {
+	_, err := w.File.Write(
+		bytes.Replace(data, []byte("\n"), []byte("\033[K\n"), -1),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// PrintSessionState prints the state of a warp along with the time-limited
+// authorizations of its users. Usernames are printed in the color of their
+// user (see cli.UserColor), as in the legend of `warp connect --legend`, to
+// tell who is writing.
 func PrintSessionState(
 	ctx context.Context,
 	disconnected bool,
 	state warp.State,
+	grants []warp.Grant,
 ) {
 	out.Boldf("Warp:\n")
 	out.Normf("  ID: ")
 	out.Valuf("%s\n", state.Warp)
+	if state.Title != "" {
+		out.Normf("  Title: ")
+		out.Valuf("%s\n", warp.SanitizeTitle(state.Title))
+	}
+	if state.ReadOnly {
+		out.Normf("  Read-only: ")
+		out.Valuf("enforced by the host\n")
+	}
+	if warp.TermRegexp.MatchString(state.Term) {
+		out.Normf("  Term: ")
+		out.Valuf("%s\n", state.Term)
+	}
 	if !disconnected {
 		out.Normf("  Size: ")
 		out.Valuf(
 			"%dx%d\n", state.WindowSize.Cols, state.WindowSize.Rows,
 		)
+		if len(state.Panes) > 0 {
+			out.Normf("  Panes:")
+			for _, p := range state.Panes {
+				if p == state.Pane {
+					out.Boldf(" [%s]", p)
+				} else {
+					out.Valuf(" %s", p)
+				}
+			}
+			out.Normf("\n")
+		}
+		if state.MaxClients > 0 {
+			out.Normf("  Max clients: ")
+			out.Valuf("%d\n", state.MaxClients)
+		}
+	}
+	if legend := cli.Legend(state); !disconnected && len(legend) > 0 {
+		out.Normf("  Writing: ")
+		for i, e := range legend {
+			if i > 0 {
+				out.Normf(", ")
+			}
+			out.Colorf(e.Color, "%s", e.Username)
+		}
+		out.Normf("\n")
 	}
 	out.Normf("  Status: ")
 	if disconnected {
@@ -107,7 +396,9 @@ func PrintSessionState(
 			out.Normf("  ID: ")
 			out.Valuf("%s", u.Token)
 			out.Normf(" Username: ")
-			out.Valuf("%s", u.Username)
+			out.Colorf(cli.UserColor(u.Token), "%s", u.Username)
+			out.Normf(" Mode: ")
+			out.Valuf("%s", u.Mode)
 			out.Normf("\n")
 		}
 	}
@@ -122,12 +413,27 @@ func PrintSessionState(
 				out.Normf("  ID: ")
 				out.Valuf("%s", u.Token)
 				out.Normf(" Username: ")
-				out.Valuf("%s", u.Username)
-				out.Normf(" Authorized: ")
+				out.Colorf(cli.UserColor(u.Token), "%s", u.Username)
+				out.Normf(" Mode: ")
 				if u.Mode&warp.ModeShellWrite != 0 {
-					out.Errof("true")
+					out.Errof("%s", u.Mode)
 				} else {
-					out.Valuf("false")
+					out.Valuf("%s", u.Mode)
+				}
+				if state.SingleWriter && state.Writer == u.Token {
+					out.Normf(" (write token)")
+				}
+				if pending := u.Requested &^ u.Mode; pending != 0 {
+					out.Normf(" (")
+					out.Warnf("requests %s", warp.ModeName(pending))
+					out.Normf(")")
+				}
+				for _, g := range grants {
+					if g.User == u.Token {
+						out.Normf(" (%s expires in ", warp.ModeName(g.Mode))
+						out.Valuf("%s", time.Until(g.Expires).Round(time.Second))
+						out.Normf(")")
+					}
 				}
 				out.Normf("\n")
 			}
@@ -0,0 +1,357 @@
+package command
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"os/user"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+	"github.com/spolu/warp/lib/plex"
+	"github.com/spolu/warp/lib/token"
+)
+
+const (
+	// CmdNmWatch is the command name.
+	CmdNmWatch cli.CmdName = "watch"
+)
+
+func init() {
+	cli.Registrar[CmdNmWatch] = NewWatch
+	cli.RegisterValueFlags(CmdNmWatch, cli.TLSFlags...)
+}
+
+// watchRetryInterval is the interval at which the sessions to the warps being
+// watched are reestablished once lost.
+const watchRetryInterval = 2 * time.Second
+
+// Watch connects to multiple warps in read-only mode and renders them as
+// tiles of the local terminal.
+type Watch struct {
+	noTLS       bool
+	insecureTLS bool
+	tlsConfig   *tls.Config
+
+	// addresses are the addresses of the warpd serving each warp.
+	addresses   []string
+	warps       []string
+	credentials warp.Session
+	username    string
+
+	grid *cli.Grid
+}
+
+// NewWatch constructs and initializes the command.
+func NewWatch() cli.Command {
+	return &Watch{}
+}
+
+// Name returns the command name.
+func (c *Watch) Name() cli.CmdName {
+	return CmdNmWatch
+}
+
+// Help prints out the help message for the command.
+func (c *Watch) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp watch <id> [<id> ...]\n")
+	out.Normf("\n")
+	out.Normf("  Connects to multiple warps in read-only mode and displays them side by side,\n")
+	out.Normf("  each in a tile of your terminal showing the part of the warp around its\n")
+	out.Normf("  cursor. Warps that disconnect are reconnected to automatically, unless warpd\n")
+	out.Normf("  rejected you or the host kicked you out.\n")
+	out.Normf("\n")
+	out.Normf("  Press Tab (or Shift-Tab) to cycle the focus between the warps, 1-9 to focus\n")
+	out.Normf("  a warp, Enter to zoom the focused warp to your whole terminal (and back) and\n")
+	out.Normf("  q to quit.\n")
+	out.Normf("\n")
+	out.Normf("Arguments:\n")
+	out.Boldf("  id\n")
+	out.Normf("    The IDs of the warps to watch.\n")
+	out.Valuf("    DJc3hR0PoyFmQIIY goofy-dev\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp watch goofy-dev minnie-dev\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Watch) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if len(args) == 0 {
+		return errors.Trace(
+			errors.Newf("Warp ID required."),
+		)
+	}
+	resolver := cli.NewResolver()
+	seen := map[string]bool{}
+	for _, a := range args {
+		w, address, err := resolver.Resolve(ctx, a)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !warp.WarpRegexp.MatchString(w) {
+			return errors.Trace(
+				errors.Newf("Malformed warp ID: %s", w),
+			)
+		}
+		if !seen[w+"@"+address] {
+			seen[w+"@"+address] = true
+			c.warps = append(c.warps, w)
+			c.addresses = append(c.addresses, address)
+		}
+	}
+
+	if _, ok := flags["insecure_tls"]; ok ||
+		os.Getenv("WARPD_INSECURE_TLS") != "" {
+		c.insecureTLS = true
+	}
+	if _, ok := flags["no_tls"]; ok ||
+		os.Getenv("WARPD_NO_TLS") != "" {
+		c.noTLS = true
+	}
+	tlsConfig, err := cli.TLSConfig(flags, c.insecureTLS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.tlsConfig = tlsConfig
+
+	user, err := user.Current()
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to retrieve current user: %v.", err),
+		)
+	}
+	c.username = user.Username
+
+	config, err := cli.RetrieveOrGenerateConfig(ctx)
+	if cli.IsConfigAccess(err) {
+		return errors.Trace(err)
+	} else if err != nil {
+		return errors.Trace(
+			errors.Newf("Error retrieving or generating config: %v", err),
+		)
+	}
+	c.credentials = warp.Session{
+		User:   config.Credentials.User,
+		Secret: config.Credentials.Secret,
+	}
+
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Watch) Execute(
+	ctx context.Context,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stdin := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(stdin) {
+		return errors.Trace(
+			errors.Newf("Not running in a terminal."),
+		)
+	}
+	restore, err := cli.MakeRawTerminal(ctx, cancel, stdin)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Unable to put terminal in raw mode: %v", err),
+		)
+	}
+	// Restors the terminal once we're done.
+	defer restore()
+
+	c.grid = cli.NewGrid(c.warps, int(os.Stdout.Fd()), os.Stdout)
+	go c.grid.Run(ctx)
+	// Leave the grid before the terminal is restored.
+	defer c.grid.Close()
+
+	for i := range c.warps {
+		go func(i int) {
+			defer cli.RecoverTerminal()
+			c.WatchLoop(ctx, i)
+		}(i)
+	}
+
+	go func() {
+		defer cli.RecoverTerminal()
+		plex.Run(ctx, func(data []byte) {
+			if c.grid.Input(data) {
+				cancel()
+			}
+		}, os.Stdin)
+		cancel()
+	}()
+
+	<-ctx.Done()
+	return nil
+}
+
+// WatchLoop maintains a session to the i-th warp, following redirects and
+// reconnecting once the session is lost, until the context is canceled or
+// warpd rejects the session or kicks the viewer (see permanent). The host
+// closing the warp is waited for.
+func (c *Watch) WatchLoop(
+	ctx context.Context,
+	i int,
+) {
+	address := c.addresses[i]
+	hops := 0
+	for {
+		err := c.WatchSession(ctx, i, address)
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if r, ok := errors.Cause(err).(*cli.RedirectError); ok &&
+			hops < warp.MaxRedirects {
+			hops++
+			address = r.Address
+			continue
+		}
+		hops = 0
+		address = c.addresses[i]
+
+		status := "disconnected"
+		if cli.IsHostClosed(err) {
+			status = "waiting for host"
+		} else if permanent(err) {
+			// Rejected or kicked sessions must not reconnect (see
+			// cli.RejectedError), the tile is left with the reason.
+			c.grid.SetStatus(i, errors.Cause(err).Error())
+			return
+		}
+		c.grid.SetStatus(i, status)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryInterval):
+		}
+	}
+}
+
+// WatchSession establishes a session to the i-th warp at the specified
+// address and renders the warp in its tile until the session is lost. It
+// returns the error received from warpd if any.
+func (c *Watch) WatchSession(
+	ctx context.Context,
+	i int,
+	address string,
+) error {
+	conn, err := c.Dial(address)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+
+	// This ctx can be canceled by the session or its parent context.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	session := c.credentials
+	session.Token = token.New("session")
+	ss, err := cli.NewSession(
+		ctx,
+		session,
+		c.warps[i],
+		warp.SsTpShellClient,
+		c.username,
+		cli.SessionOptions{},
+		cancel,
+		conn,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Close and reclaims all session related state.
+	defer ss.TearDown()
+
+	// Listen for errors.
+	errC := ss.WatchError(ctx)
+
+	// Wait for a first state update from warpd.
+	st, err := ss.DecodeState(ctx)
+	if err != nil {
+		// Receive the error sent by warpd, if any.
+		ss.TearDown()
+		return <-errC
+	}
+	if err := ss.UpdateState(*st, false); err != nil {
+		return errors.Trace(err)
+	}
+	// Clear the tile, the data that follows redraws it.
+	c.grid.Write(i, []byte("\033[2J\033[H"))
+	c.grid.Resize(i, ss.WindowSize())
+	c.grid.SetStatus(i, "")
+
+	// Listen for state updates.
+	go func() {
+		defer cli.RecoverTerminal()
+		for {
+			st, err := ss.DecodeState(ctx)
+			if err != nil {
+				break
+			}
+			if err := ss.UpdateState(*st, false); err != nil {
+				break
+			}
+			c.grid.Resize(i, ss.WindowSize())
+		}
+		cancel()
+	}()
+
+	// Multiplex dataC to the tile.
+	go func() {
+		defer cli.RecoverTerminal()
+		ss.ReadData(ctx, func(data []byte) {
+			c.grid.Write(i, data)
+		}, nil)
+		cancel()
+	}()
+
+	<-ctx.Done()
+	ss.TearDown()
+
+	return <-errC
+}
+
+// Dial opens a connection to warpd at the specified address.
+func (c *Watch) Dial(
+	address string,
+) (net.Conn, error) {
+	network, address := warp.AddressNetwork(address)
+	if c.noTLS {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, errors.Trace(
+				errors.Newf("Connection to warpd failed: %v.", err),
+			)
+		}
+		return conn, nil
+	}
+
+	conn, err := tls.Dial(network, address, c.tlsConfig)
+	if err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Connection to warpd failed: %v.", err),
+		)
+	}
+	return conn, nil
+}
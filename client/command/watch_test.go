@@ -0,0 +1,142 @@
+package command
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/daemon"
+)
+
+// startWarpd runs a warpd listening on a Unix socket with the default
+// configuration, returning the path of the socket.
+func startWarpd(
+	t *testing.T,
+) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "warpd.sock")
+	config := daemon.DefaultConfig()
+	config.Listen = warp.UnixAddressPrefix + path
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	srv := daemon.NewSrv(
+		ctx, config, daemon.NewAuditLog(ioutil.Discard), nil, nil,
+	)
+	go srv.Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return path
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("warpd not listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchStopsOnceKicked(t *testing.T) {
+	path := startWarpd(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	hostSession := warp.Session{Token: "tok", User: "host", Secret: "sec"}
+	host, err := cli.NewSession(
+		ctx, hostSession, "goofy-dev", warp.SsTpHost, "stan",
+		cli.SessionOptions{}, cancel, conn,
+	)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	update := warp.HostUpdate{
+		Warp:       "goofy-dev",
+		From:       hostSession,
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+	}
+	if err := host.SendHostUpdate(ctx, update); err != nil {
+		t.Fatalf("SendHostUpdate: %v", err)
+	}
+
+	states := make(chan *warp.State)
+	go func() {
+		for {
+			st, err := host.DecodeState(ctx)
+			if err != nil {
+				close(states)
+				return
+			}
+			states <- st
+		}
+	}()
+	// hasWatcher waits for a state from warpd and returns whether the
+	// watcher is among the users of the warp.
+	hasWatcher := func() bool {
+		select {
+		case st, ok := <-states:
+			if !ok {
+				t.Fatalf("Host session closed")
+			}
+			_, ok = st.Users["ada"]
+			return ok
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No state received")
+		}
+		return false
+	}
+
+	c := NewWatch().(*Watch)
+	c.noTLS = true
+	c.addresses = []string{warp.UnixAddressPrefix + path}
+	c.warps = []string{"goofy-dev"}
+	c.credentials = warp.Session{Token: "tok", User: "ada", Secret: "sec"}
+	c.username = "ada"
+	c.grid = cli.NewGrid(c.warps, -1, ioutil.Discard)
+	done := make(chan struct{})
+	go func() {
+		c.WatchLoop(ctx, 0)
+		close(done)
+	}()
+	for !hasWatcher() {
+	}
+
+	update.Kicks = []warp.Kick{{User: "ada", Code: warp.ErrCodeKicked}}
+	if err := host.SendHostUpdate(ctx, update); err != nil {
+		t.Fatalf("SendHostUpdate: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * watchRetryInterval):
+		t.Fatalf("Kicked watcher still watching")
+	}
+	for hasWatcher() {
+	}
+	// The watcher would rejoin after watchRetryInterval.
+	deadline := time.After(watchRetryInterval + time.Second)
+	for {
+		select {
+		case st, ok := <-states:
+			if !ok {
+				t.Fatalf("Host session closed")
+			}
+			if _, ok := st.Users["ada"]; ok {
+				t.Fatalf("Kicked watcher rejoined the warp")
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
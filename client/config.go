@@ -3,9 +3,11 @@ package cli
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spolu/warp/lib/errors"
@@ -23,20 +25,75 @@ type Config struct {
 	Credentials Credentials `json:"credentials"`
 }
 
-// ConfigPath returns the crendentials path for the current environment.
+const (
+	// EnvConfigDir overrides the directory of the config (~/.warp).
+	EnvConfigDir = "WARP_CONFIG_DIR"
+	// EnvNoConfig, if set, makes warp use ephemeral credentials generated
+	// for the current run instead of reading or storing a config.
+	EnvNoConfig = "WARP_NO_CONFIG"
+)
+
+// ConfigAccessError is returned when the config can't be read or written for
+// lack of permissions (read-only home, restricted environment).
+type ConfigAccessError struct {
+	Path string
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *ConfigAccessError) Error() string {
+	return fmt.Sprintf(
+		"Unable to access the warp config at %s (%v). Set %s to a writable "+
+			"directory, or %s=1 to use temporary credentials for this run.",
+		e.Path, e.Err, EnvConfigDir, EnvNoConfig,
+	)
+}
+
+// IsConfigAccess returns whether err is a *ConfigAccessError.
+func IsConfigAccess(
+	err error,
+) bool {
+	_, ok := errors.Cause(err).(*ConfigAccessError)
+	return ok
+}
+
+// configAccessError returns a *ConfigAccessError for permission errors
+// encountered accessing path and err unchanged otherwise.
+func configAccessError(
+	path string,
+	err error,
+) error {
+	cause := err
+	if e, ok := err.(*os.PathError); ok {
+		cause = e.Err
+	}
+	if os.IsPermission(err) || cause == syscall.EROFS {
+		return &ConfigAccessError{
+			Path: path,
+			Err:  cause,
+		}
+	}
+	return err
+}
+
+// ConfigPath returns the crendentials path for the current environment:
+// `config.json` in $WARP_CONFIG_DIR if set, ~/.warp otherwise.
 func ConfigPath(
 	ctx context.Context,
 ) (*string, error) {
-	path, err := homedir.Expand(
-		"~/.warp/config.json",
-	)
+	dir := "~/.warp"
+	if os.Getenv(EnvConfigDir) != "" {
+		dir = os.Getenv(EnvConfigDir)
+	}
+	dir, err := homedir.Expand(dir)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	path := filepath.Join(dir, "config.json")
 
-	err = os.MkdirAll(filepath.Dir(path), 0777)
+	err = os.MkdirAll(dir, 0777)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, errors.Trace(configAccessError(path, err))
 	}
 
 	return &path, nil
@@ -57,7 +114,7 @@ func RetrieveConfig(
 
 	raw, err := ioutil.ReadFile(*path)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, errors.Trace(configAccessError(*path, err))
 	}
 
 	var c Config
@@ -69,17 +126,22 @@ func RetrieveConfig(
 	return &c, nil
 }
 
+// newConfig returns a new config with a new set of credentials.
+func newConfig() *Config {
+	return &Config{
+		Credentials: Credentials{
+			User:   token.NewReadable("guest"),
+			Secret: token.RandStr(),
+		},
+	}
+}
+
 // GenerateConfig generates a new config and store it. As part of it, it
 // generates a new set of credentials.
 func GenerateConfig(
 	ctx context.Context,
 ) (*Config, error) {
-	config := &Config{
-		Credentials: Credentials{
-			User:   token.New("guest"),
-			Secret: token.RandStr(),
-		},
-	}
+	config := newConfig()
 
 	path, err := ConfigPath(ctx)
 	if err != nil {
@@ -93,16 +155,29 @@ func GenerateConfig(
 
 	err = ioutil.WriteFile(*path, formatted, 0644)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, errors.Trace(configAccessError(*path, err))
 	}
 
 	return config, nil
 }
 
-// RetrieveOrGenerateConfig retrieves the current config or generates it.
+// ephemeralConfig is the config generated for the current run if
+// $WARP_NO_CONFIG is set.
+var ephemeralConfig *Config
+
+// RetrieveOrGenerateConfig retrieves the current config or generates it. If
+// $WARP_NO_CONFIG is set, the config is generated once for the current run
+// and never stored, users then appearing to warpd and hosts as a new guest
+// each time they run warp.
 func RetrieveOrGenerateConfig(
 	ctx context.Context,
 ) (*Config, error) {
+	if os.Getenv(EnvNoConfig) != "" {
+		if ephemeralConfig == nil {
+			ephemeralConfig = newConfig()
+		}
+		return ephemeralConfig, nil
+	}
 
 	config, err := RetrieveConfig(ctx)
 	if err != nil {
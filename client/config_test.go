@@ -0,0 +1,146 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// withConfigEnv sets up the config environment variables, with the home
+// directory in a temporary directory, and returns the home directory.
+func withConfigEnv(
+	t *testing.T,
+	dir string,
+	noConfig string,
+) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(EnvConfigDir, dir)
+	t.Setenv(EnvNoConfig, noConfig)
+	homedir.DisableCache = true
+	t.Cleanup(func() {
+		homedir.DisableCache = false
+		ephemeralConfig = nil
+	})
+	return home
+}
+
+func TestConfigPathDefault(t *testing.T) {
+	home := withConfigEnv(t, "", "")
+
+	path, err := ConfigPath(context.Background())
+	if err != nil {
+		t.Fatalf("ConfigPath: %v", err)
+	}
+	if want := filepath.Join(home, ".warp", "config.json"); *path != want {
+		t.Errorf("ConfigPath: got %s, want %s", *path, want)
+	}
+}
+
+func TestConfigDirOverride(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "warp")
+	home := withConfigEnv(t, dir, "")
+
+	config, err := RetrieveOrGenerateConfig(context.Background())
+	if err != nil {
+		t.Fatalf("RetrieveOrGenerateConfig: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "config.json")); err != nil {
+		t.Errorf("Config not stored in %s: %v", dir, err)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".warp")); !os.IsNotExist(err) {
+		t.Errorf("Config directory created in the home directory: %v", err)
+	}
+
+	// The credentials stored are retrieved by the next runs.
+	again, err := RetrieveOrGenerateConfig(context.Background())
+	if err != nil {
+		t.Fatalf("RetrieveOrGenerateConfig: %v", err)
+	}
+	if again.Credentials != config.Credentials {
+		t.Errorf("Credentials: got %+v, want %+v",
+			again.Credentials, config.Credentials)
+	}
+}
+
+func TestConfigDirOverrideExpandsHome(t *testing.T) {
+	home := withConfigEnv(t, "~/config/warp", "")
+
+	path, err := ConfigPath(context.Background())
+	if err != nil {
+		t.Fatalf("ConfigPath: %v", err)
+	}
+	if want := filepath.Join(home, "config", "warp", "config.json"); *path != want {
+		t.Errorf("ConfigPath: got %s, want %s", *path, want)
+	}
+}
+
+func TestConfigAccessError(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		access bool
+	}{
+		{&os.PathError{Op: "mkdir", Path: "/", Err: syscall.EACCES}, true},
+		{&os.PathError{Op: "open", Path: "/", Err: syscall.EPERM}, true},
+		{&os.PathError{Op: "mkdir", Path: "/", Err: syscall.EROFS}, true},
+		{&os.PathError{Op: "open", Path: "/", Err: syscall.ENOENT}, false},
+		{&os.PathError{Op: "mkdir", Path: "/", Err: syscall.ENOTDIR}, false},
+	} {
+		err := configAccessError("/home/stan/.warp/config.json", tc.err)
+		if got := IsConfigAccess(err); got != tc.access {
+			t.Errorf("%v: IsConfigAccess: got %t, want %t", tc.err, got, tc.access)
+		}
+	}
+}
+
+func TestUnwritableConfigDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Permissions are not enforced for root")
+	}
+	locked := t.TempDir()
+	if err := os.Chmod(locked, 0555); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	defer os.Chmod(locked, 0755)
+	withConfigEnv(t, filepath.Join(locked, "warp"), "")
+
+	_, err := RetrieveOrGenerateConfig(context.Background())
+	if !IsConfigAccess(err) {
+		t.Fatalf("RetrieveOrGenerateConfig: got %v, want a *ConfigAccessError", err)
+	}
+}
+
+func TestNoConfigEphemeralCredentials(t *testing.T) {
+	// The config directory can't be created, as in a read-only home.
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, []byte{}, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	home := withConfigEnv(t, filepath.Join(file, "warp"), "1")
+
+	config, err := RetrieveOrGenerateConfig(context.Background())
+	if err != nil {
+		t.Fatalf("RetrieveOrGenerateConfig: %v", err)
+	}
+	if config.Credentials.User == "" || config.Credentials.Secret == "" {
+		t.Errorf("Credentials not generated: %+v", config.Credentials)
+	}
+
+	// The credentials are kept for the run and never stored.
+	again, err := RetrieveOrGenerateConfig(context.Background())
+	if err != nil {
+		t.Fatalf("RetrieveOrGenerateConfig: %v", err)
+	}
+	if again.Credentials != config.Credentials {
+		t.Errorf("Credentials: got %+v, want %+v",
+			again.Credentials, config.Credentials)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".warp")); !os.IsNotExist(err) {
+		t.Errorf("Config directory created: %v", err)
+	}
+}
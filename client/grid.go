@@ -0,0 +1,326 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/screen"
+)
+
+// gridRenderInterval is the minimum delay between two renderings of the
+// grid, so that noisy warps don't flood the local terminal.
+const gridRenderInterval = 50 * time.Millisecond
+
+// Grid renders multiple warps as tiles in the alternate screen of the local
+// terminal (`warp watch`). The output of each warp is interpreted into a
+// screen model and each tile displays the part of it around its cursor,
+// centered if the warp is smaller than the tile. The focused tile can be
+// zoomed to fill the terminal. The last line of the local terminal is used
+// as a status line.
+type Grid struct {
+	tiles []*tile
+	fd    int
+	w     io.Writer
+
+	focus  int
+	zoomed bool
+	closed bool
+	// layout identifies the layout of the last rendering (see render).
+	layout string
+
+	dirtyC chan struct{}
+	mutex  *sync.Mutex
+}
+
+// tile is the state of a warp displayed by a Grid.
+type tile struct {
+	title  string
+	screen *screen.Screen
+	// status is displayed in the title bar of the tile, the size of the warp
+	// being displayed if empty.
+	status string
+}
+
+// NewGrid constructs a Grid for the specified warps. It renders to w, fd
+// being the file descriptor of the local terminal used to retrieve its size.
+func NewGrid(
+	titles []string,
+	fd int,
+	w io.Writer,
+) *Grid {
+	g := &Grid{
+		fd:     fd,
+		w:      w,
+		dirtyC: make(chan struct{}, 1),
+		mutex:  &sync.Mutex{},
+	}
+	for _, t := range titles {
+		g.tiles = append(g.tiles, &tile{
+			title:  t,
+			screen: screen.New(80, 24, 0),
+			status: "connecting",
+		})
+	}
+	return g
+}
+
+// Run enters the alternate screen of the local terminal and renders the grid
+// each time it changes (or the local terminal is resized) until the context
+// is canceled.
+func (g *Grid) Run(
+	ctx context.Context,
+) {
+	g.w.Write([]byte("\033[?1049h\033[?25l"))
+	g.render()
+
+	winchC := make(chan os.Signal, 1)
+	signal.Notify(winchC, syscall.SIGWINCH)
+	defer signal.Stop(winchC)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-winchC:
+		case <-g.dirtyC:
+		}
+		g.render()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(gridRenderInterval):
+		}
+	}
+}
+
+// Close leaves the alternate screen of the local terminal. The grid does not
+// render anymore once closed.
+func (g *Grid) Close() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if !g.closed {
+		g.closed = true
+		g.w.Write([]byte("\033[0m\033[?25h\033[?1049l"))
+	}
+}
+
+// Write feeds the output of the i-th warp to its tile.
+func (g *Grid) Write(
+	i int,
+	data []byte,
+) {
+	g.tiles[i].screen.Write(data)
+	g.dirty()
+}
+
+// Resize resizes the screen model of the i-th warp to its window size.
+func (g *Grid) Resize(
+	i int,
+	size warp.Size,
+) {
+	g.tiles[i].screen.Resize(size.Cols, size.Rows)
+	g.dirty()
+}
+
+// SetStatus sets the status displayed in the title bar of the i-th warp (""
+// once connected).
+func (g *Grid) SetStatus(
+	i int,
+	status string,
+) {
+	g.mutex.Lock()
+	g.tiles[i].status = status
+	g.mutex.Unlock()
+	g.dirty()
+}
+
+// Input handles the keys pressed by the viewer: Tab and Shift-Tab cycle the
+// focus, 1-9 focus a tile and Enter (or z) zooms the focused tile. It returns
+// true if the viewer asked to quit (q or Ctrl-C).
+func (g *Grid) Input(
+	data []byte,
+) bool {
+	g.mutex.Lock()
+	defer g.dirty()
+	defer g.mutex.Unlock()
+
+	n := len(g.tiles)
+	for len(data) > 0 {
+		switch {
+		case data[0] == 'q' || data[0] == 0x03:
+			return true
+		case bytes.HasPrefix(data, []byte("\x1b[Z")):
+			g.focus = (g.focus + n - 1) % n
+			data = data[3:]
+			continue
+		case data[0] == '\t':
+			g.focus = (g.focus + 1) % n
+		case data[0] >= '1' && data[0] <= '9' && int(data[0]-'1') < n:
+			g.focus = int(data[0] - '1')
+		case data[0] == '\r' || data[0] == 'z':
+			g.zoomed = !g.zoomed
+		}
+		data = data[1:]
+	}
+	return false
+}
+
+// dirty schedules a rendering of the grid.
+func (g *Grid) dirty() {
+	select {
+	case g.dirtyC <- struct{}{}:
+	default:
+	}
+}
+
+// terminalSize returns the size of the local terminal.
+func (g *Grid) terminalSize() (int, int) {
+	cols, rows, err := terminal.GetSize(g.fd)
+	if err != nil || cols <= 0 || rows <= 1 {
+		return 80, 24
+	}
+	return cols, rows
+}
+
+// render renders the tiles and the status line to the local terminal.
+func (g *Grid) render() {
+	cols, rows := g.terminalSize()
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.closed {
+		return
+	}
+
+	var buf bytes.Buffer
+	// Tiles only draw their own area, the terminal is cleared when the
+	// layout changes.
+	layout := fmt.Sprintf("%dx%d:%v", cols, rows, g.zoomed)
+	if layout != g.layout {
+		buf.WriteString("\033[0m\033[2J")
+		g.layout = layout
+	}
+
+	if g.zoomed {
+		g.renderTile(&buf, g.focus, 0, 0, cols, rows-1)
+	} else {
+		// Tiles are laid out in a grid as square as possible, separated by
+		// a column.
+		n := len(g.tiles)
+		gridCols := int(math.Ceil(math.Sqrt(float64(n))))
+		gridRows := (n + gridCols - 1) / gridCols
+		width := (cols - (gridCols - 1)) / gridCols
+		height := (rows - 1) / gridRows
+		for i := range g.tiles {
+			x := (i % gridCols) * (width + 1)
+			y := (i / gridCols) * height
+			g.renderTile(&buf, i, x, y, width, height)
+			if i%gridCols < gridCols-1 {
+				for r := y; r < y+height; r++ {
+					fmt.Fprintf(&buf, "\033[%d;%dH│", r+1, x+width+1)
+				}
+			}
+		}
+	}
+
+	status := fmt.Sprintf(" watching %d warps", len(g.tiles))
+	status += " | Tab/1-9 focus, Enter zoom, q quit"
+	if r := []rune(status); len(r) > cols {
+		status = string(r[:cols])
+	} else {
+		status += strings.Repeat(" ", cols-len(r))
+	}
+	fmt.Fprintf(&buf, "\033[%d;1H\033[0;7m%s\033[0m", rows, status)
+
+	g.w.Write(buf.Bytes())
+}
+
+// renderTile renders the i-th tile at the specified position (0-based) and
+// size: a title bar followed by the part of the screen of the warp around its
+// cursor, centered if the warp is smaller. The mutex must be held.
+func (g *Grid) renderTile(
+	buf *bytes.Buffer,
+	i int,
+	x int,
+	y int,
+	width int,
+	height int,
+) {
+	if width <= 0 || height <= 0 {
+		return
+	}
+	t := g.tiles[i]
+	screenCols, screenRows := t.screen.Size()
+	cursorX, cursorY, _ := t.screen.Cursor()
+
+	status := t.status
+	if status == "" {
+		status = fmt.Sprintf("%dx%d", screenCols, screenRows)
+	}
+	title := fmt.Sprintf(" %d %s: %s", i+1, t.title, status)
+	if r := []rune(title); len(r) > width {
+		title = string(r[:width])
+	} else {
+		title += strings.Repeat(" ", width-len(r))
+	}
+	attr := "1"
+	if i == g.focus {
+		attr = "7"
+	}
+	fmt.Fprintf(buf, "\033[%d;%dH\033[0;%sm%s\033[0m", y+1, x+1, attr, title)
+
+	height--
+	// Rows and columns of the screen displayed, following the cursor if the
+	// screen doesn't fit, and padding to center it otherwise.
+	rows, top := screenRows, 0
+	if rows > height {
+		rows = height
+		if cursorY >= rows {
+			top = cursorY - rows + 1
+		}
+	}
+	cols, left := screenCols, 0
+	if cols > width {
+		cols = width
+		if cursorX >= cols {
+			left = cursorX - cols + 1
+		}
+	}
+	padY := (height - rows) / 2
+	padX := (width - cols) / 2
+
+	// Each row of the tile is entirely drawn so that the grid is redrawn
+	// without clearing the terminal (which flickers).
+	lines := t.screen.View(screenRows-top-rows, rows)
+	for r := 0; r < height; r++ {
+		fmt.Fprintf(buf, "\033[%d;%dH", y+2+r, x+1)
+		drawn := 0
+		if l := r - padY; l >= 0 && l < len(lines) {
+			buf.WriteString(strings.Repeat(" ", padX))
+			drawn = padX
+			pen := ""
+			for c := left; c < left+cols && c < len(lines[l]); c++ {
+				if lines[l][c].Pen != pen {
+					fmt.Fprintf(buf, "\033[0;%sm", lines[l][c].Pen)
+					pen = lines[l][c].Pen
+				}
+				buf.WriteRune(lines[l][c].Rune)
+				drawn++
+			}
+			buf.WriteString("\033[0m")
+		}
+		buf.WriteString(strings.Repeat(" ", width-drawn))
+	}
+}
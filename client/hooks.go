@@ -0,0 +1,96 @@
+package cli
+
+import "github.com/spolu/warp"
+
+// Hooks are callbacks invoked on the lifecycle events of a session, for Go
+// programs using it to react to them without scraping the output of warp.
+// They are invoked from the goroutine triggering the event (the state loop
+// calling UpdateState for most of them) without the session lock held, so
+// that they can call back into the session, and should return promptly not to
+// hold the loop up. Nil hooks are skipped.
+type Hooks struct {
+	// OnConnect is invoked once the first state of the warp is applied.
+	OnConnect func()
+	// OnDisconnect is invoked once a connected session is torn down.
+	OnDisconnect func()
+	// OnClientJoin and OnClientLeave are invoked as clients of the warp
+	// (other than the user of the session) join and leave it.
+	OnClientJoin  func(user warp.User)
+	OnClientLeave func(user warp.User)
+	// OnAuthorize is invoked as a client is granted write access to the warp,
+	// by warpd as seen from a client or by SetMode while hosting.
+	OnAuthorize func(user warp.User)
+	// OnStateUpdate is invoked after each state of the warp is applied, with
+	// the resulting state.
+	OnStateUpdate func(state warp.State)
+}
+
+// SetHooks sets the hooks of the session, to be called before its state loop
+// is started for OnConnect to be invoked.
+func (ss *Session) SetHooks(
+	hooks Hooks,
+) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.hooks = hooks
+}
+
+// hookEvents returns the hooks to invoke for the changes to the clients of the
+// warp since the last call, along with OnConnect and OnStateUpdate if updated
+// is true (a state of the warp was applied). It must be called with the session
+// lock held, the hooks being invoked once it is released.
+func (ss *Session) hookEvents(
+	updated bool,
+) []func() {
+	h := ss.hooks
+	st := ss.state.ProtocolState()
+	events := []func(){}
+
+	if updated && !ss.connected {
+		ss.connected = true
+		if h.OnConnect != nil {
+			events = append(events, h.OnConnect)
+		}
+	}
+
+	clients := map[string]warp.User{}
+	for token, u := range st.Users {
+		if token == ss.session.User || u.Hosting {
+			continue
+		}
+		clients[token] = u
+	}
+	for token, u := range clients {
+		u := u
+		prev, known := ss.clients[token]
+		if !known && h.OnClientJoin != nil {
+			events = append(events, func() { h.OnClientJoin(u) })
+		}
+		granted := u.Mode&warp.ModeShellWrite != 0 &&
+			(!known || prev.Mode&warp.ModeShellWrite == 0)
+		if granted && h.OnAuthorize != nil {
+			events = append(events, func() { h.OnAuthorize(u) })
+		}
+	}
+	for token, u := range ss.clients {
+		u := u
+		if _, ok := clients[token]; !ok && h.OnClientLeave != nil {
+			events = append(events, func() { h.OnClientLeave(u) })
+		}
+	}
+	ss.clients = clients
+
+	if updated && h.OnStateUpdate != nil {
+		events = append(events, func() { h.OnStateUpdate(st) })
+	}
+	return events
+}
+
+// fire invokes hooks returned by hookEvents.
+func fire(
+	events []func(),
+) {
+	for _, e := range events {
+		e()
+	}
+}
@@ -0,0 +1,70 @@
+package cli_test
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/token"
+)
+
+// A join/leave logger connecting to a warp as a shell client and logging its
+// lifecycle events until the warp closes.
+func ExampleSession_SetHooks() {
+	conn, err := tls.Dial("tcp", warp.DefaultAddress, &tls.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ss, err := cli.NewSession(
+		ctx,
+		warp.Session{
+			Token:  token.New("session"),
+			User:   token.New("guest"),
+			Secret: token.RandStr(),
+		},
+		"goofy-dev",
+		warp.SsTpShellClient,
+		"logger",
+		cli.SessionOptions{Replay: warp.ReplayNone},
+		cancel,
+		conn,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ss.SetHooks(cli.Hooks{
+		OnConnect: func() {
+			log.Printf("Connected: clients=%d", ss.ClientCount())
+		},
+		OnDisconnect: func() {
+			log.Printf("Disconnected")
+		},
+		OnClientJoin: func(user warp.User) {
+			log.Printf("Joined: %s", user.Username)
+		},
+		OnClientLeave: func(user warp.User) {
+			log.Printf("Left: %s", user.Username)
+		},
+		OnAuthorize: func(user warp.User) {
+			log.Printf("Authorized: %s", user.Username)
+		},
+	})
+	defer ss.TearDown()
+
+	// The state loop, invoking the hooks.
+	for {
+		st, err := ss.DecodeState(ctx)
+		if err != nil {
+			return
+		}
+		if err := ss.UpdateState(*st, false); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
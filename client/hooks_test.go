@@ -0,0 +1,202 @@
+package cli
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/spolu/warp"
+)
+
+// hookRecorder records the lifecycle events of a session, calling back into
+// the session from each hook.
+type hookRecorder struct {
+	ss     *Session
+	events []string
+	mutex  sync.Mutex
+}
+
+func (r *hookRecorder) record(
+	format string,
+	args ...interface{},
+) {
+	// Deadlocks if the hooks are invoked with the session lock held.
+	r.ss.ClientCount()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *hookRecorder) hooks() Hooks {
+	return Hooks{
+		OnConnect:    func() { r.record("connect") },
+		OnDisconnect: func() { r.record("disconnect") },
+		OnClientJoin: func(u warp.User) { r.record("join %s", u.Username) },
+		OnClientLeave: func(u warp.User) {
+			r.record("leave %s", u.Username)
+		},
+		OnAuthorize: func(u warp.User) { r.record("authorize %s", u.Username) },
+		OnStateUpdate: func(st warp.State) {
+			r.record("state %d", len(st.Users))
+		},
+	}
+}
+
+// take returns the events recorded since the last call, sorted as the order
+// of the hooks invoked for different users is unspecified.
+func (r *hookRecorder) take() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	events := r.events
+	r.events = nil
+	sort.Strings(events)
+	return events
+}
+
+// newHookedSession returns a session of the user `host` hosting a warp, its
+// hooks recording to the returned recorder.
+func newHookedSession(
+	t *testing.T,
+) (*Session, *hookRecorder) {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	mux, err := yamux.Client(conn, nil)
+	if err != nil {
+		t.Fatalf("yamux.Client: %v", err)
+	}
+	hello := warp.SessionHello{
+		Warp:     "goofy-dev",
+		From:     warp.Session{Token: "tok", User: "host", Secret: "sec"},
+		Type:     warp.SsTpHost,
+		Username: "stan",
+	}
+	ss := &Session{
+		session:     hello.From,
+		warp:        hello.Warp,
+		sessionType: hello.Type,
+		username:    hello.Username,
+		state:       NewWarpState(hello),
+		mux:         mux,
+		cancel:      func() {},
+		mutex:       &sync.Mutex{},
+	}
+	r := &hookRecorder{ss: ss}
+	ss.SetHooks(r.hooks())
+	return ss, r
+}
+
+// within runs f, failing the test if it doesn't return in time (a hook
+// deadlocking on the session lock).
+func within(
+	t *testing.T,
+	f func(),
+) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Hooks deadlocked")
+	}
+}
+
+// expectEvents checks the events recorded since the last call.
+func expectEvents(
+	t *testing.T,
+	r *hookRecorder,
+	want ...string,
+) {
+	t.Helper()
+	sort.Strings(want)
+	got := r.take()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Events: got %q, want %q", got, want)
+	}
+}
+
+func TestHooksLifecycle(t *testing.T) {
+	ss, r := newHookedSession(t)
+	update := func(st warp.State) {
+		t.Helper()
+		within(t, func() {
+			if err := ss.UpdateState(st, true); err != nil {
+				t.Errorf("UpdateState: %v", err)
+			}
+		})
+	}
+
+	update(stateWith(hostUser()))
+	expectEvents(t, r, "connect", "state 1")
+
+	update(stateWith(hostUser(), lurker(warp.DefaultUserMode)))
+	expectEvents(t, r, "join ada", "state 2")
+
+	update(stateWith(hostUser(), lurker(warp.DefaultUserMode)))
+	expectEvents(t, r, "state 2")
+
+	within(t, func() {
+		if err := ss.SetMode(
+			"lurker", warp.DefaultUserMode|warp.ModeShellWrite,
+		); err != nil {
+			t.Errorf("SetMode: %v", err)
+		}
+	})
+	expectEvents(t, r, "authorize ada")
+
+	update(stateWith(hostUser()))
+	expectEvents(t, r, "leave ada", "state 1")
+
+	within(t, ss.TearDown)
+	within(t, ss.TearDown)
+	expectEvents(t, r, "disconnect")
+}
+
+func TestHooksRejectedUpdate(t *testing.T) {
+	ss, r := newHookedSession(t)
+	crafted := stateWith(
+		hostUser(), lurker(warp.DefaultUserMode|warp.ModeShellWrite),
+	)
+	within(t, func() {
+		if err := ss.UpdateState(crafted, true); err == nil {
+			t.Errorf("UpdateState accepted write granted to a new user")
+		}
+	})
+	expectEvents(t, r)
+
+	// Sessions torn down before connecting don't disconnect.
+	within(t, ss.TearDown)
+	expectEvents(t, r)
+}
+
+func TestHooksAuthorizedByWarpd(t *testing.T) {
+	ss, r := newHookedSession(t)
+	ss.state = NewWarpState(warp.SessionHello{
+		Warp:     "goofy-dev",
+		From:     warp.Session{Token: "tok", User: "other", Secret: "sec"},
+		Type:     warp.SsTpShellClient,
+		Username: "bob",
+	})
+	ss.session.User = "other"
+
+	within(t, func() {
+		ss.UpdateState(stateWith(hostUser(), lurker(warp.DefaultUserMode)), false)
+	})
+	// The host isn't a client of the warp.
+	expectEvents(t, r, "connect", "join ada", "state 2")
+
+	within(t, func() {
+		ss.UpdateState(stateWith(
+			hostUser(), lurker(warp.DefaultUserMode|warp.ModeShellWrite),
+		), false)
+	})
+	expectEvents(t, r, "authorize ada", "state 2")
+}
@@ -0,0 +1,68 @@
+package cli
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/spolu/warp"
+)
+
+// legendColors are the colors (SGR foreground parameters) assigned to the
+// users of a warp.
+var legendColors = []int{31, 32, 33, 34, 35, 36, 91, 92, 93, 94, 95, 96}
+
+// LegendEntry is a user writing to a warp along with its color.
+type LegendEntry struct {
+	Username string
+	Color    int
+}
+
+// UserColor returns the color (SGR foreground parameter) of a user of a warp.
+// Colors are derived from the user tokens so that all viewers see the same
+// color for a given user.
+func UserColor(
+	token string,
+) int {
+	h := fnv.New32a()
+	h.Write([]byte(token))
+	return legendColors[h.Sum32()%uint32(len(legendColors))]
+}
+
+// Legend returns the users currently writing to a warp (see
+// warp.State.Writing) along with their color (see UserColor).
+func Legend(
+	state warp.State,
+) []LegendEntry {
+	legend := []LegendEntry{}
+	for _, token := range state.Writing {
+		u, ok := state.Users[token]
+		if !ok {
+			continue
+		}
+		legend = append(legend, LegendEntry{
+			Username: warp.SanitizeTitle(u.Username),
+			Color:    UserColor(token),
+		})
+	}
+	return legend
+}
+
+// RenderLegend renders a legend as a colored block followed by the username
+// for each user, returning the text along with its width on screen. reset is
+// the SGR sequence restoring the attributes of the surrounding text after
+// each block.
+func RenderLegend(
+	legend []LegendEntry,
+	reset string,
+) (string, int) {
+	if len(legend) == 0 {
+		return "", 0
+	}
+	text := "writing:"
+	width := len(text)
+	for _, e := range legend {
+		text += fmt.Sprintf(" \033[27;%dm█%s %s", e.Color, reset, e.Username)
+		width += 3 + len([]rune(e.Username))
+	}
+	return text, width
+}
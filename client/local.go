@@ -4,32 +4,116 @@ import (
 	"context"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/lib/errors"
 	"github.com/spolu/warp/lib/out"
 )
 
+// HostNotRunningError is returned by in-warp commands when the `warp open`
+// process hosting the warp is not running anymore: its command server socket
+// is missing or stale.
+type HostNotRunningError struct {
+	Warp string
+}
+
+// Error implements the error interface.
+func (e *HostNotRunningError) Error() string {
+	return fmt.Sprintf(
+		"The process hosting warp %s is not running anymore (it exited or "+
+			"crashed). If this shell outlived it, exit it and open a new "+
+			"warp with `warp open`.",
+		e.Warp,
+	)
+}
+
+// DisconnectedError is returned by in-warp commands when the process hosting
+// the warp is running but currently disconnected from warpd (while it
+// reconnects).
+type DisconnectedError struct {
+	Warp string
+}
+
+// Error implements the error interface.
+func (e *DisconnectedError) Error() string {
+	return fmt.Sprintf(
+		"Warp %s is currently disconnected from warpd. No client has access "+
+			"to it and all previously authorized users will be revoked upon "+
+			"reconnection. Retry once reconnected (see `warp state`).",
+		e.Warp,
+	)
+}
+
+// dialLocal connects to the command server of the current warp, returning a
+// *HostNotRunningError if no process is serving it.
+func dialLocal(
+	ctx context.Context,
+) (net.Conn, error) {
+	return dialWarp(ctx, os.Getenv(warp.EnvWarp))
+}
+
+// dialWarp connects to the command server of a warp open on this machine,
+// returning a *HostNotRunningError if no process is serving it.
+func dialWarp(
+	ctx context.Context,
+	w string,
+) (net.Conn, error) {
+	conn, err := net.Dial("unix", SocketPath(w))
+	if err != nil {
+		if hostGone(err) {
+			return nil, errors.Trace(&HostNotRunningError{Warp: w})
+		}
+		return nil, errors.Trace(
+			errors.Newf("Failed to connect to warp %s: %v", w, err),
+		)
+	}
+	return conn, nil
+}
+
+// hostGone returns whether the error returned when dialing a command server
+// indicates that its socket is missing or that no process listens on it.
+func hostGone(
+	err error,
+) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.ENOENT ||
+				sysErr.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
+
 // RunLocalCommand runs a local in-warp command and returns the result. If an
 // error is returned as part of the result, it formats a human readable error
-// that can be safely returned top the user.
+// that can be safely returned top the user. It returns a *HostNotRunningError
+// if the process hosting the warp is not running and a *DisconnectedError if
+// the warp is disconnected from warpd, in which case the result is returned
+// along with the error so that the state of the warp can still be displayed.
 func RunLocalCommand(
 	ctx context.Context,
 	cmd warp.Command,
 ) (*warp.CommandResult, error) {
-	p := path.Join(
-		os.TempDir(),
-		fmt.Sprintf("_warp_%s.sock", os.Getenv(warp.EnvWarp)),
-	)
+	return RunWarpCommand(ctx, os.Getenv(warp.EnvWarp), cmd)
+}
 
-	conn, err := net.Dial("unix", p)
+// RunWarpCommand runs a local command against a warp open on this machine,
+// designated by its ID, and returns the result as RunLocalCommand does.
+func RunWarpCommand(
+	ctx context.Context,
+	w string,
+	cmd warp.Command,
+) (*warp.CommandResult, error) {
+	conn, err := dialWarp(ctx, w)
 	if err != nil {
-		return nil, errors.Trace(
-			errors.Newf("Failed to connect to warpd: %v", err),
-		)
+		return nil, errors.Trace(err)
 	}
 	defer conn.Close()
 
@@ -45,9 +129,18 @@ func RunLocalCommand(
 	// Waiting for command result.
 	var result warp.CommandResult
 	if err := commandR.Decode(&result); err != nil {
+		if err == io.EOF {
+			// The host process exited while handling the command.
+			return nil, errors.Trace(&HostNotRunningError{Warp: w})
+		}
 		return nil, errors.Trace(err)
 	}
 
+	if result.Error.Code == errCodeDisconnected {
+		// The command requires the warp to be connected to warpd.
+		return &result, errors.Trace(&DisconnectedError{Warp: w})
+	}
+
 	if result.Error.Code != "" {
 		return nil, errors.Newf(
 			"Received %s: %s",
@@ -56,9 +149,64 @@ func RunLocalCommand(
 		)
 	}
 
+	if result.Disconnected {
+		return &result, errors.Trace(
+			&DisconnectedError{Warp: result.SessionState.Warp},
+		)
+	}
+
 	return &result, nil
 }
 
+// SubscribeLocal subscribes to the state of the current warp, sending a
+// result on the returned channel each time it changes. The channel is closed
+// once the subscription ends (the context is canceled or the warp closed).
+func SubscribeLocal(
+	ctx context.Context,
+) (chan *warp.CommandResult, error) {
+	conn, err := dialLocal(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	commandR := gob.NewDecoder(conn)
+	commandW := gob.NewEncoder(conn)
+
+	if err := commandW.Encode(warp.Command{
+		Type: warp.CmdTpSubscribe,
+		Args: []string{},
+	}); err != nil {
+		conn.Close()
+		return nil, errors.Trace(
+			errors.Newf("Failed to send command: %v", err),
+		)
+	}
+
+	// Closing the connection unblocks the decoding loop.
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	resultC := make(chan *warp.CommandResult)
+	go func() {
+		defer close(resultC)
+		for {
+			var result warp.CommandResult
+			if err := commandR.Decode(&result); err != nil {
+				return
+			}
+			select {
+			case resultC <- &result:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return resultC, nil
+}
+
 // CheckWarpEnv checks that the warp.EnvWarp env variable is set. If not it
 // returns an error after displaying an helpful message.
 func CheckEnvWarp(
@@ -74,11 +222,46 @@ func CheckEnvWarp(
 	out.Normf("\n")
 	out.Normf("Expert only: if you connected to a pre-existing tmux or screen session from\n")
 	out.Normf("your current warp, `%s` will not be propagated automatically. You can fix\n", warp.EnvWarp)
-	out.Normf("this by setting `%s` to the ID of your current warp in your environment\n", warp.EnvWarp)
-	out.Normf("(running `export __WARP=<id>`).\n")
+	out.Normf("this by running `eval \"$(warp env <id>)\"` with the ID of your current warp,\n")
+	out.Normf("or have tmux propagate it by opening your warps with `warp open --tmux`.\n")
 	out.Normf("\n")
 
 	return errors.Trace(
 		errors.Newf("This command is only available from inside a warp."),
 	)
 }
+
+// SocketWarps returns the IDs of the warps with a local command server socket
+// on this machine, whether the process hosting them is still running or not
+// (see LocalWarps).
+func SocketWarps(
+	ctx context.Context,
+) []string {
+	paths, _ := filepath.Glob(path.Join(os.TempDir(), "_warp_*.sock"))
+	warps := []string{}
+	for _, p := range paths {
+		w := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), "_warp_"), ".sock")
+		if strings.HasSuffix(w, ".attach") || !warp.WarpRegexp.MatchString(w) {
+			continue
+		}
+		warps = append(warps, w)
+	}
+	return warps
+}
+
+// LocalWarps returns the IDs of the warps currently open on this machine (as
+// detected by their local command server socket).
+func LocalWarps(
+	ctx context.Context,
+) []string {
+	warps := []string{}
+	for _, w := range SocketWarps(ctx) {
+		conn, err := net.Dial("unix", SocketPath(w))
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		warps = append(warps, w)
+	}
+	return warps
+}
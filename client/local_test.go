@@ -0,0 +1,144 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+)
+
+// inWarp sets up the environment of a shell running inside warp `w`, with the
+// command server sockets created in a temporary directory.
+func inWarp(
+	t *testing.T,
+	w string,
+) {
+	t.Helper()
+	t.Setenv("TMPDIR", t.TempDir())
+	t.Setenv(warp.EnvWarp, w)
+}
+
+// stateCommand is the command run by `warp state`.
+var stateCommand = warp.Command{Type: warp.CmdTpState, Args: []string{}}
+
+// assertHostNotRunning checks that err is a *HostNotRunningError for warp w.
+func assertHostNotRunning(
+	t *testing.T,
+	err error,
+	w string,
+) {
+	t.Helper()
+	e, ok := errors.Cause(err).(*HostNotRunningError)
+	if !ok {
+		t.Fatalf("Error: got %v, want a *HostNotRunningError", err)
+	}
+	if e.Warp != w {
+		t.Errorf("Error warp: got %q, want %q", e.Warp, w)
+	}
+}
+
+func TestRunLocalCommandMissingSocket(t *testing.T) {
+	inWarp(t, "goofy-dev")
+
+	_, err := RunLocalCommand(context.Background(), stateCommand)
+	assertHostNotRunning(t, err, "goofy-dev")
+}
+
+func TestRunLocalCommandStaleSocket(t *testing.T) {
+	inWarp(t, "goofy-dev")
+
+	// The socket left behind by a host process that crashed.
+	ln, err := net.Listen("unix", SocketPath("goofy-dev"))
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if _, err := os.Stat(SocketPath("goofy-dev")); err != nil {
+		t.Fatalf("Stale socket: %v", err)
+	}
+
+	_, err = RunLocalCommand(context.Background(), stateCommand)
+	assertHostNotRunning(t, err, "goofy-dev")
+}
+
+func TestRunLocalCommandHostExits(t *testing.T) {
+	inWarp(t, "goofy-dev")
+
+	ln, err := net.Listen("unix", SocketPath("goofy-dev"))
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		// The host process exits before sending the result.
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Read(make([]byte, 1024))
+		conn.Close()
+	}()
+
+	_, err = RunLocalCommand(context.Background(), stateCommand)
+	assertHostNotRunning(t, err, "goofy-dev")
+}
+
+func TestRunLocalCommandDisconnected(t *testing.T) {
+	inWarp(t, "goofy-dev")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A host process that never connected to warpd (or is reconnecting).
+	srv := NewSrv(ctx, "goofy-dev")
+	errC := make(chan error, 1)
+	go func() {
+		errC <- srv.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-errC; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	}()
+
+	for _, cmd := range []warp.Command{
+		stateCommand,
+		{Type: warp.CmdTpAuthorize, Args: []string{"ada"}},
+		{Type: warp.CmdTpRevoke, Args: []string{"ada"}},
+	} {
+		result, err := dialRetry(t, ctx, cmd)
+		e, ok := errors.Cause(err).(*DisconnectedError)
+		if !ok {
+			t.Fatalf("%s: got %v, want a *DisconnectedError", cmd.Type, err)
+		}
+		if e.Warp != "goofy-dev" {
+			t.Errorf("%s: error warp: got %q, want goofy-dev", cmd.Type, e.Warp)
+		}
+		if result == nil || !result.Disconnected {
+			t.Errorf("%s: result not returned along the error", cmd.Type)
+		}
+	}
+}
+
+// dialRetry runs a local command, retrying while the command server is not
+// listening yet.
+func dialRetry(
+	t *testing.T,
+	ctx context.Context,
+	cmd warp.Command,
+) (*warp.CommandResult, error) {
+	t.Helper()
+	for i := 0; ; i++ {
+		result, err := RunLocalCommand(ctx, cmd)
+		if _, ok := errors.Cause(err).(*HostNotRunningError); !ok || i == 100 {
+			return result, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
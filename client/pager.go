@@ -0,0 +1,359 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/screen"
+)
+
+// pagerRenderInterval is the minimum delay between two renderings of the
+// pager, so that a noisy warp doesn't flood the local terminal.
+const pagerRenderInterval = 30 * time.Millisecond
+
+// pagerKeys maps the keys understood by the pager to the number of lines they
+// scroll up by. pageUp, pageDown, top and bottom are resolved when scrolling.
+var pagerKeys = []struct {
+	key    string
+	scroll int
+}{
+	{"\x1b[A", 1}, {"\x1bOA", 1}, {"k", 1},
+	{"\x1b[B", -1}, {"\x1bOB", -1}, {"j", -1},
+	{"\x1b[5~", pageUp}, {"b", pageUp}, {"\x02", pageUp},
+	{"\x1b[6~", pageDown}, {" ", pageDown}, {"\x06", pageDown},
+	{"\x1b[H", top}, {"\x1b[1~", top}, {"\x1bOH", top}, {"g", top},
+	{"\x1b[F", bottom}, {"\x1b[4~", bottom}, {"\x1bOF", bottom}, {"G", bottom},
+}
+
+const (
+	pageUp   = 1 << 20
+	pageDown = -(1 << 20)
+	top      = 1 << 30
+	bottom   = -(1 << 30)
+)
+
+// Pager renders the output of a warp as a scrollable view in the alternate
+// screen of the local terminal instead of streaming it raw (`warp connect
+// --scrollback`). The output is interpreted into a screen model keeping the
+// lines scrolled off the top of the warp, so that the viewer can scroll back
+// while new output arrives. The last line of the local terminal is used as a
+// status line.
+type Pager struct {
+	title  string
+	screen *screen.Screen
+	fd     int
+	w      io.Writer
+
+	// offset is the number of lines the view is scrolled up by (0 follows
+	// the output).
+	offset int
+	notice string
+	// host is the status of the host and of the connection to warpd (see
+	// SetHost).
+	host   string
+	legend []LegendEntry
+	stats  string
+	closed bool
+
+	dirtyC chan struct{}
+	mutex  *sync.Mutex
+}
+
+// NewPager constructs a Pager for a warp of the specified size, keeping up to
+// scrollback lines. It renders to w, fd being the file descriptor of the local
+// terminal used to retrieve its size.
+func NewPager(
+	title string,
+	size warp.Size,
+	scrollback int,
+	fd int,
+	w io.Writer,
+) *Pager {
+	return &Pager{
+		title:  title,
+		screen: screen.New(size.Cols, size.Rows, scrollback),
+		fd:     fd,
+		w:      w,
+		dirtyC: make(chan struct{}, 1),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// Run enters the alternate screen of the local terminal and renders the view
+// each time it changes (or the local terminal is resized) until the context
+// is canceled.
+func (p *Pager) Run(
+	ctx context.Context,
+) {
+	p.w.Write([]byte("\033[?1049h"))
+	p.render()
+
+	winchC := make(chan os.Signal, 1)
+	signal.Notify(winchC, syscall.SIGWINCH)
+	defer signal.Stop(winchC)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-winchC:
+		case <-p.dirtyC:
+		}
+		p.render()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pagerRenderInterval):
+		}
+	}
+}
+
+// Close leaves the alternate screen of the local terminal. The pager does
+// not render anymore once closed.
+func (p *Pager) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.closed {
+		p.closed = true
+		p.w.Write([]byte("\033[0m\033[?25h\033[?1049l"))
+	}
+}
+
+// Write feeds the output of the warp to the pager. The view keeps its
+// position if it is scrolled up.
+func (p *Pager) Write(
+	data []byte,
+) {
+	pushed := p.screen.Write(data)
+	p.mutex.Lock()
+	if p.offset > 0 {
+		p.offset += pushed
+		p.clamp()
+	}
+	p.mutex.Unlock()
+	p.dirty()
+}
+
+// Resize resizes the screen model to the window size of the warp.
+func (p *Pager) Resize(
+	size warp.Size,
+) {
+	p.screen.Resize(size.Cols, size.Rows)
+	p.mutex.Lock()
+	p.clamp()
+	p.mutex.Unlock()
+	p.dirty()
+}
+
+// SetNotice sets the notice displayed in the status line ("" to remove it).
+func (p *Pager) SetNotice(
+	notice string,
+) {
+	p.mutex.Lock()
+	p.notice = notice
+	p.mutex.Unlock()
+	p.dirty()
+}
+
+// SetHost sets the status of the host displayed in the status line, such as
+// how long it has been idle ("" to remove it).
+func (p *Pager) SetHost(
+	host string,
+) {
+	p.mutex.Lock()
+	p.host = host
+	p.mutex.Unlock()
+	p.dirty()
+}
+
+// SetStats sets the latency stats displayed in the status line ("" to remove
+// them).
+func (p *Pager) SetStats(
+	stats string,
+) {
+	p.mutex.Lock()
+	p.stats = stats
+	p.mutex.Unlock()
+	p.dirty()
+}
+
+// SetLegend sets the legend of the users writing to the warp displayed in the
+// status line.
+func (p *Pager) SetLegend(
+	legend []LegendEntry,
+) {
+	p.mutex.Lock()
+	p.legend = legend
+	p.mutex.Unlock()
+	p.dirty()
+}
+
+// Input handles the keys pressed by the viewer, scrolling the view. It
+// returns true if the viewer asked to quit (q or Ctrl-C).
+func (p *Pager) Input(
+	data []byte,
+) bool {
+	_, rows := p.terminalSize()
+	page := rows - 2
+	if page < 1 {
+		page = 1
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for len(data) > 0 {
+		if data[0] == 'q' || data[0] == 0x03 {
+			return true
+		}
+		matched := false
+		for _, k := range pagerKeys {
+			if !bytes.HasPrefix(data, []byte(k.key)) {
+				continue
+			}
+			switch k.scroll {
+			case pageUp:
+				p.offset += page
+			case pageDown:
+				p.offset -= page
+			case top:
+				_, screenRows := p.screen.Size()
+				p.offset = p.screen.Scrollback() + screenRows
+			case bottom:
+				p.offset = 0
+			default:
+				p.offset += k.scroll
+			}
+			data = data[len(k.key):]
+			matched = true
+			break
+		}
+		if !matched {
+			data = data[1:]
+		}
+	}
+	p.clamp()
+	p.dirty()
+	return false
+}
+
+// clamp keeps the offset within the lines available. The mutex must be held.
+func (p *Pager) clamp() {
+	_, rows := p.terminalSize()
+	_, screenRows := p.screen.Size()
+	max := p.screen.Scrollback() + screenRows - (rows - 1)
+	if p.offset > max {
+		p.offset = max
+	}
+	if p.offset < 0 {
+		p.offset = 0
+	}
+}
+
+// dirty schedules a rendering of the view.
+func (p *Pager) dirty() {
+	select {
+	case p.dirtyC <- struct{}{}:
+	default:
+	}
+}
+
+// terminalSize returns the size of the local terminal.
+func (p *Pager) terminalSize() (int, int) {
+	cols, rows, err := terminal.GetSize(p.fd)
+	if err != nil || cols <= 0 || rows <= 1 {
+		return 80, 24
+	}
+	return cols, rows
+}
+
+// render renders the view and the status line to the local terminal.
+func (p *Pager) render() {
+	cols, rows := p.terminalSize()
+	viewRows := rows - 1
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return
+	}
+
+	lines := p.screen.View(p.offset, viewRows)
+
+	var buf bytes.Buffer
+	buf.WriteString("\033[?25l")
+	for i := 0; i < viewRows; i++ {
+		fmt.Fprintf(&buf, "\033[%d;1H", i+1)
+		if i < len(lines) {
+			pen := ""
+			for x, c := range lines[i] {
+				if x >= cols {
+					break
+				}
+				if c.Pen != pen {
+					fmt.Fprintf(&buf, "\033[0;%sm", c.Pen)
+					pen = c.Pen
+				}
+				buf.WriteRune(c.Rune)
+			}
+		}
+		buf.WriteString("\033[0m\033[K")
+	}
+
+	status := fmt.Sprintf(" warp %s: following output", p.title)
+	if p.offset > 0 {
+		status = fmt.Sprintf(
+			" warp %s: scrolled up %d lines (End to follow)", p.title, p.offset,
+		)
+	}
+	if p.notice != "" {
+		status += " | " + p.notice
+	}
+	if p.host != "" {
+		status += " | " + p.host
+	}
+	status += " | arrows/PgUp/PgDn scroll, q quit"
+	// The legend of the users writing and the latency stats are
+	// right-aligned, if they fit.
+	legend, width := RenderLegend(p.legend, "\033[0;7m")
+	if p.stats != "" {
+		if width > 0 {
+			legend += " |"
+			width += 2
+		}
+		legend += " " + p.stats
+		width += 1 + len([]rune(p.stats))
+	}
+	if width+1 > cols {
+		legend, width = "", 0
+	} else if width > 0 {
+		legend += " "
+		width++
+	}
+	if r := []rune(status); len(r) > cols-width {
+		status = string(r[:cols-width])
+	} else {
+		status += strings.Repeat(" ", cols-width-len(r))
+	}
+	fmt.Fprintf(&buf, "\033[%d;1H\033[0;7m%s%s\033[0m", rows, status, legend)
+
+	// Show the cursor of the warp when following its output.
+	x, y, visible := p.screen.Cursor()
+	_, screenRows := p.screen.Size()
+	if row := len(lines) - screenRows + y; p.offset == 0 && visible &&
+		row >= 0 && row < viewRows && x < cols {
+		fmt.Fprintf(&buf, "\033[%d;%dH\033[?25h", row+1, x+1)
+	}
+
+	p.w.Write(buf.Bytes())
+}
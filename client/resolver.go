@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+)
+
+// Resolver determines the address of the warpd serving a warp before it is
+// dialed. Warps are designated by their ID or as `<id>@<node>`, in which case
+// the node selects the warpd among the ones the resolver knows about.
+type Resolver interface {
+	// Resolve returns the ID of the designated warp and the address of the
+	// warpd serving it.
+	Resolve(
+		ctx context.Context,
+		designation string,
+	) (string, string, error)
+}
+
+// NewResolver returns the resolver configured by the environment: an
+// SRVResolver if `WARPD_SRV_DOMAIN` is set and a StaticResolver otherwise,
+// using `WARPD_ADDRESS` (or warp.DefaultAddress) as default address.
+func NewResolver() Resolver {
+	if domain := os.Getenv("WARPD_SRV_DOMAIN"); domain != "" {
+		return &SRVResolver{
+			Domain: domain,
+		}
+	}
+	address := warp.DefaultAddress
+	if os.Getenv("WARPD_ADDRESS") != "" {
+		address = os.Getenv("WARPD_ADDRESS")
+	}
+	return &StaticResolver{
+		Address: address,
+	}
+}
+
+// splitDesignation splits a warp designation into its ID and node (empty if
+// none is specified).
+func splitDesignation(
+	designation string,
+) (string, string, error) {
+	i := strings.LastIndex(designation, "@")
+	if i == -1 {
+		return designation, "", nil
+	}
+	id, node := designation[:i], designation[i+1:]
+	if id == "" || node == "" {
+		return "", "", errors.Trace(
+			errors.Newf("Malformed warp designation: %s", designation),
+		)
+	}
+	return id, node, nil
+}
+
+// StaticResolver resolves all warps to the same address, except warps
+// designated as `<id>@<node>`, resolved to the node itself (a host, the port
+// of the default address being used if the node doesn't specify one). This is
+// the behavior of warp in the absence of other resolver.
+type StaticResolver struct {
+	Address string
+}
+
+// Resolve implements Resolver.
+func (r *StaticResolver) Resolve(
+	ctx context.Context,
+	designation string,
+) (string, string, error) {
+	id, node, err := splitDesignation(designation)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+	if node == "" {
+		return id, r.Address, nil
+	}
+	if _, _, err := net.SplitHostPort(node); err == nil {
+		return id, node, nil
+	}
+	port := "4242"
+	if _, p, err := net.SplitHostPort(r.Address); err == nil {
+		port = p
+	}
+	return id, net.JoinHostPort(node, port), nil
+}
+
+// srvService is the service of the SRV records looked up by SRVResolver.
+const srvService = "warpd"
+
+// SRVResolver resolves warps using the DNS SRV records of a domain:
+// `_warpd._tcp.<domain>` for warps designated by their ID only and
+// `_warpd._tcp.<node>.<domain>` for warps designated as `<id>@<node>`. The
+// target of highest priority (chosen by weight among equals) is used.
+type SRVResolver struct {
+	Domain string
+
+	// lookupSRV looks up SRV records, net.DefaultResolver.LookupSRV if nil.
+	lookupSRV func(
+		ctx context.Context,
+		service string,
+		proto string,
+		name string,
+	) (string, []*net.SRV, error)
+}
+
+// Resolve implements Resolver.
+func (r *SRVResolver) Resolve(
+	ctx context.Context,
+	designation string,
+) (string, string, error) {
+	id, node, err := splitDesignation(designation)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+	name := r.Domain
+	if node != "" {
+		name = node + "." + r.Domain
+	}
+
+	lookupSRV := r.lookupSRV
+	if lookupSRV == nil {
+		lookupSRV = net.DefaultResolver.LookupSRV
+	}
+	_, records, err := lookupSRV(ctx, srvService, "tcp", name)
+	if err != nil {
+		return "", "", errors.Trace(
+			errors.Newf("Failed to resolve warpd for %s: %v", designation, err),
+		)
+	}
+	if len(records) == 0 {
+		return "", "", errors.Trace(
+			errors.Newf("No warpd found for %s (%s)", designation, name),
+		)
+	}
+
+	// LookupSRV sorts the records by priority and randomizes them by weight.
+	host := strings.TrimSuffix(records[0].Target, ".")
+	port := strconv.Itoa(int(records[0].Port))
+	return id, net.JoinHostPort(host, port), nil
+}
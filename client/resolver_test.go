@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/spolu/warp"
+)
+
+func TestStaticResolver(t *testing.T) {
+	r := &StaticResolver{Address: "warp.link:4242"}
+	for _, tc := range []struct {
+		designation string
+		id          string
+		address     string
+		err         bool
+	}{
+		{"goofy-dev", "goofy-dev", "warp.link:4242", false},
+		{"goofy-dev@eu1", "goofy-dev", "eu1:4242", false},
+		{"goofy-dev@eu1.warp.link:4343", "goofy-dev", "eu1.warp.link:4343", false},
+		{"goofy-dev@", "", "", true},
+		{"@eu1", "", "", true},
+	} {
+		id, address, err := r.Resolve(context.Background(), tc.designation)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error: got %v, want error %t",
+				tc.designation, err, tc.err)
+			continue
+		}
+		if id != tc.id || address != tc.address {
+			t.Errorf("%s: got %s at %s, want %s at %s",
+				tc.designation, id, address, tc.id, tc.address)
+		}
+	}
+}
+
+// fakeSRV returns a lookupSRV serving records by name.
+func fakeSRV(
+	records map[string][]*net.SRV,
+) func(context.Context, string, string, string) (string, []*net.SRV, error) {
+	return func(
+		ctx context.Context,
+		service string,
+		proto string,
+		name string,
+	) (string, []*net.SRV, error) {
+		cname := fmt.Sprintf("_%s._%s.%s.", service, proto, name)
+		rs, ok := records[cname]
+		if !ok {
+			return "", nil, &net.DNSError{Err: "no such host", Name: cname}
+		}
+		return cname, rs, nil
+	}
+}
+
+func TestSRVResolver(t *testing.T) {
+	r := &SRVResolver{
+		Domain: "warp.link",
+		lookupSRV: fakeSRV(map[string][]*net.SRV{
+			"_warpd._tcp.warp.link.": {
+				{Target: "warpd1.warp.link.", Port: 4242, Priority: 1},
+				{Target: "warpd2.warp.link.", Port: 4242, Priority: 2},
+			},
+			"_warpd._tcp.eu1.warp.link.": {
+				{Target: "eu1.warp.link.", Port: 4343, Priority: 1},
+			},
+			"_warpd._tcp.empty.warp.link.": {},
+		}),
+	}
+	for _, tc := range []struct {
+		designation string
+		id          string
+		address     string
+		err         bool
+	}{
+		{"goofy-dev", "goofy-dev", "warpd1.warp.link:4242", false},
+		{"goofy-dev@eu1", "goofy-dev", "eu1.warp.link:4343", false},
+		{"goofy-dev@us1", "", "", true},
+		{"goofy-dev@empty", "", "", true},
+		{"goofy-dev@", "", "", true},
+	} {
+		id, address, err := r.Resolve(context.Background(), tc.designation)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error: got %v, want error %t",
+				tc.designation, err, tc.err)
+			continue
+		}
+		if id != tc.id || address != tc.address {
+			t.Errorf("%s: got %s at %s, want %s at %s",
+				tc.designation, id, address, tc.id, tc.address)
+		}
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	t.Setenv("WARPD_SRV_DOMAIN", "")
+	t.Setenv("WARPD_ADDRESS", "")
+	if r, ok := NewResolver().(*StaticResolver); !ok ||
+		r.Address != warp.DefaultAddress {
+		t.Errorf("Default resolver: got %+v", NewResolver())
+	}
+
+	t.Setenv("WARPD_ADDRESS", "localhost:4242")
+	if r, ok := NewResolver().(*StaticResolver); !ok ||
+		r.Address != "localhost:4242" {
+		t.Errorf("WARPD_ADDRESS resolver: got %+v", NewResolver())
+	}
+
+	t.Setenv("WARPD_SRV_DOMAIN", "warp.link")
+	if r, ok := NewResolver().(*SRVResolver); !ok || r.Domain != "warp.link" {
+		t.Errorf("WARPD_SRV_DOMAIN resolver: got %+v", NewResolver())
+	}
+}
@@ -3,14 +3,17 @@ package cli
 import (
 	"context"
 	"encoding/gob"
+	"fmt"
 	"io/ioutil"
 	"net"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/yamux"
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/plex"
 )
 
 // Session represents a session to warpd as part of a client or a host. All
@@ -21,6 +24,16 @@ type Session struct {
 	warp        string
 	sessionType warp.SessionType
 	username    string
+	sequenced   bool
+	requested   warp.Mode
+	// compressed is set if the data channel is compressed (see
+	// warp.CompressedConn).
+	compressed bool
+	// heartbeats is set if warpd sends heartbeats (see Heartbeats).
+	heartbeats bool
+	// requests is set if warpd stages the modes requested by shell clients
+	// (see Requests).
+	requests bool
 
 	conn net.Conn
 	mux  *yamux.Session
@@ -32,15 +45,55 @@ type Session struct {
 	errorC  net.Conn
 	errorR  *gob.Decoder
 	dataC   net.Conn
+	// chatC is the chat channel of chat client sessions, nil otherwise.
+	chatC net.Conn
+	chatR *gob.Decoder
+	chatW *gob.Encoder
 
 	state *WarpState
 
+	// hostUpdate, if set, computes the host updates sent by QueueHostUpdate
+	// (defaults to HostUpdate). updateQueued is set while a host update is
+	// scheduled and modesQueued if it must carry the modes of the users.
+	hostUpdate   func() warp.HostUpdate
+	updateQueued bool
+	modesQueued  bool
+
+	// hooks are the lifecycle hooks of the session (see Hooks). connected is
+	// set once the first state of the warp is applied and clients are the
+	// clients of the warp the hooks were last invoked for.
+	hooks     Hooks
+	connected bool
+	clients   map[string]warp.User
+
 	tornDown bool
 	cancel   func()
 
 	mutex *sync.Mutex
 }
 
+// EnvAuthToken is the environment variable holding the authentication token
+// presented to warpds requiring one (see warp.SessionHello.Auth).
+const EnvAuthToken = "WARPD_AUTH_TOKEN"
+
+// SessionOptions are the optional features of a session set up with
+// NewSession. The zero value requests none of them.
+type SessionOptions struct {
+	// Sequenced, if set, has warpd send data as sequenced data frames (to be
+	// read with ReadData).
+	Sequenced bool
+	// Requested is the mode requested from the host by shell clients (see
+	// warp.SessionHello), 0 if none, refused by warpds older than protocol
+	// version 5 as they would drop it.
+	Requested warp.Mode
+	// Compress, if set, compresses the data channel if warpd supports it (see
+	// Compressed).
+	Compress bool
+	// Replay is the amount of scrollback replayed to shell clients joining
+	// the warp (see warp.SessionHello), 0 for the full scrollback.
+	Replay int
+}
+
 // NewSession sets up a session, opens the associated channels and return a
 // Session object.
 func NewSession(
@@ -49,17 +102,52 @@ func NewSession(
 	w string,
 	sessionType warp.SessionType,
 	username string,
+	opts SessionOptions,
 	cancel func(),
 	conn net.Conn,
 ) (*Session, error) {
-	mux, err := yamux.Client(conn, &yamux.Config{
-		AcceptBacklog:          256,
-		EnableKeepAlive:        true,
-		KeepAliveInterval:      2 * time.Second,
-		ConnectionWriteTimeout: 10 * time.Second,
-		MaxStreamWindowSize:    256 * 1024,
-		LogOutput:              ioutil.Discard,
-	})
+	// Exchange preambles with warpd.
+	conn.SetDeadline(time.Now().Add(warp.PreambleTimeout))
+	if err := warp.WritePreamble(conn, warp.ProtocolVersion); err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Failed to open session to warpd: %v", err),
+		)
+	}
+	version, err := warp.ReadPreamble(conn)
+	if err != nil {
+		return nil, errors.Trace(
+			errors.Newf(
+				"Failed to open session to warpd (incompatible or outdated "+
+					"warpd?): %v",
+				err,
+			),
+		)
+	}
+	if version < warp.MinClientProtocolVersion ||
+		version > warp.ProtocolVersion {
+		return nil, errors.Trace(&IncompatibleError{
+			Message: fmt.Sprintf(
+				"Incompatible warpd protocol version %d (expected %d). "+
+					"Please make sure warp is up to date.",
+				version, warp.ProtocolVersion,
+			),
+		})
+	}
+	if opts.Requested != 0 && version < 5 {
+		return nil, errors.Trace(&IncompatibleError{
+			Message: fmt.Sprintf(
+				"warpd doesn't support write access requests (protocol "+
+					"version %d, expected %d). Please update warpd or "+
+					"connect without --write.",
+				version, warp.ProtocolVersion,
+			),
+		})
+	}
+	conn.SetDeadline(time.Time{})
+
+	mux, err := yamux.Client(conn, warp.MuxConfig(
+		2*time.Second, ioutil.Discard,
+	))
 	if err != nil {
 		return nil, errors.Trace(
 			errors.Newf("Failed to open session to warpd: %v", err),
@@ -71,6 +159,11 @@ func NewSession(
 		warp:        w,
 		sessionType: sessionType,
 		username:    username,
+		sequenced:   opts.Sequenced,
+		requested:   opts.Requested,
+		compressed:  opts.Compress && version >= 3,
+		heartbeats:  version >= 4,
+		requests:    version >= 5,
 		conn:        conn,
 		mux:         mux,
 		cancel:      cancel,
@@ -78,32 +171,37 @@ func NewSession(
 	}
 
 	// Opens state channel stateC.
-	ss.stateC, err = mux.Open()
+	ss.stateC, err = openChannel(mux, warp.ChannelState)
 	if err != nil {
 		ss.TearDown()
-		return nil, errors.Trace(
-			errors.Newf("State channel open error: %v", err),
-		)
+		return nil, errors.Trace(err)
 	}
 	ss.stateR = gob.NewDecoder(ss.stateC)
 
 	// Open update channel updateC.
-	ss.updateC, err = mux.Open()
+	ss.updateC, err = openChannel(mux, warp.ChannelUpdate)
 	if err != nil {
 		ss.TearDown()
-		return nil, errors.Trace(
-			errors.Newf("Update channel open error: %v", err),
-		)
+		return nil, errors.Trace(err)
 	}
 	ss.updateW = gob.NewEncoder(ss.updateC)
 
 	// Send initial SessionHello.
 	hello := warp.SessionHello{
-		Warp:     ss.warp,
-		From:     ss.session,
-		Version:  warp.Version,
-		Type:     ss.sessionType,
-		Username: ss.username,
+		Warp:      ss.warp,
+		From:      ss.session,
+		Version:   warp.Version,
+		Schema:    warp.SchemaVersion,
+		Type:      ss.sessionType,
+		Username:  ss.username,
+		Sequenced: ss.sequenced,
+		Mode:      ss.requested,
+		Auth:      os.Getenv(EnvAuthToken),
+		Compress:  ss.compressed,
+		Replay:    opts.Replay,
+	}
+	if ss.sessionType == warp.SsTpChatClient {
+		hello.Channels = []warp.ChannelType{warp.ChannelChat}
 	}
 	if err := ss.updateW.Encode(hello); err != nil {
 		ss.TearDown()
@@ -113,22 +211,32 @@ func NewSession(
 	}
 
 	// Opens error channel errorC.
-	ss.errorC, err = mux.Open()
+	ss.errorC, err = openChannel(mux, warp.ChannelError)
 	if err != nil {
 		ss.TearDown()
-		return nil, errors.Trace(
-			errors.Newf("Error channel open error: %v", err),
-		)
+		return nil, errors.Trace(err)
 	}
 	ss.errorR = gob.NewDecoder(ss.errorC)
 
 	// Open data channel dataC.
-	ss.dataC, err = mux.Open()
+	ss.dataC, err = openChannel(mux, warp.ChannelData)
 	if err != nil {
 		ss.TearDown()
-		return nil, errors.Trace(
-			errors.Newf("Data channel open error: %v", err),
-		)
+		return nil, errors.Trace(err)
+	}
+	if ss.compressed {
+		ss.dataC = warp.NewCompressedConn(ss.dataC)
+	}
+
+	// Open chat channel chatC for chat clients.
+	if ss.sessionType == warp.SsTpChatClient {
+		ss.chatC, err = openChannel(mux, warp.ChannelChat)
+		if err != nil {
+			ss.TearDown()
+			return nil, errors.Trace(err)
+		}
+		ss.chatR = gob.NewDecoder(ss.chatC)
+		ss.chatW = gob.NewEncoder(ss.chatC)
 	}
 
 	// Setup warp state.
@@ -137,6 +245,230 @@ func NewSession(
 	return ss, nil
 }
 
+// ChannelError is returned by NewSession when a channel of the session could
+// not be opened over the connection.
+type ChannelError struct {
+	Channel string
+	Err     error
+}
+
+// Error implements the error interface.
+func (e *ChannelError) Error() string {
+	reason := e.Err.Error()
+	switch e.Err {
+	case yamux.ErrTimeout, yamux.ErrConnectionWriteTimeout:
+		reason = "timed out writing to warpd (connection stalled or warpd " +
+			"overloaded)"
+	case yamux.ErrRemoteGoAway:
+		reason = "warpd is not accepting new channels (shutting down or " +
+			"overloaded)"
+	case yamux.ErrStreamsExhausted:
+		reason = "too many channels opened over the connection"
+	case yamux.ErrSessionShutdown:
+		reason = "connection closed"
+	}
+	return fmt.Sprintf("Failed to open %s channel: %s", e.Channel, reason)
+}
+
+// Transient returns whether the failure is due to a transient condition (load
+// on warpd or the connection) and establishing the session again over a new
+// connection is likely to succeed.
+func (e *ChannelError) Transient() bool {
+	switch e.Err {
+	case yamux.ErrTimeout, yamux.ErrConnectionWriteTimeout,
+		yamux.ErrRemoteGoAway, yamux.ErrStreamsExhausted:
+		return true
+	}
+	return false
+}
+
+// openChannel opens a channel over the mux, tagging it with its type so that
+// warpd accepts it as such whatever the order in which channels are opened. A
+// failed open is not retried over the same connection (the stream may still
+// be initiated after the failure).
+func openChannel(
+	mux *yamux.Session,
+	t warp.ChannelType,
+) (net.Conn, error) {
+	c, err := mux.Open()
+	if err != nil {
+		return nil, &ChannelError{
+			Channel: string(t),
+			Err:     err,
+		}
+	}
+	if err := warp.WriteChannelTag(c, t); err != nil {
+		c.Close()
+		return nil, &ChannelError{
+			Channel: string(t),
+			Err:     errors.Cause(err),
+		}
+	}
+	return c, nil
+}
+
+const (
+	// SessionRetries is the number of times establishing a session is
+	// retried (over a new connection) after a transient failure.
+	SessionRetries = 3
+	// sessionRetryDelay is the delay before the first retry, doubled before
+	// each subsequent one.
+	sessionRetryDelay = 250 * time.Millisecond
+)
+
+// IsTransient returns whether err is a transient failure to establish a
+// session that can be retried.
+func IsTransient(
+	err error,
+) bool {
+	e, ok := errors.Cause(err).(*ChannelError)
+	return ok && e.Transient()
+}
+
+// SessionRetryDelay returns the backoff delay before the nth retry (starting
+// at 1) to establish a session.
+func SessionRetryDelay(
+	retry int,
+) time.Duration {
+	return sessionRetryDelay << uint(retry-1)
+}
+
+// RedirectError is returned by SessionError when warpd redirected the
+// session to another warpd.
+type RedirectError struct {
+	Address string
+}
+
+// Error implements the error interface.
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("Redirected to warpd at %s", e.Address)
+}
+
+// InternalError is returned by SessionError when warpd failed to serve the
+// session (warp.ErrCodeInternal). Contrary to other errors it is worth
+// reconnecting after it.
+type InternalError struct {
+	Message string
+}
+
+// Error implements the error interface.
+func (e *InternalError) Error() string {
+	return fmt.Sprintf("Received %s: %s", warp.ErrCodeInternal, e.Message)
+}
+
+// IsInternal returns whether err is an *InternalError.
+func IsInternal(
+	err error,
+) bool {
+	_, ok := errors.Cause(err).(*InternalError)
+	return ok
+}
+
+// KickedError is returned by SessionError when the host disconnected the user
+// (warp.ErrCodeKicked). Clients must not reconnect after it, even if
+// following the warp.
+type KickedError struct {
+	Message string
+}
+
+// Error implements the error interface.
+func (e *KickedError) Error() string {
+	return fmt.Sprintf("Received %s: %s", warp.ErrCodeKicked, e.Message)
+}
+
+// IsKicked returns whether err is a *KickedError.
+func IsKicked(
+	err error,
+) bool {
+	_, ok := errors.Cause(err).(*KickedError)
+	return ok
+}
+
+// HostClosedError is returned by SessionError when the host of the warp
+// closed it (warp.ErrCodeHostClosed), disconnected
+// (warp.ErrCodeHostDisconnected) or the warp does not exist
+// (warp.ErrCodeWarpUnknown), which is the case once its host disconnected.
+type HostClosedError struct {
+	Code    string
+	Message string
+}
+
+// Error implements the error interface.
+func (e *HostClosedError) Error() string {
+	return fmt.Sprintf("Received %s: %s", e.Code, e.Message)
+}
+
+// IsHostClosed returns whether err is a *HostClosedError.
+func IsHostClosed(
+	err error,
+) bool {
+	_, ok := errors.Cause(err).(*HostClosedError)
+	return ok
+}
+
+// RejectedError is returned by SessionError for the other errors sent by warpd
+// (warp.ErrCodeUnauthorized, warp.ErrCodeSchemaMismatch, ...). Clients must
+// not reconnect after it, even if following the warp.
+type RejectedError struct {
+	Code    string
+	Message string
+}
+
+// Error implements the error interface.
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("Received %s: %s", e.Code, e.Message)
+}
+
+// IsRejected returns whether err is a *RejectedError.
+func IsRejected(
+	err error,
+) bool {
+	_, ok := errors.Cause(err).(*RejectedError)
+	return ok
+}
+
+// IncompatibleError is returned by NewSession when warpd doesn't speak a
+// protocol version compatible with the session requested. Clients must not
+// reconnect after it, even if following the warp.
+type IncompatibleError struct {
+	Message string
+}
+
+// Error implements the error interface.
+func (e *IncompatibleError) Error() string {
+	return e.Message
+}
+
+// IsIncompatible returns whether err is an *IncompatibleError.
+func IsIncompatible(
+	err error,
+) bool {
+	_, ok := errors.Cause(err).(*IncompatibleError)
+	return ok
+}
+
+// SessionError converts an error received from warpd into an error to be
+// reported to the user, a *RedirectError for redirects, an *InternalError for
+// internal errors, a *KickedError for kicks, a *HostClosedError if the warp
+// is gone or a *RejectedError otherwise.
+func SessionError(
+	e *warp.Error,
+) error {
+	switch {
+	case e.Code == warp.ErrCodeRedirect && e.Redirect != "":
+		return &RedirectError{Address: e.Redirect}
+	case e.Code == warp.ErrCodeInternal:
+		return &InternalError{Message: e.Message}
+	case e.Code == warp.ErrCodeKicked:
+		return &KickedError{Message: e.Message}
+	case e.Code == warp.ErrCodeHostClosed ||
+		e.Code == warp.ErrCodeHostDisconnected ||
+		e.Code == warp.ErrCodeWarpUnknown:
+		return &HostClosedError{Code: e.Code, Message: e.Message}
+	}
+	return &RejectedError{Code: e.Code, Message: e.Message}
+}
+
 // Command methods
 
 // DataC returns the data channel. Using the dataC is not thread-safe and
@@ -148,6 +480,46 @@ func (ss *Session) DataC() net.Conn {
 	return ss.dataC
 }
 
+// ReadData pipes the data received from warpd to dst until the data channel
+// is closed or the context canceled. For sequenced sessions, onGap is called
+// (before dst) each time a gap is detected in the sequence of data frames,
+// with the number of frames missing.
+func (ss *Session) ReadData(
+	ctx context.Context,
+	dst func([]byte),
+	onGap func(missing uint64),
+) {
+	if !ss.sequenced {
+		plex.Run(ctx, dst, ss.DataC())
+		return
+	}
+
+	r := ss.DataC()
+	last := uint64(0)
+	for {
+		seq, data, err := warp.ReadDataFrame(r)
+		if err != nil {
+			return
+		}
+		// The sequence starts wherever the warp is at when joining.
+		if last != 0 && seq != last+1 {
+			missing := uint64(0)
+			if seq > last {
+				missing = seq - last - 1
+			}
+			onGap(missing)
+		}
+		last = seq
+		dst(data)
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
 // WriteData writes to dataC in a thread-safe way, checking that the session is
 // not torn down.
 func (ss *Session) WriteDataC(
@@ -160,6 +532,33 @@ func (ss *Session) WriteDataC(
 	}
 }
 
+// Compressed returns whether the data channel of the session is compressed,
+// compression being requested but not supported by warpds older than
+// protocol version 3.
+func (ss *Session) Compressed() bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.compressed
+}
+
+// Heartbeats returns whether warpd sends the state of the warp every
+// warp.HeartbeatInterval while its host is idle, which warpds older than
+// protocol version 4 don't.
+func (ss *Session) Heartbeats() bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.heartbeats
+}
+
+// Requests returns whether warpd stages the modes requested by shell clients
+// for their host to grant or decline, which warpds older than protocol version
+// 5 don't.
+func (ss *Session) Requests() bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.requests
+}
+
 // Warp returns the session warp token.
 func (ss *Session) Warp() string {
 	ss.mutex.Lock()
@@ -181,6 +580,20 @@ func (ss *Session) ProtocolState() warp.State {
 	return ss.state.ProtocolState()
 }
 
+// ClientCount returns the number of users connected to the warp, excluding
+// the host.
+func (ss *Session) ClientCount() int {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	count := 0
+	for _, u := range ss.state.ProtocolState().Users {
+		if !u.Hosting {
+			count++
+		}
+	}
+	return count
+}
+
 // GetMode returns the mode of a user.
 func (ss *Session) GetMode(
 	user string,
@@ -190,24 +603,174 @@ func (ss *Session) GetMode(
 	return ss.state.GetMode(user)
 }
 
-// SetMode sets the mode for a user.
+// SetMode sets the mode for a user, invoking the OnAuthorize hook if it is
+// granted write access.
 func (ss *Session) SetMode(
 	user string,
 	mode warp.Mode,
 ) error {
+	ss.mutex.Lock()
+	err := ss.state.SetMode(user, mode)
+	var events []func()
+	if err == nil && ss.connected {
+		events = ss.hookEvents(false)
+	}
+	ss.mutex.Unlock()
+
+	fire(events)
+	return err
+}
+
+// SetSingleWriter enables the single-writer mode of the warp.
+func (ss *Session) SetSingleWriter() {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.state.SetSingleWriter()
+}
+
+// SingleWriter returns whether the warp is in single-writer mode and the user
+// holding the write token if any.
+func (ss *Session) SingleWriter() (bool, string) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.state.SingleWriter()
+}
+
+// SetMaxClients sets the maximum number of clients of the warp.
+func (ss *Session) SetMaxClients(
+	max int,
+) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.state.SetMaxClients(max)
+}
+
+// MaxClients returns the maximum number of clients of the warp (0 if
+// unlimited).
+func (ss *Session) MaxClients() int {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.state.MaxClients()
+}
+
+// SetTitle sets the title of the warp.
+func (ss *Session) SetTitle(
+	title string,
+) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.state.SetTitle(title)
+}
+
+// SetTerm sets the terminal type of the warp.
+func (ss *Session) SetTerm(
+	term string,
+) {
 	ss.mutex.Lock()
 	defer ss.mutex.Unlock()
-	return ss.state.SetMode(user, mode)
+	ss.state.SetTerm(term)
 }
 
-// UpdateState updates the session state with a received warp.State.
+// SetReadOnly marks the warp as read-only (see warp.HostUpdate).
+func (ss *Session) SetReadOnly() {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.state.SetReadOnly()
+}
+
+// ReadOnly returns whether the host never writes the input of the warp.
+func (ss *Session) ReadOnly() bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.state.ReadOnly()
+}
+
+// PendingRequest returns the mode requested by a user that wasn't granted
+// yet, 0 if none.
+func (ss *Session) PendingRequest(
+	user string,
+) warp.Mode {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.state.PendingRequest(user)
+}
+
+// ExcessClients returns the users exceeding the maximum number of clients of
+// the warp, the ones who joined last.
+func (ss *Session) ExcessClients() []string {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.state.ExcessClients()
+}
+
+// SetWriter hands the write token to a user (single-writer mode only).
+func (ss *Session) SetWriter(
+	user string,
+) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.state.SetWriter(user)
+}
+
+// CanWrite returns whether a user can currently write to the warp.
+func (ss *Session) CanWrite(
+	user string,
+) bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.state.CanWrite(user)
+}
+
+// HostUpdate computes a host update from the session state.
+func (ss *Session) HostUpdate() warp.HostUpdate {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	singleWriter, writer := ss.state.SingleWriter()
+	return warp.HostUpdate{
+		Warp:         ss.warp,
+		From:         ss.session,
+		WindowSize:   ss.state.WindowSize(),
+		Modes:        ss.state.Modes(),
+		SingleWriter: singleWriter,
+		Writer:       writer,
+		MaxClients:   ss.state.MaxClients(),
+	}
+}
+
+// SetPanes sets the panes of the warp.
+func (ss *Session) SetPanes(
+	panes []string,
+	pane string,
+) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.state.SetPanes(panes, pane)
+}
+
+// UpdateState updates the session state with a received warp.State,
+// invoking the hooks of the session (see Hooks).
 func (ss *Session) UpdateState(
 	state warp.State,
 	hosting bool,
 ) error {
+	ss.mutex.Lock()
+	err := ss.state.Update(state, hosting)
+	var events []func()
+	if err == nil {
+		events = ss.hookEvents(true)
+	}
+	ss.mutex.Unlock()
+
+	fire(events)
+	return err
+}
+
+// IgnoredModes returns the modes sent by warpd that the last state update
+// ignored while hosting (see WarpState.Update).
+func (ss *Session) IgnoredModes() []IgnoredMode {
 	ss.mutex.Lock()
 	defer ss.mutex.Unlock()
-	return ss.state.Update(state, hosting)
+	return ss.state.IgnoredModes()
 }
 
 // HostCanReceiverWrite retruns whether the host can receive write from any
@@ -232,6 +795,15 @@ func (ss *Session) Modes() map[string]warp.Mode {
 	return ss.state.Modes()
 }
 
+// Ping measures the round-trip time to warpd over the session connection.
+func (ss *Session) Ping() (time.Duration, error) {
+	rtt, err := ss.mux.Ping()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return rtt, nil
+}
+
 // TornDown returns the session tornDown value.
 func (ss *Session) TornDown() bool {
 	ss.mutex.Lock()
@@ -239,15 +811,24 @@ func (ss *Session) TornDown() bool {
 	return ss.tornDown
 }
 
-// TearDown tears down a session, closing and reclaiming channels.
+// TearDown tears down a session, closing and reclaiming channels, invoking the
+// OnDisconnect hook if it was connected.
 func (ss *Session) TearDown() {
 	ss.mutex.Lock()
-	defer ss.mutex.Unlock()
+	var onDisconnect func()
 	if !ss.tornDown {
 		ss.tornDown = true
 		ss.cancel()
 		// Closes stateC, updateC, errorC, dataC, mux and conn.
 		ss.mux.Close()
+		if ss.connected {
+			onDisconnect = ss.hooks.OnDisconnect
+		}
+	}
+	ss.mutex.Unlock()
+
+	if onDisconnect != nil {
+		onDisconnect()
 	}
 }
 
@@ -266,6 +847,196 @@ func (ss *Session) SendHostUpdate(
 	return nil
 }
 
+// SendKicks immediately sends a host update carrying the modes of the users
+// and requesting warpd to disconnect the specified users with the specified
+// error code. warpd applies the modes before disconnecting the users, so that
+// both happen at once from the perspective of the other clients.
+func (ss *Session) SendKicks(
+	ctx context.Context,
+	users []string,
+	code string,
+) error {
+	ss.mutex.Lock()
+	hostUpdate := ss.hostUpdate
+	tornDown := ss.tornDown
+	ss.mutex.Unlock()
+	if tornDown {
+		return errors.Trace(
+			errors.Newf("Session to warpd is closed"),
+		)
+	}
+
+	if hostUpdate == nil {
+		hostUpdate = ss.HostUpdate
+	}
+	update := hostUpdate()
+	update.Modes = ss.Modes()
+	for _, user := range users {
+		update.Kicks = append(update.Kicks, warp.Kick{
+			User: user,
+			Code: code,
+		})
+	}
+	if err := ss.SendHostUpdate(ctx, update); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// SendDeclines immediately sends a host update carrying the modes of the
+// users and declining the modes requested by the specified users.
+func (ss *Session) SendDeclines(
+	ctx context.Context,
+	users []string,
+) error {
+	ss.mutex.Lock()
+	hostUpdate := ss.hostUpdate
+	tornDown := ss.tornDown
+	for _, user := range users {
+		ss.state.DeclineRequest(user)
+	}
+	ss.mutex.Unlock()
+	if tornDown {
+		return errors.Trace(
+			errors.Newf("Session to warpd is closed"),
+		)
+	}
+
+	if hostUpdate == nil {
+		hostUpdate = ss.HostUpdate
+	}
+	update := hostUpdate()
+	update.Modes = ss.Modes()
+	update.Declines = users
+	if err := ss.SendHostUpdate(ctx, update); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// SetHostUpdate sets the function computing the host updates sent by
+// QueueHostUpdate.
+func (ss *Session) SetHostUpdate(
+	hostUpdate func() warp.HostUpdate,
+) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.hostUpdate = hostUpdate
+}
+
+// QueueHostUpdate schedules a host update to be sent after
+// warp.HostUpdateDebounce. Updates queued in the meantime are coalesced into
+// that one, which is computed when sent so that it always reflects the latest
+// state. If modes is true (the modes of the users changed), the update carries
+// the modes of the users. It returns an error only if the session is torn
+// down.
+func (ss *Session) QueueHostUpdate(
+	ctx context.Context,
+	modes bool,
+) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if ss.tornDown {
+		return errors.Trace(
+			errors.Newf("Session to warpd is closed"),
+		)
+	}
+	ss.modesQueued = ss.modesQueued || modes
+	if ss.updateQueued {
+		return nil
+	}
+	ss.updateQueued = true
+	time.AfterFunc(warp.HostUpdateDebounce, func() {
+		ss.mutex.Lock()
+		ss.updateQueued = false
+		modes := ss.modesQueued
+		ss.modesQueued = false
+		hostUpdate := ss.hostUpdate
+		ss.mutex.Unlock()
+
+		if hostUpdate == nil {
+			hostUpdate = ss.HostUpdate
+		}
+		update := hostUpdate()
+		if modes {
+			update.Modes = ss.Modes()
+		}
+		// Errors are ignored as they are reported by the session itself
+		// being torn down.
+		ss.SendHostUpdate(ctx, update)
+	})
+	return nil
+}
+
+// SendRefresh requests warpd to send the current state again and the host to
+// redraw the screen of the warp.
+func (ss *Session) SendRefresh(
+	ctx context.Context,
+) error {
+	return ss.sendClientUpdate(ctx, warp.ClientUpdate{
+		Refresh: true,
+	})
+}
+
+// SendWindowSize reports the size of the client terminal to warpd.
+func (ss *Session) SendWindowSize(
+	ctx context.Context,
+	size warp.Size,
+) error {
+	return ss.sendClientUpdate(ctx, warp.ClientUpdate{
+		WindowSize: size,
+	})
+}
+
+// SendRequest requests a mode from the host (see warp.ClientUpdate). It errors
+// if warpd doesn't stage requests (see Requests).
+func (ss *Session) SendRequest(
+	ctx context.Context,
+	mode warp.Mode,
+) error {
+	if !ss.Requests() {
+		return errors.Trace(
+			errors.Newf("warpd doesn't support write access requests"),
+		)
+	}
+	return ss.sendClientUpdate(ctx, warp.ClientUpdate{
+		Request: mode,
+	})
+}
+
+// sendClientUpdate sends a client update over the update channel.
+func (ss *Session) sendClientUpdate(
+	ctx context.Context,
+	update warp.ClientUpdate,
+) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if !ss.tornDown {
+		if err := ss.updateW.Encode(update); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// SendChat sends a chat message over the chat channel of a chat client
+// session.
+func (ss *Session) SendChat(
+	ctx context.Context,
+	text string,
+) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if !ss.tornDown {
+		if err := ss.chatW.Encode(warp.ChatMessage{
+			Text: text,
+		}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
 //
 // Non thread-safe methods.
 //
@@ -282,6 +1053,27 @@ func (ss *Session) DecodeError(
 	return &e, nil
 }
 
+// WatchError decodes the error sent by warpd, if any, in the background. The
+// session is torn down as soon as an error is received (warpd closes the
+// session after sending one). The returned channel receives that error and is
+// closed once the error channel is drained, which happens at the latest when
+// the session is torn down: an error sent by warpd before closing the session
+// is therefore received by waiting on the channel after TearDown, without
+// having to guess how long it takes to arrive.
+func (ss *Session) WatchError(
+	ctx context.Context,
+) <-chan error {
+	errC := make(chan error, 1)
+	go func() {
+		defer close(errC)
+		if e, err := ss.DecodeError(ctx); err == nil {
+			errC <- SessionError(e)
+			ss.TearDown()
+		}
+	}()
+	return errC
+}
+
 // DecodeState attempts to decode state from the sateC. This method is not
 // thread-safe.
 func (ss *Session) DecodeState(
@@ -293,3 +1085,27 @@ func (ss *Session) DecodeState(
 	}
 	return &st, nil
 }
+
+// DecodeChat attempts to decode a chat message from the chat channel of a
+// chat client session. This method is not thread-safe.
+func (ss *Session) DecodeChat(
+	ctx context.Context,
+) (*warp.ChatMessage, error) {
+	var msg warp.ChatMessage
+	if err := ss.chatR.Decode(&msg); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &msg, nil
+}
+
+// DecodeResolution decodes the result of a prefix resolution from the state
+// channel of a resolve session.
+func (ss *Session) DecodeResolution(
+	ctx context.Context,
+) (*warp.Resolution, error) {
+	var res warp.Resolution
+	if err := ss.stateR.Decode(&res); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &res, nil
+}
@@ -0,0 +1,346 @@
+package cli
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+)
+
+func TestChannelError(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		reason    string
+		transient bool
+	}{
+		{yamux.ErrTimeout, "timed out writing to warpd", true},
+		{yamux.ErrConnectionWriteTimeout, "timed out writing to warpd", true},
+		{yamux.ErrRemoteGoAway, "warpd is not accepting new channels", true},
+		{yamux.ErrStreamsExhausted, "too many channels", true},
+		{yamux.ErrSessionShutdown, "connection closed", false},
+		{fmt.Errorf("boom"), "boom", false},
+	} {
+		err := errors.Trace(&ChannelError{Channel: "state", Err: tc.err})
+		msg := errors.Cause(err).Error()
+		if !strings.HasPrefix(msg, "Failed to open state channel: ") ||
+			!strings.Contains(msg, tc.reason) {
+			t.Errorf("%v: message: got %q, want %q", tc.err, msg, tc.reason)
+		}
+		if IsTransient(err) != tc.transient {
+			t.Errorf("%v: transient: got %t, want %t",
+				tc.err, !tc.transient, tc.transient)
+		}
+	}
+}
+
+func TestSessionRetryDelay(t *testing.T) {
+	for retry, want := range []time.Duration{
+		250 * time.Millisecond, 500 * time.Millisecond, time.Second,
+	} {
+		if got := SessionRetryDelay(retry + 1); got != want {
+			t.Errorf("Retry %d: got %s, want %s", retry+1, got, want)
+		}
+	}
+}
+
+// stalledWarpd exchanges preambles over conn then stops reading from it, as
+// an overloaded warpd would.
+func stalledWarpd(
+	conn net.Conn,
+) {
+	if _, err := warp.ReadPreamble(conn); err != nil {
+		return
+	}
+	warp.WritePreamble(conn, warp.ProtocolVersion)
+}
+
+func TestNewSessionStalledWarpd(t *testing.T) {
+	timeout := warp.MuxWriteTimeout
+	warp.MuxWriteTimeout = 100 * time.Millisecond
+	defer func() { warp.MuxWriteTimeout = timeout }()
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go stalledWarpd(peer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errC := make(chan error, 1)
+	go func() {
+		_, err := NewSession(
+			ctx, warp.Session{Token: "tok", User: "usr", Secret: "sec"},
+			"goofy-dev", warp.SsTpShellClient, "stan",
+			SessionOptions{}, cancel, conn,
+		)
+		errC <- err
+	}()
+
+	select {
+	case err := <-errC:
+		if err == nil {
+			t.Fatalf("NewSession succeeded against a stalled warpd")
+		}
+		if !IsTransient(err) {
+			t.Errorf("Error not transient: %v", err)
+		}
+		msg := errors.Cause(err).Error()
+		if !strings.Contains(msg, "Failed to open state channel: timed out") {
+			t.Errorf("Error: got %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("NewSession hung against a stalled warpd")
+	}
+}
+
+// fakeHostWarpd serves a host session over conn, relaying the host updates it
+// receives.
+func fakeHostWarpd(
+	t *testing.T,
+	conn net.Conn,
+) <-chan warp.HostUpdate {
+	updatesC := make(chan warp.HostUpdate, 256)
+	go func() {
+		defer close(updatesC)
+		if _, err := warp.ReadPreamble(conn); err != nil {
+			return
+		}
+		if err := warp.WritePreamble(conn, warp.ProtocolVersion); err != nil {
+			return
+		}
+		mux, err := yamux.Server(conn, warp.MuxConfig(
+			time.Second, ioutil.Discard,
+		))
+		if err != nil {
+			return
+		}
+		defer mux.Close()
+
+		var updateR *gob.Decoder
+		for range warp.RequiredChannels {
+			c, err := mux.Accept()
+			if err != nil {
+				return
+			}
+			ct, err := warp.ReadChannelTag(c)
+			if err != nil {
+				return
+			}
+			if ct == warp.ChannelUpdate {
+				updateR = gob.NewDecoder(c)
+			}
+		}
+		var hello warp.SessionHello
+		if err := updateR.Decode(&hello); err != nil {
+			return
+		}
+		for {
+			var update warp.HostUpdate
+			if err := updateR.Decode(&update); err != nil {
+				return
+			}
+			updatesC <- update
+		}
+	}()
+	return updatesC
+}
+
+// hostSession sets up a host session with a fake warpd, returning it along
+// with the host updates received by warpd. The updates queued carry the
+// window size returned by size and no modes, as the ones of `warp open`.
+func hostSession(
+	t *testing.T,
+	size func() warp.Size,
+) (*Session, <-chan warp.HostUpdate) {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	updatesC := fakeHostWarpd(t, peer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ss, err := NewSession(
+		ctx, warp.Session{Token: "tok", User: "host", Secret: "sec"},
+		"goofy-dev", warp.SsTpHost, "stan",
+		SessionOptions{}, cancel, conn,
+	)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	t.Cleanup(ss.TearDown)
+	if err := ss.UpdateState(
+		stateWith(hostUser(), lurker(warp.DefaultUserMode)), true,
+	); err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+	ss.SetHostUpdate(func() warp.HostUpdate {
+		return warp.HostUpdate{
+			Warp:       "goofy-dev",
+			From:       ss.Session(),
+			WindowSize: size(),
+		}
+	})
+	return ss, updatesC
+}
+
+// receiveUpdates returns the host updates received until none is received
+// for quiet.
+func receiveUpdates(
+	updatesC <-chan warp.HostUpdate,
+	quiet time.Duration,
+) []warp.HostUpdate {
+	updates := []warp.HostUpdate{}
+	for {
+		select {
+		case update, ok := <-updatesC:
+			if !ok {
+				return updates
+			}
+			updates = append(updates, update)
+		case <-time.After(quiet):
+			return updates
+		}
+	}
+}
+
+func TestQueueHostUpdateTrailingModes(t *testing.T) {
+	mutex := &sync.Mutex{}
+	size := warp.Size{Rows: 24, Cols: 80}
+	ss, updatesC := hostSession(t, func() warp.Size {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return size
+	})
+
+	// A burst of resizes, the lurker being granted write in the middle.
+	ctx := context.Background()
+	for i := 1; i <= 20; i++ {
+		mutex.Lock()
+		size.Cols = 80 + i
+		mutex.Unlock()
+		modes := false
+		if i == 10 {
+			if err := ss.SetMode(
+				"lurker", warp.DefaultUserMode|warp.ModeShellWrite,
+			); err != nil {
+				t.Fatalf("SetMode: %v", err)
+			}
+			modes = true
+		}
+		if err := ss.QueueHostUpdate(ctx, modes); err != nil {
+			t.Fatalf("QueueHostUpdate: %v", err)
+		}
+	}
+
+	updates := receiveUpdates(updatesC, 4*warp.HostUpdateDebounce)
+	if len(updates) != 1 {
+		t.Fatalf("Host updates: got %d, want 1", len(updates))
+	}
+	if updates[0].WindowSize.Cols != 100 {
+		t.Errorf("Window size: got %+v, want the last one", updates[0].WindowSize)
+	}
+	if updates[0].Modes["lurker"]&warp.ModeShellWrite == 0 {
+		t.Errorf("Modes: got %v, want write granted to lurker", updates[0].Modes)
+	}
+
+	// Modes are not sent again if they didn't change since.
+	if err := ss.QueueHostUpdate(ctx, false); err != nil {
+		t.Fatalf("QueueHostUpdate: %v", err)
+	}
+	updates = receiveUpdates(updatesC, 4*warp.HostUpdateDebounce)
+	if len(updates) != 1 || updates[0].Modes != nil {
+		t.Errorf("Host updates: got %+v, want 1 without modes", updates)
+	}
+}
+
+func TestQueueHostUpdateResizeBurst(t *testing.T) {
+	mutex := &sync.Mutex{}
+	size := warp.Size{Rows: 24, Cols: 80}
+	ss, updatesC := hostSession(t, func() warp.Size {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return size
+	})
+
+	// A window dragged for 500ms, resized every 5ms. warpd broadcasts its
+	// state to the clients once per host update.
+	ctx := context.Background()
+	resizes := 100
+	for i := 1; i <= resizes; i++ {
+		mutex.Lock()
+		size.Cols = 80 + i
+		mutex.Unlock()
+		if err := ss.QueueHostUpdate(ctx, false); err != nil {
+			t.Fatalf("QueueHostUpdate: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	updates := receiveUpdates(updatesC, 4*warp.HostUpdateDebounce)
+	t.Logf("%d resizes sent as %d host updates (state broadcasts)",
+		resizes, len(updates))
+	// At most one update per debounce window, plus the trailing one.
+	max := int(time.Duration(resizes)*5*time.Millisecond/
+		warp.HostUpdateDebounce) + 2
+	if len(updates) == 0 || len(updates) > max {
+		t.Fatalf("Host updates: got %d, want at most %d", len(updates), max)
+	}
+	if last := updates[len(updates)-1]; last.WindowSize.Cols != 80+resizes {
+		t.Errorf("Trailing update: got %+v, want the last size", last.WindowSize)
+	}
+}
+
+func TestReadDataGaps(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	ss := &Session{sequenced: true, dataC: conn, mutex: &sync.Mutex{}}
+
+	// The sequence starts wherever the warp is at when joining: no gap is
+	// reported for the first frame.
+	go func() {
+		for _, seq := range []uint64{7, 8, 10, 11, 15} {
+			warp.WriteDataFrame(peer, seq, []byte(fmt.Sprintf("%d;", seq)))
+		}
+		peer.Close()
+	}()
+
+	events := []string{}
+	ss.ReadData(context.Background(), func(data []byte) {
+		events = append(events, string(data))
+	}, func(missing uint64) {
+		events = append(events, fmt.Sprintf("gap:%d", missing))
+	})
+
+	want := []string{"7;", "8;", "gap:1", "10;", "11;", "gap:3", "15;"}
+	if strings.Join(events, " ") != strings.Join(want, " ") {
+		t.Errorf("Events: got %v, want %v", events, want)
+	}
+}
+
+func TestReadDataUnsequenced(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	ss := &Session{dataC: conn, mutex: &sync.Mutex{}}
+
+	go func() {
+		peer.Write([]byte("raw data"))
+		peer.Close()
+	}()
+	var got []byte
+	ss.ReadData(context.Background(), func(data []byte) {
+		got = append(got, data...)
+	}, func(missing uint64) {
+		t.Errorf("Gap of %d reported on an unsequenced session", missing)
+	})
+	if string(got) != "raw data" {
+		t.Errorf("Data: got %q, want %q", got, "raw data")
+	}
+}
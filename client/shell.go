@@ -1,8 +1,15 @@
 package cli
 
 import (
+	"bufio"
 	"context"
+	"fmt"
 	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
 
 	"github.com/spolu/warp/lib/errors"
 )
@@ -11,18 +18,157 @@ type Shell struct {
 	Command string
 }
 
+// defaultShell is the shell used if the login shell of the user can't be
+// determined.
+var defaultShell = "/bin/bash"
+
+// The lookups of the login shell of the user, replaced in tests to simulate
+// the different platforms.
+var (
+	currentUser = user.Current
+	goos        = runtime.GOOS
+	passwdPath  = "/etc/passwd"
+	// commandOutput runs a command and returns its standard output.
+	commandOutput = func(name string, args ...string) ([]byte, error) {
+		return exec.Command(name, args...).Output()
+	}
+)
+
+// ShellError is returned when no usable shell was found.
+type ShellError struct {
+	// Tried lists the shells that were considered, if any.
+	Tried []string
+}
+
+// Error implements the error interface.
+func (e *ShellError) Error() string {
+	return fmt.Sprintf(
+		"No usable shell found (tried: %s)", strings.Join(e.Tried, ", "),
+	)
+}
+
 // retrieveShell retrieves the current shell for the user using the following
 // fallbacks:
+// - the login shell of the user from the OS user database
 // - read env variable SHELL
-// - TODO: read /etc/password
 // - default to `/bin/bash`
+// Shells that are not executable are skipped.
 func retrieveShell(
 	ctx context.Context,
 ) (string, error) {
+	candidates := []string{}
+	if u, err := currentUser(); err == nil {
+		if shell := loginShell(u); shell != "" {
+			candidates = append(candidates, shell)
+		}
+	}
 	if os.Getenv("SHELL") != "" {
-		return os.Getenv("SHELL"), nil
+		candidates = append(candidates, os.Getenv("SHELL"))
+	}
+	candidates = append(candidates, defaultShell)
+
+	for _, shell := range candidates {
+		if isExecutable(shell) {
+			return shell, nil
+		}
+	}
+	return "", errors.Trace(&ShellError{Tried: candidates})
+}
+
+// loginShell returns the login shell of the user as stored in the OS user
+// database, or an empty string if it can't be retrieved. It does not rely on
+// cgo: the database is queried with `dscl` on macOS and `getent` elsewhere,
+// falling back to reading /etc/passwd.
+func loginShell(
+	u *user.User,
+) string {
+	if goos == "darwin" {
+		out, err := commandOutput(
+			"dscl", ".", "-read", "/Users/"+u.Username, "UserShell",
+		)
+		if err != nil {
+			return ""
+		}
+		// Output is `UserShell: /bin/zsh`.
+		fields := strings.Fields(string(out))
+		if len(fields) == 2 && fields[0] == "UserShell:" {
+			return fields[1]
+		}
+		return ""
+	}
+
+	out, err := commandOutput("getent", "passwd", u.Username)
+	if err == nil {
+		entry := strings.TrimSpace(string(out))
+		if shell, ok := passwdShell(entry, u.Username); ok {
+			return shell
+		}
+	}
+
+	f, err := os.Open(passwdPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if shell, ok := passwdShell(scanner.Text(), u.Username); ok {
+			return shell
+		}
+	}
+	return ""
+}
+
+// passwdShell returns the shell of a passwd(5) entry (its seventh field) if it
+// is the entry of the specified user. Users whose shell is empty use
+// `/bin/sh`, as per passwd(5).
+func passwdShell(
+	entry string,
+	username string,
+) (string, bool) {
+	fields := strings.Split(entry, ":")
+	if len(fields) != 7 || fields[0] != username {
+		return "", false
+	}
+	if fields[6] == "" {
+		return "/bin/sh", true
+	}
+	return fields[6], true
+}
+
+// isExecutable returns whether path is an absolute path to an executable
+// file.
+func isExecutable(
+	path string,
+) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return info.Mode().IsRegular() && info.Mode()&0111 != 0
+}
+
+// LookupShell returns the shell designated by name, a path or a command
+// looked up in the PATH, erroring if it is not an executable file.
+func LookupShell(
+	name string,
+) (*Shell, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !isExecutable(path) {
+		return nil, errors.Trace(errors.Newf("%s is not executable", path))
 	}
-	return "/bin/bash", nil
+	return &Shell{
+		Command: path,
+	}, nil
 }
 
 func DetectShell(
@@ -0,0 +1,230 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// mockLookups replaces the lookups of the login shell for the duration of a
+// test, the OS user database answering with the output of commands (keyed by
+// the command line) and passwd.
+func mockLookups(
+	t *testing.T,
+	platform string,
+	commands map[string]string,
+	passwd string,
+) {
+	t.Helper()
+	prevUser, prevOS, prevPasswd, prevOutput, prevDefault :=
+		currentUser, goos, passwdPath, commandOutput, defaultShell
+	t.Cleanup(func() {
+		currentUser, goos, passwdPath, commandOutput, defaultShell =
+			prevUser, prevOS, prevPasswd, prevOutput, prevDefault
+	})
+
+	currentUser = func() (*user.User, error) {
+		return &user.User{Uid: "501", Username: "stan"}, nil
+	}
+	goos = platform
+	commandOutput = func(name string, args ...string) ([]byte, error) {
+		line := strings.Join(append([]string{name}, args...), " ")
+		if out, ok := commands[line]; ok {
+			return []byte(out), nil
+		}
+		return nil, fmt.Errorf("command not found: %s", line)
+	}
+	passwdPath = writeFile(t, "passwd", passwd, 0644)
+	defaultShell = filepath.Join(t.TempDir(), "missing")
+}
+
+// writeFile writes a file in a temporary directory and returns its path.
+func writeFile(
+	t *testing.T,
+	name string,
+	content string,
+	perm os.FileMode,
+) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+// executable returns the path of a new executable file.
+func executable(
+	t *testing.T,
+	name string,
+) string {
+	return writeFile(t, name, "#!/bin/sh\n", 0755)
+}
+
+func TestPasswdShell(t *testing.T) {
+	for _, tc := range []struct {
+		entry string
+		shell string
+		ok    bool
+	}{
+		{"stan:x:501:20:Stan:/home/stan:/bin/zsh", "/bin/zsh", true},
+		{"stan:x:501:20:Stan:/home/stan:", "/bin/sh", true},
+		{"stanley:x:502:20::/home/stanley:/bin/fish", "", false},
+		{"stan:x:501", "", false},
+		{"", "", false},
+	} {
+		shell, ok := passwdShell(tc.entry, "stan")
+		if shell != tc.shell || ok != tc.ok {
+			t.Errorf("%q: got %q, %t, want %q, %t",
+				tc.entry, shell, ok, tc.shell, tc.ok)
+		}
+	}
+}
+
+func TestLoginShell(t *testing.T) {
+	u := &user.User{Uid: "501", Username: "stan"}
+	for _, tc := range []struct {
+		name     string
+		os       string
+		commands map[string]string
+		passwd   string
+		shell    string
+	}{
+		{
+			"darwin dscl", "darwin",
+			map[string]string{
+				"dscl . -read /Users/stan UserShell": "UserShell: /bin/zsh\n",
+			},
+			"stan:x:501:20::/home/stan:/bin/bash\n", "/bin/zsh",
+		},
+		{
+			"darwin without dscl", "darwin", nil,
+			"stan:x:501:20::/home/stan:/bin/bash\n", "",
+		},
+		{
+			"linux getent", "linux",
+			map[string]string{
+				"getent passwd stan": "stan:x:501:20::/home/stan:/bin/fish\n",
+			},
+			"stan:x:501:20::/home/stan:/bin/bash\n", "/bin/fish",
+		},
+		{
+			"linux passwd", "linux", nil,
+			"root:x:0:0::/root:/bin/sh\nstan:x:501:20::/home/stan:/bin/bash\n",
+			"/bin/bash",
+		},
+		{
+			"unknown user", "freebsd", nil,
+			"root:x:0:0::/root:/bin/sh\n", "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockLookups(t, tc.os, tc.commands, tc.passwd)
+			if shell := loginShell(u); shell != tc.shell {
+				t.Errorf("Login shell: got %q, want %q", shell, tc.shell)
+			}
+		})
+	}
+}
+
+// passwdFixture is a passwd(5) file where the entry of the current user
+// (stan, uid 501) comes after users with higher uids, a user sharing its uid
+// and a user whose name starts with its own.
+const passwdFixture = `# /etc/passwd
+root:x:0:0:root:/root:/bin/bash
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+ada:x:1000:1000:Ada:/home/ada:/bin/fish
+grace:x:1001:1001:Grace:/home/grace:/bin/tcsh
+stanley:x:1002:1002:Stanley:/home/stanley:/bin/ksh
+alias:x:501:20:Alias of stan:/home/stan:/bin/dash
+malformed:x:501
+stan:x:501:20:Stan:/home/stan:%s
+nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin
+`
+
+func TestRetrieveShellPasswdFixture(t *testing.T) {
+	zsh := executable(t, "zsh")
+	mockLookups(t, "linux", nil, fmt.Sprintf(passwdFixture, zsh))
+	t.Setenv("SHELL", executable(t, "env"))
+
+	shell, err := retrieveShell(context.Background())
+	if err != nil {
+		t.Fatalf("retrieveShell: %v", err)
+	}
+	if shell != zsh {
+		t.Errorf("Shell: got %q, want the shell of stan %q", shell, zsh)
+	}
+
+	// Without an entry for the current user, the fallbacks are used.
+	currentUser = func() (*user.User, error) {
+		return &user.User{Uid: "1003", Username: "linus"}, nil
+	}
+	t.Setenv("SHELL", "")
+	defaultShell = executable(t, "bash")
+	if shell, err := retrieveShell(context.Background()); err != nil ||
+		shell != defaultShell {
+		t.Errorf("Shell: got %q (%v), want the default %q",
+			shell, err, defaultShell)
+	}
+}
+
+func TestRetrieveShellFallbacks(t *testing.T) {
+	ctx := context.Background()
+	login := executable(t, "login")
+	env := executable(t, "env")
+	missing := filepath.Join(t.TempDir(), "missing")
+	notExecutable := writeFile(t, "sh", "", 0644)
+
+	for _, tc := range []struct {
+		name   string
+		login  string
+		env    string
+		def    string
+		shell  string
+		failed bool
+	}{
+		{"login shell", login, env, "", login, false},
+		{"missing login shell", missing, env, "", env, false},
+		{"login shell not executable", notExecutable, env, "", env, false},
+		{"relative SHELL", "", "bash", login, login, false},
+		{"default", "", "", login, login, false},
+		{"none", missing, notExecutable, missing, "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockLookups(t, "linux", nil,
+				fmt.Sprintf("stan:x:501:20::/home/stan:%s\n", tc.login),
+			)
+			if tc.login == "" {
+				passwdPath = missing
+			}
+			if tc.def != "" {
+				defaultShell = tc.def
+			}
+			t.Setenv("SHELL", tc.env)
+
+			shell, err := retrieveShell(ctx)
+			if tc.failed {
+				e, ok := errors.Cause(err).(*ShellError)
+				if !ok {
+					t.Fatalf("Error: got %v, want a ShellError", err)
+				}
+				if len(e.Tried) != 3 {
+					t.Errorf("Tried: got %v", e.Tried)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("retrieveShell: %v", err)
+			}
+			if shell != tc.shell {
+				t.Errorf("Shell: got %q, want %q", shell, tc.shell)
+			}
+		})
+	}
+}
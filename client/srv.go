@@ -7,18 +7,51 @@ import (
 	"net"
 	"os"
 	"path"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/listen"
 )
 
 type Srv struct {
 	warp    string
 	session *Session
 	path    string
-	mutex   *sync.Mutex
+	status  *StatusFile
+	// grants are the time-limited authorizations currently scheduled to be
+	// revoked, indexed by grantKey.
+	grants map[string]*grant
+	// subscribers are notified each time the state changes.
+	subscribers map[chan struct{}]struct{}
+	// maxClients is the maximum number of clients of the warp set by the host
+	// (0 if unlimited), changed with limit commands.
+	maxClients int
+	// closeC is closed once the warp was closed with a close command.
+	closeC chan struct{}
+	closed bool
+	mutex  *sync.Mutex
+}
+
+// errCodeDisconnected is the error code of the result of commands requiring
+// the warp to be connected to warpd, run while it is disconnected.
+const errCodeDisconnected = "disconnected"
+
+// grant is a time-limited authorization along with its revocation timer.
+type grant struct {
+	warp.Grant
+	timer *time.Timer
+}
+
+// grantKey returns the key of a grant in the grants map.
+func grantKey(
+	user string,
+	mode warp.Mode,
+) string {
+	return fmt.Sprintf("%s:%d", user, mode)
 }
 
 // Path returns the unix socket path.
@@ -26,19 +59,65 @@ func (s *Srv) Path() string {
 	return s.path
 }
 
+// SocketPath returns the path of the local command server unix socket of a
+// warp.
+func SocketPath(
+	w string,
+) string {
+	return path.Join(
+		os.TempDir(),
+		fmt.Sprintf("_warp_%s.sock", w),
+	)
+}
+
 // NewSrv constructs a Srv ready to start serving local requests.
 func NewSrv(
 	ctx context.Context,
 	warp string,
 ) *Srv {
 	return &Srv{
-		warp:    warp,
-		session: nil,
-		path: path.Join(
-			os.TempDir(),
-			fmt.Sprintf("_warp_%s.sock", warp),
-		),
-		mutex: &sync.Mutex{},
+		warp:        warp,
+		session:     nil,
+		path:        SocketPath(warp),
+		status:      NewStatusFile(warp),
+		grants:      map[string]*grant{},
+		subscribers: map[chan struct{}]struct{}{},
+		closeC:      make(chan struct{}),
+		mutex:       &sync.Mutex{},
+	}
+}
+
+// SetMaxClients sets the maximum number of clients of the warp, as opened.
+func (s *Srv) SetMaxClients(
+	max int,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxClients = max
+}
+
+// MaxClients returns the maximum number of clients of the warp, 0 if
+// unlimited.
+func (s *Srv) MaxClients() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.maxClients
+}
+
+// Closed returns a channel closed once the warp was closed with a close
+// command (`warp close`), for the host to exit.
+func (s *Srv) Closed() <-chan struct{} {
+	return s.closeC
+}
+
+// Close removes the status file of the warp and cancels all scheduled
+// revocations.
+func (s *Srv) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.Close()
+	for key := range s.grants {
+		s.cancelGrant(key)
 	}
 }
 
@@ -53,6 +132,124 @@ func (s *Srv) SetSession(
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.session = session
+	if session == nil {
+		// All authorizations are lost when disconnected.
+		for key := range s.grants {
+			s.cancelGrant(key)
+		}
+	}
+	s.stateChanged()
+}
+
+// StateUpdated is called by the host each time it receives a state update. It
+// updates the status file and cancels the scheduled revocations of users who
+// disconnected.
+func (s *Srv) StateUpdated(
+	ctx context.Context,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.session != nil {
+		state := s.session.ProtocolState()
+		for key, g := range s.grants {
+			if _, ok := state.Users[g.User]; !ok {
+				s.cancelGrant(key)
+			}
+		}
+	}
+	s.stateChanged()
+}
+
+// Modes returns the modes of the users of the warp, without the modes granted
+// to them for a limited time. It is used to restore the modes of the users
+// once the warp is rehosted after an internal error of warpd.
+func (s *Srv) Modes() map[string]warp.Mode {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.session == nil {
+		return map[string]warp.Mode{}
+	}
+	modes := s.session.Modes()
+	for _, g := range s.grants {
+		if mode, ok := modes[g.User]; ok {
+			modes[g.User] = mode &^ g.Mode
+		}
+	}
+	return modes
+}
+
+// scheduleGrant schedules the revocation of a mode for a user after ttl. It
+// must be called with the lock held.
+func (s *Srv) scheduleGrant(
+	ctx context.Context,
+	user string,
+	mode warp.Mode,
+	ttl time.Duration,
+) {
+	key := grantKey(user, mode)
+	s.cancelGrant(key)
+	g := &grant{
+		Grant: warp.Grant{
+			User:    user,
+			Mode:    mode,
+			Expires: time.Now().Add(ttl),
+		},
+	}
+	g.timer = time.AfterFunc(ttl, func() {
+		s.mutex.Lock()
+		current := s.grants[key] == g
+		if current {
+			delete(s.grants, key)
+		}
+		s.mutex.Unlock()
+		if current {
+			s.executeRevoke(ctx, warp.Command{
+				Type: warp.CmdTpRevoke,
+				Args: []string{user},
+				Mode: mode,
+			})
+		}
+	})
+	s.grants[key] = g
+}
+
+// cancelGrant cancels the scheduled revocation for the given key if any. It
+// must be called with the lock held.
+func (s *Srv) cancelGrant(
+	key string,
+) {
+	if g, ok := s.grants[key]; ok {
+		g.timer.Stop()
+		delete(s.grants, key)
+	}
+}
+
+// grantList returns the scheduled revocations. It must be called with the lock
+// held.
+func (s *Srv) grantList() []warp.Grant {
+	grants := []warp.Grant{}
+	for _, g := range s.grants {
+		grants = append(grants, g.Grant)
+	}
+	return grants
+}
+
+// stateChanged updates the status file and notifies subscribers. It must be
+// called with the lock held.
+func (s *Srv) stateChanged() {
+	if s.session == nil {
+		s.status.Update(nil)
+	} else {
+		state := s.session.ProtocolState()
+		s.status.Update(&state)
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// A notification is already pending.
+		}
+	}
 }
 
 // Run starts the local server.
@@ -69,10 +266,17 @@ func (s *Srv) Run(
 	}
 	defer ln.Close()
 
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
 	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			continue
+		conn, err := listen.Accept(ctx, ln, nil)
+		if errors.Cause(err) == net.ErrClosed {
+			return nil
+		} else if err != nil {
+			return errors.Trace(err)
 		}
 		go func() {
 			s.handle(ctx, conn)
@@ -97,6 +301,10 @@ func (s *Srv) handle(
 		)
 	}
 
+	if cmd.Type == warp.CmdTpSubscribe {
+		return s.handleSubscribe(ctx, commandR, commandW)
+	}
+
 	var result warp.CommandResult
 
 	switch cmd.Type {
@@ -106,6 +314,10 @@ func (s *Srv) handle(
 		result = s.executeAuthorize(ctx, cmd)
 	case warp.CmdTpRevoke:
 		result = s.executeRevoke(ctx, cmd)
+	case warp.CmdTpClose:
+		result = s.executeClose(ctx, cmd)
+	case warp.CmdTpLimit:
+		result = s.executeLimit(ctx, cmd)
 	default:
 		result.Error.Code = "command_unknown"
 		result.Error.Message = fmt.Sprintf(
@@ -116,11 +328,10 @@ func (s *Srv) handle(
 	// Always return the current state of the warp if connected or an
 	// indication of the disconnection otherwise.
 	s.mutex.Lock()
+	s.appendState(&result)
 	if s.session != nil {
-		result.SessionState = s.session.ProtocolState()
-	} else {
-		result.SessionState.Warp = s.warp
-		result.Disconnected = true
+		// Commands can alter modes, let's keep the status file in sync.
+		s.stateChanged()
 	}
 	s.mutex.Unlock()
 
@@ -130,9 +341,104 @@ func (s *Srv) handle(
 		)
 	}
 
+	// The warp is closed once the result is sent, as the host exits.
+	if cmd.Type == warp.CmdTpClose {
+		s.mutex.Lock()
+		if !s.closed {
+			s.closed = true
+			close(s.closeC)
+		}
+		s.mutex.Unlock()
+	}
+
 	return nil
 }
 
+// appendState sets the current state of the warp on a command result. It must
+// be called with the lock held.
+func (s *Srv) appendState(
+	result *warp.CommandResult,
+) {
+	if s.session != nil {
+		result.SessionState = s.session.ProtocolState()
+		result.Grants = s.grantList()
+	} else {
+		result.SessionState.Warp = s.warp
+		result.Disconnected = true
+	}
+}
+
+// Subscribe returns a channel notified each time the state changes (and
+// immediately), along with a function to unsubscribe. Notifications are
+// coalesced so that a slow subscriber is notified at most once for the
+// changes that happened since it last received one.
+func (s *Srv) Subscribe() (<-chan struct{}, func()) {
+	notifyC := make(chan struct{}, 1)
+	notifyC <- struct{}{}
+	s.mutex.Lock()
+	s.subscribers[notifyC] = struct{}{}
+	s.mutex.Unlock()
+	return notifyC, func() {
+		s.mutex.Lock()
+		delete(s.subscribers, notifyC)
+		s.mutex.Unlock()
+	}
+}
+
+// handleSubscribe streams the state of the warp over a local connection each
+// time it changes, until the connection is closed.
+func (s *Srv) handleSubscribe(
+	ctx context.Context,
+	commandR *gob.Decoder,
+	commandW *gob.Encoder,
+) error {
+	notifyC, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+
+	// Nothing is expected from the subscriber, a read returns once the
+	// connection is closed.
+	closedC := make(chan struct{})
+	go func() {
+		var cmd warp.Command
+		commandR.Decode(&cmd)
+		close(closedC)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-closedC:
+			return nil
+		case <-notifyC:
+		}
+
+		result := warp.CommandResult{
+			Type: warp.CmdTpSubscribe,
+		}
+		s.mutex.Lock()
+		s.appendState(&result)
+		s.mutex.Unlock()
+
+		if err := commandW.Encode(result); err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to send command result: %v", err),
+			)
+		}
+	}
+}
+
+// commandMode returns the mode bit targeted by an authorize or revoke command,
+// defaulting to warp.ModeShellWrite.
+func commandMode(
+	cmd warp.Command,
+) warp.Mode {
+	if cmd.Mode == 0 {
+		return warp.ModeShellWrite
+	}
+	return cmd.Mode
+}
+
 // executeState executes the *state* command.
 func (s *Srv) executeState(
 	ctx context.Context,
@@ -156,7 +462,7 @@ func (s *Srv) executeAuthorize(
 		return warp.CommandResult{
 			Type: warp.CmdTpAuthorize,
 			Error: warp.Error{
-				Code:    "disconnected",
+				Code:    errCodeDisconnected,
 				Message: "The warp is currently disconnected.",
 			},
 		}
@@ -172,6 +478,16 @@ func (s *Srv) executeAuthorize(
 		}
 	}
 
+	if s.session.ReadOnly() && commandMode(cmd)&warp.ModeShellWrite != 0 {
+		return warp.CommandResult{
+			Type: warp.CmdTpAuthorize,
+			Error: warp.Error{
+				Code:    "read_only",
+				Message: "The warp is read-only, its input is never written.",
+			},
+		}
+	}
+
 	mode, err := s.session.GetMode(cmd.Args[0])
 	if err != nil {
 		return warp.CommandResult{
@@ -183,7 +499,7 @@ func (s *Srv) executeAuthorize(
 		}
 	}
 
-	err = s.session.SetMode(cmd.Args[0], *mode|warp.ModeShellWrite)
+	err = s.session.SetMode(cmd.Args[0], *mode|commandMode(cmd))
 	if err != nil {
 		return warp.CommandResult{
 			Type: warp.CmdTpAuthorize,
@@ -194,12 +510,21 @@ func (s *Srv) executeAuthorize(
 		}
 	}
 
-	if err := s.session.SendHostUpdate(ctx, warp.HostUpdate{
-		Warp:       s.session.Warp(),
-		From:       s.session.Session(),
-		WindowSize: s.session.WindowSize(),
-		Modes:      s.session.Modes(),
-	}); err != nil {
+	// In single-writer mode, authorizing a user to write hands them the
+	// write token.
+	if commandMode(cmd) == warp.ModeShellWrite {
+		if err := s.session.SetWriter(cmd.Args[0]); err != nil {
+			return warp.CommandResult{
+				Type: warp.CmdTpAuthorize,
+				Error: warp.Error{
+					Code:    "user_unknown",
+					Message: err.Error() + ".",
+				},
+			}
+		}
+	}
+
+	if err := s.session.QueueHostUpdate(ctx, true); err != nil {
 		return warp.CommandResult{
 			Type: warp.CmdTpAuthorize,
 			Error: warp.Error{
@@ -209,6 +534,13 @@ func (s *Srv) executeAuthorize(
 		}
 	}
 
+	// A new authorization replaces any previous time-limited one.
+	if cmd.TTL > 0 {
+		s.scheduleGrant(ctx, cmd.Args[0], commandMode(cmd), cmd.TTL)
+	} else {
+		s.cancelGrant(grantKey(cmd.Args[0], commandMode(cmd)))
+	}
+
 	// NO-OP State is automatically appended to all results.
 	return warp.CommandResult{
 		Type: warp.CmdTpAuthorize,
@@ -227,12 +559,13 @@ func (s *Srv) executeRevoke(
 		return warp.CommandResult{
 			Type: warp.CmdTpRevoke,
 			Error: warp.Error{
-				Code:    "disconnected",
+				Code:    errCodeDisconnected,
 				Message: "The warp is currently disconnected.",
 			},
 		}
 	}
 
+	declines := []string{}
 	for _, user := range cmd.Args {
 		mode, err := s.session.GetMode(user)
 		if err != nil {
@@ -245,7 +578,9 @@ func (s *Srv) executeRevoke(
 			}
 		}
 
-		err = s.session.SetMode(user, *mode-*mode&warp.ModeShellWrite)
+		s.cancelGrant(grantKey(user, commandMode(cmd)))
+
+		err = s.session.SetMode(user, *mode&^commandMode(cmd))
 		if err != nil {
 			return warp.CommandResult{
 				Type: warp.CmdTpRevoke,
@@ -255,14 +590,36 @@ func (s *Srv) executeRevoke(
 				},
 			}
 		}
+
+		// Revoking a requested mode declines the request.
+		if s.session.PendingRequest(user)&commandMode(cmd) != 0 {
+			declines = append(declines, user)
+		}
 	}
 
-	if err := s.session.SendHostUpdate(ctx, warp.HostUpdate{
-		Warp:       s.session.Warp(),
-		From:       s.session.Session(),
-		WindowSize: s.session.WindowSize(),
-		Modes:      s.session.Modes(),
-	}); err != nil {
+	if cmd.Kick {
+		if err := s.session.SendKicks(
+			ctx, cmd.Args, warp.ErrCodeKicked,
+		); err != nil {
+			return warp.CommandResult{
+				Type: warp.CmdTpRevoke,
+				Error: warp.Error{
+					Code:    "update_failed",
+					Message: "Failed to apply update to warp.",
+				},
+			}
+		}
+	} else if len(declines) > 0 {
+		if err := s.session.SendDeclines(ctx, declines); err != nil {
+			return warp.CommandResult{
+				Type: warp.CmdTpRevoke,
+				Error: warp.Error{
+					Code:    "update_failed",
+					Message: "Failed to apply update to warp.",
+				},
+			}
+		}
+	} else if err := s.session.QueueHostUpdate(ctx, true); err != nil {
 		return warp.CommandResult{
 			Type: warp.CmdTpRevoke,
 			Error: warp.Error{
@@ -277,3 +634,64 @@ func (s *Srv) executeRevoke(
 		Type: warp.CmdTpRevoke,
 	}
 }
+
+// executeClose executes the *close* command. The warp is closed by handle once
+// the result is sent.
+func (s *Srv) executeClose(
+	ctx context.Context,
+	cmd warp.Command,
+) warp.CommandResult {
+	return warp.CommandResult{
+		Type: warp.CmdTpClose,
+	}
+}
+
+// executeLimit executes the *limit* command. The limit is applied to the warp
+// once connected if it is currently disconnected.
+func (s *Srv) executeLimit(
+	ctx context.Context,
+	cmd warp.Command,
+) warp.CommandResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	max := 0
+	if len(cmd.Args) == 1 {
+		max, _ = strconv.Atoi(cmd.Args[0])
+	}
+	if len(cmd.Args) != 1 || max < 0 {
+		return warp.CommandResult{
+			Type: warp.CmdTpLimit,
+			Error: warp.Error{
+				Code:    "limit_invalid",
+				Message: "Invalid maximum number of clients.",
+			},
+		}
+	}
+
+	s.maxClients = max
+	if s.session != nil {
+		s.session.SetMaxClients(max)
+		var err error
+		if excess := s.session.ExcessClients(); len(excess) > 0 {
+			// The newest clients are disconnected if the limit is exceeded.
+			err = s.session.SendKicks(ctx, excess, warp.ErrCodeWarpFull)
+		} else {
+			err = s.session.QueueHostUpdate(ctx, false)
+		}
+		if err != nil {
+			return warp.CommandResult{
+				Type: warp.CmdTpLimit,
+				Error: warp.Error{
+					Code:    "update_failed",
+					Message: "Failed to apply update to warp.",
+				},
+			}
+		}
+	}
+
+	// NO-OP State is automatically appended to all results.
+	return warp.CommandResult{
+		Type: warp.CmdTpLimit,
+	}
+}
@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/spolu/warp"
+)
+
+// statusDebounce is the minimum delay between two writes of the status file.
+const statusDebounce = 250 * time.Millisecond
+
+// StatusPath returns the path of the status file of a warp.
+func StatusPath(
+	w string,
+) string {
+	return path.Join(
+		os.TempDir(),
+		fmt.Sprintf("_warp_%s.status", w),
+	)
+}
+
+// StatusFile maintains a small status file for prompt and script integrations
+// (its path is exposed to the shell through warp.EnvWarpStatus). The file is
+// made of `key=value` lines so that it can be sourced by a shell:
+//
+//	connected=true
+//	clients=2
+//	authorized=1
+//
+// `clients` is the number of users connected to the warp (excluding the host)
+// and `authorized` the number of them authorized to write. The file is
+// rewritten atomically, only when its content changes and at most once every
+// statusDebounce.
+type StatusFile struct {
+	path    string
+	pending string
+	written string
+	timer   *time.Timer
+	closed  bool
+
+	mutex *sync.Mutex
+}
+
+// NewStatusFile constructs a StatusFile for the given warp.
+func NewStatusFile(
+	w string,
+) *StatusFile {
+	return &StatusFile{
+		path:  StatusPath(w),
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Update schedules a write of the status file from the provided state. A nil
+// state indicates that the warp is disconnected.
+func (s *StatusFile) Update(
+	state *warp.State,
+) {
+	connected := state != nil
+	clients := 0
+	authorized := 0
+	if state != nil {
+		for _, u := range state.Users {
+			if u.Hosting {
+				continue
+			}
+			clients++
+			if u.Mode&warp.ModeShellWrite != 0 {
+				authorized++
+			}
+		}
+	}
+	content := fmt.Sprintf(
+		"connected=%t\nclients=%d\nauthorized=%d\n",
+		connected, clients, authorized,
+	)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.pending = content
+	if s.timer == nil {
+		s.timer = time.AfterFunc(statusDebounce, s.flush)
+	}
+}
+
+// flush writes the pending content if it changed since the last write.
+func (s *StatusFile) flush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.timer = nil
+	if s.closed || s.pending == s.written {
+		return
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(s.pending), 0644); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return
+	}
+	s.written = s.pending
+}
+
+// Close cancels any pending write and removes the status file.
+func (s *StatusFile) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	os.Remove(s.path)
+}
@@ -0,0 +1,226 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// statusLineInterval is the minimum delay between two drawings of the status
+// line.
+const statusLineInterval = 100 * time.Millisecond
+
+// StatusLine draws a line of text over the last row of the local terminal of
+// a viewer streaming a warp raw (`warp connect --legend`), along with a
+// right-aligned text (`warp connect --latency-stats`). The output of the
+// warp is written through the StatusLine, which redraws the line after it
+// (as the output may have overwritten it), saving and restoring the cursor
+// around the drawing so as not to disturb the stream. The line is only drawn
+// between escape sequences of the output (applications of the warp saving
+// the cursor position themselves may see it moved though).
+type StatusLine struct {
+	fd int
+	w  io.Writer
+
+	text       string
+	width      int
+	right      string
+	rightWidth int
+	drawn      bool
+	dirty      bool
+
+	// state is the state of the escape sequence parser tracking whether
+	// the output is between escape sequences and partial whether it ends
+	// with an incomplete character.
+	state   escState
+	partial bool
+
+	mutex *sync.Mutex
+}
+
+// escState is the state of the parser tracking escape sequences.
+type escState int
+
+const (
+	escGround escState = iota
+	escEscape
+	escCSI
+	escString
+	escStringEscape
+)
+
+// NewStatusLine constructs a StatusLine drawing to w, fd being the file
+// descriptor of the local terminal used to retrieve its size.
+func NewStatusLine(
+	fd int,
+	w io.Writer,
+) *StatusLine {
+	return &StatusLine{
+		fd:    fd,
+		w:     w,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Run redraws the status line when needed until the context is canceled.
+func (s *StatusLine) Run(
+	ctx context.Context,
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(statusLineInterval):
+		}
+		s.mutex.Lock()
+		if s.dirty && s.state == escGround && !s.partial {
+			s.draw()
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// Set sets the text of the status line (cleared if empty), width being its
+// width on screen (the text may contain SGR sequences).
+func (s *StatusLine) Set(
+	text string,
+	width int,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if text == s.text {
+		return
+	}
+	s.text = text
+	s.width = width
+	s.dirty = true
+}
+
+// SetRight sets the right-aligned text of the status line (cleared if
+// empty), width being its width on screen. It is only drawn if it fits
+// along with the text set with Set.
+func (s *StatusLine) SetRight(
+	text string,
+	width int,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if text == s.right {
+		return
+	}
+	s.right = text
+	s.rightWidth = width
+	s.dirty = true
+}
+
+// Write writes output of the warp to the local terminal.
+func (s *StatusLine) Write(
+	data []byte,
+) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range data {
+		s.state = s.state.next(c)
+	}
+	if len(data) > 0 {
+		s.partial = partialRune(data)
+	}
+	if s.text != "" || s.right != "" || s.drawn {
+		s.dirty = true
+	}
+	return s.w.Write(data)
+}
+
+// Close clears the status line.
+func (s *StatusLine) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.drawn {
+		s.text = ""
+		s.right = ""
+		s.draw()
+	}
+}
+
+// draw draws the status line. It must be called with the lock held.
+func (s *StatusLine) draw() {
+	cols, rows, err := terminal.GetSize(s.fd)
+	if err != nil || rows <= 0 {
+		return
+	}
+	s.dirty = false
+	s.drawn = s.text != "" || s.right != ""
+	text, width := s.text, s.width
+	if width > cols {
+		// Better not drawn than wrapped over the stream.
+		text, width = "", 0
+	}
+	right := ""
+	if s.right != "" && width+1+s.rightWidth <= cols {
+		right = fmt.Sprintf(
+			"\033[%d;%dH%s\033[0m", rows, cols-s.rightWidth+1, s.right,
+		)
+	}
+	fmt.Fprintf(s.w,
+		"\0337\033[%d;1H\033[0m%s\033[0m\033[K%s\0338", rows, text, right,
+	)
+}
+
+// next returns the state of the parser after byte c.
+func (e escState) next(
+	c byte,
+) escState {
+	switch e {
+	case escEscape:
+		switch {
+		case c == '[':
+			return escCSI
+		case c == ']' || c == 'P' || c == '_' || c == '^' || c == 'X':
+			return escString
+		case c >= 0x20 && c <= 0x2f:
+			// Intermediate bytes (charset designation etc.).
+			return escEscape
+		}
+		return escGround
+	case escCSI:
+		if c >= 0x40 && c <= 0x7e {
+			return escGround
+		}
+		return escCSI
+	case escString:
+		switch c {
+		case 0x07:
+			return escGround
+		case 0x1b:
+			return escStringEscape
+		}
+		return escString
+	case escStringEscape:
+		if c == '\\' {
+			return escGround
+		}
+		return escString
+	}
+	if c == 0x1b {
+		return escEscape
+	}
+	return escGround
+}
+
+// partialRune returns whether data ends with an incomplete UTF-8 encoded
+// character.
+func partialRune(
+	data []byte,
+) bool {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			return !utf8.FullRune(data[i:])
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// terminalMutex protects the saved terminal state so that it can be restored
+// from any goroutine (signal handler, panic recovery or regular teardown).
+var terminalMutex = &sync.Mutex{}
+var terminalFd int
+var terminalOld *terminal.State
+
+// MakeRawTerminal puts the terminal in raw mode, saving its previous state so
+// that it is restored even on abnormal exit. It installs a signal handler
+// that restores the terminal and calls cancel on SIGINT, SIGTERM, SIGHUP and
+// SIGQUIT. The returned function restores the terminal and uninstalls the
+// signal handler.
+func MakeRawTerminal(
+	ctx context.Context,
+	cancel func(),
+	fd int,
+) (func(), error) {
+	old, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	terminalMutex.Lock()
+	terminalFd = fd
+	terminalOld = old
+	terminalMutex.Unlock()
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch,
+		syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT,
+	)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ch:
+			RestoreTerminal()
+			cancel()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		close(done)
+		RestoreTerminal()
+	}, nil
+}
+
+// RestoreTerminal restores the terminal to the state saved by MakeRawTerminal
+// if any. It is safe to call it multiple times and from any goroutine.
+func RestoreTerminal() {
+	terminalMutex.Lock()
+	defer terminalMutex.Unlock()
+	if terminalOld != nil {
+		terminal.Restore(terminalFd, terminalOld)
+		terminalOld = nil
+	}
+}
+
+// RecoverTerminal is meant to be deferred at the top of goroutines that run
+// while the terminal is in raw mode. In case of panic, it restores the
+// terminal before resuming the panic.
+func RecoverTerminal() {
+	if r := recover(); r != nil {
+		RestoreTerminal()
+		panic(r)
+	}
+}
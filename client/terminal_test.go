@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kr/pty"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// openTerminal opens a pseudo-terminal, returning the file descriptor of its
+// terminal end and its initial state.
+func openTerminal(
+	t *testing.T,
+) (int, *terminal.State, func()) {
+	t.Helper()
+	p, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("No pseudo-terminal available: %v", err)
+	}
+	fd := int(tty.Fd())
+	initial, err := terminal.GetState(fd)
+	if err != nil {
+		t.Fatalf("GetState: %v", err)
+	}
+	return fd, initial, func() {
+		tty.Close()
+		p.Close()
+	}
+}
+
+// assertState checks that the terminal is (or is not) in its initial state.
+func assertState(
+	t *testing.T,
+	fd int,
+	initial *terminal.State,
+	restored bool,
+) {
+	t.Helper()
+	st, err := terminal.GetState(fd)
+	if err != nil {
+		t.Fatalf("GetState: %v", err)
+	}
+	if reflect.DeepEqual(st, initial) != restored {
+		if restored {
+			t.Errorf("Terminal not restored")
+		} else {
+			t.Errorf("Terminal not in raw mode")
+		}
+	}
+}
+
+func TestRestoreTerminalOnSignal(t *testing.T) {
+	fd, initial, closeTerminal := openTerminal(t)
+	defer closeTerminal()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restore, err := MakeRawTerminal(ctx, cancel, fd)
+	if err != nil {
+		t.Fatalf("MakeRawTerminal: %v", err)
+	}
+	defer restore()
+	assertState(t, fd, initial, false)
+
+	// The signal handler installed by MakeRawTerminal catches the signal.
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("Kill: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Session not canceled on SIGTERM")
+	}
+	assertState(t, fd, initial, true)
+}
+
+func TestRestoreTerminalOnPanic(t *testing.T) {
+	fd, initial, closeTerminal := openTerminal(t)
+	defer closeTerminal()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restore, err := MakeRawTerminal(ctx, cancel, fd)
+	if err != nil {
+		t.Fatalf("MakeRawTerminal: %v", err)
+	}
+	defer restore()
+	assertState(t, fd, initial, false)
+
+	recovered := make(chan interface{})
+	go func() {
+		// Catches the panic resumed by RecoverTerminal.
+		defer func() {
+			recovered <- recover()
+		}()
+		defer RecoverTerminal()
+		panic("boom")
+	}()
+	if r := <-recovered; r != "boom" {
+		t.Errorf("Panic not resumed: got %v", r)
+	}
+	assertState(t, fd, initial, true)
+}
@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// TLSFlags are the flags configuring the TLS connection to warpd (see
+// TLSConfig), registered as value flags by the commands connecting to it.
+var TLSFlags = []string{"tls-cert", "tls-key", "pin"}
+
+// ErrCodePinMismatch is the code of the error returned when the certificate
+// of warpd does not match the pinned fingerprint.
+const ErrCodePinMismatch = "certificate_pin_mismatch"
+
+// PinMismatchError is returned when connecting to a warpd whose certificate
+// does not match the pinned fingerprint (`--pin`).
+type PinMismatchError struct {
+	Pin         string
+	Fingerprint string
+}
+
+// Error implements the error interface.
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf(
+		"%s: the certificate of warpd (SHA-256 fingerprint %s) does not "+
+			"match the pinned fingerprint %s",
+		ErrCodePinMismatch, e.Fingerprint, e.Pin,
+	)
+}
+
+// IsPinMismatch returns whether err is a *PinMismatchError.
+func IsPinMismatch(
+	err error,
+) bool {
+	_, ok := errors.Cause(err).(*PinMismatchError)
+	return ok
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate (DER encoded)
+// as lowercase hex.
+func Fingerprint(
+	raw []byte,
+) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// TLSConfig constructs the TLS configuration used to connect to warpd. The
+// client certificate and key are read from the flags `tls-cert` and `tls-key`
+// or the WARPD_TLS_CERT and WARPD_TLS_KEY env variables, and presented to
+// warpd if it requires client certificates.
+//
+// If a pin is set (flag `pin` or WARPD_TLS_PIN env variable), the certificate
+// of warpd is verified against the pinned SHA-256 fingerprint instead of the
+// system CAs, for self-hosted warpds with self-signed certificates.
+func TLSConfig(
+	flags map[string]string,
+	insecure bool,
+) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+
+	pin := os.Getenv("WARPD_TLS_PIN")
+	if p, ok := flags["pin"]; ok {
+		pin = p
+	}
+	if pin != "" {
+		// Fingerprints are commonly printed with colons (openssl).
+		pin = strings.ToLower(strings.Replace(pin, ":", "", -1))
+		if b, err := hex.DecodeString(pin); err != nil ||
+			len(b) != sha256.Size {
+			return nil, errors.Trace(
+				errors.Newf("Invalid certificate pin (expected a SHA-256 " +
+					"fingerprint): --pin=<sha256>"),
+			)
+		}
+		// The chain is not verified against the system CAs, the leaf
+		// certificate is verified against the pin instead.
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(
+			rawCerts [][]byte,
+			verifiedChains [][]*x509.Certificate,
+		) error {
+			if len(rawCerts) == 0 {
+				return &PinMismatchError{Pin: pin, Fingerprint: "none"}
+			}
+			if f := Fingerprint(rawCerts[0]); f != pin {
+				return &PinMismatchError{Pin: pin, Fingerprint: f}
+			}
+			return nil
+		}
+	}
+
+	certFile := os.Getenv("WARPD_TLS_CERT")
+	if f, ok := flags["tls-cert"]; ok {
+		certFile = f
+	}
+	keyFile := os.Getenv("WARPD_TLS_KEY")
+	if f, ok := flags["tls-key"]; ok {
+		keyFile = f
+	}
+
+	if certFile == "" && keyFile == "" {
+		return config, nil
+	}
+	if certFile == "" || keyFile == "" || certFile == "true" ||
+		keyFile == "true" {
+		return nil, errors.Trace(
+			errors.Newf("Both `--tls-cert=<file>` and `--tls-key=<file>` are " +
+				"required to present a client certificate."),
+		)
+	}
+
+	cer, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Failed to load client certificate: %v", err),
+		)
+	}
+	config.Certificates = []tls.Certificate{cer}
+
+	return config, nil
+}
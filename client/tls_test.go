@@ -0,0 +1,177 @@
+package cli
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+)
+
+// pinnedWarpd serves host sessions over TLS with a self-signed certificate,
+// returning its address and the fingerprint of its certificate. The outcome
+// of each TLS handshake is sent on the returned channel.
+func pinnedWarpd(
+	t *testing.T,
+) (string, string, <-chan error) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "warpd"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{raw},
+			PrivateKey:  key,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	handshakesC := make(chan error, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			err = conn.(*tls.Conn).Handshake()
+			handshakesC <- err
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			fakeHostWarpd(t, conn)
+		}
+	}()
+	return ln.Addr().String(), Fingerprint(raw), handshakesC
+}
+
+// colonFingerprint formats a fingerprint the way openssl prints it.
+func colonFingerprint(
+	fingerprint string,
+) string {
+	pairs := []string{}
+	for i := 0; i < len(fingerprint); i += 2 {
+		pairs = append(pairs, fingerprint[i:i+2])
+	}
+	return strings.ToUpper(strings.Join(pairs, ":"))
+}
+
+func TestTLSConfigPin(t *testing.T) {
+	address, fingerprint, handshakesC := pinnedWarpd(t)
+	wrong := Fingerprint([]byte("another certificate"))
+
+	for _, tc := range []struct {
+		name  string
+		flags map[string]string
+		env   string
+		ok    bool
+	}{
+		{"matching pin", map[string]string{"pin": fingerprint}, "", true},
+		{"colon separated uppercase pin",
+			map[string]string{"pin": colonFingerprint(fingerprint)}, "", true},
+		{"pin from the environment", map[string]string{}, fingerprint, true},
+		{"flag overriding the environment",
+			map[string]string{"pin": fingerprint}, wrong, true},
+		{"wrong pin", map[string]string{"pin": wrong}, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("WARPD_TLS_PIN", tc.env)
+			config, err := TLSConfig(tc.flags, false)
+			if err != nil {
+				t.Fatalf("TLSConfig: %v", err)
+			}
+			conn, err := tls.Dial("tcp", address, config)
+			if !tc.ok {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("Connected with a wrong pin")
+				}
+				if !IsPinMismatch(err) {
+					t.Fatalf("Not a pin mismatch: %v", err)
+				}
+				if !strings.Contains(err.Error(), fingerprint) {
+					t.Errorf("Fingerprint of warpd not reported: %v", err)
+				}
+				// The connection is dropped during the handshake, before
+				// any session is set up.
+				if err := <-handshakesC; err == nil {
+					t.Errorf("Handshake completed with a wrong pin")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer conn.Close()
+			if err := <-handshakesC; err != nil {
+				t.Fatalf("Handshake: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ss, err := NewSession(
+				ctx, warp.Session{Token: "tok", User: "host", Secret: "sec"},
+				"goofy-dev", warp.SsTpHost, "stan",
+				SessionOptions{}, cancel, conn,
+			)
+			if err != nil {
+				t.Fatalf("NewSession: %v", err)
+			}
+			ss.TearDown()
+		})
+	}
+}
+
+func TestTLSConfigInvalidPin(t *testing.T) {
+	t.Setenv("WARPD_TLS_PIN", "")
+	fingerprint := Fingerprint([]byte("certificate"))
+	for _, pin := range []string{
+		"not-hex",
+		fingerprint[:62],
+		fingerprint + "00",
+		fingerprint[:63] + "g",
+	} {
+		if _, err := TLSConfig(map[string]string{"pin": pin}, false); err == nil {
+			t.Errorf("Pin %q accepted", pin)
+		}
+	}
+	t.Setenv("WARPD_TLS_PIN", "sha256")
+	if _, err := TLSConfig(map[string]string{}, false); err == nil {
+		t.Errorf("Invalid pin accepted from the environment")
+	}
+
+	// Without a pin the certificate is verified against the system CAs.
+	t.Setenv("WARPD_TLS_PIN", "")
+	config, err := TLSConfig(map[string]string{}, false)
+	if err != nil {
+		t.Fatalf("TLSConfig: %v", err)
+	}
+	if config.InsecureSkipVerify || config.VerifyPeerCertificate != nil {
+		t.Errorf("Certificate not verified without a pin")
+	}
+}
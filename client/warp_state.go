@@ -1,18 +1,63 @@
 package cli
 
 import (
+	"sort"
+
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/lib/errors"
 )
 
-// WarpState repreents the state of a warp client side. The warp state method
-// are not thread-safe and access to it should be protected by the associated
-// session lock.
+// WarpState represents the state of a warp client side. It is the only
+// client-side representation of a warp and is used by both host and shell
+// client sessions. WarpState methods are not thread-safe: the WarpState is
+// owned by a Session and only accessed through the Session methods, which
+// hold the session lock.
 type WarpState struct {
 	token string
 
 	windowSize warp.Size
 	users      map[string]UserState
+
+	panes []string
+	pane  string
+
+	// singleWriter and writer are the write token state of the warp (see
+	// warp.HostUpdate).
+	singleWriter bool
+	writer       string
+
+	// maxClients is the maximum number of clients of the warp (see
+	// warp.HostUpdate).
+	maxClients int
+	// title and term are the title and terminal type of the warp (see
+	// warp.HostUpdate).
+	title string
+	term  string
+	// readOnly indicates that the host never writes the input of the warp
+	// (see warp.HostUpdate).
+	readOnly bool
+	// writing is the list of the users writing to the warp (see
+	// warp.State).
+	writing []string
+	// hostSessions is the number of shell client sessions of the host user
+	// (see warp.State).
+	hostSessions int
+	// joins counts the users who joined the warp, to order them.
+	joins int
+	// ignored lists the modes sent by warpd that the last update ignored
+	// while hosting (see IgnoredModes).
+	ignored []IgnoredMode
+}
+
+// IgnoredMode is a mode sent by warpd for a user that differs from the mode
+// the host set for that user, ignored by the host.
+type IgnoredMode struct {
+	User     string
+	Username string
+	// Mode is the mode of the user as set by the host and Received the one
+	// sent by warpd.
+	Mode     warp.Mode
+	Received warp.Mode
 }
 
 // UserState represents the state of a user as seen client-side.
@@ -21,15 +66,21 @@ type UserState struct {
 	username string
 	mode     warp.Mode
 	hosting  bool
+	// requested is the mode requested by the user pending the host's
+	// decision, informational and taken from warpd as is (see warp.User).
+	requested warp.Mode
+	// joined is the order in which the user joined the warp.
+	joined int
 }
 
 // User returns a warp.User from the current UserState.
 func (u *UserState) ProtocolUser() warp.User {
 	return warp.User{
-		Token:    u.token,
-		Username: u.username,
-		Mode:     u.mode,
-		Hosting:  u.hosting,
+		Token:     u.token,
+		Username:  u.username,
+		Mode:      u.mode,
+		Requested: u.requested,
+		Hosting:   u.hosting,
 	}
 }
 
@@ -59,9 +110,15 @@ func NewWarpState(
 
 // Update the warp state given a warp.State received over the wire.
 //
-// If preserveModes is true the modes are preserved (used from the host session
-// as the server is not trusted with modes). If the state includes an unknown
-// user, the default secure modes are used (~read-only).
+// If hosting is true, the server is not trusted with modes, panes nor with the
+// hosting flag and its user list is treated as membership-only: modes are
+// preserved, new users are added with the default secure mode (~read-only)
+// and the host user is never removed. Any attempt by the server to grant a
+// non-default mode to a new user or to change which user is hosting is
+// rejected with an error. A mode sent for an existing user that differs from
+// the one set by the host is ignored and recorded (see IgnoredModes): it may
+// be an escalation attempt but also warpd lagging behind the host updates. If
+// hosting is false, the server state is applied as is.
 func (w *WarpState) Update(
 	state warp.State,
 	hosting bool,
@@ -72,8 +129,6 @@ func (w *WarpState) Update(
 		)
 	}
 
-	w.windowSize = state.WindowSize
-
 	for token, user := range state.Users {
 		if token != user.Token {
 			return errors.Trace(
@@ -83,51 +138,119 @@ func (w *WarpState) Update(
 				),
 			)
 		}
-		if _, ok := w.users[token]; !ok {
-			// User connected.
+		if !hosting {
+			continue
+		}
+		userState, ok := w.users[token]
+		if user.Hosting && (!ok || !userState.hosting) {
+			return errors.Trace(
+				errors.Newf("Unexpected hosting user update: %s", token),
+			)
+		}
+		if !user.Hosting && ok && userState.hosting {
+			return errors.Trace(
+				errors.Newf("Unexpected host user update: %s", token),
+			)
+		}
+		if !ok && user.Mode != warp.DefaultUserMode {
+			return errors.Trace(
+				errors.Newf(
+					"Unexpected user update mode: %s %s",
+					token, user.Mode,
+				),
+			)
+		}
+	}
 
-			if hosting && user.Hosting {
-				return errors.Trace(
-					errors.Newf("Unexptected hosting user update: %s", token),
-				)
-			}
-			if hosting && user.Mode != warp.DefaultUserMode {
-				return errors.Trace(
-					errors.Newf(
-						"Unexptected user update mode: %s %d",
-						token, user.Mode,
-					),
-				)
-			}
+	// The state is validated, let's apply it. Invalid window sizes are
+	// ignored.
+	w.ignored = nil
+	if state.WindowSize.Valid() {
+		w.windowSize = state.WindowSize
+	}
+	// The users writing are informational and taken from warpd as is.
+	w.writing = state.Writing
+	w.hostSessions = state.HostSessions
+	if !hosting {
+		w.panes = state.Panes
+		w.pane = state.Pane
+		w.singleWriter = state.SingleWriter
+		w.writer = state.Writer
+		w.maxClients = state.MaxClients
+		w.title = state.Title
+		w.term = state.Term
+		w.readOnly = state.ReadOnly
+	}
 
+	// Users are applied in a deterministic order so that users joining in
+	// the same update are ordered by token.
+	tokens := []string{}
+	for token := range state.Users {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	for _, token := range tokens {
+		user := state.Users[token]
+		if _, ok := w.users[token]; !ok {
 			// We have a new user that connected let's add it.
+			w.joins++
 			w.users[token] = UserState{
-				token:    token,
-				username: user.Username,
-				mode:     warp.DefaultUserMode,
-				hosting:  user.Hosting,
+				token:     token,
+				username:  user.Username,
+				mode:      warp.DefaultUserMode,
+				hosting:   user.Hosting,
+				requested: user.Requested,
+				joined:    w.joins,
+			}
+			if !hosting {
+				userState := w.users[token]
+				userState.mode = user.Mode
+				w.users[token] = userState
 			}
 		} else {
 			// Update the user state.
 			userState := w.users[token]
 			userState.username = user.Username
+			userState.requested = user.Requested
 			if !hosting {
 				userState.mode = user.Mode
+				userState.hosting = user.Hosting
+			} else if user.Mode != userState.mode {
+				w.ignored = append(w.ignored, IgnoredMode{
+					User:     token,
+					Username: user.Username,
+					Mode:     userState.mode,
+					Received: user.Mode,
+				})
 			}
 			w.users[token] = userState
 		}
 	}
 
-	for token, _ := range w.users {
+	for token, userState := range w.users {
 		if _, ok := state.Users[token]; !ok {
+			if hosting && userState.hosting {
+				// The host user is never removed from the host's own state.
+				continue
+			}
 			// User disconnected.
 			delete(w.users, token)
+			if hosting && token == w.writer {
+				// The write token returns to the host.
+				w.writer = ""
+			}
 		}
 	}
 
 	return nil
 }
 
+// IgnoredModes returns the modes sent by warpd that the last update ignored
+// while hosting, ordered by user token.
+func (w *WarpState) IgnoredModes() []IgnoredMode {
+	return w.ignored
+}
+
 // GetMode returns the mode of a given user.
 func (w *WarpState) GetMode(
 	user string,
@@ -155,31 +278,203 @@ func (w *WarpState) SetMode(
 	}
 
 	userState.mode = mode
+	// Granting a requested mode settles the request.
+	userState.requested &^= mode
 	w.users[user] = userState
+	if user == w.writer && mode&warp.ModeShellWrite == 0 {
+		// The write token returns to the host.
+		w.writer = ""
+	}
+
+	return nil
+}
+
+// SetSingleWriter enables the single-writer mode of the warp. It is used by
+// the host, which is authoritative on the write token.
+func (w *WarpState) SetSingleWriter() {
+	w.singleWriter = true
+}
+
+// SingleWriter returns whether the warp is in single-writer mode and the user
+// holding the write token if any.
+func (w *WarpState) SingleWriter() (bool, string) {
+	return w.singleWriter, w.writer
+}
+
+// SetWriter hands the write token to a given user if the warp is in
+// single-writer mode. The user must be authorized to write.
+func (w *WarpState) SetWriter(
+	user string,
+) error {
+	if !w.singleWriter {
+		return nil
+	}
+	userState, ok := w.users[user]
+	if !ok {
+		return errors.Trace(
+			errors.Newf("Unknown user: %s", user),
+		)
+	}
+	if userState.mode&warp.ModeShellWrite == 0 {
+		return errors.Trace(
+			errors.Newf("User not authorized to write: %s", user),
+		)
+	}
+	w.writer = user
+	return nil
+}
+
+// SetMaxClients sets the maximum number of clients of the warp. It is used by
+// the host, which enforces it.
+func (w *WarpState) SetMaxClients(
+	max int,
+) {
+	w.maxClients = max
+}
+
+// MaxClients returns the maximum number of clients of the warp (0 if
+// unlimited).
+func (w *WarpState) MaxClients() int {
+	return w.maxClients
+}
+
+// SetTitle sets the title of the warp. It is used by the host, whose state
+// doesn't take it from warpd.
+func (w *WarpState) SetTitle(
+	title string,
+) {
+	w.title = title
+}
 
+// SetTerm sets the terminal type of the warp. It is used by the host, whose
+// state doesn't take it from warpd.
+func (w *WarpState) SetTerm(
+	term string,
+) {
+	w.term = term
+}
+
+// PendingRequest returns the mode requested by a user that wasn't granted
+// yet, 0 if none.
+func (w *WarpState) PendingRequest(
+	user string,
+) warp.Mode {
+	userState, ok := w.users[user]
+	if !ok {
+		return 0
+	}
+	return userState.requested &^ userState.mode
+}
+
+// DeclineRequest clears the mode requested by a user. It is used by the host
+// as it declines the request (see warp.HostUpdate).
+func (w *WarpState) DeclineRequest(
+	user string,
+) error {
+	userState, ok := w.users[user]
+	if !ok {
+		return errors.Trace(
+			errors.Newf("Unknown user: %s", user),
+		)
+	}
+	userState.requested = 0
+	w.users[user] = userState
 	return nil
 }
 
+// SetReadOnly marks the warp as read-only. It is used by the host, whose state
+// doesn't take it from warpd.
+func (w *WarpState) SetReadOnly() {
+	w.readOnly = true
+}
+
+// ReadOnly returns whether the host never writes the input of the warp.
+func (w *WarpState) ReadOnly() bool {
+	return w.readOnly
+}
+
+// ExcessClients returns the tokens of the users exceeding the maximum number
+// of clients of the warp, the ones who joined last.
+func (w *WarpState) ExcessClients() []string {
+	if w.maxClients == 0 {
+		return nil
+	}
+	clients := []UserState{}
+	for _, u := range w.users {
+		if !u.hosting {
+			clients = append(clients, u)
+		}
+	}
+	if len(clients) <= w.maxClients {
+		return nil
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].joined < clients[j].joined
+	})
+	excess := []string{}
+	for _, u := range clients[w.maxClients:] {
+		excess = append(excess, u.token)
+	}
+	return excess
+}
+
+// CanWrite returns whether a given user can currently write to the warp: the
+// user must be authorized to write and, in single-writer mode, hold the write
+// token unless hosting.
+func (w *WarpState) CanWrite(
+	user string,
+) bool {
+	userState, ok := w.users[user]
+	if !ok || userState.mode&warp.ModeShellWrite == 0 {
+		return false
+	}
+	return !w.singleWriter || userState.hosting || user == w.writer
+}
+
+// SetPanes updates the panes of the warp. It is used by the host, which is
+// authoritative on its panes.
+func (w *WarpState) SetPanes(
+	panes []string,
+	pane string,
+) {
+	w.panes = panes
+	w.pane = pane
+}
+
 // HostCanReceiveWrite computes whether the host can receive write from the
 // shell clients. This is used as defense in depth to prevent any write if
-// that's not the case.
+// that's not the case. The host user (whose mode grants write by default) can
+// write through its own shell client sessions while it has some.
 func (w *WarpState) HostCanReceiveWrite() bool {
 	can := false
 	for _, user := range w.users {
-		if !user.hosting && user.mode&warp.ModeShellWrite != 0 {
+		if user.mode&warp.ModeShellWrite == 0 {
+			continue
+		}
+		if !user.hosting || w.hostSessions > 0 {
 			can = true
 		}
 	}
 	return can
 }
 
-// ProtocolState computes a warp.State from the current warp. It acquires the
-// warp lock.
+// ProtocolState computes a warp.State from the current warp.
 func (w *WarpState) ProtocolState() warp.State {
 	state := warp.State{
 		Warp:       w.token,
 		WindowSize: w.windowSize,
 		Users:      map[string]warp.User{},
+		Panes:      w.panes,
+		Pane:       w.pane,
+
+		SingleWriter: w.singleWriter,
+		Writer:       w.writer,
+		MaxClients:   w.maxClients,
+		Title:        w.title,
+		Term:         w.term,
+		ReadOnly:     w.readOnly,
+		Writing:      w.writing,
+		HostSessions: w.hostSessions,
 	}
 
 	for token, user := range w.users {
@@ -189,7 +484,7 @@ func (w *WarpState) ProtocolState() warp.State {
 	return state
 }
 
-// WindowSizse returns the current window size.
+// WindowSize returns the current window size.
 func (w *WarpState) WindowSize() warp.Size {
 	return w.windowSize
 }
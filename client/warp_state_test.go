@@ -0,0 +1,292 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/spolu/warp"
+)
+
+// newHostState returns the state of a warp hosted by user `host`.
+func newHostState() *WarpState {
+	return NewWarpState(warp.SessionHello{
+		Warp:     "goofy-dev",
+		From:     warp.Session{Token: "tok", User: "host", Secret: "sec"},
+		Type:     warp.SsTpHost,
+		Username: "stan",
+	})
+}
+
+// hostUser returns the host user as sent by warpd.
+func hostUser() warp.User {
+	return warp.User{
+		Token:    "host",
+		Username: "stan",
+		Mode:     warp.DefaultHostMode,
+		Hosting:  true,
+	}
+}
+
+// lurker returns a user other than the host as sent by warpd.
+func lurker(
+	mode warp.Mode,
+) warp.User {
+	return warp.User{
+		Token:    "lurker",
+		Username: "ada",
+		Mode:     mode,
+	}
+}
+
+// stateWith returns a warp.State of the warp with the specified users.
+func stateWith(
+	users ...warp.User,
+) warp.State {
+	st := warp.State{
+		Warp:       "goofy-dev",
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+		Users:      map[string]warp.User{},
+	}
+	for _, u := range users {
+		st.Users[u.Token] = u
+	}
+	return st
+}
+
+// mode returns the mode of a user, failing the test if it is unknown.
+func mode(
+	t *testing.T,
+	w *WarpState,
+	user string,
+) warp.Mode {
+	t.Helper()
+	m, err := w.GetMode(user)
+	if err != nil {
+		t.Fatalf("GetMode %s: %v", user, err)
+	}
+	return *m
+}
+
+func TestUpdateNewUserWhileHosting(t *testing.T) {
+	w := newHostState()
+	if err := w.Update(
+		stateWith(hostUser(), lurker(warp.DefaultUserMode)), true,
+	); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if m := mode(t, w, "lurker"); m != warp.DefaultUserMode {
+		t.Errorf("New user mode: got %s, want %s", m, warp.DefaultUserMode)
+	}
+	if len(w.users) != 2 {
+		t.Errorf("Users: got %d, want 2", len(w.users))
+	}
+}
+
+func TestUpdatePreservesModesWhileHosting(t *testing.T) {
+	w := newHostState()
+	if err := w.Update(
+		stateWith(hostUser(), lurker(warp.DefaultUserMode)), true,
+	); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	granted := warp.DefaultUserMode | warp.ModeShellWrite
+	if err := w.SetMode("lurker", granted); err != nil {
+		t.Fatalf("SetMode: %v", err)
+	}
+
+	// warpd lagging behind the host still reports the previous mode.
+	if err := w.Update(
+		stateWith(hostUser(), lurker(warp.DefaultUserMode)), true,
+	); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if m := mode(t, w, "lurker"); m != granted {
+		t.Errorf("Mode after update: got %s, want %s", m, granted)
+	}
+	if m := mode(t, w, "host"); m != warp.DefaultHostMode {
+		t.Errorf("Host mode: got %s, want %s", m, warp.DefaultHostMode)
+	}
+}
+
+func TestUpdateAppliesModesAsClient(t *testing.T) {
+	w := NewWarpState(warp.SessionHello{
+		Warp:     "goofy-dev",
+		From:     warp.Session{Token: "tok", User: "lurker", Secret: "sec"},
+		Type:     warp.SsTpShellClient,
+		Username: "ada",
+	})
+	granted := warp.DefaultUserMode | warp.ModeShellWrite
+	if err := w.Update(stateWith(hostUser(), lurker(granted)), false); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if m := mode(t, w, "lurker"); m != granted {
+		t.Errorf("Mode: got %s, want %s", m, granted)
+	}
+	if !w.CanWrite("lurker") {
+		t.Errorf("Client granted write can't write")
+	}
+}
+
+func TestUpdateRemovesUsers(t *testing.T) {
+	w := newHostState()
+	if err := w.Update(
+		stateWith(hostUser(), lurker(warp.DefaultUserMode)), true,
+	); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	w.SetSingleWriter()
+	if err := w.SetMode(
+		"lurker", warp.DefaultUserMode|warp.ModeShellWrite,
+	); err != nil {
+		t.Fatalf("SetMode: %v", err)
+	}
+	if err := w.SetWriter("lurker"); err != nil {
+		t.Fatalf("SetWriter: %v", err)
+	}
+
+	// The lurker left and warpd omits the host user.
+	if err := w.Update(stateWith(), true); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, err := w.GetMode("lurker"); err == nil {
+		t.Errorf("User not removed")
+	}
+	if _, err := w.GetMode("host"); err != nil {
+		t.Errorf("Host user removed from the host state: %v", err)
+	}
+	if _, writer := w.SingleWriter(); writer != "" {
+		t.Errorf("Write token not returned to the host: %s", writer)
+	}
+}
+
+func TestHostCanReceiveWriteFromOwnSessions(t *testing.T) {
+	w := newHostState()
+	for _, tc := range []struct {
+		name     string
+		users    []warp.User
+		sessions int
+		can      bool
+	}{
+		{"host alone", []warp.User{hostUser()}, 0, false},
+		{"host session", []warp.User{hostUser()}, 1, true},
+		{"host sessions closed", []warp.User{hostUser()}, 0, false},
+		{"read-only lurker", []warp.User{
+			hostUser(), lurker(warp.DefaultUserMode),
+		}, 0, false},
+		{"read-only lurker and host session", []warp.User{
+			hostUser(), lurker(warp.DefaultUserMode),
+		}, 2, true},
+	} {
+		st := stateWith(tc.users...)
+		st.HostSessions = tc.sessions
+		if err := w.Update(st, true); err != nil {
+			t.Fatalf("%s: Update: %v", tc.name, err)
+		}
+		if got := w.HostCanReceiveWrite(); got != tc.can {
+			t.Errorf("%s: HostCanReceiveWrite: got %t, want %t",
+				tc.name, got, tc.can)
+		}
+	}
+}
+
+func TestUpdateRejectsWriteGrantedToNewLurker(t *testing.T) {
+	w := newHostState()
+	crafted := stateWith(
+		hostUser(), lurker(warp.DefaultUserMode|warp.ModeShellWrite),
+	)
+	if err := w.Update(crafted, true); err == nil {
+		t.Fatalf("Update accepted write granted to a new user by warpd")
+	}
+	if w.CanWrite("lurker") {
+		t.Errorf("Lurker can write")
+	}
+}
+
+func TestUpdateIgnoresWriteGrantedToLurker(t *testing.T) {
+	w := newHostState()
+	if err := w.Update(
+		stateWith(hostUser(), lurker(warp.DefaultUserMode)), true,
+	); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	crafted := stateWith(
+		hostUser(), lurker(warp.DefaultUserMode|warp.ModeShellWrite),
+	)
+	if err := w.Update(crafted, true); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if w.CanWrite("lurker") {
+		t.Errorf("Lurker can write")
+	}
+	if m := mode(t, w, "lurker"); m != warp.DefaultUserMode {
+		t.Errorf("Lurker mode: got %s, want %s", m, warp.DefaultUserMode)
+	}
+	ignored := w.IgnoredModes()
+	if len(ignored) != 1 {
+		t.Fatalf("Ignored modes: got %v, want 1", ignored)
+	}
+	if ignored[0].User != "lurker" ||
+		ignored[0].Mode != warp.DefaultUserMode ||
+		ignored[0].Received != warp.DefaultUserMode|warp.ModeShellWrite {
+		t.Errorf("Ignored mode: got %+v", ignored[0])
+	}
+
+	// The ignored modes are those of the last update only.
+	if err := w.Update(
+		stateWith(hostUser(), lurker(warp.DefaultUserMode)), true,
+	); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if ignored := w.IgnoredModes(); len(ignored) != 0 {
+		t.Errorf("Ignored modes: got %v, want none", ignored)
+	}
+}
+
+func TestUpdateRejectsHostingLurker(t *testing.T) {
+	w := newHostState()
+	if err := w.Update(
+		stateWith(hostUser(), lurker(warp.DefaultUserMode)), true,
+	); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	crafted := lurker(warp.DefaultUserMode)
+	crafted.Hosting = true
+	if err := w.Update(stateWith(hostUser(), crafted), true); err == nil {
+		t.Errorf("Update accepted a lurker flagged as hosting")
+	}
+
+	demoted := hostUser()
+	demoted.Hosting = false
+	if err := w.Update(
+		stateWith(demoted, lurker(warp.DefaultUserMode)), true,
+	); err == nil {
+		t.Errorf("Update accepted the host flagged as not hosting")
+	}
+	if w.CanWrite("lurker") {
+		t.Errorf("Lurker can write")
+	}
+}
+
+func TestUpdateIgnoresInvalidWindowSize(t *testing.T) {
+	w := newHostState()
+	if err := w.Update(stateWith(hostUser()), true); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	for _, size := range []warp.Size{
+		{},
+		{Rows: 24, Cols: 0},
+		{Rows: -1, Cols: 80},
+		{Rows: 24, Cols: warp.MaxWindowSize + 1},
+		{Rows: 1 << 30, Cols: 1 << 30},
+	} {
+		st := stateWith(hostUser())
+		st.WindowSize = size
+		if err := w.Update(st, true); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if got := w.WindowSize(); got != (warp.Size{Rows: 24, Cols: 80}) {
+			t.Errorf("Window size after %+v: got %+v", size, got)
+		}
+	}
+}
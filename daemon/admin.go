@@ -0,0 +1,322 @@
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/logging"
+)
+
+// AdminCommand is the name of an admin API command.
+type AdminCommand string
+
+const (
+	// AdminCmdList lists the warps currently open.
+	AdminCmdList AdminCommand = "list"
+	// AdminCmdDescribe describes a warp and its users.
+	AdminCmdDescribe AdminCommand = "describe"
+	// AdminCmdClose closes a warp, disconnecting its host and clients.
+	AdminCmdClose AdminCommand = "close"
+	// AdminCmdStats returns statistics about warpd.
+	AdminCmdStats AdminCommand = "stats"
+)
+
+// adminIdleTimeout is the time after which idle admin connections are closed.
+const adminIdleTimeout = 60 * time.Second
+
+// AdminRequest is a request to the admin API. The admin API speaks JSON
+// objects, one per line, over plain TCP connections to the admin listener.
+// Each request gets a response on the same connection:
+//
+//	{"token":"secret","command":"describe","args":["goofy-dev"]}
+//	{"warp":{"id":"goofy-dev","created":"...","host":"stan",...}}
+//
+// Requests with an invalid token get an error response and the connection is
+// closed.
+type AdminRequest struct {
+	Token   string       `json:"token"`
+	Command AdminCommand `json:"command"`
+	Args    []string     `json:"args,omitempty"`
+}
+
+// AdminResponse is the response to an AdminRequest. Only the fields relevant
+// to the command are set.
+type AdminResponse struct {
+	Error string      `json:"error,omitempty"`
+	Warps []AdminWarp `json:"warps,omitempty"`
+	Warp  *AdminWarp  `json:"warp,omitempty"`
+	Stats *AdminStats `json:"stats,omitempty"`
+}
+
+// AdminWarp describes a warp. Users is only set by the describe command.
+type AdminWarp struct {
+	ID      string      `json:"id"`
+	Title   string      `json:"title,omitempty"`
+	Created time.Time   `json:"created"`
+	Host    string      `json:"host"`
+	Clients int         `json:"clients"`
+	Writers int         `json:"writers"`
+	Cols    int         `json:"cols"`
+	Rows    int         `json:"rows"`
+	Users   []AdminUser `json:"users,omitempty"`
+}
+
+// AdminUser describes a user of a warp.
+type AdminUser struct {
+	Token    string `json:"token"`
+	Username string `json:"username"`
+	Mode     string `json:"mode"`
+	Hosting  bool   `json:"hosting"`
+	Sessions int    `json:"sessions"`
+}
+
+// AdminStats are statistics about warpd.
+type AdminStats struct {
+	Version     string    `json:"version"`
+	Started     time.Time `json:"started"`
+	Connections uint64    `json:"connections"`
+	Warps       int       `json:"warps"`
+	Users       int       `json:"users"`
+	Sessions    int       `json:"sessions"`
+}
+
+// AdminSrv serves the admin API of a Srv.
+type AdminSrv struct {
+	address string
+	srv     *Srv
+
+	// token is protected by the mutex (reloadable).
+	token string
+	mutex *sync.Mutex
+}
+
+// NewAdminSrv constructs an AdminSrv for srv. Addresses without host are bound
+// to localhost.
+func NewAdminSrv(
+	ctx context.Context,
+	address string,
+	token string,
+	srv *Srv,
+) *AdminSrv {
+	if host, port, err := net.SplitHostPort(address); err == nil && host == "" {
+		address = net.JoinHostPort("127.0.0.1", port)
+	}
+	return &AdminSrv{
+		address: address,
+		srv:     srv,
+		token:   token,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// Reload applies the reloadable settings of config (the admin token).
+func (a *AdminSrv) Reload(
+	ctx context.Context,
+	config Config,
+) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.token = config.AdminToken
+}
+
+// Run starts the admin server.
+func (a *AdminSrv) Run(
+	ctx context.Context,
+) error {
+	a.mutex.Lock()
+	token := a.token
+	a.mutex.Unlock()
+	if token == "" {
+		return errors.Trace(
+			errors.Newf("An admin token is required to run the admin API"),
+		)
+	}
+
+	ln, err := net.Listen("tcp", a.address)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer ln.Close()
+
+	logging.Logf(ctx, "Admin listening: address=%s", a.address)
+	if host, _, err := net.SplitHostPort(a.address); err == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			logging.Logf(ctx,
+				"Admin API exposed on a non-loopback address: address=%s",
+				a.address,
+			)
+		}
+	}
+
+	for {
+		conn, err := accept(ctx, ln)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		go a.handle(ctx, conn)
+	}
+}
+
+// handle an incoming admin connection.
+func (a *AdminSrv) handle(
+	ctx context.Context,
+	conn net.Conn,
+) {
+	defer conn.Close()
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(adminIdleTimeout))
+
+		var req AdminRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+
+		a.mutex.Lock()
+		token := a.token
+		a.mutex.Unlock()
+
+		// An empty token (removed by a reload) rejects all requests.
+		if token == "" || subtle.ConstantTimeCompare(
+			[]byte(req.Token), []byte(token),
+		) != 1 {
+			logging.Logf(ctx,
+				"Rejected admin request: remote=%s command=%s",
+				conn.RemoteAddr().String(), req.Command,
+			)
+			enc.Encode(AdminResponse{Error: "Invalid admin token."})
+			return
+		}
+
+		logging.Logf(ctx,
+			"Admin request: remote=%s command=%s args=%v",
+			conn.RemoteAddr().String(), req.Command, req.Args,
+		)
+		if err := enc.Encode(a.execute(ctx, req)); err != nil {
+			return
+		}
+	}
+}
+
+// execute executes an authenticated admin request.
+func (a *AdminSrv) execute(
+	ctx context.Context,
+	req AdminRequest,
+) AdminResponse {
+	switch req.Command {
+	case AdminCmdList:
+		warps := []AdminWarp{}
+		for _, w := range a.srv.warpList() {
+			warps = append(warps, w.Admin(ctx, false))
+		}
+		sort.Slice(warps, func(i, j int) bool {
+			return warps[i].ID < warps[j].ID
+		})
+		return AdminResponse{Warps: warps}
+
+	case AdminCmdDescribe, AdminCmdClose:
+		if len(req.Args) != 1 {
+			return AdminResponse{Error: "Warp ID required."}
+		}
+		a.srv.mutex.Lock()
+		w, ok := a.srv.warps[req.Args[0]]
+		a.srv.mutex.Unlock()
+		if !ok {
+			return AdminResponse{Error: "Unknown warp: " + req.Args[0] + "."}
+		}
+		desc := w.Admin(ctx, true)
+		if req.Command == AdminCmdClose {
+			w.Close(ctx,
+				warp.ErrCodeWarpClosed,
+				"The warp was closed by the warpd operator.",
+			)
+		}
+		return AdminResponse{Warp: &desc}
+
+	case AdminCmdStats:
+		stats := AdminStats{
+			Version:     warp.Version,
+			Started:     a.srv.started,
+			Connections: atomic.LoadUint64(&a.srv.connections),
+		}
+		for _, w := range a.srv.warpList() {
+			desc := w.Admin(ctx, true)
+			stats.Warps++
+			stats.Users += len(desc.Users)
+			for _, u := range desc.Users {
+				stats.Sessions += u.Sessions
+			}
+		}
+		return AdminResponse{Stats: &stats}
+	}
+
+	return AdminResponse{Error: "Unknown command: " + string(req.Command) + "."}
+}
+
+// warpList returns the warps currently open.
+func (s *Srv) warpList() []*Warp {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	warps := []*Warp{}
+	for _, w := range s.warps {
+		warps = append(warps, w)
+	}
+	return warps
+}
+
+// Admin returns the description of the warp for the admin API, including its
+// users if detailed is true. It acquires the warp lock.
+func (w *Warp) Admin(
+	ctx context.Context,
+	detailed bool,
+) AdminWarp {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	desc := AdminWarp{
+		ID:      w.token,
+		Title:   w.title,
+		Created: w.created,
+		Clients: len(w.clients),
+		Cols:    w.windowSize.Cols,
+		Rows:    w.windowSize.Rows,
+	}
+	users := []AdminUser{}
+	if w.host != nil {
+		desc.Host = w.host.username
+		users = append(users, AdminUser{
+			Token:    w.host.token,
+			Username: w.host.username,
+			Mode:     w.host.mode.String(),
+			Hosting:  true,
+			// The host session along with its shell client sessions.
+			Sessions: 1 + len(w.host.sessions),
+		})
+	}
+	for _, c := range w.clients {
+		if c.mode&warp.ModeShellWrite != 0 {
+			desc.Writers++
+		}
+		users = append(users, AdminUser{
+			Token:    c.token,
+			Username: c.username,
+			Mode:     c.mode.String(),
+			Sessions: len(c.sessions),
+		})
+	}
+	if detailed {
+		desc.Users = users
+	}
+	return desc
+}
@@ -0,0 +1,245 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+)
+
+// startAdmin runs the admin API of srv with token, returning it along with
+// its address.
+func startAdmin(
+	t *testing.T,
+	srv *Srv,
+	token string,
+) (*AdminSrv, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	admin := NewAdminSrv(ctx, address, token, srv)
+	go admin.Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return admin, address
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Admin API not listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// adminClient is a connection to the admin API.
+type adminClient struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+// dialAdmin connects to the admin API at address.
+func dialAdmin(
+	t *testing.T,
+	address string,
+) *adminClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &adminClient{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+		dec:  json.NewDecoder(conn),
+	}
+}
+
+// do sends a request and returns its response.
+func (c *adminClient) do(
+	t *testing.T,
+	token string,
+	command AdminCommand,
+	args ...string,
+) AdminResponse {
+	t.Helper()
+	if err := c.enc.Encode(AdminRequest{
+		Token:   token,
+		Command: command,
+		Args:    args,
+	}); err != nil {
+		t.Fatalf("Encode %s: %v", command, err)
+	}
+	var res AdminResponse
+	if err := c.dec.Decode(&res); err != nil {
+		t.Fatalf("Decode %s: %v", command, err)
+	}
+	return res
+}
+
+// assertClosed checks that the admin API closed the connection.
+func (c *adminClient) assertClosed(
+	t *testing.T,
+) {
+	t.Helper()
+	var res AdminResponse
+	if err := c.dec.Decode(&res); err == nil {
+		t.Errorf("Connection not closed: got %+v", res)
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	srv, _, _ := startSrv(t)
+	admin := NewAdminSrv(context.Background(), "127.0.0.1:0", "", srv)
+	if err := admin.Run(context.Background()); err == nil {
+		t.Errorf("Admin API run without a token")
+	}
+}
+
+func TestAdminRejectsInvalidToken(t *testing.T) {
+	srv, _, _ := startSrv(t)
+	_, address := startAdmin(t, srv, "secret")
+
+	for _, token := range []string{"", "secre", "secret2"} {
+		c := dialAdmin(t, address)
+		res := c.do(t, token, AdminCmdList)
+		if res.Error != "Invalid admin token." || res.Warps != nil {
+			t.Errorf("Token %q: got %+v", token, res)
+		}
+		c.assertClosed(t)
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	srv, path, _ := startSrv(t)
+	_, address := startAdmin(t, srv, "secret")
+	openHost(t, path, "goofy-one")
+	openHost(t, path, "goofy-two")
+	ada := connectClient(t, path, "goofy-two", "ada")
+
+	// Requests are served over the same connection.
+	c := dialAdmin(t, address)
+
+	res := c.do(t, "secret", AdminCmdList)
+	if len(res.Warps) != 2 ||
+		res.Warps[0].ID != "goofy-one" || res.Warps[1].ID != "goofy-two" {
+		t.Fatalf("List: got %+v", res.Warps)
+	}
+	if w := res.Warps[1]; w.Host != "stan" || w.Clients != 1 ||
+		w.Cols != 80 || w.Rows != 24 || w.Users != nil {
+		t.Errorf("List goofy-two: got %+v", w)
+	}
+
+	res = c.do(t, "secret", AdminCmdDescribe, "goofy-two")
+	if res.Warp == nil || res.Warp.ID != "goofy-two" || len(res.Warp.Users) != 2 {
+		t.Fatalf("Describe: got %+v", res)
+	}
+	for _, u := range res.Warp.Users {
+		switch u.Username {
+		case "stan":
+			if !u.Hosting || u.Sessions != 1 {
+				t.Errorf("Describe host: got %+v", u)
+			}
+		case "ada":
+			if u.Hosting || u.Sessions != 1 ||
+				u.Mode != warp.DefaultUserMode.String() {
+				t.Errorf("Describe ada: got %+v", u)
+			}
+		default:
+			t.Errorf("Describe: unexpected user %+v", u)
+		}
+	}
+
+	for _, tc := range []struct {
+		command AdminCommand
+		args    []string
+		err     string
+	}{
+		{AdminCmdDescribe, nil, "Warp ID required."},
+		{AdminCmdDescribe, []string{"goofy-three"}, "Unknown warp: goofy-three."},
+		{AdminCmdClose, []string{"goofy-one", "goofy-two"}, "Warp ID required."},
+		{"reboot", nil, "Unknown command: reboot."},
+	} {
+		if res := c.do(t, "secret", tc.command, tc.args...); res.Error != tc.err {
+			t.Errorf("%s %v: got %q, want %q", tc.command, tc.args, res.Error, tc.err)
+		}
+	}
+
+	res = c.do(t, "secret", AdminCmdStats)
+	if res.Stats == nil || res.Stats.Version != warp.Version ||
+		res.Stats.Warps != 2 || res.Stats.Users != 3 ||
+		res.Stats.Sessions != 3 || res.Stats.Connections < 3 {
+		t.Errorf("Stats: got %+v", res.Stats)
+	}
+
+	// Closing a warp disconnects its clients with ErrCodeWarpClosed.
+	res = c.do(t, "secret", AdminCmdClose, "goofy-two")
+	if res.Warp == nil || res.Warp.ID != "goofy-two" {
+		t.Errorf("Close: got %+v", res)
+	}
+	e, err := ada.DecodeError(context.Background())
+	if err != nil {
+		t.Fatalf("DecodeError: %v", err)
+	}
+	if e.Code != warp.ErrCodeWarpClosed {
+		t.Errorf("Error code: got %q, want %q", e.Code, warp.ErrCodeWarpClosed)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for warpCount(srv) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Warp not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	res = c.do(t, "secret", AdminCmdList)
+	if len(res.Warps) != 1 || res.Warps[0].ID != "goofy-one" {
+		t.Errorf("List after close: got %+v", res.Warps)
+	}
+}
+
+func TestAdminReloadToken(t *testing.T) {
+	srv, _, _ := startSrv(t)
+	admin, address := startAdmin(t, srv, "secret")
+	c := dialAdmin(t, address)
+	if res := c.do(t, "secret", AdminCmdStats); res.Error != "" {
+		t.Fatalf("Stats: %s", res.Error)
+	}
+
+	config := DefaultConfig()
+	config.AdminToken = "rotated"
+	admin.Reload(context.Background(), config)
+	if res := c.do(t, "secret", AdminCmdStats); res.Error == "" {
+		t.Errorf("Request accepted with the previous token")
+	}
+	c.assertClosed(t)
+	c = dialAdmin(t, address)
+	if res := c.do(t, "rotated", AdminCmdStats); res.Error != "" {
+		t.Errorf("Request rejected with the reloaded token: %s", res.Error)
+	}
+
+	// Removing the token rejects all requests, including empty tokens.
+	config.AdminToken = ""
+	admin.Reload(context.Background(), config)
+	for _, token := range []string{"", "rotated"} {
+		c = dialAdmin(t, address)
+		if res := c.do(t, token, AdminCmdStats); res.Error == "" {
+			t.Errorf("Token %q accepted once the token was removed", token)
+		}
+		c.assertClosed(t)
+	}
+}
@@ -0,0 +1,128 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/logging"
+)
+
+// AuditEventType is the type of an audit event.
+type AuditEventType string
+
+const (
+	// AuditHostConnected is emitted when a host opens a warp.
+	AuditHostConnected AuditEventType = "host_connected"
+	// AuditHostDisconnected is emitted when a host session ends.
+	AuditHostDisconnected AuditEventType = "host_disconnected"
+	// AuditClientConnected is emitted when a shell client session is added.
+	AuditClientConnected AuditEventType = "client_connected"
+	// AuditClientRejected is emitted when a shell client session is rejected
+	// because of a secret mismatch or because the warp is full.
+	AuditClientRejected AuditEventType = "client_rejected"
+	// AuditClientDisconnected is emitted when a shell client session ends.
+	AuditClientDisconnected AuditEventType = "client_disconnected"
+	// AuditModeChanged is emitted when the host changes the mode of a user.
+	AuditModeChanged AuditEventType = "mode_changed"
+	// AuditClientKicked is emitted when the host disconnects a user.
+	AuditClientKicked AuditEventType = "client_kicked"
+	// AuditWarpClosed is emitted when a warp is closed through the admin API.
+	AuditWarpClosed AuditEventType = "warp_closed"
+	// AuditSessionUnauthorized is emitted when a session is rejected for not
+	// presenting a valid authentication token (`warpd -auth-tokens`).
+	AuditSessionUnauthorized AuditEventType = "session_unauthorized"
+)
+
+// AuditEvent is a security relevant event. It is serialized as one JSON
+// object per line. Fields are only ever added to this struct so that the
+// format remains stable for parsers.
+type AuditEvent struct {
+	Time     time.Time        `json:"time"`
+	Event    AuditEventType   `json:"event"`
+	Warp     string           `json:"warp"`
+	User     string           `json:"user"`
+	Username string           `json:"username"`
+	Session  string           `json:"session"`
+	Type     warp.SessionType `json:"type"`
+	Remote   string           `json:"remote"`
+	Mode     string           `json:"mode"`
+	Write    bool             `json:"write"`
+	// Identity is the identity derived from the TLS client certificate of
+	// the session, if client certificates are required.
+	Identity string `json:"identity,omitempty"`
+	// Target, TargetUsername and PreviousMode are only set for mode_changed
+	// events, the session fields identifying the host that changed the mode
+	// of the target user and Mode being the target user's new mode. Target
+	// and TargetUsername are also set for client_kicked events.
+	Target         string `json:"target,omitempty"`
+	TargetUsername string `json:"target_username,omitempty"`
+	PreviousMode   string `json:"previous_mode,omitempty"`
+}
+
+// newAuditEvent constructs an audit event for the given session.
+func newAuditEvent(
+	event AuditEventType,
+	ss *Session,
+	mode warp.Mode,
+) AuditEvent {
+	return AuditEvent{
+		Time:     time.Now().UTC(),
+		Event:    event,
+		Warp:     ss.warp,
+		User:     ss.session.User,
+		Username: ss.username,
+		Session:  ss.session.Token,
+		Type:     ss.sessionType,
+		Remote:   ss.conn.RemoteAddr().String(),
+		Mode:     mode.String(),
+		Write:    mode&warp.ModeShellWrite != 0,
+		Identity: ss.identity,
+	}
+}
+
+// AuditLog writes audit events to an underlying writer. A nil AuditLog is
+// valid and discards all events.
+type AuditLog struct {
+	w     io.Writer
+	mutex *sync.Mutex
+}
+
+// NewAuditLog constructs an AuditLog writing to w.
+func NewAuditLog(
+	w io.Writer,
+) *AuditLog {
+	return &AuditLog{
+		w:     w,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Log writes an audit event as a JSON line.
+func (a *AuditLog) Log(
+	ctx context.Context,
+	ev AuditEvent,
+) {
+	if a == nil {
+		return
+	}
+
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		logging.Logf(ctx,
+			"Error encoding audit event: event=%s error=%v", ev.Event, err,
+		)
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, err := a.w.Write(append(raw, '\n')); err != nil {
+		logging.Logf(ctx,
+			"Error writing audit event: event=%s error=%v", ev.Event, err,
+		)
+	}
+}
@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/logging"
+)
+
+// ChatSessions returns the chat client sessions of the warp.
+func (w *Warp) ChatSessions(
+	ctx context.Context,
+) []*Session {
+	sessions := []*Session{}
+	w.mutex.Lock()
+	for _, c := range w.chats {
+		sessions = append(sessions, c)
+	}
+	w.mutex.Unlock()
+	return sessions
+}
+
+// chatSecret returns the secret of the sessions of a user known to the warp
+// (host, shell client or chat sessions), empty if the user has none. It
+// expects the warp lock to be held.
+func (w *Warp) chatSecret(
+	user string,
+) string {
+	if user == w.host.UserState.token {
+		return w.host.session.session.Secret
+	}
+	if c, ok := w.clients[user]; ok {
+		for _, s := range c.sessions {
+			return s.session.Secret
+		}
+	}
+	for _, s := range w.chats {
+		if s.session.User == user {
+			return s.session.Secret
+		}
+	}
+	return ""
+}
+
+// handleChatClient is responsible for handling the SsTpChatClient sessions.
+// It receives the messages of the chat client and fans them out to all the
+// chat sessions of the warp.
+func (w *Warp) handleChatClient(
+	ctx context.Context,
+	ss *Session,
+) {
+	if ss.chatR == nil {
+		ss.SendError(ctx,
+			warp.ErrCodeChatUnsupported,
+			"Your client does not support chat. Please update warp.",
+		)
+		return
+	}
+
+	w.mutex.Lock()
+	secret := w.chatSecret(ss.session.User)
+	if secret != "" && ss.session.Secret != secret {
+		w.mutex.Unlock()
+		ss.SendError(ctx,
+			warp.ErrCodeAuthorizationFailed,
+			"Session secret mismatch.",
+		)
+		return
+	}
+	// If we have a session conflict, let's kill the old one.
+	if s, ok := w.chats[ss.session.Token]; ok {
+		s.TearDown()
+	}
+	w.chats[ss.session.Token] = ss
+	w.mutex.Unlock()
+
+	w.broadcastChat(ctx, warp.ChatMessage{
+		Time:     time.Now().UTC(),
+		Username: ss.username,
+		Text:     fmt.Sprintf("%s joined the chat.", ss.username),
+	})
+
+	logging.Logf(ctx,
+		"Chat session running: session=%s",
+		ss.ToString(),
+	)
+
+	// Receive chat messages. The session is torn down once the chat channel
+	// is closed.
+	go func() {
+		for {
+			var msg warp.ChatMessage
+			if err := ss.chatR.Decode(&msg); err != nil {
+				break
+			}
+			w.rcvChatMessage(ctx, ss, msg)
+		}
+		ss.TearDown()
+	}()
+
+	<-ss.ctx.Done()
+
+	// Clean-up chat client.
+	logging.Logf(ctx,
+		"Cleaning-up chat client: session=%s",
+		ss.ToString(),
+	)
+
+	w.mutex.Lock()
+	if w.chats[ss.session.Token] == ss {
+		delete(w.chats, ss.session.Token)
+	}
+	w.mutex.Unlock()
+
+	w.broadcastChat(ctx, warp.ChatMessage{
+		Time:     time.Now().UTC(),
+		Username: ss.username,
+		Text:     fmt.Sprintf("%s left the chat.", ss.username),
+	})
+}
+
+// rcvChatMessage stamps a message received from a chat session with its
+// sender and fans it out to all the chat sessions of the warp. Messages of
+// muted users (warp.ModeSpeakMuted) are dropped.
+func (w *Warp) rcvChatMessage(
+	ctx context.Context,
+	ss *Session,
+	msg warp.ChatMessage,
+) {
+	text := warp.SanitizeChatMessage(msg.Text)
+	if text == "" {
+		return
+	}
+
+	w.mutex.Lock()
+	host := ss.session.User == w.host.UserState.token
+	if c, ok := w.clients[ss.session.User]; ok &&
+		c.mode&warp.ModeSpeakMuted != 0 {
+		w.mutex.Unlock()
+		logging.Logf(ctx,
+			"Dropping chat message from muted user: session=%s",
+			ss.ToString(),
+		)
+		return
+	}
+	w.mutex.Unlock()
+
+	w.broadcastChat(ctx, warp.ChatMessage{
+		Time:     time.Now().UTC(),
+		From:     ss.session.User,
+		Username: ss.username,
+		Host:     host,
+		Text:     text,
+	})
+}
+
+// broadcastChat fans a chat message out to all the chat sessions of the
+// warp.
+func (w *Warp) broadcastChat(
+	ctx context.Context,
+	msg warp.ChatMessage,
+) {
+	for _, s := range w.ChatSessions(ctx) {
+		s.SendChat(ctx, msg)
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"context"
 	"flag"
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
 	"runtime/pprof"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/spolu/warp"
@@ -14,20 +18,68 @@ import (
 	"github.com/spolu/warp/lib/logging"
 )
 
+var cfgFlag string
 var lstFlag string
 var prfFlag string
 var crtFlag string
 var keyFlag string
+var ccaFlag string
+var audFlag string
+var rdrFlag string
+var rslFlag bool
+var admFlag string
+var atkFlag string
+var hltFlag string
+var mxwFlag int
+var whkFlag string
+var autFlag string
+var hgrFlag int
+var sbkFlag int
+var mtrFlag string
+var idlFlag int
+var mxcFlag int
 
 func init() {
+	flag.StringVar(&cfgFlag, "config",
+		"", "Load settings from the specified JSON file (overridden by flags, reloaded on SIGHUP)")
 	flag.StringVar(&lstFlag, "listen",
-		":4242", "Address to listen on ([ip]:port), default: `:4242`")
+		":4242", "Address to listen on ([ip]:port or unix:<path>), default: `:4242`")
 	flag.StringVar(&prfFlag, "cpuprofile",
 		"", "Enalbe CPU profiling and write to specified file")
 	flag.StringVar(&crtFlag, "cert",
 		"", "Use the specified cert file to accetpt connections over TLS")
 	flag.StringVar(&keyFlag, "key",
 		"", "Use the specified key file to accept connections over TLS")
+	flag.StringVar(&ccaFlag, "tls-client-ca",
+		"", "Require TLS clients to present a certificate signed by a CA of the specified file")
+	flag.StringVar(&audFlag, "audit-log",
+		"", "Append security relevant events as JSON lines to the specified file")
+	flag.StringVar(&rdrFlag, "redirect",
+		"", "Redirect all hosts and clients to the warpd at the specified address")
+	flag.BoolVar(&rslFlag, "resolve-prefix",
+		false, "Let clients resolve warp IDs by prefix (exposes active warp IDs)")
+	flag.StringVar(&admFlag, "admin",
+		"", "Serve the admin API on the specified address (localhost if no ip), e.g. `:4243`")
+	flag.StringVar(&atkFlag, "admin-token",
+		"", "Token required by the admin API (defaults to $WARPD_ADMIN_TOKEN)")
+	flag.StringVar(&hltFlag, "health",
+		"", "Serve an HTTP health check (/healthz) on the specified address (localhost if no ip), e.g. `:4244`")
+	flag.StringVar(&mtrFlag, "metrics-addr",
+		"", "Serve Prometheus metrics (/metrics) on the specified address (localhost if no ip), e.g. `:4245`")
+	flag.IntVar(&mxwFlag, "max-warps",
+		0, "Reject new warps once the specified number of warps are open (unlimited if 0)")
+	flag.StringVar(&whkFlag, "webhook",
+		"", "POST warps opening and closing as JSON to the specified URL (http or https)")
+	flag.StringVar(&autFlag, "auth-tokens",
+		"", "Require hosts and clients to present one of the specified comma-separated tokens (defaults to $WARPD_AUTH_TOKENS)")
+	flag.IntVar(&mxcFlag, "max-clients",
+		0, "Refuse users connecting to a warp once it has the specified number of clients (unlimited if 0)")
+	flag.IntVar(&hgrFlag, "host-grace",
+		0, "Keep warps open for the specified number of seconds after their host disconnected, for it to reconnect (disabled if 0)")
+	flag.IntVar(&idlFlag, "idle-timeout",
+		0, "Close warps whose host produced no output for the specified number of seconds (disabled if 0)")
+	flag.IntVar(&sbkFlag, "scrollback",
+		64, "Replay the specified number of kilobytes of the last output of warps to the clients joining them (disabled if 0)")
 
 	if fl := log.Flags(); fl&log.Ltime != 0 {
 		log.SetFlags(fl | log.Lmicroseconds)
@@ -55,17 +107,169 @@ func main() {
 
 	ctx := context.Background()
 
-	srv := daemon.NewSrv(
-		ctx,
-		lstFlag,
-		crtFlag,
-		keyFlag,
-	)
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(errors.Details(err))
+	}
+
+	var audit *daemon.AuditLog
+	if config.AuditLog != "" {
+		f, err := os.OpenFile(
+			config.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600,
+		)
+		if err != nil {
+			log.Fatal(errors.Details(err))
+		}
+		defer f.Close()
+		audit = daemon.NewAuditLog(f)
+	}
+
+	var webhook *daemon.Webhook
+	if config.Webhook != "" {
+		u, err := url.Parse(config.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+			u.Host == "" {
+			log.Fatalf("Invalid webhook URL: %s", config.Webhook)
+		}
+		webhook = daemon.NewWebhook(ctx, config.Webhook)
+	}
+
+	var metrics *daemon.Metrics
+	if config.MetricsAddr != "" {
+		metrics = daemon.NewMetrics()
+	}
+
+	srv := daemon.NewSrv(ctx, config, audit, webhook, metrics)
+
+	var admin *daemon.AdminSrv
+	if config.Admin != "" {
+		admin = daemon.NewAdminSrv(ctx, config.Admin, config.AdminToken, srv)
+		go func() {
+			if err := admin.Run(ctx); err != nil {
+				log.Fatal(errors.Details(err))
+			}
+		}()
+	}
+
+	if config.Health != "" {
+		health := daemon.NewHealthSrv(ctx, config.Health, srv)
+		go func() {
+			if err := health.Run(ctx); err != nil {
+				log.Fatal(errors.Details(err))
+			}
+		}()
+	}
+
+	if metrics != nil {
+		m := daemon.NewMetricsSrv(ctx, config.MetricsAddr, srv, metrics)
+		go func() {
+			if err := m.Run(ctx); err != nil {
+				log.Fatal(errors.Details(err))
+			}
+		}()
+	}
+
+	// Reload the configuration on SIGHUP.
+	hupC := make(chan os.Signal, 1)
+	signal.Notify(hupC, syscall.SIGHUP)
+	go func() {
+		for range hupC {
+			reloaded, err := loadConfig()
+			if err != nil {
+				logging.Logf(ctx, "Error reloading config: error=%v", err)
+				continue
+			}
+			for _, name := range config.RestartRequired(reloaded) {
+				logging.Logf(ctx,
+					"Ignoring config change requiring a restart: setting=%s",
+					name,
+				)
+			}
+			srv.Reload(ctx, reloaded)
+			if admin != nil {
+				admin.Reload(ctx, reloaded)
+			}
+			logging.Logf(ctx, "Reloaded config: path=%s", cfgFlag)
+		}
+	}()
 
 	logging.Logf(ctx, "Started warpd: version=%s", warp.Version)
 
-	err := srv.Run(ctx)
+	err = srv.Run(ctx)
 	if err != nil {
 		log.Fatal(errors.Details(err))
 	}
 }
+
+// loadConfig loads the configuration file, if any, and applies the flags set
+// on the command line over it.
+func loadConfig() (daemon.Config, error) {
+	config := daemon.DefaultConfig()
+	if cfgFlag != "" {
+		if err := daemon.LoadConfig(cfgFlag, &config); err != nil {
+			return config, errors.Trace(err)
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			config.Listen = lstFlag
+		case "cert":
+			config.Cert = crtFlag
+		case "key":
+			config.Key = keyFlag
+		case "tls-client-ca":
+			config.TLSClientCA = ccaFlag
+		case "audit-log":
+			config.AuditLog = audFlag
+		case "redirect":
+			config.Redirect = rdrFlag
+		case "resolve-prefix":
+			config.ResolvePrefix = rslFlag
+		case "admin":
+			config.Admin = admFlag
+		case "admin-token":
+			config.AdminToken = atkFlag
+		case "health":
+			config.Health = hltFlag
+		case "metrics-addr":
+			config.MetricsAddr = mtrFlag
+		case "max-warps":
+			config.MaxWarps = mxwFlag
+		case "max-clients":
+			config.MaxClients = mxcFlag
+		case "webhook":
+			config.Webhook = whkFlag
+		case "auth-tokens":
+			config.AuthTokens = splitTokens(autFlag)
+		case "host-grace":
+			config.HostGrace = hgrFlag
+		case "scrollback":
+			config.Scrollback = sbkFlag
+		case "idle-timeout":
+			config.IdleTimeout = idlFlag
+		}
+	})
+	if config.AdminToken == "" {
+		config.AdminToken = os.Getenv("WARPD_ADMIN_TOKEN")
+	}
+	if len(config.AuthTokens) == 0 {
+		config.AuthTokens = splitTokens(os.Getenv("WARPD_AUTH_TOKENS"))
+	}
+
+	return config, nil
+}
+
+// splitTokens splits a comma-separated list of tokens, ignoring empty ones.
+func splitTokens(
+	list string,
+) []string {
+	tokens := []string{}
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
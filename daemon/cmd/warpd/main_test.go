@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigFlagsOverFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warpd.json")
+	if err := os.WriteFile(path, []byte(`{
+		"listen": ":5000",
+		"max_warps": 10,
+		"max_clients": 3,
+		"auth_tokens": ["file"]
+	}`), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	fs := flag.CommandLine
+	if err := fs.Parse([]string{
+		"-config", path, "-max-warps", "20", "-auth-tokens", "a, b,",
+	}); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	if config.Listen != ":5000" {
+		t.Errorf("Listen (file): got %q", config.Listen)
+	}
+	if config.MaxClients != 3 {
+		t.Errorf("MaxClients (file): got %d", config.MaxClients)
+	}
+	if config.MaxWarps != 20 {
+		t.Errorf("MaxWarps (flag over file): got %d", config.MaxWarps)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(config.AuthTokens, want) {
+		t.Errorf("AuthTokens (flag over file): got %v", config.AuthTokens)
+	}
+	if config.HostGrace != 0 {
+		t.Errorf("HostGrace (default): got %d", config.HostGrace)
+	}
+}
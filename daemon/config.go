@@ -0,0 +1,146 @@
+package daemon
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// Config is the configuration of warpd. It is loaded from a JSON file (`warpd
+// -config`), flags set on the command line taking precedence over it:
+//
+//	{
+//	  "listen": ":4242",
+//	  "cert": "/etc/warpd/cert.pem",
+//	  "key": "/etc/warpd/key.pem",
+//	  "resolve_prefix": true
+//	}
+//
+// The configuration is reloaded on SIGHUP without affecting open warps. Only
+// the reloadable settings are applied, the others require a restart.
+type Config struct {
+	// Listen is the address to listen on ([ip]:port or unix:<path>).
+	Listen string `json:"listen"`
+	// Cert and Key are the TLS certificate and key files (TLS is disabled if
+	// they are not set).
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// TLSClientCA is the file of the CA certificates client certificates are
+	// verified against. If set, TLS connections are only accepted from
+	// clients presenting a valid certificate.
+	TLSClientCA string `json:"tls_client_ca"`
+	// AuditLog is the file audit events are appended to.
+	AuditLog string `json:"audit_log"`
+	// Admin is the address of the admin API (disabled if not set).
+	Admin string `json:"admin"`
+	// Health is the address of the HTTP health check (disabled if not set).
+	Health string `json:"health"`
+	// Webhook is the URL warps opening and closing are posted to (disabled
+	// if not set).
+	Webhook string `json:"webhook"`
+	// MetricsAddr is the address of the Prometheus metrics endpoint
+	// (disabled if not set).
+	MetricsAddr string `json:"metrics_addr"`
+
+	// Redirect is the address of the warpd all sessions are redirected to
+	// (reloadable).
+	Redirect string `json:"redirect"`
+	// ResolvePrefix lets clients resolve warp IDs by prefix (reloadable).
+	ResolvePrefix bool `json:"resolve_prefix"`
+	// MaxWarps is the maximum number of warps served concurrently, new warps
+	// being rejected once reached (unlimited if 0, reloadable).
+	MaxWarps int `json:"max_warps"`
+	// AdminToken is the token required by the admin API (reloadable).
+	AdminToken string `json:"admin_token"`
+	// AuthTokens, if set, are the tokens hosts and clients must present to
+	// be served (see warp.SessionHello.Auth, reloadable).
+	AuthTokens []string `json:"auth_tokens"`
+	// HostGrace is the number of seconds a warp is kept open after its host
+	// disconnected unexpectedly, for the host to reconnect to it with its
+	// clients still attached (disabled if 0, the default, as hosts that
+	// crash or predate HostUpdate.Closing would leave their clients waiting,
+	// reloadable).
+	HostGrace int `json:"host_grace"`
+	// Scrollback is the size in kilobytes of the last output of each warp
+	// replayed to the clients joining it (disabled if 0, reloadable for the
+	// warps opened afterwards).
+	Scrollback int `json:"scrollback"`
+	// IdleTimeout is the number of seconds after which warps whose host
+	// produced no output are closed (disabled if 0, reloadable for the warps
+	// opened afterwards).
+	IdleTimeout int `json:"idle_timeout"`
+	// MaxClients is the maximum number of users (other than the host) that
+	// can connect to each warp, on top of the limit set by its host if any
+	// (unlimited if 0, reloadable for the warps opened afterwards).
+	MaxClients int `json:"max_clients"`
+}
+
+// DefaultConfig returns the configuration used in the absence of file and
+// flags.
+func DefaultConfig() Config {
+	return Config{
+		Listen:     ":4242",
+		Scrollback: 64,
+	}
+}
+
+// LoadConfig loads the JSON configuration file at path over config. Unknown
+// settings are rejected.
+func LoadConfig(
+	path string,
+	config *Config,
+) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to open config file: %v", err),
+		)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to parse config file %s: %v", path, err),
+		)
+	}
+	return nil
+}
+
+// RestartRequired returns the names of the settings that are not reloadable
+// and differ between the two configurations.
+func (c Config) RestartRequired(
+	other Config,
+) []string {
+	names := []string{}
+	if c.Listen != other.Listen {
+		names = append(names, "listen")
+	}
+	if c.Cert != other.Cert {
+		names = append(names, "cert")
+	}
+	if c.Key != other.Key {
+		names = append(names, "key")
+	}
+	if c.TLSClientCA != other.TLSClientCA {
+		names = append(names, "tls_client_ca")
+	}
+	if c.AuditLog != other.AuditLog {
+		names = append(names, "audit_log")
+	}
+	if c.Admin != other.Admin {
+		names = append(names, "admin")
+	}
+	if c.Health != other.Health {
+		names = append(names, "health")
+	}
+	if c.Webhook != other.Webhook {
+		names = append(names, "webhook")
+	}
+	if c.MetricsAddr != other.MetricsAddr {
+		names = append(names, "metrics_addr")
+	}
+	return names
+}
@@ -0,0 +1,115 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a configuration file and returns its path.
+func writeConfig(
+	t *testing.T,
+	content string,
+) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "warpd.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigOverDefaults(t *testing.T) {
+	path := writeConfig(t, `{
+		"listen": "unix:/run/warpd.sock",
+		"max_warps": 10,
+		"auth_tokens": ["a", "b"],
+		"host_grace": 10
+	}`)
+	config := DefaultConfig()
+	if err := LoadConfig(path, &config); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	want := DefaultConfig()
+	want.Listen = "unix:/run/warpd.sock"
+	want.MaxWarps = 10
+	want.AuthTokens = []string{"a", "b"}
+	want.HostGrace = 10
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("Config:\n got %+v\nwant %+v", config, want)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown setting": `{"listen": ":4242", "max_warp": 10}`,
+		"invalid type":    `{"max_warps": "10"}`,
+		"invalid json":    `{"listen": `,
+	} {
+		config := DefaultConfig()
+		if err := LoadConfig(writeConfig(t, content), &config); err == nil {
+			t.Errorf("%s: LoadConfig succeeded", name)
+		}
+	}
+	config := DefaultConfig()
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	if err := LoadConfig(missing, &config); err == nil {
+		t.Errorf("LoadConfig succeeded on a missing file")
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	config := DefaultConfig()
+	if names := config.RestartRequired(config); len(names) != 0 {
+		t.Errorf("Same config: got %v", names)
+	}
+
+	reloaded := config
+	reloaded.Listen = ":4343"
+	reloaded.Cert = "cert.pem"
+	// Reloadable settings.
+	reloaded.MaxWarps = 10
+	reloaded.MaxClients = 2
+	reloaded.AuthTokens = []string{"a"}
+	reloaded.Redirect = "warpd2:4242"
+	want := []string{"listen", "cert"}
+	if names := config.RestartRequired(reloaded); !reflect.DeepEqual(names, want) {
+		t.Errorf("Names: got %v, want %v", names, want)
+	}
+}
+
+func TestReloadKeepsWarps(t *testing.T) {
+	srv, path, _ := startSrv(t)
+	openHost(t, path, "goofy-dev")
+
+	config := DefaultConfig()
+	config.Listen = "unix:" + filepath.Join(t.TempDir(), "other.sock")
+	config.MaxWarps = 10
+	config.MaxClients = 2
+	config.AuthTokens = []string{"a"}
+	config.HostGrace = 5
+	config.Scrollback = 0
+	config.IdleTimeout = 60
+	config.Redirect = "warpd2:4242"
+	config.ResolvePrefix = true
+	srv.Reload(context.Background(), config)
+
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.maxWarps != 10 || srv.maxClients != 2 ||
+		!reflect.DeepEqual(srv.authTokens, []string{"a"}) ||
+		srv.hostGrace != 5*time.Second || srv.scrollback != 0 ||
+		srv.idleTimeout != time.Minute || srv.redirect != "warpd2:4242" ||
+		!srv.resolvePrefix {
+		t.Errorf("Settings not reloaded: %+v", srv)
+	}
+	if srv.address != "unix:"+path {
+		t.Errorf("Listen address reloaded: %s", srv.address)
+	}
+	if _, ok := srv.warps["goofy-dev"]; !ok {
+		t.Errorf("Warp dropped on reload")
+	}
+}
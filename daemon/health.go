@@ -0,0 +1,110 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/logging"
+)
+
+// healthTimeout bounds the time spent reading a health request and writing
+// its response.
+const healthTimeout = 5 * time.Second
+
+// Health is the body of the health check response:
+//
+//	{"status":"ok","version":"0.0.4","warps":2,"sessions":5}
+//
+// Status is "ok" (200) if warpd is accepting connections and "unavailable"
+// (503) otherwise.
+type Health struct {
+	Status   string `json:"status"`
+	Version  string `json:"version"`
+	Warps    int    `json:"warps"`
+	Sessions int64  `json:"sessions"`
+}
+
+// HealthSrv serves the health check of a Srv over HTTP (`GET /healthz`), for
+// load balancers and liveness probes that don't speak the warp protocol.
+type HealthSrv struct {
+	address string
+	srv     *Srv
+}
+
+// NewHealthSrv constructs a HealthSrv for srv. Addresses without host are
+// bound to localhost.
+func NewHealthSrv(
+	ctx context.Context,
+	address string,
+	srv *Srv,
+) *HealthSrv {
+	if host, port, err := net.SplitHostPort(address); err == nil && host == "" {
+		address = net.JoinHostPort("127.0.0.1", port)
+	}
+	return &HealthSrv{
+		address: address,
+		srv:     srv,
+	}
+}
+
+// Run starts the health check server.
+func (h *HealthSrv) Run(
+	ctx context.Context,
+) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.handle)
+
+	server := &http.Server{
+		Addr:         h.address,
+		Handler:      mux,
+		ReadTimeout:  healthTimeout,
+		WriteTimeout: healthTimeout,
+	}
+
+	logging.Logf(ctx, "Health listening: address=%s", h.address)
+	if err := server.ListenAndServe(); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// handle serves a health check request.
+func (h *HealthSrv) handle(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	health := h.srv.Health()
+	w.Header().Set("Content-Type", "application/json")
+	if health.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// Health returns the health of the server. It only acquires the server lock
+// (not the warp locks) to count the warps.
+func (s *Srv) Health() Health {
+	health := Health{
+		Status:   "ok",
+		Version:  warp.Version,
+		Sessions: atomic.LoadInt64(&s.sessions),
+	}
+	if atomic.LoadInt32(&s.listening) == 0 {
+		health.Status = "unavailable"
+	}
+	s.mutex.Lock()
+	health.Warps = len(s.warps)
+	s.mutex.Unlock()
+	return health
+}
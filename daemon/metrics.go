@@ -0,0 +1,216 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/logging"
+)
+
+// metricsTimeout bounds the time spent reading a metrics request and writing
+// its response.
+const metricsTimeout = 5 * time.Second
+
+// Metrics holds the counters of warpd exposed to Prometheus by MetricsSrv.
+// Its methods are no-ops on a nil Metrics (metrics disabled).
+type Metrics struct {
+	// hostBytes and clientBytes (accessed atomically) are the bytes relayed
+	// from the hosts to their clients and from the clients to the hosts.
+	hostBytes   uint64
+	clientBytes uint64
+	// closed counts the sessions closed by session type and reason (the code
+	// of the error sent to the peer, "none" if none was).
+	closed map[metricsClosed]uint64
+
+	mutex *sync.Mutex
+}
+
+// metricsClosed is the key of the closed sessions counters.
+type metricsClosed struct {
+	sessionType warp.SessionType
+	reason      string
+}
+
+// NewMetrics constructs a Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		closed: map[metricsClosed]uint64{},
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// HostData counts data relayed from a host to its clients.
+func (m *Metrics) HostData(
+	size int,
+) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.hostBytes, uint64(size))
+}
+
+// ClientData counts data relayed from a client to its host.
+func (m *Metrics) ClientData(
+	size int,
+) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.clientBytes, uint64(size))
+}
+
+// SessionClosed counts a session closed by warpd, reason being the code of
+// the error sent to the peer (empty if none was).
+func (m *Metrics) SessionClosed(
+	sessionType warp.SessionType,
+	reason string,
+) {
+	if m == nil {
+		return
+	}
+	switch sessionType {
+	case warp.SsTpHost, warp.SsTpShellClient, warp.SsTpChatClient,
+		warp.SsTpResolve:
+	default:
+		// The session type is sent by the peer.
+		sessionType = "unknown"
+	}
+	if reason == "" {
+		reason = "none"
+	}
+	m.mutex.Lock()
+	m.closed[metricsClosed{sessionType, reason}]++
+	m.mutex.Unlock()
+}
+
+// MetricsSrv serves the metrics of a Srv over HTTP (`GET /metrics`) in the
+// Prometheus text format.
+type MetricsSrv struct {
+	address string
+	srv     *Srv
+	metrics *Metrics
+}
+
+// NewMetricsSrv constructs a MetricsSrv for srv. Addresses without host are
+// bound to localhost.
+func NewMetricsSrv(
+	ctx context.Context,
+	address string,
+	srv *Srv,
+	metrics *Metrics,
+) *MetricsSrv {
+	if host, port, err := net.SplitHostPort(address); err == nil && host == "" {
+		address = net.JoinHostPort("127.0.0.1", port)
+	}
+	return &MetricsSrv{
+		address: address,
+		srv:     srv,
+		metrics: metrics,
+	}
+}
+
+// Run starts the metrics server.
+func (m *MetricsSrv) Run(
+	ctx context.Context,
+) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.handle)
+
+	server := &http.Server{
+		Addr:         m.address,
+		Handler:      mux,
+		ReadTimeout:  metricsTimeout,
+		WriteTimeout: metricsTimeout,
+	}
+
+	logging.Logf(ctx, "Metrics listening: address=%s", m.address)
+	if err := server.ListenAndServe(); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// handle serves a metrics request.
+func (m *MetricsSrv) handle(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Write(r.Context(), w)
+}
+
+// Write writes the metrics in the Prometheus text format. The gauges are
+// computed from the warps currently open.
+func (m *MetricsSrv) Write(
+	ctx context.Context,
+	w io.Writer,
+) {
+	warps := m.srv.warpList()
+	clients := 0
+	for _, wp := range warps {
+		clients += len(wp.CientSessions(ctx))
+	}
+
+	metric := func(name string, kind string, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	}
+
+	metric("warpd_warps", "gauge", "Number of warps open.")
+	fmt.Fprintf(w, "warpd_warps %d\n", len(warps))
+	metric("warpd_shell_clients", "gauge",
+		"Number of shell client sessions connected to the warps.")
+	fmt.Fprintf(w, "warpd_shell_clients %d\n", clients)
+	metric("warpd_sessions", "gauge", "Number of connections being handled.")
+	fmt.Fprintf(w, "warpd_sessions %d\n", atomic.LoadInt64(&m.srv.sessions))
+	metric("warpd_connections_total", "counter",
+		"Number of connections accepted.")
+	fmt.Fprintf(w, "warpd_connections_total %d\n",
+		atomic.LoadUint64(&m.srv.connections),
+	)
+	metric("warpd_host_bytes_total", "counter",
+		"Bytes of data relayed from the hosts to their clients.")
+	fmt.Fprintf(w, "warpd_host_bytes_total %d\n",
+		atomic.LoadUint64(&m.metrics.hostBytes),
+	)
+	metric("warpd_client_bytes_total", "counter",
+		"Bytes of data relayed from the clients to their hosts.")
+	fmt.Fprintf(w, "warpd_client_bytes_total %d\n",
+		atomic.LoadUint64(&m.metrics.clientBytes),
+	)
+
+	m.metrics.mutex.Lock()
+	keys := []metricsClosed{}
+	for k := range m.metrics.closed {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].sessionType != keys[j].sessionType {
+			return keys[i].sessionType < keys[j].sessionType
+		}
+		return keys[i].reason < keys[j].reason
+	})
+	metric("warpd_sessions_closed_total", "counter",
+		"Sessions closed by type and reason (the code of the error sent, "+
+			"none if the peer closed it).")
+	for _, k := range keys {
+		fmt.Fprintf(w,
+			"warpd_sessions_closed_total{type=\"%s\",reason=\"%s\"} %d\n",
+			k.sessionType, k.reason, m.metrics.closed[k],
+		)
+	}
+	m.metrics.mutex.Unlock()
+}
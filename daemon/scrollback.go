@@ -0,0 +1,238 @@
+package daemon
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/logging"
+)
+
+// scrollbackSegment is the maximum number of bytes of output compressed
+// together in a segment of a scrollback. Each segment is an independent
+// deflate stream (a reset point of the compression), so that the oldest ones
+// can be dropped and the others decompressed on their own.
+const scrollbackSegment = 16 * 1024
+
+// flateWriters pools the deflate compressors used to seal the segments of the
+// scrollbacks, which are too large to be kept per warp.
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		// NewWriter only fails on an invalid level.
+		fw, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return fw
+	},
+}
+
+// Scrollback keeps the last bytes of the output of a warp, replayed to the
+// shell clients joining it so that they don't face a blank terminal until the
+// host produces new output. Terminal output being highly compressible, it is
+// stored as deflate compressed segments, the output of the current segment
+// only being kept raw until the segment is full.
+type Scrollback struct {
+	size    int
+	segment int
+	// segments are the sealed (compressed) segments, oldest first.
+	segments []segment
+	// pending is the raw output of the current segment.
+	pending []byte
+	// total is the number of bytes of output kept, sealed or pending.
+	total int
+	// dropped is set once output was dropped to keep within size.
+	dropped bool
+}
+
+// segment is a sealed segment of a Scrollback.
+type segment struct {
+	data []byte
+	// size is the size of the raw output compressed in data.
+	size int
+}
+
+// NewScrollback constructs a Scrollback keeping up to size bytes.
+func NewScrollback(
+	size int,
+) *Scrollback {
+	seg := scrollbackSegment
+	if size < seg {
+		seg = size
+	}
+	return newScrollback(size, seg)
+}
+
+// newScrollback constructs a Scrollback keeping up to size bytes, compressed in
+// segments of seg bytes.
+func newScrollback(
+	size int,
+	seg int,
+) *Scrollback {
+	return &Scrollback{
+		size:    size,
+		segment: seg,
+	}
+}
+
+// Write appends data to the scrollback, dropping the oldest segments once
+// it keeps more than its size without them.
+func (s *Scrollback) Write(
+	data []byte,
+) {
+	if len(data) > s.size {
+		data = data[len(data)-s.size:]
+		s.dropped = true
+	}
+	for len(data) > 0 {
+		if s.pending == nil {
+			s.pending = make([]byte, 0, s.segment)
+		}
+		n := s.segment - len(s.pending)
+		if n > len(data) {
+			n = len(data)
+		}
+		s.pending = append(s.pending, data[:n]...)
+		s.total += n
+		data = data[n:]
+		if len(s.pending) == s.segment {
+			s.seal()
+		}
+	}
+	for len(s.segments) > 0 && s.total-s.segments[0].size >= s.size {
+		s.total -= s.segments[0].size
+		s.segments[0] = segment{}
+		s.segments = s.segments[1:]
+		s.dropped = true
+	}
+}
+
+// seal compresses the pending output into a new segment.
+func (s *Scrollback) seal() {
+	var buf bytes.Buffer
+	fw := flateWriters.Get().(*flate.Writer)
+	fw.Reset(&buf)
+	// Writing to a bytes.Buffer can't fail.
+	fw.Write(s.pending)
+	fw.Close()
+	flateWriters.Put(fw)
+
+	s.segments = append(s.segments, segment{
+		data: append([]byte{}, buf.Bytes()...),
+		size: len(s.pending),
+	})
+	s.pending = s.pending[:0]
+}
+
+// Bytes returns the last max bytes of the content of the scrollback (all of
+// it if max is 0 or larger than its size), decompressing the segments holding
+// them only. Once output was left out, it starts after the first newline, the
+// oldest line (and the escape sequence or character it may begin with) being
+// incomplete.
+func (s *Scrollback) Bytes(
+	max int,
+) ([]byte, error) {
+	if max <= 0 || max > s.size {
+		max = s.size
+	}
+	// Skip the oldest segments not holding any of the last max bytes.
+	first, need := len(s.segments), max-len(s.pending)
+	for first > 0 && need > 0 {
+		first--
+		need -= s.segments[first].size
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(max - need)
+	for _, sg := range s.segments[first:] {
+		fr := flate.NewReader(bytes.NewReader(sg.data))
+		_, err := io.Copy(&buf, fr)
+		fr.Close()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	buf.Write(s.pending)
+
+	data := buf.Bytes()
+	dropped := s.dropped || first > 0
+	if len(data) > max {
+		data = data[len(data)-max:]
+		dropped = true
+	}
+	if dropped {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	return data, nil
+}
+
+// Memory returns the number of bytes of memory held by the scrollback for its
+// content.
+func (s *Scrollback) Memory() int {
+	n := cap(s.pending)
+	for _, sg := range s.segments {
+		n += cap(sg.data)
+	}
+	return n
+}
+
+// scrollbackReplay returns the scrollback of the warp to replay to a shell
+// client session joining it, as much as requested by the session (see
+// warp.SessionHello.Replay) up to the scrollback kept. It must be called with
+// the warp lock held.
+func (w *Warp) scrollbackReplay(
+	ctx context.Context,
+	ss *Session,
+) []byte {
+	if w.scrollback == nil || ss.replay == warp.ReplayNone {
+		return nil
+	}
+	data, err := w.scrollback.Bytes(ss.replay)
+	if err != nil {
+		logging.Logf(ctx,
+			"Error reading scrollback: session=%s error=%v",
+			ss.ToString(), err,
+		)
+		return nil
+	}
+	return data
+}
+
+// replayScrollback writes the scrollback of the warp to a shell client session
+// joining it, in frames numbered 0 for sequenced sessions (the sequence
+// starting with the live data that follows). It must be called with the data
+// lock held, for the replay to precede the live data relayed to the session.
+func (w *Warp) replayScrollback(
+	ctx context.Context,
+	ss *Session,
+	data []byte,
+) {
+	if len(data) == 0 {
+		return
+	}
+	logging.Logf(ctx,
+		"Replaying scrollback: session=%s size=%d",
+		ss.ToString(), len(data),
+	)
+
+	var err error
+	if ss.sequenced {
+		for len(data) > 0 && err == nil {
+			n := len(data)
+			if n > warp.MaxDataFrameSize {
+				n = warp.MaxDataFrameSize
+			}
+			err = warp.WriteDataFrame(ss.dataC, 0, data[:n])
+			data = data[n:]
+		}
+	} else {
+		_, err = ss.dataC.Write(data)
+	}
+	if err != nil {
+		ss.SendInternalError(ctx)
+		ss.TearDown()
+	}
+}
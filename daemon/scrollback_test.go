@@ -0,0 +1,196 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+)
+
+// logStream returns n bytes of colored log output, as typically produced by
+// a server run in a warp.
+func logStream(
+	n int,
+) []byte {
+	r := rand.New(rand.NewSource(42))
+	levels := []string{
+		"\x1b[32mINFO\x1b[0m", "\x1b[32mINFO\x1b[0m", "\x1b[33mWARN\x1b[0m",
+	}
+	paths := []string{"/api/v1/users", "/api/v1/warps", "/healthz"}
+	t := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		t = t.Add(time.Duration(r.Intn(50)) * time.Millisecond)
+		fmt.Fprintf(&buf,
+			"\x1b[2m%s\x1b[0m %s http: GET %s/%d %d %.1fms request_id=%08x\r\n",
+			t.Format(time.RFC3339Nano), levels[r.Intn(len(levels))],
+			paths[r.Intn(len(paths))], r.Intn(10000), 200, r.Float64()*100,
+			r.Uint32(),
+		)
+	}
+	return buf.Bytes()[:n]
+}
+
+// expectedScrollback returns the content expected from a scrollback of size
+// bytes to which written was written.
+func expectedScrollback(
+	written []byte,
+	size int,
+) []byte {
+	if len(written) <= size {
+		return written
+	}
+	data := written[len(written)-size:]
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	}
+	return data
+}
+
+func TestScrollbackReplay(t *testing.T) {
+	stream := logStream(64 * 1024)
+	for _, tc := range []struct {
+		name  string
+		size  int
+		seg   int
+		chunk int
+	}{
+		{"empty", 1024, 256, 0},
+		{"within a segment", 1024, 256, 100},
+		{"chunks at reset points", 4096, 256, 256},
+		{"chunks across reset points", 4096, 256, 100},
+		{"chunks larger than segments", 4096, 256, 1000},
+		{"chunks larger than size", 4096, 256, 5000},
+		{"single segment", 4096, 4096, 333},
+		{"default segment", 16 * 1024, scrollbackSegment, 777},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sb := newScrollback(tc.size, tc.seg)
+			written := 0
+			for {
+				// Check the content after each chunk written.
+				got, err := sb.Bytes(0)
+				if err != nil {
+					t.Fatalf("Bytes: %v", err)
+				}
+				want := expectedScrollback(stream[:written], tc.size)
+				if !bytes.Equal(got, want) {
+					t.Fatalf(
+						"Content after %d bytes written: got %d bytes, want %d",
+						written, len(got), len(want),
+					)
+				}
+				if tc.chunk == 0 || written == len(stream) {
+					break
+				}
+				n := tc.chunk
+				if n > len(stream)-written {
+					n = len(stream) - written
+				}
+				sb.Write(stream[written : written+n])
+				written += n
+			}
+		})
+	}
+}
+
+func TestScrollbackDropsOldestSegments(t *testing.T) {
+	sb := newScrollback(4096, 1024)
+	sb.Write(logStream(64 * 1024))
+	if sb.total < sb.size || sb.total > sb.size+sb.segment {
+		t.Errorf("Output kept: got %d, want %d to %d",
+			sb.total, sb.size, sb.size+sb.segment)
+	}
+	if len(sb.segments) > sb.size/sb.segment+1 {
+		t.Errorf("Segments kept: got %d", len(sb.segments))
+	}
+}
+
+func TestScrollbackCompresses(t *testing.T) {
+	sb := NewScrollback(64 * 1024)
+	sb.Write(logStream(256 * 1024))
+	if m := sb.Memory(); m > 64*1024/2 {
+		t.Errorf("Memory: got %d, want less than half the raw size", m)
+	}
+}
+
+// BenchmarkScrollbackMemory measures the memory held by a 64KB scrollback fed
+// log-heavy output, against the 64KB of a raw ring buffer.
+func BenchmarkScrollbackMemory(b *testing.B) {
+	const size = 64 * 1024
+	stream := logStream(1024 * 1024)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+
+	var memory int
+	for i := 0; i < b.N; i++ {
+		sb := NewScrollback(size)
+		for data := stream; len(data) > 0; {
+			n := 512
+			if n > len(data) {
+				n = len(data)
+			}
+			sb.Write(data[:n])
+			data = data[n:]
+		}
+		memory = sb.Memory()
+	}
+	b.ReportMetric(float64(size), "raw-bytes/warp")
+	b.ReportMetric(float64(memory), "compressed-bytes/warp")
+}
+
+// BenchmarkScrollbackReplay measures the decompression of a full 64KB
+// scrollback for a joining client.
+func BenchmarkScrollbackReplay(b *testing.B) {
+	sb := NewScrollback(64 * 1024)
+	sb.Write(logStream(1024 * 1024))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := sb.Bytes(0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestScrollbackReplayRequested(t *testing.T) {
+	const size = 4096
+	stream := logStream(64 * 1024)
+	w := &Warp{scrollback: newScrollback(size, 256)}
+	for data := stream; len(data) > 0; data = data[100:] {
+		if len(data) < 100 {
+			w.scrollback.Write(data)
+			break
+		}
+		w.scrollback.Write(data[:100])
+	}
+
+	for _, tc := range []struct {
+		name   string
+		replay int
+		want   []byte
+	}{
+		{"default", 0, expectedScrollback(stream, size)},
+		{"none", warp.ReplayNone, nil},
+		{"within a segment", 100, expectedScrollback(stream, 100)},
+		{"across segments", 1000, expectedScrollback(stream, 1000)},
+		{"all", size, expectedScrollback(stream, size)},
+		{"over the cap", 10 * size, expectedScrollback(stream, size)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := w.scrollbackReplay(
+				context.Background(), &Session{replay: tc.replay},
+			)
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("Replay: got %d bytes, want %d", len(got), len(tc.want))
+			}
+			if len(got) > size {
+				t.Errorf("Replay over the cap: %d bytes", len(got))
+			}
+		})
+	}
+}
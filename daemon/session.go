@@ -2,9 +2,13 @@ package daemon
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/gob"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -14,6 +18,11 @@ import (
 	"github.com/spolu/warp/lib/logging"
 )
 
+// SessionFlushTimeout is the maximum time a session is kept open after an
+// error was sent to its peer, waiting for the peer to close it. It can be
+// lowered to speed up tests.
+var SessionFlushTimeout = 500 * time.Millisecond
+
 // Session represents a client session connected to the warp.
 type Session struct {
 	session warp.Session
@@ -22,6 +31,23 @@ type Session struct {
 	sessionType warp.SessionType
 
 	username string
+	// identity is the identity derived from the TLS client certificate, if
+	// any (see certIdentity).
+	identity string
+	// sequenced indicates that data is sent to the session as sequenced data
+	// frames.
+	sequenced bool
+	// requested is the mode requested by a shell client session (see
+	// warp.SessionHello).
+	requested warp.Mode
+	// replay is the amount of scrollback requested by a shell client session
+	// (see warp.SessionHello).
+	replay int
+	// auth is the authentication token presented by the session, if any.
+	auth string
+	// size is the size of the client terminal as reported by shell clients.
+	// It is protected by the warp lock.
+	size warp.Size
 
 	conn net.Conn
 	mux  *yamux.Session
@@ -33,10 +59,19 @@ type Session struct {
 	errorC  net.Conn
 	errorW  *gob.Encoder
 	dataC   net.Conn
+	// channels are the optional channels of the session supported by warpd
+	// (see supportedChannels).
+	channels map[warp.ChannelType]net.Conn
+	// chatR and chatW are set if the session opened a chat channel.
+	chatR *gob.Decoder
+	chatW *gob.Encoder
 
-	tornDown bool
-	ctx      context.Context
-	cancel   func()
+	// errorSent is the code of the error sent to the peer, if any (see
+	// TearDown).
+	errorSent string
+	tornDown  bool
+	ctx       context.Context
+	cancel    func()
 
 	mutex *sync.Mutex
 }
@@ -48,7 +83,50 @@ func NewSession(
 	cancel func(),
 	conn net.Conn,
 ) (*Session, error) {
-	mux, err := yamux.Server(conn, nil)
+	// Exchange preambles, rejecting connections not speaking the warp
+	// protocol before any further decoding happens.
+	conn.SetDeadline(time.Now().Add(warp.PreambleTimeout))
+	version, err := warp.ReadPreamble(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Trace(
+			errors.Newf("Rejected connection: %v", err),
+		)
+	}
+	// Newer peers are served with our version, which they may speak, and
+	// peers too old to be served are sent our version before being rejected.
+	negotiated := version
+	if negotiated > warp.ProtocolVersion ||
+		negotiated < warp.MinProtocolVersion {
+		negotiated = warp.ProtocolVersion
+	}
+	if err := warp.WritePreamble(conn, negotiated); err != nil {
+		conn.Close()
+		return nil, errors.Trace(
+			errors.Newf("Preamble write error: %v", err),
+		)
+	}
+	if version < warp.MinProtocolVersion {
+		// Our preamble was sent so that the client can report the mismatch.
+		conn.Close()
+		return nil, errors.Trace(
+			errors.Newf(
+				"Rejected connection: protocol version mismatch: %d",
+				version,
+			),
+		)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The TLS handshake completed while reading the preamble.
+	identity := ""
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		identity = certIdentity(tlsConn.ConnectionState())
+	}
+
+	mux, err := yamux.Server(conn, warp.MuxConfig(
+		30*time.Second, os.Stderr,
+	))
 	if err != nil {
 		return nil, errors.Trace(
 			errors.Newf("Mux error: %v", err),
@@ -58,69 +136,260 @@ func NewSession(
 	ss := &Session{
 		conn:     conn,
 		mux:      mux,
+		identity: identity,
+		channels: map[warp.ChannelType]net.Conn{},
 		tornDown: false,
 		ctx:      ctx,
 		cancel:   cancel,
 		mutex:    &sync.Mutex{},
 	}
 
-	// Opens state channel stateC.
-	ss.stateC, err = mux.Accept()
+	var hello *warp.SessionHello
+	if negotiated < 2 {
+		hello, err = ss.acceptOrderedChannels()
+	} else {
+		hello, err = ss.acceptTaggedChannels()
+	}
 	if err != nil {
+		ss.TearDown()
+		return nil, errors.Trace(err)
+	}
+	ss.session = hello.From
+	ss.warp = hello.Warp
+	ss.sessionType = hello.Type
+	ss.username = hello.Username
+	ss.sequenced = hello.Sequenced
+	ss.requested = hello.Mode
+	ss.replay = hello.Replay
+	ss.auth = hello.Auth
+	if hello.Compress && negotiated >= 3 {
+		ss.dataC = warp.NewCompressedConn(ss.dataC)
+	}
+	if chatC, ok := ss.channels[warp.ChannelChat]; ok {
+		ss.chatR = gob.NewDecoder(chatC)
+		ss.chatW = gob.NewEncoder(chatC)
+	}
+
+	logging.Logf(ctx,
+		"Session hello received: session=%s type=%s username=%s identity=%s "+
+			"protocol=%d compress=%t",
+		ss.ToString(), hello.Type, hello.Username, ss.identity, negotiated,
+		hello.Compress,
+	)
+
+	if hello.Schema != warp.SchemaVersion {
+		ss.SendError(ctx,
+			warp.ErrCodeSchemaMismatch,
+			fmt.Sprintf(
+				"The protocol schema of your client (%d, version %s) is "+
+					"incompatible with warpd's (%d, version %s). Please use "+
+					"a matching version of warp.",
+				hello.Schema, hello.Version, warp.SchemaVersion, warp.Version,
+			),
+		)
 		ss.TearDown()
 		return nil, errors.Trace(
-			errors.Newf("State channel open error: %v", err),
+			errors.Newf(
+				"Rejected session: schema mismatch: session=%s schema=%d",
+				ss.ToString(), hello.Schema,
+			),
 		)
 	}
+
+	return ss, nil
+}
+
+// acceptOrderedChannels accepts the channels of a version 1 session, opened
+// in order by the peer, and returns its hello (received over the update
+// channel, second to be opened).
+func (ss *Session) acceptOrderedChannels() (*warp.SessionHello, error) {
+	var err error
+	// Opens state channel stateC.
+	ss.stateC, err = acceptChannel(ss.mux, "state")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 	ss.stateW = gob.NewEncoder(ss.stateC)
 
 	// Open update channel updateC.
-	ss.updateC, err = mux.Accept()
+	ss.updateC, err = acceptChannel(ss.mux, "update")
 	if err != nil {
-		ss.TearDown()
-		return nil, errors.Trace(
-			errors.Newf("Update channel open error: %v", err),
-		)
+		return nil, errors.Trace(err)
 	}
 	ss.updateR = gob.NewDecoder(ss.updateC)
 
 	var hello warp.SessionHello
 	if err := ss.updateR.Decode(&hello); err != nil {
-		ss.TearDown()
 		return nil, errors.Trace(
 			errors.Newf("Initial client update error: %v", err),
 		)
 	}
-	ss.session = hello.From
-	ss.warp = hello.Warp
-	ss.sessionType = hello.Type
-	ss.username = hello.Username
-
-	logging.Logf(ctx,
-		"Session hello received: session=%s type=%s username=%s",
-		ss.ToString(), hello.Type, hello.Username,
-	)
 
 	// Opens error channel errorC.
-	ss.errorC, err = mux.Accept()
+	ss.errorC, err = acceptChannel(ss.mux, "error")
 	if err != nil {
-		ss.TearDown()
-		return nil, errors.Trace(
-			errors.Newf("Error channel open error: %v", err),
-		)
+		return nil, errors.Trace(err)
 	}
 	ss.errorW = gob.NewEncoder(ss.errorC)
 
 	// Open data channel dataC.
-	ss.dataC, err = mux.Accept()
+	ss.dataC, err = acceptChannel(ss.mux, "data")
 	if err != nil {
-		ss.TearDown()
+		return nil, errors.Trace(err)
+	}
+
+	return &hello, nil
+}
+
+// supportedChannels are the optional channels warpd supports (see
+// warp.SessionHello.Channels). Other optional channels are closed upon being
+// accepted.
+var supportedChannels = map[warp.ChannelType]bool{
+	warp.ChannelChat: true,
+}
+
+// acceptTaggedChannels accepts the channels of a version 2 session by type, in
+// any order: the required channels and the optional ones announced by the
+// hello of the session (received over the update channel), which it returns.
+// Optional channels warpd doesn't support are closed.
+func (ss *Session) acceptTaggedChannels() (*warp.SessionHello, error) {
+	channels := map[warp.ChannelType]net.Conn{}
+	announced := map[warp.ChannelType]bool{}
+	var hello *warp.SessionHello
+
+	pending := len(warp.RequiredChannels)
+	for pending > 0 {
+		if len(channels) >= warp.MaxSessionChannels {
+			return nil, errors.Trace(
+				errors.Newf("Too many channels opened by session"),
+			)
+		}
+		c, err := acceptChannel(ss.mux, "next")
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		t, err := warp.ReadChannelTag(c)
+		if err != nil {
+			return nil, errors.Trace(
+				errors.Newf("Failed to read channel tag: %v", err),
+			)
+		}
+		if _, ok := channels[t]; ok {
+			return nil, errors.Trace(
+				errors.Newf("Duplicate %s channel", t),
+			)
+		}
+		channels[t] = c
+		pending--
+
+		if t != warp.ChannelUpdate {
+			continue
+		}
+		ss.updateC = c
+		ss.updateR = gob.NewDecoder(ss.updateC)
+		hello = &warp.SessionHello{}
+		if err := ss.updateR.Decode(hello); err != nil {
+			return nil, errors.Trace(
+				errors.Newf("Initial client update error: %v", err),
+			)
+		}
+		if len(warp.RequiredChannels)+len(hello.Channels) >
+			warp.MaxSessionChannels {
+			return nil, errors.Trace(
+				errors.Newf("Too many channels announced by session"),
+			)
+		}
+		for _, o := range hello.Channels {
+			if isRequiredChannel(o) || announced[o] {
+				return nil, errors.Trace(
+					errors.Newf("Invalid optional %s channel", o),
+				)
+			}
+			announced[o] = true
+		}
+		pending += len(hello.Channels)
+	}
+
+	// All channels received are required or announced (so that all of them
+	// were received as their types are unique).
+	for t, c := range channels {
+		if isRequiredChannel(t) {
+			continue
+		}
+		if !announced[t] {
+			return nil, errors.Trace(
+				errors.Newf("Unannounced %s channel", t),
+			)
+		}
+		if supportedChannels[t] {
+			ss.channels[t] = c
+		} else {
+			c.Close()
+		}
+	}
+
+	ss.stateC = channels[warp.ChannelState]
+	ss.stateW = gob.NewEncoder(ss.stateC)
+	ss.errorC = channels[warp.ChannelError]
+	ss.errorW = gob.NewEncoder(ss.errorC)
+	ss.dataC = channels[warp.ChannelData]
+
+	return hello, nil
+}
+
+// isRequiredChannel returns whether a channel type is one of the required
+// channels of sessions.
+func isRequiredChannel(
+	t warp.ChannelType,
+) bool {
+	for _, r := range warp.RequiredChannels {
+		if t == r {
+			return true
+		}
+	}
+	return false
+}
+
+// certIdentity returns the identity of the peer of a TLS connection as
+// derived from its verified client certificate: its subject common name, or
+// its first DNS or email SAN if it has none. It returns an empty string if
+// no certificate was presented.
+func certIdentity(
+	state tls.ConnectionState,
+) string {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// acceptChannel accepts the named channel of a session over the mux.
+func acceptChannel(
+	mux *yamux.Session,
+	name string,
+) (net.Conn, error) {
+	c, err := mux.Accept()
+	if err == yamux.ErrSessionShutdown {
+		return nil, errors.Trace(
+			errors.Newf(
+				"Connection closed before the %s channel was opened", name,
+			),
+		)
+	} else if err != nil {
 		return nil, errors.Trace(
-			errors.Newf("Data channel open error: %v", err),
+			errors.Newf("Failed to accept %s channel: %v", name, err),
 		)
 	}
-
-	return ss, nil
+	return c, nil
 }
 
 // ToStering returns a string that identifies the session for logging.
@@ -130,17 +399,35 @@ func (ss *Session) ToString() string {
 	)
 }
 
-// TearDown tears down a session, closing and reclaiming channels.
+// TornDown returns the session tornDown value.
+func (ss *Session) TornDown() bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.tornDown
+}
+
+// TearDown tears down a session, closing and reclaiming channels. The session
+// context is canceled immediately. Writes to the mux return once written to
+// the connection so the mux is closed immediately, unless an error was sent
+// to the peer: closing the connection while the peer is still sending data
+// resets it, possibly before the error is read. The mux is then closed once
+// the peer closed the session upon receiving the error, or after
+// SessionFlushTimeout.
 func (ss *Session) TearDown() {
 	ss.mutex.Lock()
 	defer ss.mutex.Unlock()
 	if !ss.tornDown {
 		ss.tornDown = true
 		ss.cancel()
+		if ss.errorSent == "" || ss.mux.IsClosed() {
+			ss.mux.Close()
+			return
+		}
 		go func() {
-			// Sleep for 500ms before killing the session to give a chance to
-			// the bufffers to flush.
-			time.Sleep(500 * time.Millisecond)
+			// The peer never writes to errorC, reading from it returns once
+			// the peer closed the session or the deadline is reached.
+			ss.errorC.SetReadDeadline(time.Now().Add(SessionFlushTimeout))
+			io.Copy(ioutil.Discard, ss.errorC)
 			// Closes stateC, updateC, errorC, dataC, mux and conn.
 			ss.mux.Close()
 		}()
@@ -153,25 +440,115 @@ func (ss *Session) SendError(
 	ctx context.Context,
 	code string,
 	message string,
+) {
+	ss.sendError(ctx, warp.Error{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// SendRedirect sends a redirect error to the client which should trigger a
+// disconnection and a reconnection to the specified address on its end.
+func (ss *Session) SendRedirect(
+	ctx context.Context,
+	address string,
+) {
+	ss.sendError(ctx, warp.Error{
+		Code: warp.ErrCodeRedirect,
+		Message: fmt.Sprintf(
+			"The warp is served by another warpd: %s.", address,
+		),
+		Redirect: address,
+	})
+}
+
+// SendResolution sends the result of a prefix resolution over the state
+// channel of a resolve session.
+func (ss *Session) SendResolution(
+	ctx context.Context,
+	res warp.Resolution,
 ) {
 	ss.mutex.Lock()
 	defer ss.mutex.Unlock()
-	if ss.tornDown {
+	if ss.tornDown || ss.mux.IsClosed() {
+		return
+	}
+	if err := ss.stateW.Encode(res); err != nil {
+		logging.Logf(ctx,
+			"Error sending resolution: session=%s error=%v",
+			ss.ToString(), err,
+		)
+	}
+}
+
+// SendState sends a state over the state channel.
+func (ss *Session) SendState(
+	ctx context.Context,
+	st warp.State,
+) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if ss.tornDown || ss.mux.IsClosed() {
+		return
+	}
+	if err := ss.stateW.Encode(st); err != nil {
+		logging.Logf(ctx,
+			"Error sending state: session=%s error=%v",
+			ss.ToString(), err,
+		)
+	}
+}
+
+// SendChat sends a chat message over the chat channel, if the session has
+// one.
+func (ss *Session) SendChat(
+	ctx context.Context,
+	msg warp.ChatMessage,
+) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if ss.tornDown || ss.mux.IsClosed() || ss.chatW == nil {
+		return
+	}
+	if err := ss.chatW.Encode(msg); err != nil {
+		logging.Logf(ctx,
+			"Error sending chat message: session=%s error=%v",
+			ss.ToString(), err,
+		)
+	}
+}
+
+// sendError sends an error over the error channel.
+func (ss *Session) sendError(
+	ctx context.Context,
+	e warp.Error,
+) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if ss.tornDown || ss.mux.IsClosed() {
+		// The session is already closed, the error would not be received.
 		return
 	}
 	logging.Logf(ctx,
 		"Sending session error: session=%s code=%s message=%s",
-		ss.ToString(), code, message,
+		ss.ToString(), e.Code, e.Message,
 	)
-	if err := ss.errorW.Encode(warp.Error{
-		Code:    code,
-		Message: message,
-	}); err != nil {
+	if err := ss.errorW.Encode(e); err != nil {
 		logging.Logf(ctx,
 			"Error sending session error: session=%s error=%v",
 			ss.ToString(), err,
 		)
+		return
 	}
+	ss.errorSent = e.Code
+}
+
+// ErrorSent returns the code of the error sent to the peer, empty if none
+// was.
+func (ss *Session) ErrorSent() string {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.errorSent
 }
 
 // SendInternalError sends an internal error to the client which should trigger
@@ -180,7 +557,7 @@ func (ss *Session) SendInternalError(
 	ctx context.Context,
 ) {
 	ss.SendError(ctx,
-		"internal_error",
+		warp.ErrCodeInternal,
 		fmt.Sprintf(
 			"The warp experienced an internal error (session: %s).",
 			ss.ToString(),
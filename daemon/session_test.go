@@ -0,0 +1,251 @@
+package daemon
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/spolu/warp"
+)
+
+// testHello returns the hello of a shell client session announcing the
+// optional channels specified.
+func testHello(
+	channels ...warp.ChannelType,
+) warp.SessionHello {
+	return warp.SessionHello{
+		Warp:     "goofy-dev",
+		From:     warp.Session{Token: "tok", User: "usr", Secret: "sec"},
+		Version:  warp.Version,
+		Schema:   warp.SchemaVersion,
+		Type:     warp.SsTpShellClient,
+		Username: "stan",
+		Channels: channels,
+	}
+}
+
+// peerSession is the result of a session set up by a test peer.
+type peerSession struct {
+	// ss is the session accepted by warpd, nil if it was rejected.
+	ss *Session
+	// err is the error returned by NewSession.
+	err error
+	// negotiated is the protocol version replied by warpd.
+	negotiated byte
+	// channels are the channels opened by the peer, by type.
+	channels map[warp.ChannelType]net.Conn
+}
+
+// dialSession sets up a session with NewSession as a peer speaking protocol
+// version, opening channels in the order specified (tagged for versions 2 and
+// above) and sending hello over the update channel.
+func dialSession(
+	t *testing.T,
+	version byte,
+	hello warp.SessionHello,
+	order []warp.ChannelType,
+) *peerSession {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	type result struct {
+		ss  *Session
+		err error
+	}
+	resultC := make(chan result, 1)
+	go func() {
+		ss, err := NewSession(ctx, cancel, server)
+		resultC <- result{ss, err}
+	}()
+
+	if err := warp.WritePreamble(client, version); err != nil {
+		t.Fatalf("WritePreamble: %v", err)
+	}
+	negotiated, err := warp.ReadPreamble(client)
+	if err != nil {
+		t.Fatalf("ReadPreamble: %v", err)
+	}
+	mux, err := yamux.Client(client, warp.MuxConfig(
+		time.Second, ioutil.Discard,
+	))
+	if err != nil {
+		t.Fatalf("yamux.Client: %v", err)
+	}
+	t.Cleanup(func() { mux.Close() })
+
+	// Channels are opened until warpd rejects the session.
+	p := &peerSession{
+		negotiated: negotiated,
+		channels:   map[warp.ChannelType]net.Conn{},
+	}
+	for _, ct := range order {
+		c, err := mux.Open()
+		if err != nil {
+			break
+		}
+		if version >= 2 {
+			if err := warp.WriteChannelTag(c, ct); err != nil {
+				break
+			}
+		}
+		p.channels[ct] = c
+		if ct == warp.ChannelUpdate {
+			if err := gob.NewEncoder(c).Encode(hello); err != nil {
+				break
+			}
+		}
+	}
+
+	select {
+	case r := <-resultC:
+		p.ss, p.err = r.ss, r.err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("NewSession blocked")
+	}
+	if p.ss != nil {
+		t.Cleanup(p.ss.TearDown)
+	}
+	return p
+}
+
+// assertRouted checks that the required channels opened by the peer are
+// routed to the matching channels of the session.
+func assertRouted(
+	t *testing.T,
+	p *peerSession,
+) {
+	t.Helper()
+	if p.err != nil {
+		t.Fatalf("NewSession: %v", p.err)
+	}
+	go p.channels[warp.ChannelData].Write([]byte("ls\r"))
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(p.ss.dataC, buf); err != nil {
+		t.Fatalf("Read data: %v", err)
+	}
+	if string(buf) != "ls\r" {
+		t.Errorf("Data: got %q, want %q", buf, "ls\r")
+	}
+
+	go p.ss.stateW.Encode(warp.State{Warp: "goofy-dev"})
+	var st warp.State
+	if err := gob.NewDecoder(p.channels[warp.ChannelState]).Decode(&st); err != nil {
+		t.Fatalf("Decode state: %v", err)
+	}
+	if st.Warp != "goofy-dev" {
+		t.Errorf("State warp: got %q, want goofy-dev", st.Warp)
+	}
+}
+
+func TestNewSessionOrderedChannels(t *testing.T) {
+	p := dialSession(t, 1, testHello(), warp.RequiredChannels)
+	if p.negotiated != 1 {
+		t.Errorf("Negotiated version: got %d, want 1", p.negotiated)
+	}
+	assertRouted(t, p)
+}
+
+func TestNewSessionNewerPeer(t *testing.T) {
+	p := dialSession(t, warp.ProtocolVersion+1, testHello(), warp.RequiredChannels)
+	if p.negotiated != warp.ProtocolVersion {
+		t.Errorf("Negotiated version: got %d, want %d",
+			p.negotiated, warp.ProtocolVersion)
+	}
+	assertRouted(t, p)
+}
+
+func TestNewSessionTaggedChannelsInAnyOrder(t *testing.T) {
+	p := dialSession(t, warp.ProtocolVersion, testHello(), []warp.ChannelType{
+		warp.ChannelData, warp.ChannelError, warp.ChannelUpdate, warp.ChannelState,
+	})
+	if p.negotiated != warp.ProtocolVersion {
+		t.Errorf("Negotiated version: got %d, want %d",
+			p.negotiated, warp.ProtocolVersion)
+	}
+	assertRouted(t, p)
+	if len(p.ss.channels) != 0 {
+		t.Errorf("Optional channels: got %v, want none", p.ss.channels)
+	}
+}
+
+func TestNewSessionOptionalChannels(t *testing.T) {
+	// A chat capable peer, and a peer newer than warpd opening an events
+	// channel unknown to it.
+	p := dialSession(t, warp.ProtocolVersion, testHello(
+		warp.ChannelChat, "events",
+	), []warp.ChannelType{
+		warp.ChannelState, warp.ChannelUpdate, "events",
+		warp.ChannelError, warp.ChannelData, warp.ChannelChat,
+	})
+	assertRouted(t, p)
+
+	if _, ok := p.ss.channels[warp.ChannelChat]; !ok || p.ss.chatW == nil {
+		t.Errorf("Chat channel not accepted")
+	}
+	if _, ok := p.ss.channels["events"]; ok {
+		t.Errorf("Unsupported events channel accepted")
+	}
+	// The unsupported channel is closed by warpd.
+	events := p.channels["events"]
+	events.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := events.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Events channel: got %v, want io.EOF", err)
+	}
+
+	// A peer not announcing the chat channel is served without it.
+	p = dialSession(t, warp.ProtocolVersion, testHello(), warp.RequiredChannels)
+	assertRouted(t, p)
+	if p.ss.chatW != nil {
+		t.Errorf("Chat channel set up without being announced")
+	}
+}
+
+func TestNewSessionRejectsInvalidChannels(t *testing.T) {
+	tooMany := []warp.ChannelType{}
+	for i := 0; i < warp.MaxSessionChannels; i++ {
+		tooMany = append(tooMany, warp.ChannelType(strings.Repeat("x", i+1)))
+	}
+	for _, tc := range []struct {
+		name  string
+		hello warp.SessionHello
+		order []warp.ChannelType
+		err   string
+	}{
+		{"duplicate channel", testHello(), []warp.ChannelType{
+			warp.ChannelState, warp.ChannelState,
+		}, "Duplicate state channel"},
+		{"unannounced channel", testHello(), []warp.ChannelType{
+			warp.ChannelState, "events", warp.ChannelUpdate, warp.ChannelError,
+		}, "Unannounced events channel"},
+		{"required channel announced", testHello(warp.ChannelData), []warp.ChannelType{
+			warp.ChannelUpdate,
+		}, "Invalid optional data channel"},
+		{"channel announced twice", testHello(
+			warp.ChannelChat, warp.ChannelChat,
+		), []warp.ChannelType{
+			warp.ChannelUpdate,
+		}, "Invalid optional chat channel"},
+		{"too many channels announced", testHello(tooMany...), []warp.ChannelType{
+			warp.ChannelUpdate,
+		}, "Too many channels announced"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := dialSession(t, warp.ProtocolVersion, tc.hello, tc.order)
+			if p.err == nil {
+				t.Fatalf("Session accepted")
+			}
+			if !strings.Contains(p.err.Error(), tc.err) {
+				t.Errorf("Error: got %v, want %q", p.err, tc.err)
+			}
+		})
+	}
+}
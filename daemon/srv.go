@@ -2,13 +2,22 @@ package daemon
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/listen"
 	"github.com/spolu/warp/lib/logging"
 )
 
@@ -17,6 +26,54 @@ type Srv struct {
 	address  string
 	certFile string
 	keyFile  string
+	// clientCAFile, if set, requires TLS clients to present a certificate
+	// signed by one of its CAs.
+	clientCAFile string
+
+	audit *AuditLog
+	// webhook, if set, is posted the opening and closing of warps.
+	webhook *Webhook
+	// metrics, if set, counts the data relayed and the sessions closed.
+	metrics *Metrics
+	// redirect, if set, is the address of the warpd all sessions are
+	// redirected to. It is protected by the mutex (reloadable).
+	redirect string
+	// resolvePrefix indicates whether clients can resolve warp IDs by prefix
+	// (disabled by default as it lets clients probe for active warps). It is
+	// protected by the mutex (reloadable).
+	resolvePrefix bool
+	// maxWarps, if positive, is the maximum number of warps served
+	// concurrently. It is protected by the mutex (reloadable).
+	maxWarps int
+	// authTokens, if set, are the tokens sessions must present to be
+	// served. It is protected by the mutex (reloadable).
+	authTokens []string
+	// hostGrace is the time warps are kept open after their host
+	// disconnected unexpectedly, for it to reconnect (disabled if 0). It is
+	// protected by the mutex (reloadable).
+	hostGrace time.Duration
+	// scrollback is the size in bytes of the scrollback of the warps opened,
+	// replayed to the shell clients joining them (disabled if 0). It is
+	// protected by the mutex (reloadable).
+	scrollback int
+	// idleTimeout is the time after which the warps opened whose host
+	// produced no output are closed (disabled if 0). It is protected by the
+	// mutex (reloadable).
+	idleTimeout time.Duration
+	// maxClients is the maximum number of clients of the warps opened (on
+	// top of the limit set by their host, unlimited if 0). It is protected
+	// by the mutex (reloadable).
+	maxClients int
+
+	// started and connections (accessed atomically) are reported by the
+	// admin API.
+	started     time.Time
+	connections uint64
+	// listening (set once accepting connections) and sessions (the number of
+	// connections being handled) are accessed atomically and reported by the
+	// health check.
+	listening int32
+	sessions  int64
 
 	warps map[string]*Warp
 	mutex *sync.Mutex
@@ -25,25 +82,86 @@ type Srv struct {
 // NewSrv constructs a Srv ready to start serving requests.
 func NewSrv(
 	ctx context.Context,
-	address string,
-	certFile string,
-	keyFile string,
+	config Config,
+	audit *AuditLog,
+	webhook *Webhook,
+	metrics *Metrics,
 ) *Srv {
 	return &Srv{
-		address:  address,
-		certFile: certFile,
-		keyFile:  keyFile,
-		warps:    map[string]*Warp{},
-		mutex:    &sync.Mutex{},
+		address:       config.Listen,
+		certFile:      config.Cert,
+		keyFile:       config.Key,
+		clientCAFile:  config.TLSClientCA,
+		audit:         audit,
+		webhook:       webhook,
+		metrics:       metrics,
+		redirect:      config.Redirect,
+		resolvePrefix: config.ResolvePrefix,
+		maxWarps:      config.MaxWarps,
+		authTokens:    config.AuthTokens,
+		hostGrace:     time.Duration(config.HostGrace) * time.Second,
+		scrollback:    config.Scrollback * 1024,
+		idleTimeout:   time.Duration(config.IdleTimeout) * time.Second,
+		maxClients:    config.MaxClients,
+		started:       time.Now(),
+		warps:         map[string]*Warp{},
+		mutex:         &sync.Mutex{},
 	}
 }
 
+// Reload applies the reloadable settings of config. Open warps are not
+// affected.
+func (s *Srv) Reload(
+	ctx context.Context,
+	config Config,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.redirect = config.Redirect
+	s.resolvePrefix = config.ResolvePrefix
+	s.maxWarps = config.MaxWarps
+	s.authTokens = config.AuthTokens
+	s.hostGrace = time.Duration(config.HostGrace) * time.Second
+	s.scrollback = config.Scrollback * 1024
+	s.idleTimeout = time.Duration(config.IdleTimeout) * time.Second
+	s.maxClients = config.MaxClients
+}
+
+// authorized returns whether a session presented one of the authentication
+// tokens of warpd, if it requires one. Tokens are compared in constant time.
+func (s *Srv) authorized(
+	ss *Session,
+) bool {
+	s.mutex.Lock()
+	tokens := s.authTokens
+	s.mutex.Unlock()
+
+	if len(tokens) == 0 {
+		return true
+	}
+	ok := false
+	for _, t := range tokens {
+		if t != "" &&
+			subtle.ConstantTimeCompare([]byte(t), []byte(ss.auth)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
 // Run starts the server.
 func (s *Srv) Run(
 	ctx context.Context,
 ) error {
 	var ln net.Listener
 
+	network, address := warp.AddressNetwork(s.address)
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
 	if s.certFile != "" && s.keyFile != "" {
 		cer, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
 		if err != nil {
@@ -65,31 +183,43 @@ func (s *Srv) Run(
 			},
 		}
 
-		ln, err = tls.Listen("tcp", s.address, tlsConfig)
+		if s.clientCAFile != "" {
+			pool, err := loadCertPool(s.clientCAFile)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		ln, err = tls.Listen(network, address, tlsConfig)
 		if err != nil {
 			return errors.Trace(err)
 		}
 		logging.Logf(ctx,
-			"Listening: address=%s tls=true cert_file=%s key_file=%s",
-			s.address, s.certFile, s.keyFile)
+			"Listening: address=%s tls=true cert_file=%s key_file=%s "+
+				"client_ca_file=%s",
+			s.address, s.certFile, s.keyFile, s.clientCAFile)
+	} else if s.clientCAFile != "" {
+		return errors.Trace(
+			errors.Newf("Client certificates require a TLS cert and key"),
+		)
 	} else {
 		var err error
-		ln, err = net.Listen("tcp", s.address)
+		ln, err = net.Listen(network, address)
 		if err != nil {
 			return errors.Trace(err)
 		}
 		logging.Logf(ctx, "Listening: address=%s tls=false", s.address)
 	}
 	defer ln.Close()
+	atomic.StoreInt32(&s.listening, 1)
+	defer atomic.StoreInt32(&s.listening, 0)
 
 	for {
-		conn, err := ln.Accept()
+		conn, err := accept(ctx, ln)
 		if err != nil {
-			logging.Logf(ctx,
-				"Error accepting connection: remote=%s error=%v",
-				conn.RemoteAddr().String(), err,
-			)
-			continue
+			return errors.Trace(err)
 		}
 		go func() {
 			err := s.handle(ctx, conn)
@@ -108,6 +238,64 @@ func (s *Srv) Run(
 	}
 }
 
+// accept waits for the next connection on ln, backing off on temporary
+// errors (see listen.Accept) and logging them.
+func accept(
+	ctx context.Context,
+	ln net.Listener,
+) (net.Conn, error) {
+	conn, err := listen.Accept(ctx, ln,
+		func(err error, delay time.Duration) {
+			logging.Logf(ctx,
+				"Error accepting connection: address=%s error=%v retry_in=%s",
+				ln.Addr().String(), err, delay,
+			)
+		},
+	)
+	return conn, errors.Trace(err)
+}
+
+// removeStaleSocket removes the Unix socket at path left behind by a previous
+// warpd that did not exit cleanly, erroring if it is still in use.
+func removeStaleSocket(
+	path string,
+) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.Trace(
+			errors.Newf("Socket already in use: %s", path),
+		)
+	}
+	if err := os.Remove(path); err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to remove stale socket %s: %v", path, err),
+		)
+	}
+	return nil
+}
+
+// loadCertPool loads the PEM encoded certificates of the specified file.
+func loadCertPool(
+	path string,
+) (*x509.CertPool, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Failed to read client CA file: %v", err),
+		)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, errors.Trace(
+			errors.Newf("No certificate found in client CA file: %s", path),
+		)
+	}
+	return pool, nil
+}
+
 // handle an incoming connection.
 func (s *Srv) handle(
 	ctx context.Context,
@@ -117,6 +305,9 @@ func (s *Srv) handle(
 		"Handling new connection: remote=%s",
 		conn.RemoteAddr().String(),
 	)
+	atomic.AddUint64(&s.connections, 1)
+	atomic.AddInt64(&s.sessions, 1)
+	defer atomic.AddInt64(&s.sessions, -1)
 
 	// Create a new context for this client with its own cancelation function.
 	ctx, cancel := context.WithCancel(ctx)
@@ -127,12 +318,47 @@ func (s *Srv) handle(
 	}
 	// Close and reclaims all session related state.
 	defer ss.TearDown()
+	defer func() {
+		s.metrics.SessionClosed(ss.sessionType, ss.ErrorSent())
+	}()
+
+	s.mutex.Lock()
+	redirect := s.redirect
+	s.mutex.Unlock()
+
+	if redirect != "" {
+		logging.Logf(ctx,
+			"Redirecting session: session=%s redirect=%s",
+			ss.ToString(), redirect,
+		)
+		ss.SendRedirect(ctx, redirect)
+		return nil
+	}
+
+	if !s.authorized(ss) {
+		s.audit.Log(ctx, newAuditEvent(AuditSessionUnauthorized, ss, 0))
+		ss.SendError(ctx,
+			warp.ErrCodeUnauthorized,
+			"This warpd requires an authentication token. Please set "+
+				"WARPD_AUTH_TOKEN to a token it accepts.",
+		)
+		return errors.Trace(
+			errors.Newf(
+				"Rejected session: unauthorized: session=%s",
+				ss.ToString(),
+			),
+		)
+	}
 
 	switch ss.sessionType {
 	case warp.SsTpHost:
 		err = s.handleHost(ctx, ss)
 	case warp.SsTpShellClient:
 		err = s.handleShellClient(ctx, ss)
+	case warp.SsTpChatClient:
+		err = s.handleChatClient(ctx, ss)
+	case warp.SsTpResolve:
+		err = s.handleResolve(ctx, ss)
 	}
 	if err != nil {
 		return errors.Trace(err)
@@ -157,45 +383,193 @@ func (s *Srv) handleHost(
 		"Initial host update received: session=%s\n",
 		ss.ToString(),
 	)
+	if !initial.WindowSize.Valid() {
+		logging.Logf(ctx,
+			"Ignoring invalid initial window size: session=%s cols=%d rows=%d",
+			ss.ToString(), initial.WindowSize.Cols, initial.WindowSize.Rows,
+		)
+		initial.WindowSize = warp.Size{Rows: 24, Cols: 80}
+	}
 
-	s.mutex.Lock()
-	_, ok := s.warps[ss.warp]
+	// A host reconnecting to its warp reattaches to it, other hosts are
+	// refused.
+	for {
+		s.mutex.Lock()
+		w, ok := s.warps[ss.warp]
+		if !ok {
+			break
+		}
+		s.mutex.Unlock()
+
+		reattached, done := w.reattach(ctx, ss, initial)
+		if reattached {
+			logging.Logf(ctx,
+				"Host reattached to warp: session=%s",
+				ss.ToString(),
+			)
+			return s.hostWarp(ctx, w, ss)
+		}
+		if done == nil {
+			ss.SendError(ctx,
+				warp.ErrCodeWarpInUse,
+				fmt.Sprintf(
+					"The warp you attempted to open is already in use: %s.",
+					ss.warp,
+				),
+			)
+			return errors.Trace(
+				errors.Newf("Host error: warp already in use: %s", ss.warp),
+			)
+		}
+		// Wait for the previous host session to be done with.
+		select {
+		case <-done:
+		case <-ss.ctx.Done():
+			return nil
+		}
+	}
 
-	if ok {
+	// Existing warps and their clients are not affected by the cap, only the
+	// creation of new warps is rejected once it is reached.
+	if s.maxWarps > 0 && len(s.warps) >= s.maxWarps {
+		count, max := len(s.warps), s.maxWarps
 		s.mutex.Unlock()
 		ss.SendError(ctx,
-			"warp_in_use",
-			fmt.Sprintf(
-				"The warp you attempted to open is already in use: %s.",
-				ss.warp,
-			),
+			warp.ErrCodeCapacity,
+			"This warpd is serving its maximum number of warps. "+
+				"Please try again later.",
 		)
 		return errors.Trace(
-			errors.Newf("Host error: warp already in use: %s", ss.warp),
+			errors.Newf(
+				"Host error: capacity reached: warp=%s warps=%d max_warps=%d",
+				ss.warp, count, max,
+			),
 		)
 	}
 
 	s.warps[ss.warp] = &Warp{
 		token:      ss.warp,
 		windowSize: initial.WindowSize,
+		panes:      initial.Panes,
+		pane:       initial.Pane,
 		host:       nil,
 		clients:    map[string]*UserState{},
+		chats:      map[string]*Session{},
+		created:    time.Now(),
 		data:       make(chan []byte),
+		audit:      s.audit,
+		metrics:    s.metrics,
 		mutex:      &sync.Mutex{},
+
+		singleWriter: initial.SingleWriter,
+		maxClients:   initial.MaxClients,
+		warpdMax:     s.maxClients,
+		sizePolicy:   initial.SizePolicy,
+		title:        warp.SanitizeTitle(initial.Title),
+		term:         sanitizeTerm(initial.Term),
+		readOnly:     initial.ReadOnly,
+		lastInput:    map[string]time.Time{},
+		lastOutput:   time.Now(),
+		dataMutex:    &sync.Mutex{},
+		hostDone:     make(chan struct{}),
+	}
+	if s.scrollback > 0 {
+		s.warps[ss.warp].scrollback = NewScrollback(s.scrollback)
+	}
+	w := s.warps[ss.warp]
+	if s.idleTimeout > 0 {
+		w.watchIdle(ctx, s.idleTimeout)
 	}
 
 	s.mutex.Unlock()
 
-	s.warps[ss.warp].handleHost(ctx, ss)
+	s.webhook.Post(ctx, newWebhookEvent(WebhookWarpOpened, ss))
+
+	return s.hostWarp(ctx, w, ss)
+}
+
+// hostWarp runs a warp for a host session. Once the host session ends, the
+// warp is kept open for s.hostGrace for the host to reconnect and reattach to
+// it, unless the host closed it. It is cleaned-up if it did not, its clients
+// being disconnected with warp.ErrCodeHostClosed if the host closed it.
+func (s *Srv) hostWarp(
+	ctx context.Context,
+	w *Warp,
+	ss *Session,
+) error {
+	w.handleHost(ctx, ss)
+
+	s.mutex.Lock()
+	grace := s.hostGrace
+	w.mutex.Lock()
+	closing := w.closing
+	orphaned := grace > 0 && !closing
+	if orphaned {
+		w.orphaned = true
+		w.reattached = make(chan struct{})
+	} else if s.warps[w.token] == w {
+		delete(s.warps, w.token)
+	}
+	reattached := w.reattached
+	close(w.hostDone)
+	w.mutex.Unlock()
+	s.mutex.Unlock()
+
+	if orphaned {
+		logging.Logf(ctx,
+			"Waiting for host to reconnect: session=%s grace=%s",
+			ss.ToString(), grace,
+		)
+		w.updateClientSessions(ctx)
+
+		select {
+		case <-reattached:
+		case <-time.After(grace):
+		}
+
+		s.mutex.Lock()
+		w.mutex.Lock()
+		orphaned = w.orphaned
+		if orphaned {
+			w.orphaned = false
+			if s.warps[w.token] == w {
+				delete(s.warps, w.token)
+			}
+		}
+		w.mutex.Unlock()
+		s.mutex.Unlock()
+
+		if !orphaned {
+			// The host reattached, the warp is run for its new session.
+			return nil
+		}
+	}
 
 	// Clean-up warp.
 	logging.Logf(ctx,
 		"Cleaning-up warp: session=%s",
 		ss.ToString(),
 	)
-	s.mutex.Lock()
-	delete(s.warps, ss.warp)
-	s.mutex.Unlock()
+	w.stopIdle()
+	if ss.ErrorSent() == warp.ErrCodeInternal && !orphaned {
+		// The host rehosts the warp after internal errors.
+		w.disconnectClients(ctx,
+			warp.ErrCodeInternal,
+			"The warp host was disconnected by an internal error.",
+		)
+	} else if closing {
+		w.disconnectClients(ctx,
+			warp.ErrCodeHostClosed,
+			"The warp host closed the warp.",
+		)
+	} else {
+		w.disconnectClients(ctx,
+			warp.ErrCodeHostDisconnected,
+			"The warp host disconnected.",
+		)
+	}
+
+	s.webhook.Post(ctx, newWebhookEvent(WebhookWarpClosed, ss))
 
 	return nil
 }
@@ -213,7 +587,7 @@ func (s *Srv) handleShellClient(
 	if !ok {
 		// This error code (warp_unknown) is expected by brew for warp 0.0.3.
 		ss.SendError(ctx,
-			"warp_unknown",
+			warp.ErrCodeWarpUnknown,
 			fmt.Sprintf(
 				"The warp you attempted to connect does not exist: %s.",
 				ss.warp,
@@ -228,3 +602,78 @@ func (s *Srv) handleShellClient(
 
 	return nil
 }
+
+// handleChatClient handles a chat client connecting, retrieving the required
+// warp or erroring accordingly.
+func (s *Srv) handleChatClient(
+	ctx context.Context,
+	ss *Session,
+) error {
+	s.mutex.Lock()
+	w, ok := s.warps[ss.warp]
+	s.mutex.Unlock()
+
+	if !ok {
+		ss.SendError(ctx,
+			warp.ErrCodeWarpUnknown,
+			fmt.Sprintf(
+				"The warp you attempted to chat in does not exist: %s.",
+				ss.warp,
+			),
+		)
+		return errors.Trace(
+			errors.Newf("Chat client error: warp unknown %s", ss.warp),
+		)
+	}
+
+	w.handleChatClient(ctx, ss)
+
+	return nil
+}
+
+// handleResolve handles a client resolving a warp ID prefix, sending the
+// matching warps or erroring if prefix resolution is disabled.
+func (s *Srv) handleResolve(
+	ctx context.Context,
+	ss *Session,
+) error {
+	s.mutex.Lock()
+	resolvePrefix := s.resolvePrefix
+	s.mutex.Unlock()
+
+	if !resolvePrefix {
+		ss.SendError(ctx,
+			warp.ErrCodeResolveDisabled,
+			"Resolving warp IDs by prefix is disabled on this warpd.",
+		)
+		return errors.Trace(
+			errors.Newf("Client error: resolve disabled %s", ss.warp),
+		)
+	}
+
+	res := warp.Resolution{
+		Prefix: ss.warp,
+		Warps:  []string{},
+	}
+	s.mutex.Lock()
+	for id := range s.warps {
+		if strings.HasPrefix(id, ss.warp) {
+			res.Warps = append(res.Warps, id)
+		}
+	}
+	s.mutex.Unlock()
+
+	sort.Strings(res.Warps)
+	if len(res.Warps) > warp.MaxResolution {
+		res.Warps = res.Warps[:warp.MaxResolution]
+		res.Truncated = true
+	}
+
+	logging.Logf(ctx,
+		"Resolving prefix: session=%s prefix=%s matches=%d",
+		ss.ToString(), ss.warp, len(res.Warps),
+	)
+	ss.SendResolution(ctx, res)
+
+	return nil
+}
@@ -0,0 +1,623 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+)
+
+func TestMain(m *testing.M) {
+	// The test sessions rejected by warpd only read the error once the
+	// session is closed: warpd closes them without waiting for them.
+	SessionFlushTimeout = 10 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, capturing the audit
+// log.
+type syncBuffer struct {
+	buf   bytes.Buffer
+	mutex sync.Mutex
+}
+
+func (b *syncBuffer) Write(
+	p []byte,
+) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// startSrv runs a warpd listening on a Unix socket, returning it along with
+// the path of the socket and the audit log.
+func startSrv(
+	t *testing.T,
+) (*Srv, string, *syncBuffer) {
+	t.Helper()
+	return startSrvWith(t, func(*Config) {}, nil)
+}
+
+// startSrvWith runs a warpd listening on a Unix socket with the default
+// configuration modified by configure, posting to webhook if not nil.
+func startSrvWith(
+	t *testing.T,
+	configure func(*Config),
+	webhook *Webhook,
+) (*Srv, string, *syncBuffer) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "warpd.sock")
+	audit := &syncBuffer{}
+	config := DefaultConfig()
+	config.Listen = "unix:" + path
+	configure(&config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	srv := NewSrv(ctx, config, NewAuditLog(audit), webhook, nil)
+	go srv.Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return srv, path, audit
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("warpd not listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// hostSession is the session of the host of the warps opened by tests.
+var hostSession = warp.Session{Token: "tok", User: "host", Secret: "sec"}
+
+// openWarp opens warp w as its host over conn, returning once warpd sent the
+// initial state, or the error sent by warpd if it rejected the warp.
+func openWarp(
+	t *testing.T,
+	conn net.Conn,
+	w string,
+) error {
+	_, err := openWarpSession(t, conn, w)
+	return err
+}
+
+// openWarpSession opens warp w as its host over conn, returning the host
+// session once warpd sent the initial state.
+func openWarpSession(
+	t *testing.T,
+	conn net.Conn,
+	w string,
+) (*cli.Session, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ss, err := cli.NewSession(
+		ctx, hostSession, w, warp.SsTpHost, "stan",
+		cli.SessionOptions{}, cancel, conn,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := ss.SendHostUpdate(ctx, warp.HostUpdate{
+		Warp:       w,
+		From:       hostSession,
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := ss.DecodeState(ctx); err != nil {
+		if e, decodeErr := ss.DecodeError(ctx); decodeErr == nil {
+			return nil, cli.SessionError(e)
+		}
+		return nil, err
+	}
+	return ss, nil
+}
+
+// openHost opens warp w as its host, returning the host connection once warpd
+// sent the initial state.
+func openHost(
+	t *testing.T,
+	path string,
+	w string,
+) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := openWarp(t, conn, w); err != nil {
+		t.Fatalf("Open warp %s: %v", w, err)
+	}
+	return conn
+}
+
+// joinWarp joins warp w as a shell client of user over conn, returning the
+// client session once warpd sent the initial state, or the error sent by
+// warpd if it rejected the session.
+func joinWarp(
+	t *testing.T,
+	conn net.Conn,
+	w string,
+	user string,
+) (*cli.Session, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ss, err := cli.NewSession(
+		ctx, warp.Session{Token: "tok", User: user, Secret: "sec"},
+		w, warp.SsTpShellClient, user,
+		cli.SessionOptions{}, cancel, conn,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ss.DecodeState(ctx); err != nil {
+		if e, decodeErr := ss.DecodeError(ctx); decodeErr == nil {
+			return nil, cli.SessionError(e)
+		}
+		return nil, err
+	}
+	return ss, nil
+}
+
+// connectClient connects user to warp w as a shell client, returning the
+// client session once warpd sent the initial state.
+func connectClient(
+	t *testing.T,
+	path string,
+	w string,
+	user string,
+) *cli.Session {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ss, err := joinWarp(t, conn, w, user)
+	if err != nil {
+		t.Fatalf("Join warp %s as %s: %v", w, user, err)
+	}
+	return ss
+}
+
+// awaitError waits for warpd to send an error to the client session ss,
+// failing if none is received within 5s or if its code is not code. It
+// returns the time elapsed since start once it is received.
+func awaitError(
+	t *testing.T,
+	ss *cli.Session,
+	code string,
+	start time.Time,
+) time.Duration {
+	t.Helper()
+	errC := make(chan *warp.Error, 1)
+	go func() {
+		defer close(errC)
+		if e, err := ss.DecodeError(context.Background()); err == nil {
+			errC <- e
+		}
+	}()
+	select {
+	case e, ok := <-errC:
+		d := time.Since(start)
+		if !ok {
+			t.Fatalf("Session closed without error")
+		}
+		if e.Code != code {
+			t.Fatalf("Error code: got %q, want %q", e.Code, code)
+		}
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No error received")
+	}
+	return 0
+}
+
+func TestHostCleanCloseDetectedPromptly(t *testing.T) {
+	_, path, audit := startSrvWith(t, func(config *Config) {
+		// Warps are closed as soon as their host disconnects.
+		config.HostGrace = 0
+	}, nil)
+	conn := openHost(t, path, "goofy-dev")
+	ada := connectClient(t, path, "goofy-dev", "ada")
+
+	closed := time.Now()
+	conn.Close()
+	d := awaitError(t, ada, warp.ErrCodeHostDisconnected, closed)
+	// The host session used to be closed after a fixed 500ms delay.
+	if d > 250*time.Millisecond {
+		t.Errorf("Client disconnected after %s", d)
+	}
+	if !strings.Contains(audit.String(), string(AuditHostDisconnected)) {
+		t.Errorf("Host disconnection not audited: %s", audit.String())
+	}
+}
+
+func TestDefaultConfigDropsClientsOnHostClose(t *testing.T) {
+	// Hosts that crash or predate HostUpdate.Closing never close their warp
+	// explicitly: the grace period is opt-in for them not to leave clients
+	// waiting by default.
+	_, path, _ := startSrv(t)
+	conn := openHost(t, path, "goofy-dev")
+	ada := connectClient(t, path, "goofy-dev", "ada")
+
+	closed := time.Now()
+	conn.Close()
+	if d := awaitError(
+		t, ada, warp.ErrCodeHostDisconnected, closed,
+	); d > 250*time.Millisecond {
+		t.Errorf("Client disconnected after %s", d)
+	}
+}
+
+// warpCount returns the number of warps served by srv.
+func warpCount(
+	srv *Srv,
+) int {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return len(srv.warps)
+}
+
+func TestMaxWarps(t *testing.T) {
+	srv, path, audit := startSrvWith(t, func(config *Config) {
+		config.MaxWarps = 2
+		// Warps are closed as soon as their host disconnects.
+		config.HostGrace = 0
+	}, nil)
+	first := openHost(t, path, "goofy-one")
+	openHost(t, path, "goofy-two")
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	err = openWarp(t, conn, "goofy-three")
+	if err == nil {
+		t.Fatalf("Warp opened over the cap")
+	}
+	if !strings.Contains(err.Error(), warp.ErrCodeCapacity) {
+		t.Errorf("Error: got %v, want %s", err, warp.ErrCodeCapacity)
+	}
+	if n := warpCount(srv); n != 2 {
+		t.Errorf("Warps: got %d, want 2", n)
+	}
+
+	// Clients of the existing warps are not affected by the cap.
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ss, err := cli.NewSession(
+		ctx, warp.Session{Token: "tok", User: "ada", Secret: "sec"},
+		"goofy-one", warp.SsTpShellClient, "ada",
+		cli.SessionOptions{}, cancel, client,
+	)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if _, err := ss.DecodeState(ctx); err != nil {
+		t.Errorf("Client of an existing warp rejected: %v", err)
+	}
+
+	// Closing a warp frees a slot.
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for warpCount(srv) > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Warp not closed: %s", audit.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	openHost(t, path, "goofy-three")
+}
+
+func TestHostWritesThroughOwnSession(t *testing.T) {
+	_, path, _ := startSrv(t)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	// The host session fails instead of blocking if warpd never sends the
+	// state or data expected.
+	timer := time.AfterFunc(10*time.Second, func() { conn.Close() })
+	defer timer.Stop()
+	host, err := openWarpSession(t, conn, "goofy-dev")
+	if err != nil {
+		t.Fatalf("Open warp: %v", err)
+	}
+
+	// The host connects to its own warp from another terminal.
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ss, err := cli.NewSession(
+		ctx, warp.Session{Token: "own", User: "host", Secret: "sec"},
+		"goofy-dev", warp.SsTpShellClient, "stan",
+		cli.SessionOptions{}, cancel, client,
+	)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if _, err := ss.DecodeState(ctx); err != nil {
+		t.Fatalf("Host session rejected: %v", err)
+	}
+
+	// The host is told about its own session to accept its input.
+	for {
+		st, err := host.DecodeState(ctx)
+		if err != nil {
+			t.Fatalf("DecodeState: %v", err)
+		}
+		if st.HostSessions == 1 {
+			if _, ok := st.Users["host"]; !ok || len(st.Users) != 1 {
+				t.Errorf("Users: got %+v, want the host only", st.Users)
+			}
+			break
+		}
+	}
+
+	ss.WriteDataC([]byte("ls\r"))
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(host.DataC(), buf); err != nil {
+		t.Fatalf("Input of the host session not relayed: %v", err)
+	}
+	if got := string(buf); got != "ls\r" {
+		t.Errorf("Input: got %q, want %q", got, "ls\r")
+	}
+}
+
+// assertUnauthorized checks that err is the rejection of a session by warpd
+// for not presenting a valid authentication token.
+func assertUnauthorized(
+	t *testing.T,
+	err error,
+) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("Session accepted")
+	}
+	e, ok := errors.Cause(err).(*cli.RejectedError)
+	if !ok || e.Code != warp.ErrCodeUnauthorized {
+		t.Fatalf("Error: got %v, want %s", err, warp.ErrCodeUnauthorized)
+	}
+}
+
+func TestAuthTokens(t *testing.T) {
+	_, path, audit := startSrvWith(t, func(c *Config) {
+		c.AuthTokens = []string{"alpha", "beta"}
+	}, nil)
+	dial := func() net.Conn {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	for _, token := range []string{"", "gamma", "alph"} {
+		t.Setenv(cli.EnvAuthToken, token)
+		assertUnauthorized(t, openWarp(t, dial(), "goofy-dev"))
+	}
+	if n := strings.Count(audit.String(), string(AuditSessionUnauthorized)); n != 3 {
+		t.Errorf("Unauthorized sessions audited: got %d, want 3", n)
+	}
+
+	t.Setenv(cli.EnvAuthToken, "beta")
+	if err := openWarp(t, dial(), "goofy-dev"); err != nil {
+		t.Fatalf("Open warp with a valid token: %v", err)
+	}
+
+	for _, token := range []string{"", "gamma"} {
+		t.Setenv(cli.EnvAuthToken, token)
+		_, err := joinWarp(t, dial(), "goofy-dev", "ada")
+		assertUnauthorized(t, err)
+	}
+	t.Setenv(cli.EnvAuthToken, "alpha")
+	if _, err := joinWarp(t, dial(), "goofy-dev", "ada"); err != nil {
+		t.Fatalf("Join warp with a valid token: %v", err)
+	}
+}
+
+func TestNoAuthTokens(t *testing.T) {
+	// Without -auth-tokens, warpd is open to any session, whatever the token
+	// it presents.
+	_, path, _ := startSrv(t)
+	t.Setenv(cli.EnvAuthToken, "")
+	openHost(t, path, "goofy-dev")
+	connectClient(t, path, "goofy-dev", "ada")
+	t.Setenv(cli.EnvAuthToken, "alpha")
+	connectClient(t, path, "goofy-dev", "bob")
+}
+
+// testCA is a certificate authority issuing certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA generates a self-signed certificate authority.
+func newTestCA(
+	t *testing.T,
+	name string,
+) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue issues a certificate from tmpl, writing it and its key as PEM files
+// and returning their paths along with the DER certificate.
+func (ca *testCA) issue(
+	t *testing.T,
+	tmpl *x509.Certificate,
+) (string, string, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", raw)
+	writePEM(t, keyFile, "EC PRIVATE KEY", der)
+	return certFile, keyFile, raw
+}
+
+// writePEM writes a PEM encoded block to path.
+func writePEM(
+	t *testing.T,
+	path string,
+	blockType string,
+	der []byte,
+) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	ca := newTestCA(t, "warp test CA")
+	other := newTestCA(t, "other CA")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ca.cert.Raw)
+
+	srvCert, srvKey, srvRaw := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "warpd"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	_, path, audit := startSrvWith(t, func(c *Config) {
+		c.Cert = srvCert
+		c.Key = srvKey
+		c.TLSClientCA = caFile
+	}, nil)
+
+	client := func(ca *testCA, name string) map[string]string {
+		certFile, keyFile, _ := ca.issue(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		return map[string]string{"tls-cert": certFile, "tls-key": keyFile}
+	}
+	for _, tc := range []struct {
+		name  string
+		flags map[string]string
+		ok    bool
+	}{
+		{"trusted certificate", client(ca, "stan@example.com"), true},
+		{"no certificate", map[string]string{}, false},
+		{"untrusted certificate", client(other, "mallory"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("WARPD_TLS_CERT", "")
+			t.Setenv("WARPD_TLS_KEY", "")
+			tc.flags["pin"] = cli.Fingerprint(srvRaw)
+			config, err := cli.TLSConfig(tc.flags, false)
+			if err != nil {
+				t.Fatalf("TLSConfig: %v", err)
+			}
+			if len(config.Certificates) > 0 {
+				// Present the certificate even if warpd doesn't list its CA
+				// as acceptable, for warpd to verify it.
+				cert := config.Certificates[0]
+				config.GetClientCertificate = func(
+					*tls.CertificateRequestInfo,
+				) (*tls.Certificate, error) {
+					return &cert, nil
+				}
+			}
+			conn, err := tls.Dial("unix", path, config)
+			if err == nil {
+				defer conn.Close()
+				err = openWarp(t, conn, "goofy-dev")
+			}
+			if tc.ok && err != nil {
+				t.Fatalf("Open warp: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatalf("Open warp succeeded")
+			}
+		})
+	}
+
+	if !strings.Contains(audit.String(), `"identity":"stan@example.com"`) {
+		t.Errorf("Identity not audited: %s", audit.String())
+	}
+	if strings.Contains(audit.String(), "mallory") {
+		t.Errorf("Untrusted identity audited: %s", audit.String())
+	}
+}
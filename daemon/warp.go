@@ -2,7 +2,10 @@ package daemon
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/lib/logging"
@@ -14,22 +17,102 @@ type Warp struct {
 	token string
 
 	windowSize warp.Size
+	panes      []string
+	pane       string
 
 	host    *HostState
 	clients map[string]*UserState
+	// chats are the chat client sessions of the warp by session token.
+	chats map[string]*Session
 
+	created time.Time
+
+	// data carries the input of authorized clients to the host data loop. It
+	// is never closed, senders give up once the host session ends instead.
 	data chan []byte
+	// seq is the sequence number of the last chunk of data received from the
+	// host. It is only accessed from the host data loop.
+	seq uint64
+	// scrollback, if set, keeps the last output of the warp for the shell
+	// clients joining it. dataMutex serializes the relaying of host data to
+	// the shell clients with the replay of the scrollback to new ones, for
+	// the replay to precede the live data.
+	scrollback *Scrollback
+	dataMutex  *sync.Mutex
+
+	audit   *AuditLog
+	metrics *Metrics
+
+	// singleWriter and writer are the write token state set by the host (see
+	// warp.HostUpdate).
+	singleWriter bool
+	writer       string
+	// maxClients is the maximum number of users (other than the host) set by
+	// the host and warpdMax the one set by warpd (`warpd -max-clients`), 0
+	// if unlimited (see clientLimit).
+	maxClients int
+	warpdMax   int
+	// sizePolicy is the size policy of the warp set by the host.
+	sizePolicy warp.SizePolicy
+	// title is the sanitized title of the warp set by the host.
+	title string
+	// term is the terminal type of the warp set by the host, empty if
+	// unknown or invalid.
+	term string
+	// readOnly is set by hosts that never write the input of the warp.
+	readOnly bool
+	// lastInput is the time of the last input received from each user,
+	// typing the usernames of the users currently typing simultaneously (nil
+	// if less than two users are) and writing the tokens of the users who
+	// wrote within the last warp.WritingWindow.
+	lastInput map[string]time.Time
+	typing    []string
+	writing   []string
+	// refreshed is the time of the last refresh forwarded to the host.
+	refreshed time.Time
+
+	// hostDone is closed once the current host session is done with (see
+	// Srv.hostWarp). orphaned is set while the warp waits for its host to
+	// reconnect after it disconnected unexpectedly, reattached being closed
+	// once it did (or the warp was closed meanwhile).
+	hostDone   chan struct{}
+	orphaned   bool
+	reattached chan struct{}
+	// idleTimeout is the time after which the warp is closed if its host
+	// produced no output (disabled if 0), lastOutput the time of its last
+	// output (see warp.State.HostIdle) and idleTimer the timer checking it,
+	// nil once stopped.
+	idleTimeout time.Duration
+	lastOutput  time.Time
+	idleTimer   *time.Timer
+
+	// closing is set once the host announced that it is closing the warp
+	// (see warp.HostUpdate) or the warp was closed by the operator, in which
+	// case warpd does not wait for the host to reconnect.
+	closing bool
 
 	mutex *sync.Mutex
 }
 
+// warpFullMessage is the message of the error sent to users refused or kicked
+// as the warp reached its maximum number of clients.
+const warpFullMessage = "The warp is full " +
+	"(the number of its clients is limited)."
+
+// refreshInterval is the minimum interval between refreshes forwarded to the
+// host, as each of them clears the screen of all clients.
+const refreshInterval = 1 * time.Second
+
 // UserState represents the state of a user along with a list of all his
 // sessions.
 type UserState struct {
 	token    string
 	username string
 	mode     warp.Mode
-	sessions map[string]*Session
+	// requested is the mode requested by the user's sessions that the host
+	// didn't grant nor decline yet (see warp.User).
+	requested warp.Mode
+	sessions  map[string]*Session
 }
 
 // User returns a warp.User from the current UserState.
@@ -37,10 +120,11 @@ func (u *UserState) User(
 	ctx context.Context,
 ) warp.User {
 	return warp.User{
-		Token:    u.token,
-		Username: u.username,
-		Mode:     u.mode,
-		Hosting:  false,
+		Token:     u.token,
+		Username:  u.username,
+		Mode:      u.mode,
+		Hosting:   false,
+		Requested: u.requested,
 	}
 }
 
@@ -63,6 +147,16 @@ func (h *HostState) User(
 	}
 }
 
+// clientLimit returns the maximum number of clients of the warp, the lowest of
+// the limits set by the host and warpd, 0 if unlimited. It must be called
+// with the warp lock held.
+func (w *Warp) clientLimit() int {
+	if w.warpdMax > 0 && (w.maxClients == 0 || w.warpdMax < w.maxClients) {
+		return w.warpdMax
+	}
+	return w.maxClients
+}
+
 // State computes a warp.State from the current warp. It acquires the warp
 // lock.
 func (w *Warp) State(
@@ -74,6 +168,23 @@ func (w *Warp) State(
 		Warp:       w.token,
 		WindowSize: w.windowSize,
 		Users:      map[string]warp.User{},
+		Panes:      w.panes,
+		Pane:       w.pane,
+
+		SingleWriter: w.singleWriter,
+		Writer:       w.writer,
+		Title:        w.title,
+		Term:         w.term,
+		ReadOnly:     w.readOnly,
+		Typing:       w.typing,
+		Writing:      w.writing,
+		HostSessions: len(w.host.UserState.sessions),
+		MaxClients:   w.clientLimit(),
+		SizePolicy:   w.sizePolicy,
+		ClientsSize:  w.clientsSize(),
+
+		HostReconnecting: w.orphaned,
+		HostIdle:         time.Since(w.lastOutput),
 	}
 
 	state.Users[w.host.session.session.User] = w.host.User(ctx)
@@ -124,7 +235,7 @@ func (w *Warp) updateClientSessions(
 func (w *Warp) updateHost(
 	ctx context.Context,
 ) {
-	if !w.host.session.tornDown {
+	if !w.host.session.TornDown() {
 		st := w.State(ctx)
 
 		logging.Logf(ctx,
@@ -136,6 +247,35 @@ func (w *Warp) updateHost(
 	}
 }
 
+// sessionMode returns the mode of the user associated with a shell client
+// session. It must be called with the warp lock held.
+func (w *Warp) sessionMode(
+	ss *Session,
+) warp.Mode {
+	if ss.session.User == w.host.UserState.token {
+		return w.host.UserState.mode
+	}
+	if c, ok := w.clients[ss.session.User]; ok {
+		return c.mode
+	}
+	return 0
+}
+
+// sessionCanWrite returns whether the user associated with a shell client
+// session is authorized to write and, in single-writer mode, holds the write
+// token (the host's own sessions can always write). It must be called with
+// the warp lock held.
+func (w *Warp) sessionCanWrite(
+	ss *Session,
+) bool {
+	if w.sessionMode(ss)&warp.ModeShellWrite == 0 {
+		return false
+	}
+	return !w.singleWriter ||
+		ss.session.User == w.host.UserState.token ||
+		ss.session.User == w.writer
+}
+
 // rcvShellClientData handles incoming client data and commits it to the data
 // channel if the client is authorized to do so.
 func (w *Warp) rcvShellClientData(
@@ -143,34 +283,213 @@ func (w *Warp) rcvShellClientData(
 	ss *Session,
 	data []byte,
 ) {
-	var mode warp.Mode
 	w.mutex.Lock()
-	if ss.session.User == w.host.UserState.token {
-		mode = w.host.UserState.mode
-	} else {
-		if _, ok := w.clients[ss.session.User]; ok {
-			mode = w.clients[ss.session.User].mode
-		}
+	canWrite := w.sessionCanWrite(ss)
+	host := w.host.session
+	typingChanged := false
+	writingChanged := false
+	if canWrite {
+		typingChanged, writingChanged = w.rcvInput(ctx, ss.session.User)
 	}
+	typing := w.typing
 	w.mutex.Unlock()
 
-	if mode&warp.ModeShellWrite != 0 {
-		w.data <- data
+	if typingChanged {
+		logging.Logf(ctx,
+			"Users typing simultaneously: session=%s users=%v",
+			ss.ToString(), typing,
+		)
+	}
+	if typingChanged || writingChanged {
+		w.updateHost(ctx)
+		w.updateClientSessions(ctx)
+	}
+
+	// The data is dropped if the host or the client session ends before the
+	// host data loop receives it.
+	if canWrite {
+		select {
+		case w.data <- data:
+			w.metrics.ClientData(len(data))
+		case <-host.ctx.Done():
+		case <-ss.ctx.Done():
+		}
 	}
 }
 
+// rcvInput records input from a user, returning whether it changed the users
+// currently typing simultaneously and the users writing to the warp. The
+// typing and writing states are cleared by watchers once at most one user
+// typed within the last warp.TypingWindow and no user wrote within the last
+// warp.WritingWindow respectively. It must be called with the warp lock held.
+func (w *Warp) rcvInput(
+	ctx context.Context,
+	user string,
+) (bool, bool) {
+	now := time.Now()
+	w.lastInput[user] = now
+
+	writingChanged := false
+	if writing := w.writingUsers(now); !equalStrings(writing, w.writing) {
+		if len(w.writing) == 0 {
+			go w.watchWriting(ctx)
+		}
+		w.writing = writing
+		writingChanged = true
+	}
+
+	typing := w.typingUsers(now)
+	if len(typing) < 2 || equalStrings(typing, w.typing) {
+		return false, writingChanged
+	}
+	if w.typing == nil {
+		go w.watchTyping(ctx)
+	}
+	w.typing = typing
+	return true, writingChanged
+}
+
+// writingUsers returns the sorted tokens of the users who wrote within the
+// last warp.WritingWindow, forgetting older input. It must be called with the
+// warp lock held.
+func (w *Warp) writingUsers(
+	now time.Time,
+) []string {
+	writing := []string{}
+	for user, t := range w.lastInput {
+		if now.Sub(t) > warp.WritingWindow {
+			delete(w.lastInput, user)
+			continue
+		}
+		if _, ok := w.clients[user]; !ok && user != w.host.UserState.token {
+			// The user disconnected.
+			continue
+		}
+		writing = append(writing, user)
+	}
+	sort.Strings(writing)
+	return writing
+}
+
+// watchWriting updates the host and clients as users stop writing to the
+// warp, until none is.
+func (w *Warp) watchWriting(
+	ctx context.Context,
+) {
+	for {
+		time.Sleep(warp.WritingWindow / 4)
+		w.mutex.Lock()
+		writing := w.writingUsers(time.Now())
+		changed := !equalStrings(writing, w.writing)
+		w.writing = writing
+		w.mutex.Unlock()
+		if changed {
+			w.updateHost(ctx)
+			w.updateClientSessions(ctx)
+		}
+		if len(writing) == 0 {
+			break
+		}
+	}
+}
+
+// equalStrings returns whether two lists of strings are equal.
+func equalStrings(
+	a []string,
+	b []string,
+) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeTerm returns the terminal type set by a host if valid, empty
+// otherwise (it is displayed by clients).
+func sanitizeTerm(
+	term string,
+) string {
+	if !warp.TermRegexp.MatchString(term) {
+		return ""
+	}
+	return term
+}
+
+// typingUsers returns the sorted usernames of the users who typed within the
+// last warp.TypingWindow. It must be called with the warp lock held.
+func (w *Warp) typingUsers(
+	now time.Time,
+) []string {
+	typing := []string{}
+	for user, t := range w.lastInput {
+		if now.Sub(t) > warp.TypingWindow {
+			continue
+		}
+		if user == w.host.UserState.token {
+			typing = append(typing, w.host.UserState.username)
+		} else if c, ok := w.clients[user]; ok {
+			typing = append(typing, c.username)
+		}
+	}
+	sort.Strings(typing)
+	return typing
+}
+
+// watchTyping clears the typing state and updates the host and clients once
+// users stopped typing simultaneously.
+func (w *Warp) watchTyping(
+	ctx context.Context,
+) {
+	for {
+		time.Sleep(warp.TypingWindow)
+		w.mutex.Lock()
+		if len(w.typingUsers(time.Now())) < 2 {
+			w.typing = nil
+			w.mutex.Unlock()
+			break
+		}
+		w.mutex.Unlock()
+	}
+	w.updateHost(ctx)
+	w.updateClientSessions(ctx)
+}
+
+// rcvHostData handles incoming host data, relaying it to all shell client
+// sessions.
 func (w *Warp) rcvHostData(
 	ctx context.Context,
 	ss *Session,
 	data []byte,
 ) {
+	w.dataMutex.Lock()
+	defer w.dataMutex.Unlock()
+
+	w.metrics.HostData(len(data))
+	w.seq++
+	w.mutex.Lock()
+	w.lastOutput = time.Now()
+	if w.scrollback != nil {
+		w.scrollback.Write(data)
+	}
+	w.mutex.Unlock()
+
 	sessions := w.CientSessions(ctx)
 	for _, s := range sessions {
 		// logging.Logf(ctx,
 		// 	"Sending data to session: session=%s size=%d",
 		// 	s.ToString(), len(data),
 		// )
-		_, err := s.dataC.Write(data)
+		var err error
+		if s.sequenced {
+			err = warp.WriteDataFrame(s.dataC, w.seq, data)
+		} else {
+			_, err = s.dataC.Write(data)
+		}
 		if err != nil {
 			// If we fail to write to a session, send an internal error there
 			// and tear down the session. This will not impact the warp.
@@ -180,6 +499,102 @@ func (w *Warp) rcvHostData(
 	}
 }
 
+// clientsSize returns the smallest window size (rows and columns
+// independently) reported by the clients of the warp, zero if none did. It
+// must be called with the warp lock held.
+func (w *Warp) clientsSize() warp.Size {
+	size := warp.Size{}
+	for _, user := range w.clients {
+		for _, s := range user.sessions {
+			if !s.size.Valid() {
+				continue
+			}
+			if size.Rows == 0 || s.size.Rows < size.Rows {
+				size.Rows = s.size.Rows
+			}
+			if size.Cols == 0 || s.size.Cols < size.Cols {
+				size.Cols = s.size.Cols
+			}
+		}
+	}
+	return size
+}
+
+// rcvClientSize handles the window size reported by a shell client, updating
+// the host if the size of the clients changed.
+func (w *Warp) rcvClientSize(
+	ctx context.Context,
+	ss *Session,
+	size warp.Size,
+) {
+	w.mutex.Lock()
+	before := w.clientsSize()
+	ss.size = size
+	changed := w.clientsSize() != before
+	w.mutex.Unlock()
+
+	if changed {
+		w.updateHost(ctx)
+	}
+}
+
+// rcvRefresh handles a refresh requested by a shell client: the current state
+// is sent back to it and the refresh is forwarded to the host, unless another
+// one was forwarded within the last refreshInterval.
+func (w *Warp) rcvRefresh(
+	ctx context.Context,
+	ss *Session,
+) {
+	st := w.State(ctx)
+	ss.SendState(ctx, st)
+
+	w.mutex.Lock()
+	forward := time.Since(w.refreshed) >= refreshInterval
+	if forward {
+		w.refreshed = time.Now()
+	}
+	w.mutex.Unlock()
+
+	logging.Logf(ctx,
+		"Received refresh: session=%s forwarded=%t",
+		ss.ToString(), forward,
+	)
+
+	if forward && !w.host.session.TornDown() {
+		st.Refresh = true
+		w.host.session.SendState(ctx, st)
+	}
+}
+
+// rcvRequest handles a mode requested by a shell client while connected: it
+// is staged for the host to grant or decline and the host updated if it is a
+// new request.
+func (w *Warp) rcvRequest(
+	ctx context.Context,
+	ss *Session,
+	mode warp.Mode,
+) {
+	w.mutex.Lock()
+	c, ok := w.clients[ss.session.User]
+	staged := false
+	if ok {
+		pending := mode &^ c.mode &^ c.requested
+		c.requested |= pending
+		staged = pending != 0
+	}
+	w.mutex.Unlock()
+
+	logging.Logf(ctx,
+		"Received request: session=%s mode=%s staged=%t",
+		ss.ToString(), mode, staged,
+	)
+
+	if staged {
+		w.updateHost(ctx)
+		w.updateClientSessions(ctx)
+	}
+}
+
 // handleHost is responsible for handling the host session. It is in charge of:
 // - receiving and validating host update.
 // - multiplexing host data to shell clients.
@@ -190,27 +605,35 @@ func (w *Warp) handleHost(
 ) {
 	// Add the host.
 	w.mutex.Lock()
+	// Initialize host sessions as empty as the current client is the host
+	// session and does not act as "client". Subsequent client session coming
+	// from the host would be added to this list. They are kept when the host
+	// reattaches to the warp (see reattach).
+	sessions := map[string]*Session{}
+	if w.host != nil {
+		sessions = w.host.UserState.sessions
+	}
 	w.host = &HostState{
 		UserState: UserState{
 			token:    ss.session.User,
 			username: ss.username,
 			mode:     warp.DefaultHostMode,
-			// Initialize host sessions as empty as the current client is
-			// the host session and does not act as "client". Subsequent
-			// client session coming from the host would be added to this
-			// list.
-			sessions: map[string]*Session{},
+			sessions: sessions,
 		},
 		session: ss,
 	}
 	w.mutex.Unlock()
 
+	w.audit.Log(ctx, newAuditEvent(AuditHostConnected, ss, warp.DefaultHostMode))
+
 	// run state updates
+	stateDone := make(chan struct{})
 	go func() {
+		defer close(stateDone)
 	STATELOOP:
 		for {
 			var st warp.HostUpdate
-			if err := w.host.session.updateR.Decode(&st); err != nil {
+			if err := ss.updateR.Decode(&st); err != nil {
 				logging.Logf(ctx,
 					"Error receiving host update: session=%s error=%v",
 					ss.ToString(), err,
@@ -222,8 +645,8 @@ func (w *Warp) handleHost(
 			if st.Warp != w.token {
 				logging.Logf(ctx,
 					"Host update warp mismatch: session=%s "+
-						"expected=% received=%s",
-					ss.ToString, w.token, st.Warp,
+						"expected=%s received=%s",
+					ss.ToString(), w.token, st.Warp,
 				)
 				break STATELOOP
 			}
@@ -235,22 +658,72 @@ func (w *Warp) handleHost(
 				st.From.Secret != ss.session.Secret {
 				logging.Logf(ctx,
 					"Host credentials mismatch: session=%s",
-					ss.ToString,
+					ss.ToString(),
 				)
 				break STATELOOP
 			}
 
 			w.mutex.Lock()
-			w.windowSize = st.WindowSize
+			if st.WindowSize.Valid() {
+				w.windowSize = st.WindowSize
+			} else {
+				logging.Logf(ctx,
+					"Ignoring invalid window size: session=%s cols=%d rows=%d",
+					ss.ToString(), st.WindowSize.Cols, st.WindowSize.Rows,
+				)
+			}
+			if len(st.Panes) > 0 {
+				w.panes = st.Panes
+				w.pane = st.Pane
+			}
+			w.singleWriter = st.SingleWriter
+			w.maxClients = st.MaxClients
+			w.sizePolicy = st.SizePolicy
+			w.title = warp.SanitizeTitle(st.Title)
+			w.term = sanitizeTerm(st.Term)
+			w.readOnly = st.ReadOnly
+			if st.Closing {
+				w.closing = true
+			}
 			for user, mode := range st.Modes {
-				if _, ok := w.clients[user]; ok {
-					w.clients[user].mode = mode
+				if c, ok := w.clients[user]; ok {
+					if c.mode != mode {
+						ev := newAuditEvent(AuditModeChanged, ss, mode)
+						ev.Target = user
+						ev.TargetUsername = c.username
+						ev.PreviousMode = c.mode.String()
+						w.audit.Log(ctx, ev)
+					}
+					c.mode = mode
+					c.requested &^= mode
 				} else {
+					// The user may have left after the state the host
+					// updated was sent.
 					logging.Logf(ctx,
-						"Unknown user from host update: session=%s user=%s",
+						"Ignoring unknown user from host update: "+
+							"session=%s user=%s",
 						ss.ToString(), user,
 					)
-					break STATELOOP
+				}
+			}
+			if _, ok := w.clients[st.Writer]; ok || st.Writer == "" {
+				w.writer = st.Writer
+			} else {
+				logging.Logf(ctx,
+					"Unknown writer from host update: session=%s user=%s",
+					ss.ToString(), st.Writer,
+				)
+				w.writer = ""
+			}
+			for _, user := range st.Declines {
+				if c, ok := w.clients[user]; ok {
+					c.requested = 0
+				}
+			}
+			kicked := map[*UserState]string{}
+			for _, k := range st.Kicks {
+				if c, ok := w.clients[k.User]; ok {
+					kicked[c] = k.Code
 				}
 			}
 			w.mutex.Unlock()
@@ -260,6 +733,10 @@ func (w *Warp) handleHost(
 				ss.ToString(), st.WindowSize.Rows, st.WindowSize.Cols,
 			)
 
+			for c, code := range kicked {
+				w.kick(ctx, ss, c, code)
+			}
+
 			w.updateClientSessions(ctx)
 		}
 		ss.SendInternalError(ctx)
@@ -279,27 +756,46 @@ func (w *Warp) handleHost(
 		ss.TearDown()
 	}()
 
-	// Send data to host.
+	// Send data to host until the host session ends. w.data is never closed
+	// (see rcvShellClientData).
 	go func() {
 	DATALOOP:
 		for {
-			buf, ok := <-w.data
-			// logging.Logf(ctx,
-			// 	"Sending data to host: session=%s size=%d",
-			// 	ss.ToString(), len(buf),
-			// )
-			_, err := ss.dataC.Write(buf)
-			if err != nil {
-				break DATALOOP
-			}
-			if !ok {
+			select {
+			case <-ss.ctx.Done():
 				break DATALOOP
+			case buf := <-w.data:
+				// logging.Logf(ctx,
+				// 	"Sending data to host: session=%s size=%d",
+				// 	ss.ToString(), len(buf),
+				// )
+				if _, err := ss.dataC.Write(buf); err != nil {
+					ss.SendInternalError(ctx)
+					break DATALOOP
+				}
 			}
 		}
-		ss.SendInternalError(ctx)
 		ss.TearDown()
 	}()
 
+	// Send the state to the clients while the host is idle, for them to know
+	// that the connection is alive.
+	go func() {
+		for {
+			select {
+			case <-ss.ctx.Done():
+				return
+			case <-time.After(warp.HeartbeatInterval):
+			}
+			w.mutex.Lock()
+			idle := time.Since(w.lastOutput)
+			w.mutex.Unlock()
+			if idle >= warp.HeartbeatInterval {
+				w.updateClientSessions(ctx)
+			}
+		}
+	}()
+
 	// Update host and clients (should be no client).
 	w.updateHost(ctx)
 	w.updateClientSessions(ctx)
@@ -310,42 +806,172 @@ func (w *Warp) handleHost(
 	)
 
 	<-ss.ctx.Done()
+	// The updates received before the session ended, in particular the one
+	// announcing that the host is closing the warp, are applied first.
+	<-stateDone
 
-	close(w.data)
+	w.audit.Log(ctx, newAuditEvent(AuditHostDisconnected, ss, warp.DefaultHostMode))
+}
 
-	// Cancel all clients.
-	logging.Logf(ctx,
-		"Cancelling all clients: session=%s",
-		ss.ToString(),
-	)
-	sessions := w.CientSessions(ctx)
-	for _, s := range sessions {
-		s.SendError(ctx,
-			"host_disconnected",
-			"The warp host disconnected.",
+// reattach attaches a host session to the warp after its host reconnected,
+// provided it is the same host (the same session token, user and secret, a
+// second `warp open` of the same user being refused) and the warp was not
+// closed. If the previous host session is still attached (warpd did not
+// notice the connection drop yet), it is torn down and the channel closed
+// once it is done with is returned for the caller to try again.
+//
+// The modes of the users are reset as the reconnected host revokes all the
+// authorizations it granted (or restores them if it rehosts the warp after
+// an internal error).
+func (w *Warp) reattach(
+	ctx context.Context,
+	ss *Session,
+	initial warp.HostUpdate,
+) (bool, chan struct{}) {
+	w.mutex.Lock()
+	if w.closing ||
+		ss.session.Token != w.host.session.session.Token ||
+		ss.session.User != w.host.UserState.token ||
+		ss.session.Secret != w.host.session.session.Secret {
+		w.mutex.Unlock()
+		return false, nil
+	}
+	if !w.orphaned {
+		previous, done := w.host.session, w.hostDone
+		w.mutex.Unlock()
+		logging.Logf(ctx,
+			"Replacing previous host session: session=%s previous=%s",
+			ss.ToString(), previous.ToString(),
 		)
+		previous.TearDown()
+		return false, done
+	}
+	w.orphaned = false
+	close(w.reattached)
+	w.hostDone = make(chan struct{})
+
+	w.windowSize = initial.WindowSize
+	if len(initial.Panes) > 0 {
+		w.panes = initial.Panes
+		w.pane = initial.Pane
+	}
+	w.singleWriter = initial.SingleWriter
+	w.writer = ""
+	w.maxClients = initial.MaxClients
+	w.sizePolicy = initial.SizePolicy
+	w.title = warp.SanitizeTitle(initial.Title)
+	w.term = sanitizeTerm(initial.Term)
+	w.readOnly = initial.ReadOnly
+	for _, c := range w.clients {
+		if c.mode != warp.DefaultUserMode {
+			ev := newAuditEvent(AuditModeChanged, ss, warp.DefaultUserMode)
+			ev.Target = c.token
+			ev.TargetUsername = c.username
+			ev.PreviousMode = c.mode.String()
+			w.audit.Log(ctx, ev)
+		}
+		c.mode = warp.DefaultUserMode
+	}
+	w.mutex.Unlock()
+
+	return true, nil
+}
+
+// disconnectClients sends the provided error to the shell and chat clients of
+// the warp before tearing their sessions down, once the warp is closed.
+func (w *Warp) disconnectClients(
+	ctx context.Context,
+	code string,
+	message string,
+) {
+	sessions := append(w.CientSessions(ctx), w.ChatSessions(ctx)...)
+	for _, s := range sessions {
+		s.SendError(ctx, code, message)
+		s.TearDown()
+	}
+}
+
+// kick disconnects all the sessions of a user on the host's request.
+func (w *Warp) kick(
+	ctx context.Context,
+	host *Session,
+	user *UserState,
+	code string,
+) {
+	w.mutex.Lock()
+	sessions := []*Session{}
+	for _, s := range user.sessions {
+		sessions = append(sessions, s)
+	}
+	for _, s := range w.chats {
+		if s.session.User == user.token {
+			sessions = append(sessions, s)
+		}
+	}
+	w.mutex.Unlock()
+
+	ev := newAuditEvent(AuditClientKicked, host, warp.DefaultHostMode)
+	ev.Target = user.token
+	ev.TargetUsername = user.username
+	w.audit.Log(ctx, ev)
+
+	message := "You were disconnected by the warp host."
+	if code == warp.ErrCodeWarpFull {
+		message = warpFullMessage
+	}
+	for _, s := range sessions {
+		s.SendError(ctx, code, message)
 		s.TearDown()
 	}
 }
 
+// Close closes the warp, sending the provided error to its shell clients,
+// chat clients and host before tearing their sessions down.
+func (w *Warp) Close(
+	ctx context.Context,
+	code string,
+	message string,
+) {
+	w.disconnectClients(ctx, code, message)
+
+	w.mutex.Lock()
+	host := w.host
+	// The warp is not kept waiting for its host to reconnect.
+	if w.orphaned && !w.closing {
+		close(w.reattached)
+	}
+	w.closing = true
+	w.mutex.Unlock()
+	if host != nil {
+		w.audit.Log(ctx, newAuditEvent(AuditWarpClosed, host.session, host.mode))
+		host.session.SendError(ctx, code, message)
+		host.session.TearDown()
+	}
+}
+
 // handleShellClient is responsible for handling the SsTpShellClient sessions.
 // It is in charge of:
 // - receiving shell client data and passing it to the host if authorized.
+// - receiving shell client updates (window size, refresh requests).
 func (w *Warp) handleShellClient(
 	ctx context.Context,
 	ss *Session,
 ) {
-	// Add the client.
+	// Add the client. The data lock is held until the scrollback is replayed
+	// to it.
+	w.dataMutex.Lock()
 	w.mutex.Lock()
 	isHostSession := false
 	if ss.session.User == w.host.UserState.token {
 		// Check that the host secret matches.
 		if ss.session.Secret != w.host.session.session.Secret {
+			w.audit.Log(ctx, newAuditEvent(AuditClientRejected, ss, 0))
 			ss.SendError(ctx,
-				"authorization_failed",
+				warp.ErrCodeAuthorizationFailed,
 				"Session secret mismatch.",
 			)
 			w.mutex.Unlock()
+			w.dataMutex.Unlock()
 			return
 		}
 		isHostSession = true
@@ -356,6 +982,17 @@ func (w *Warp) handleShellClient(
 		w.host.UserState.sessions[ss.session.Token] = ss
 	} else {
 		if c, ok := w.clients[ss.session.User]; !ok {
+			if limit := w.clientLimit(); limit > 0 &&
+				len(w.clients) >= limit {
+				w.audit.Log(ctx, newAuditEvent(AuditClientRejected, ss, 0))
+				ss.SendError(ctx,
+					warp.ErrCodeWarpFull,
+					warpFullMessage,
+				)
+				w.mutex.Unlock()
+				w.dataMutex.Unlock()
+				return
+			}
 			w.clients[ss.session.User] = &UserState{
 				token:    ss.session.User,
 				username: ss.username,
@@ -371,11 +1008,13 @@ func (w *Warp) handleShellClient(
 			}
 			// Check that the host secret matches.
 			if ss.session.Secret != any().session.Secret {
+				w.audit.Log(ctx, newAuditEvent(AuditClientRejected, ss, 0))
 				ss.SendError(ctx,
-					"authorization_failed",
+					warp.ErrCodeAuthorizationFailed,
 					"Session secret mismatch.",
 				)
 				w.mutex.Unlock()
+				w.dataMutex.Unlock()
 				return
 			}
 		}
@@ -384,9 +1023,19 @@ func (w *Warp) handleShellClient(
 			s.TearDown()
 		}
 		w.clients[ss.session.User].sessions[ss.session.Token] = ss
+		// The requested mode is staged for the host to grant or decline.
+		c := w.clients[ss.session.User]
+		c.requested |= ss.requested &^ c.mode
 	}
+	mode := w.sessionMode(ss)
+	replay := w.scrollbackReplay(ctx, ss)
 	w.mutex.Unlock()
 
+	w.replayScrollback(ctx, ss, replay)
+	w.dataMutex.Unlock()
+
+	w.audit.Log(ctx, newAuditEvent(AuditClientConnected, ss, mode))
+
 	// Receive shell client data.
 	go func() {
 		plex.Run(ctx, func(data []byte) {
@@ -400,6 +1049,26 @@ func (w *Warp) handleShellClient(
 		ss.TearDown()
 	}()
 
+	// Receive shell client updates. Errors are ignored as the session is
+	// torn down by the data loop.
+	go func() {
+		for {
+			var update warp.ClientUpdate
+			if err := ss.updateR.Decode(&update); err != nil {
+				break
+			}
+			if update.WindowSize.Valid() {
+				w.rcvClientSize(ctx, ss, update.WindowSize)
+			}
+			if update.Refresh {
+				w.rcvRefresh(ctx, ss)
+			}
+			if update.Request != 0 {
+				w.rcvRequest(ctx, ss, update.Request)
+			}
+		}
+	}()
+
 	// Update host and clients (including the new session).
 	w.updateHost(ctx)
 	w.updateClientSessions(ctx)
@@ -418,17 +1087,83 @@ func (w *Warp) handleShellClient(
 	)
 
 	w.mutex.Lock()
+	mode = w.sessionMode(ss)
 	if isHostSession {
 		delete(w.host.sessions, ss.session.Token)
 	} else {
 		delete(w.clients[ss.session.User].sessions, ss.session.Token)
 		if len(w.clients[ss.session.User].sessions) == 0 {
 			delete(w.clients, ss.session.User)
+			if w.writer == ss.session.User {
+				// The write token returns to the host.
+				w.writer = ""
+			}
 		}
 	}
 	w.mutex.Unlock()
 
+	w.audit.Log(ctx, newAuditEvent(AuditClientDisconnected, ss, mode))
+
 	// Update host and remaining clients
 	w.updateHost(ctx)
 	w.updateClientSessions(ctx)
 }
+
+// watchIdle starts the timer closing the warp once its host produced no
+// output for timeout.
+func (w *Warp) watchIdle(
+	ctx context.Context,
+	timeout time.Duration,
+) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.idleTimeout = timeout
+	w.lastOutput = time.Now()
+	w.idleTimer = time.AfterFunc(timeout, func() {
+		w.checkIdle(ctx)
+	})
+}
+
+// checkIdle closes the warp if its host produced no output within the idle
+// timeout. Otherwise the timer is rearmed to fire idleTimeout after the last
+// output, which is how host output resets it.
+func (w *Warp) checkIdle(
+	ctx context.Context,
+) {
+	w.mutex.Lock()
+	if w.idleTimer == nil {
+		// The timer was stopped.
+		w.mutex.Unlock()
+		return
+	}
+	if remaining := w.idleTimeout - time.Since(w.lastOutput); remaining > 0 {
+		w.idleTimer.Reset(remaining)
+		w.mutex.Unlock()
+		return
+	}
+	w.idleTimer = nil
+	timeout := w.idleTimeout
+	w.mutex.Unlock()
+
+	logging.Logf(ctx,
+		"Closing idle warp: warp=%s idle_timeout=%s",
+		w.token, timeout,
+	)
+	w.Close(ctx,
+		warp.ErrCodeIdleTimeout,
+		fmt.Sprintf(
+			"The warp was closed after %s without output from its host.",
+			timeout,
+		),
+	)
+}
+
+// stopIdle stops the idle timer of the warp, if any, once it is closed.
+func (w *Warp) stopIdle() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.idleTimer != nil {
+		w.idleTimer.Stop()
+		w.idleTimer = nil
+	}
+}
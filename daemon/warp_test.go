@@ -0,0 +1,215 @@
+package daemon
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+)
+
+// sessionStates relays the states received by a session.
+func sessionStates(
+	t *testing.T,
+	ss *cli.Session,
+) <-chan warp.State {
+	statesC := make(chan warp.State, 64)
+	go func() {
+		defer close(statesC)
+		for {
+			st, err := ss.DecodeState(context.Background())
+			if err != nil {
+				return
+			}
+			statesC <- *st
+		}
+	}()
+	return statesC
+}
+
+// waitState waits for a state matching match, failing the test with desc if
+// none is received within timeout.
+func waitState(
+	t *testing.T,
+	statesC <-chan warp.State,
+	timeout time.Duration,
+	desc string,
+	match func(warp.State) bool,
+) warp.State {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case st, ok := <-statesC:
+			if !ok {
+				t.Fatalf("Session closed waiting for %s", desc)
+			}
+			if match(st) {
+				return st
+			}
+		case <-deadline:
+			t.Fatalf("No state with %s", desc)
+		}
+	}
+}
+
+// typingIs returns a state matcher for the users typing simultaneously.
+func typingIs(
+	users ...string,
+) func(warp.State) bool {
+	return func(st warp.State) bool {
+		if len(users) == 0 {
+			return len(st.Typing) == 0
+		}
+		return reflect.DeepEqual(st.Typing, users)
+	}
+}
+
+// writingIs returns a state matcher for the users writing to the warp.
+func writingIs(
+	users ...string,
+) func(warp.State) bool {
+	return func(st warp.State) bool {
+		if len(users) == 0 {
+			return len(st.Writing) == 0
+		}
+		return reflect.DeepEqual(st.Writing, users)
+	}
+}
+
+func TestTypingAndWritingNotices(t *testing.T) {
+	_, path, _ := startSrv(t)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	host, err := openWarpSession(t, conn, "goofy-dev")
+	if err != nil {
+		t.Fatalf("Open warp: %v", err)
+	}
+	statesC := sessionStates(t, host)
+
+	clients := map[string]*cli.Session{}
+	modes := map[string]warp.Mode{}
+	for _, user := range []string{"alice", "bob", "carol", "dave"} {
+		clients[user] = connectClient(t, path, "goofy-dev", user)
+		modes[user] = warp.DefaultUserMode | warp.ModeShellWrite
+	}
+	if err := host.SendHostUpdate(context.Background(), warp.HostUpdate{
+		Warp:       "goofy-dev",
+		From:       hostSession,
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+		Modes:      modes,
+	}); err != nil {
+		t.Fatalf("SendHostUpdate: %v", err)
+	}
+	// Clients are updated with the modes granted by the host.
+	waitState(t, sessionStates(t, clients["alice"]), 5*time.Second,
+		"write granted", func(st warp.State) bool {
+			for _, user := range []string{"alice", "bob", "carol", "dave"} {
+				if st.Users[user].Mode&warp.ModeShellWrite == 0 {
+					return false
+				}
+			}
+			return true
+		})
+
+	// A single user writing is not typing simultaneously with anyone.
+	clients["alice"].WriteDataC([]byte("a"))
+	st := waitState(t, statesC, 5*time.Second, "alice writing", writingIs("alice"))
+	if len(st.Typing) != 0 {
+		t.Errorf("Typing: got %v, want none", st.Typing)
+	}
+
+	clients["bob"].WriteDataC([]byte("b"))
+	start := time.Now()
+	waitState(t, statesC, 5*time.Second, "alice and bob typing",
+		typingIs("alice", "bob"))
+
+	// window returns the time at fraction f of the typing window from start.
+	window := func(f float64) time.Time {
+		return start.Add(time.Duration(f * float64(warp.TypingWindow)))
+	}
+	time.Sleep(time.Until(window(0.6)))
+	clients["alice"].WriteDataC([]byte("a"))
+	clients["carol"].WriteDataC([]byte("c"))
+	waitState(t, statesC, 5*time.Second, "alice, bob and carol typing",
+		typingIs("alice", "bob", "carol"))
+
+	// Bob stopped typing as dave starts: the users typing change but not
+	// their number.
+	time.Sleep(time.Until(window(1.3)))
+	clients["dave"].WriteDataC([]byte("d"))
+	waitState(t, statesC, time.Until(window(1.6)), "alice, carol and dave typing",
+		typingIs("alice", "carol", "dave"))
+
+	// The notices are cleared once users stop typing and writing.
+	waitState(t, statesC, 5*time.Second, "no one typing", typingIs())
+	waitState(t, statesC, 2*warp.WritingWindow, "no one writing", writingIs())
+}
+
+func TestHostResizeBurstBroadcasts(t *testing.T) {
+	_, path, _ := startSrv(t)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	host, err := openWarpSession(t, conn, "goofy-dev")
+	if err != nil {
+		t.Fatalf("Open warp: %v", err)
+	}
+	go func() {
+		for {
+			if _, err := host.DecodeState(context.Background()); err != nil {
+				return
+			}
+		}
+	}()
+	statesC := sessionStates(t, connectClient(t, path, "goofy-dev", "ada"))
+
+	mutex := &sync.Mutex{}
+	size := warp.Size{Rows: 24, Cols: 80}
+	host.SetHostUpdate(func() warp.HostUpdate {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return warp.HostUpdate{
+			Warp:       "goofy-dev",
+			From:       hostSession,
+			WindowSize: size,
+		}
+	})
+
+	// The host window is dragged for 500ms, resized every 5ms.
+	resizes := 100
+	for i := 1; i <= resizes; i++ {
+		mutex.Lock()
+		size.Cols = 80 + i
+		mutex.Unlock()
+		if err := host.QueueHostUpdate(context.Background(), false); err != nil {
+			t.Fatalf("QueueHostUpdate: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	broadcasts := 0
+	for {
+		st := waitState(t, statesC, 5*time.Second, "the last size",
+			func(warp.State) bool { return true })
+		broadcasts++
+		if st.WindowSize.Cols == 80+resizes {
+			break
+		}
+	}
+	t.Logf("%d resizes broadcast to clients %d times", resizes, broadcasts)
+	max := int(time.Duration(resizes)*5*time.Millisecond/
+		warp.HostUpdateDebounce) + 2
+	if broadcasts > max {
+		t.Errorf("Broadcasts: got %d, want at most %d", broadcasts, max)
+	}
+}
@@ -0,0 +1,182 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/logging"
+)
+
+// WebhookEventType is the type of a webhook event.
+type WebhookEventType string
+
+const (
+	// WebhookWarpOpened is posted when a host opens a warp.
+	WebhookWarpOpened WebhookEventType = "warp_opened"
+	// WebhookWarpClosed is posted when a warp is closed (its host
+	// disconnected).
+	WebhookWarpClosed WebhookEventType = "warp_closed"
+)
+
+const (
+	// webhookQueue is the number of events queued for delivery. Events are
+	// dropped (and logged) if the queue is full.
+	webhookQueue = 256
+	// webhookAttempts is the number of attempts to deliver an event, the
+	// delay between two attempts being doubled from webhookRetryDelay.
+	webhookAttempts   = 3
+	webhookRetryDelay = 1 * time.Second
+	// webhookTimeout bounds each delivery attempt.
+	webhookTimeout = 5 * time.Second
+)
+
+// WebhookEvent is the JSON payload posted to the webhook:
+//
+//	{"time":"...","event":"warp_opened","warp":"goofy-dev",
+//	 "user":"guest_...","username":"stan","remote":"1.2.3.4:5678"}
+//
+// The user, username and remote address are the host's.
+type WebhookEvent struct {
+	Time     time.Time        `json:"time"`
+	Event    WebhookEventType `json:"event"`
+	Warp     string           `json:"warp"`
+	User     string           `json:"user"`
+	Username string           `json:"username"`
+	Remote   string           `json:"remote"`
+}
+
+// newWebhookEvent constructs a webhook event for the given host session.
+func newWebhookEvent(
+	event WebhookEventType,
+	ss *Session,
+) WebhookEvent {
+	return WebhookEvent{
+		Time:     time.Now().UTC(),
+		Event:    event,
+		Warp:     ss.warp,
+		User:     ss.session.User,
+		Username: ss.username,
+		Remote:   ss.conn.RemoteAddr().String(),
+	}
+}
+
+// Webhook posts the events of the lifecycle of warps to an HTTP endpoint
+// (`warpd -webhook`) for ChatOps integrations. Events are delivered in the
+// background and in order, so that posting never blocks warpd. A nil Webhook
+// is valid and discards all events.
+type Webhook struct {
+	url    string
+	client *http.Client
+	eventC chan WebhookEvent
+}
+
+// NewWebhook constructs a Webhook posting to url and starts delivering events
+// until the context is canceled.
+func NewWebhook(
+	ctx context.Context,
+	url string,
+) *Webhook {
+	w := &Webhook{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		eventC: make(chan WebhookEvent, webhookQueue),
+	}
+	go w.run(ctx)
+	return w
+}
+
+// Post queues an event for delivery. It never blocks: the event is dropped
+// if the queue is full.
+func (w *Webhook) Post(
+	ctx context.Context,
+	ev WebhookEvent,
+) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.eventC <- ev:
+	default:
+		logging.Logf(ctx,
+			"Dropping webhook event (queue full): event=%s warp=%s",
+			ev.Event, ev.Warp,
+		)
+	}
+}
+
+// run delivers the queued events until the context is canceled.
+func (w *Webhook) run(
+	ctx context.Context,
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-w.eventC:
+			w.deliver(ctx, ev)
+		}
+	}
+}
+
+// deliver posts an event, retrying up to webhookAttempts times.
+func (w *Webhook) deliver(
+	ctx context.Context,
+	ev WebhookEvent,
+) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logging.Logf(ctx, "Error encoding webhook event: error=%v", err)
+		return
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := w.post(ctx, body)
+		if err == nil {
+			return
+		}
+		logging.Logf(ctx,
+			"Error posting webhook event: event=%s warp=%s attempt=%d "+
+				"error=%v",
+			ev.Event, ev.Warp, attempt, err,
+		)
+		if attempt == webhookAttempts {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// post posts a JSON body to the webhook.
+func (w *Webhook) post(
+	ctx context.Context,
+	body []byte,
+) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Trace(
+			errors.Newf("Unexpected status: %s", res.Status),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer is an HTTP server receiving webhook events, failing the
+// first fail requests.
+type webhookServer struct {
+	*httptest.Server
+	eventC chan WebhookEvent
+
+	mutex    sync.Mutex
+	fail     int
+	attempts int
+}
+
+// startWebhookServer starts a webhookServer.
+func startWebhookServer(
+	t *testing.T,
+	fail int,
+) *webhookServer {
+	t.Helper()
+	s := &webhookServer{
+		eventC: make(chan WebhookEvent, 16),
+		fail:   fail,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			s.mutex.Lock()
+			s.attempts++
+			failing := s.attempts <= s.fail
+			s.mutex.Unlock()
+			if failing {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if r.Method != "POST" ||
+				r.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("Request: got %s %s", r.Method,
+					r.Header.Get("Content-Type"))
+			}
+			var ev WebhookEvent
+			if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+				t.Errorf("Decode event: %v", err)
+			}
+			s.eventC <- ev
+		},
+	))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// next returns the next event received by the server.
+func (s *webhookServer) next(
+	t *testing.T,
+) WebhookEvent {
+	t.Helper()
+	select {
+	case ev := <-s.eventC:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a webhook event")
+	}
+	return WebhookEvent{}
+}
+
+func TestWebhookOpenAndClose(t *testing.T) {
+	hook := startWebhookServer(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, path, _ := startSrvWith(t, func(config *Config) {
+		// Warps are closed as soon as their host disconnects.
+		config.HostGrace = 0
+	}, NewWebhook(ctx, hook.URL))
+
+	opened := time.Now()
+	conn := openHost(t, path, "goofy-dev")
+	for _, want := range []WebhookEventType{
+		WebhookWarpOpened, WebhookWarpClosed,
+	} {
+		ev := hook.next(t)
+		if ev.Event != want || ev.Warp != "goofy-dev" ||
+			ev.User != "host" || ev.Username != "stan" || ev.Remote == "" {
+			t.Errorf("Event: got %+v, want %s", ev, want)
+		}
+		if ev.Time.Before(opened.Add(-time.Second)) ||
+			ev.Time.After(time.Now()) {
+			t.Errorf("Event time: got %s", ev.Time)
+		}
+		conn.Close()
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	hook := startWebhookServer(t, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := NewWebhook(ctx, hook.URL)
+
+	w.Post(ctx, WebhookEvent{Event: WebhookWarpOpened, Warp: "goofy-dev"})
+	if ev := hook.next(t); ev.Warp != "goofy-dev" {
+		t.Errorf("Event: got %+v", ev)
+	}
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	if hook.attempts != 2 {
+		t.Errorf("Attempts: got %d, want 2", hook.attempts)
+	}
+}
+
+func TestWebhookNeverBlocks(t *testing.T) {
+	stalled := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-stalled
+		},
+	))
+	defer hook.Close()
+	defer close(stalled)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := NewWebhook(ctx, hook.URL)
+
+	// Events are dropped once the queue is full.
+	start := time.Now()
+	for i := 0; i < webhookQueue+2; i++ {
+		w.Post(ctx, WebhookEvent{Event: WebhookWarpOpened, Warp: "goofy-dev"})
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Posting blocked for %s", d)
+	}
+
+	// A nil Webhook discards events.
+	var none *Webhook
+	none.Post(ctx, WebhookEvent{Event: WebhookWarpClosed})
+}
@@ -0,0 +1,213 @@
+package asciicast
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// Header is the first line of an asciicast v2 file.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Writer writes an asciicast v2 stream. It is thread-safe.
+type Writer struct {
+	w     *bufio.Writer
+	start time.Time
+	// pending holds the trailing bytes of an incomplete UTF-8 sequence so
+	// that multi-byte characters split across writes are not mangled.
+	pending []byte
+
+	mutex *sync.Mutex
+}
+
+// NewWriter constructs a Writer and writes the header for the given initial
+// terminal size.
+func NewWriter(
+	w io.Writer,
+	cols int,
+	rows int,
+	env map[string]string,
+) (*Writer, error) {
+	a := &Writer{
+		w:     bufio.NewWriter(w),
+		start: time.Now(),
+		mutex: &sync.Mutex{},
+	}
+
+	raw, err := json.Marshal(Header{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: a.start.Unix(),
+		Env:       env,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, err := a.w.Write(append(raw, '\n')); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return a, nil
+}
+
+// event writes an event line. It must be called with the lock held.
+func (a *Writer) event(
+	code string,
+	data string,
+) error {
+	delta := time.Since(a.start).Seconds()
+	raw, err := json.Marshal([]interface{}{delta, code, data})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := a.w.Write(append(raw, '\n')); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Output records data written to the terminal.
+func (a *Writer) Output(
+	data []byte,
+) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	buf := append(a.pending, data...)
+	// Hold back an incomplete UTF-8 sequence at the end of the buffer.
+	cut := len(buf)
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	a.pending = append([]byte{}, buf[cut:]...)
+	if cut == 0 {
+		return nil
+	}
+
+	return a.event("o", string(buf[:cut]))
+}
+
+// Resize records a terminal resize.
+func (a *Writer) Resize(
+	cols int,
+	rows int,
+) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// Flush flushes buffered events to the underlying writer.
+func (a *Writer) Flush() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.pending) > 0 {
+		if err := a.event("o", string(a.pending)); err != nil {
+			return errors.Trace(err)
+		}
+		a.pending = nil
+	}
+	return errors.Trace(a.w.Flush())
+}
+
+// Event is an event of an asciicast v2 stream: Time is the number of seconds
+// since the start of the recording, Code the type of the event ("o" for
+// output, "r" for resizes) and Data its payload.
+type Event struct {
+	Time float64
+	Code string
+	Data string
+}
+
+// Reader reads an asciicast v2 stream.
+type Reader struct {
+	r      *bufio.Reader
+	header Header
+}
+
+// NewReader constructs a Reader, reading the header of the stream.
+func NewReader(
+	r io.Reader,
+) (*Reader, error) {
+	a := &Reader{
+		r: bufio.NewReader(r),
+	}
+	line, err := a.r.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, errors.Trace(
+			errors.Newf("Failed to read header: %v", err),
+		)
+	}
+	if err := json.Unmarshal(line, &a.header); err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Malformed header: %v", err),
+		)
+	}
+	if a.header.Version != 2 {
+		return nil, errors.Trace(
+			errors.Newf("Unsupported version: %d", a.header.Version),
+		)
+	}
+	return a, nil
+}
+
+// Header returns the header of the stream.
+func (a *Reader) Header() Header {
+	return a.header
+}
+
+// Next returns the next event of the stream, io.EOF once done. Empty lines
+// are skipped.
+func (a *Reader) Next() (*Event, error) {
+	for {
+		line, err := a.r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, errors.Trace(err)
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var raw []interface{}
+		if err := json.Unmarshal(line, &raw); err != nil {
+			return nil, errors.Trace(
+				errors.Newf("Malformed event: %v", err),
+			)
+		}
+		if len(raw) != 3 {
+			return nil, errors.Trace(
+				errors.Newf("Malformed event: %d fields", len(raw)),
+			)
+		}
+		t, okT := raw[0].(float64)
+		code, okC := raw[1].(string)
+		data, okD := raw[2].(string)
+		if !okT || !okC || !okD {
+			return nil, errors.Trace(
+				errors.Newf("Malformed event: %s", bytes.TrimSpace(line)),
+			)
+		}
+		return &Event{Time: t, Code: code, Data: data}, nil
+	}
+}
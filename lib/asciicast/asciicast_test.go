@@ -0,0 +1,166 @@
+package asciicast
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// readAll reads the header and events of a recording.
+func readAll(
+	t *testing.T,
+	data string,
+) (Header, []Event) {
+	t.Helper()
+	r, err := NewReader(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	events := []Event{}
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			return r.Header(), events
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		events = append(events, *ev)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	before := time.Now().Unix()
+	w, err := NewWriter(buf, 80, 24, map[string]string{"TERM": "xterm-256color"})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+
+	// Output is recorded verbatim, escape sequences and control characters
+	// included, multi-byte characters split across writes held until
+	// complete.
+	outputs := []string{
+		"$ ls\r\n",
+		"\x1b[1;34mdir\x1b[0m \"quoted\" \\ \t\x07",
+		"caf\xc3",
+		"\xa9 \xe2\x9c",
+		"\x93\r\n",
+	}
+	for i, o := range outputs {
+		if err := w.Output([]byte(o)); err != nil {
+			t.Fatalf("Output: %v", err)
+		}
+		if i == 1 {
+			time.Sleep(10 * time.Millisecond)
+			if err := w.Resize(120, 40); err != nil {
+				t.Fatalf("Resize: %v", err)
+			}
+		}
+	}
+	// The header and events are buffered until flushed.
+	if buf.Len() != 0 {
+		t.Errorf("Written before flush: %q", buf.String())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	header, events := readAll(t, buf.String())
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 ||
+		header.Env["TERM"] != "xterm-256color" ||
+		header.Timestamp < before || header.Timestamp > time.Now().Unix() {
+		t.Errorf("Header: got %+v", header)
+	}
+
+	output := ""
+	resizes := []string{}
+	last := 0.0
+	for _, ev := range events {
+		if ev.Time < last {
+			t.Errorf("Event at %f after %f", ev.Time, last)
+		}
+		last = ev.Time
+		switch ev.Code {
+		case "o":
+			if !utf8.ValidString(ev.Data) {
+				t.Errorf("Output split within a character: %q", ev.Data)
+			}
+			output += ev.Data
+		case "r":
+			resizes = append(resizes, ev.Data)
+			if ev.Time < 0.01 {
+				t.Errorf("Resize at %f, want at least 0.01", ev.Time)
+			}
+		default:
+			t.Errorf("Unexpected event: %+v", ev)
+		}
+	}
+	if want := strings.Join(outputs, ""); output != want {
+		t.Errorf("Output: got %q, want %q", output, want)
+	}
+	if len(resizes) != 1 || resizes[0] != "120x40" {
+		t.Errorf("Resizes: got %v", resizes)
+	}
+}
+
+func TestFlushIncompleteCharacter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, 80, 24, nil)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	w.Output([]byte("ok \xe2\x9c"))
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	// The bytes of an incomplete character are recorded on flush, as
+	// replacement characters since JSON strings can't hold invalid UTF-8.
+	_, events := readAll(t, buf.String())
+	output := ""
+	for _, ev := range events {
+		output += ev.Data
+	}
+	if want := "ok \ufffd\ufffd"; output != want {
+		t.Errorf("Output: got %q, want %q", output, want)
+	}
+	if strings.Contains(buf.String(), "env") {
+		t.Errorf("Empty env recorded: %s", buf.String())
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"malformed header", "{\"version\":\n"},
+		{"unsupported version", "{\"version\":1,\"width\":80,\"height\":24}\n"},
+	} {
+		if _, err := NewReader(strings.NewReader(tc.data)); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+
+	header := "{\"version\":2,\"width\":80,\"height\":24}\n"
+	for _, tc := range []struct {
+		name string
+		line string
+	}{
+		{"malformed event", "[0.1, \"o\"\n"},
+		{"missing field", "[0.1, \"o\"]\n"},
+		{"wrong type", "[\"0.1\", \"o\", \"x\"]\n"},
+	} {
+		r, err := NewReader(strings.NewReader(header + "\n" + tc.line))
+		if err != nil {
+			t.Fatalf("%s: NewReader: %v", tc.name, err)
+		}
+		if _, err := r.Next(); err == nil || err == io.EOF {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
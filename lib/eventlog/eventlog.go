@@ -0,0 +1,157 @@
+package eventlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// Type is the type of an event.
+type Type string
+
+const (
+	// Connected is logged when the host session to warpd is established.
+	Connected Type = "connected"
+	// Disconnected is logged when the host session to warpd ends.
+	Disconnected Type = "disconnected"
+	// State is logged for each state update received from warpd.
+	State Type = "state"
+	// Resized is logged when the window size of the warp changes.
+	Resized Type = "resized"
+	// Joined is logged when a user connects to the warp.
+	Joined Type = "joined"
+	// Left is logged when a user disconnects from the warp.
+	Left Type = "left"
+	// ModeChanged is logged when the mode of a user changes.
+	ModeChanged Type = "mode_changed"
+	// Granted is logged when a user joining the warp is authorized to write
+	// to it automatically (`warp open --insecure-allow-write-from-all`).
+	Granted Type = "granted"
+	// ModeIgnored is logged when warpd sends a mode for a user that differs
+	// from the one set by the host, which the host ignores (an escalation
+	// attempt or warpd lagging behind the host updates).
+	ModeIgnored Type = "mode_ignored"
+)
+
+// Event is an event of the event log, serialized as one JSON object per line.
+// Fields are only ever added to this struct so that the format remains stable
+// for parsers. Fields that don't apply to an event are omitted.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Event Type      `json:"event"`
+	Warp  string    `json:"warp"`
+
+	// Session is the host session token (connected and disconnected events).
+	Session string `json:"session,omitempty"`
+
+	// Cols and Rows are the window size (state and resized events).
+	Cols int `json:"cols,omitempty"`
+	Rows int `json:"rows,omitempty"`
+	// Clients is the number of users connected to the warp other than the
+	// host (state events, omitted if none).
+	Clients int `json:"clients,omitempty"`
+
+	// User, Username and Mode identify the user and its mode (joined, left,
+	// mode_changed, granted and mode_ignored events). PreviousMode is only set
+	// for mode_changed events and ReceivedMode, the mode sent by warpd, for
+	// mode_ignored events.
+	User         string `json:"user,omitempty"`
+	Username     string `json:"username,omitempty"`
+	Mode         string `json:"mode,omitempty"`
+	PreviousMode string `json:"previous_mode,omitempty"`
+	ReceivedMode string `json:"received_mode,omitempty"`
+}
+
+// Writer writes events to an underlying writer. A nil Writer is valid and
+// discards all events. It is thread-safe.
+type Writer struct {
+	w     io.Writer
+	mutex *sync.Mutex
+}
+
+// NewWriter constructs a Writer writing to w.
+func NewWriter(
+	w io.Writer,
+) *Writer {
+	return &Writer{
+		w:     w,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Log writes an event as a JSON line, setting its time if not set.
+func (l *Writer) Log(
+	ev Event,
+) error {
+	if l == nil {
+		return nil
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.w.Write(append(raw, '\n')); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Reader reads the events of an event log.
+type Reader struct {
+	r    *bufio.Reader
+	line int
+}
+
+// NewReader constructs a Reader reading from r.
+func NewReader(
+	r io.Reader,
+) *Reader {
+	return &Reader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// Next returns the next event of the log. It returns io.EOF once all events
+// were read. Empty lines are skipped. If the last line of the log is truncated
+// (the host exited while writing it), it returns io.ErrUnexpectedEOF.
+func (r *Reader) Next() (*Event, error) {
+	for {
+		raw, err := r.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, errors.Trace(err)
+		}
+		eof := err == io.EOF
+		raw = bytes.TrimRight(raw, "\r\n")
+		if len(raw) == 0 {
+			if eof {
+				return nil, io.EOF
+			}
+			r.line++
+			continue
+		}
+		r.line++
+
+		var ev Event
+		if err := json.Unmarshal(raw, &ev); err != nil {
+			if eof {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, errors.Trace(
+				errors.Newf("Malformed event on line %d: %v", r.line, err),
+			)
+		}
+		return &ev, nil
+	}
+}
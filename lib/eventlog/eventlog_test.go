@@ -0,0 +1,151 @@
+package eventlog
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// events are events of each type, as logged by `warp open --event-log`.
+var events = []Event{
+	{Event: Connected, Warp: "goofy-dev", Session: "tok"},
+	{Event: State, Warp: "goofy-dev", Cols: 80, Rows: 24, Clients: 2},
+	{Event: Resized, Warp: "goofy-dev", Cols: 120, Rows: 40},
+	{Event: Joined, Warp: "goofy-dev", User: "u1", Username: "ada", Mode: "read"},
+	{Event: Granted, Warp: "goofy-dev", User: "u1", Username: "ada", Mode: "read,write"},
+	{Event: ModeChanged, Warp: "goofy-dev", User: "u1", Username: "ada",
+		Mode: "read", PreviousMode: "read,write"},
+	{Event: ModeIgnored, Warp: "goofy-dev", User: "u1", Username: "ada",
+		Mode: "read", ReceivedMode: "read,write"},
+	{Event: Left, Warp: "goofy-dev", User: "u1", Username: "ada", Mode: "read"},
+	{Event: Disconnected, Warp: "goofy-dev", Session: "tok"},
+}
+
+// writeEvents writes events to an event log, returning it.
+func writeEvents(
+	t *testing.T,
+	events []Event,
+) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for i, ev := range events {
+		ev.Time = start.Add(time.Duration(i) * time.Second)
+		if err := w.Log(ev); err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+	}
+	return buf
+}
+
+// readEvents reads the events of an event log until an error.
+func readEvents(
+	data string,
+) ([]Event, error) {
+	r := NewReader(strings.NewReader(data))
+	read := []Event{}
+	for {
+		ev, err := r.Next()
+		if err != nil {
+			return read, err
+		}
+		read = append(read, *ev)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	buf := writeEvents(t, events)
+	if n := strings.Count(buf.String(), "\n"); n != len(events) {
+		t.Fatalf("Lines: got %d, want %d", n, len(events))
+	}
+
+	read, err := readEvents(buf.String())
+	if err != io.EOF {
+		t.Fatalf("Next: %v", err)
+	}
+	if len(read) != len(events) {
+		t.Fatalf("Events: got %d, want %d", len(read), len(events))
+	}
+	for i, ev := range read {
+		want := events[i]
+		want.Time = time.Date(2024, 5, 1, 10, 0, i, 0, time.UTC)
+		if !reflect.DeepEqual(ev, want) {
+			t.Errorf("%s: got %+v, want %+v", want.Event, ev, want)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	// Parsers rely on the field names and on fields that don't apply to an
+	// event being omitted.
+	buf := writeEvents(t, []Event{events[1], events[5]})
+	want := `{"time":"2024-05-01T10:00:00Z","event":"state","warp":"goofy-dev",` +
+		`"cols":80,"rows":24,"clients":2}` + "\n" +
+		`{"time":"2024-05-01T10:00:01Z","event":"mode_changed",` +
+		`"warp":"goofy-dev","user":"u1","username":"ada","mode":"read",` +
+		`"previous_mode":"read,write"}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Log:\ngot  %s\nwant %s", got, want)
+	}
+}
+
+func TestLogSetsTime(t *testing.T) {
+	buf := &bytes.Buffer{}
+	before := time.Now().UTC()
+	if err := NewWriter(buf).Log(Event{Event: Connected, Warp: "goofy-dev"}); err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	read, err := readEvents(buf.String())
+	if err != io.EOF || len(read) != 1 {
+		t.Fatalf("Events: got %+v, %v", read, err)
+	}
+	if read[0].Time.Before(before.Truncate(time.Second)) ||
+		read[0].Time.Location() != time.UTC {
+		t.Errorf("Time: got %s, logged after %s", read[0].Time, before)
+	}
+
+	// A nil Writer discards events.
+	var w *Writer
+	if err := w.Log(events[0]); err != nil {
+		t.Errorf("Log to a nil Writer: %v", err)
+	}
+}
+
+func TestTruncatedLastLine(t *testing.T) {
+	data := writeEvents(t, events[:3]).String()
+	for _, cut := range []int{2, 10, 30} {
+		truncated := data[:len(data)-cut]
+		read, err := readEvents(truncated)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("Cut %d: got %v, want %v", cut, err, io.ErrUnexpectedEOF)
+		}
+		// Events preceding the truncated line are read.
+		if len(read) != 2 || read[1].Event != State {
+			t.Errorf("Cut %d: got %+v", cut, read)
+		}
+	}
+}
+
+func TestReaderLines(t *testing.T) {
+	lines := strings.Split(writeEvents(t, events[:3]).String(), "\n")
+
+	// Empty lines are skipped, CRLF line endings and a missing trailing
+	// newline accepted.
+	data := lines[0] + "\n\n" + lines[1] + "\r\n" + lines[2]
+	read, err := readEvents(data)
+	if err != io.EOF || len(read) != 3 || read[2].Event != Resized {
+		t.Errorf("Events: got %+v, %v", read, err)
+	}
+
+	// A malformed line is reported, except at the end of the log.
+	data = lines[0] + "\n\n" + `{"event":` + "\n" + lines[1] + "\n"
+	read, err = readEvents(data)
+	if err == nil || err == io.ErrUnexpectedEOF ||
+		!strings.Contains(err.Error(), "line 3") || len(read) != 1 {
+		t.Errorf("Malformed line: got %+v, %v", read, err)
+	}
+}
@@ -0,0 +1,81 @@
+package inputlog
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// Writer writes the input received by the host of a warp from its clients
+// (`warp open --log-input`), one line per chunk of data:
+//
+//	<time> <sources> <data>
+//
+// where time is formatted as RFC3339 (with nanoseconds), sources lists the
+// users the data may come from as `username:token` separated by commas
+// (whitespace in usernames being replaced by underscores) and data is the data
+// received, quoted as a Go string.
+//
+// The input log captures everything typed by the users authorized to write,
+// including passwords. A nil Writer is valid and discards all input. It is
+// thread-safe.
+type Writer struct {
+	w     io.Writer
+	mutex *sync.Mutex
+}
+
+// Source is a user the input may come from.
+type Source struct {
+	User     string
+	Username string
+}
+
+// NewWriter constructs a Writer writing to w.
+func NewWriter(
+	w io.Writer,
+) *Writer {
+	return &Writer{
+		w:     w,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Log writes a chunk of data received from the specified sources. warpd does
+// not tell the host who sent the data so that the sources are the users
+// authorized to write when it was received: the data is attributed to a
+// single user unless multiple users were authorized.
+func (l *Writer) Log(
+	sources []Source,
+	data []byte,
+) error {
+	if l == nil {
+		return nil
+	}
+
+	s := []string{}
+	for _, source := range sources {
+		username := strings.Join(strings.Fields(source.Username), "_")
+		s = append(s, fmt.Sprintf("%s:%s", username, source.User))
+	}
+	if len(s) == 0 {
+		s = append(s, "unknown")
+	}
+	line := fmt.Sprintf(
+		"%s %s %s\n",
+		time.Now().UTC().Format(time.RFC3339Nano),
+		strings.Join(s, ","),
+		strconv.Quote(string(data)),
+	)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := io.WriteString(l.w, line); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
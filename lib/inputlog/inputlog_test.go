@@ -0,0 +1,123 @@
+package inputlog
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingWriter fails all writes.
+type failingWriter struct{}
+
+func (failingWriter) Write(
+	p []byte,
+) (int, error) {
+	return 0, fmt.Errorf("no space left on device")
+}
+
+// parseLine parses a line of the input log into its time, sources and data.
+func parseLine(
+	t *testing.T,
+	line string,
+) (time.Time, string, string) {
+	t.Helper()
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 {
+		t.Fatalf("Malformed line: %q", line)
+	}
+	tm, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		t.Fatalf("Malformed time: %q", parts[0])
+	}
+	data, err := strconv.Unquote(parts[2])
+	if err != nil {
+		t.Fatalf("Malformed data: %q", parts[2])
+	}
+	return tm, parts[1], data
+}
+
+func TestLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewWriter(buf)
+	ada := Source{User: "u1", Username: "ada"}
+	bob := Source{User: "u2", Username: "Bob  Smith"}
+
+	before := time.Now().UTC()
+	for _, tc := range []struct {
+		sources []Source
+		data    string
+		want    string
+	}{
+		{[]Source{ada}, "ls -la\r", "ada:u1"},
+		{[]Source{ada, bob}, "hunter2\r", "ada:u1,Bob_Smith:u2"},
+		{nil, "\x1b[A\x03\"quoted\" \\ \xff", "unknown"},
+	} {
+		buf.Reset()
+		if err := l.Log(tc.sources, []byte(tc.data)); err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+		line := buf.String()
+		if !strings.HasSuffix(line, "\n") || strings.Count(line, "\n") != 1 {
+			t.Fatalf("Not a single line: %q", line)
+		}
+		tm, sources, data := parseLine(t, strings.TrimSuffix(line, "\n"))
+		if tm.Before(before) || tm.After(time.Now().UTC()) {
+			t.Errorf("Time: got %s", tm)
+		}
+		if sources != tc.want {
+			t.Errorf("Sources: got %q, want %q", sources, tc.want)
+		}
+		if data != tc.data {
+			t.Errorf("Data: got %q, want %q", data, tc.data)
+		}
+	}
+
+	// A nil Writer discards input.
+	var nl *Writer
+	if err := nl.Log([]Source{ada}, []byte("x")); err != nil {
+		t.Errorf("Log to a nil Writer: %v", err)
+	}
+}
+
+func TestLogClosedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input.log")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	l := NewWriter(f)
+	if err := l.Log(nil, []byte("before\r")); err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	f.Close()
+
+	if err := l.Log(nil, []byte("after\r")); err == nil ||
+		!strings.Contains(err.Error(), "closed") {
+		t.Errorf("Log to a closed file: got %v", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n"); len(lines) != 1 {
+		t.Errorf("Lines: got %q", lines)
+	} else if _, _, data := parseLine(t, lines[0]); data != "before\r" {
+		t.Errorf("Data: got %q", data)
+	}
+}
+
+func TestLogFailingFile(t *testing.T) {
+	l := NewWriter(failingWriter{})
+	// Every failed write is reported, the log remaining usable.
+	for i := 0; i < 2; i++ {
+		err := l.Log([]Source{{User: "u1", Username: "ada"}}, []byte("ls\r"))
+		if err == nil || !strings.Contains(err.Error(), "no space left") {
+			t.Errorf("Log %d: got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package listen
+
+import (
+	"context"
+	stderrors "errors"
+	"net"
+	"time"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+const (
+	// MinDelay and MaxDelay bound the delay before accepting connections
+	// again after a temporary error, doubled on each successive error.
+	MinDelay = 5 * time.Millisecond
+	MaxDelay = 1 * time.Second
+)
+
+// Accept waits for the next connection on ln. On temporary errors (such as
+// running out of file descriptors) it backs off before accepting again, as
+// net/http does, rather than spinning, calling onRetry (if not nil) with the
+// error and the delay before the next attempt. It returns an error whose
+// cause is net.ErrClosed once the listener is closed or the context is done,
+// and any other error if the listener failed permanently.
+func Accept(
+	ctx context.Context,
+	ln net.Listener,
+	onRetry func(err error, delay time.Duration),
+) (net.Conn, error) {
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if stderrors.Is(err, net.ErrClosed) {
+			return nil, errors.Trace(net.ErrClosed)
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+			return nil, errors.Trace(
+				errors.Newf(
+					"Failed to accept connections: address=%s error=%v",
+					ln.Addr().String(), err,
+				),
+			)
+		}
+		if delay == 0 {
+			delay = MinDelay
+		} else {
+			delay *= 2
+		}
+		if delay > MaxDelay {
+			delay = MaxDelay
+		}
+		if onRetry != nil {
+			onRetry(err, delay)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Trace(net.ErrClosed)
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package listen
+
+import (
+	"context"
+	stderrors "errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// tempError is a temporary net.Error, as returned by Accept when running out
+// of file descriptors.
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// fakeListener returns the queued errors from Accept, then a connection.
+type fakeListener struct {
+	errs    []error
+	accepts int
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	l.accepts++
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func (l *fakeListener) Close() error { return nil }
+
+func (l *fakeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "fake", Net: "unix"}
+}
+
+func TestAcceptBacksOffOnTemporaryErrors(t *testing.T) {
+	ln := &fakeListener{
+		errs: []error{tempError{}, tempError{}, tempError{}},
+	}
+	delays := []time.Duration{}
+	conn, err := Accept(context.Background(), ln,
+		func(err error, delay time.Duration) {
+			delays = append(delays, delay)
+		},
+	)
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	conn.Close()
+	if ln.accepts != 4 {
+		t.Errorf("Accept calls: got %d, want 4", ln.accepts)
+	}
+	want := []time.Duration{MinDelay, 2 * MinDelay, 4 * MinDelay}
+	if len(delays) != len(want) {
+		t.Fatalf("Retries: got %v, want %v", delays, want)
+	}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Errorf("Retry %d delay: got %s, want %s", i, delays[i], want[i])
+		}
+	}
+}
+
+func TestAcceptPermanentError(t *testing.T) {
+	ln := &fakeListener{errs: []error{stderrors.New("boom")}}
+	if _, err := Accept(context.Background(), ln, nil); err == nil {
+		t.Fatalf("Accept: expected an error")
+	}
+	if ln.accepts != 1 {
+		t.Errorf("Accept calls: got %d, want 1", ln.accepts)
+	}
+}
+
+func TestAcceptClosed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ln.Close()
+	_, err = Accept(context.Background(), ln, nil)
+	if errors.Cause(err) != net.ErrClosed {
+		t.Errorf("Accept on closed listener: got %v, want net.ErrClosed", err)
+	}
+}
+
+func TestAcceptCanceledDuringBackoff(t *testing.T) {
+	errs := make([]error, 100)
+	for i := range errs {
+		errs[i] = tempError{}
+	}
+	ln := &fakeListener{errs: errs}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := Accept(ctx, ln, func(err error, delay time.Duration) {
+		cancel()
+	})
+	if errors.Cause(err) != net.ErrClosed {
+		t.Errorf("Accept once canceled: got %v, want net.ErrClosed", err)
+	}
+	if ln.accepts != 1 {
+		t.Errorf("Accept calls: got %d, want 1", ln.accepts)
+	}
+}
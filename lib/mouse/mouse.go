@@ -0,0 +1,280 @@
+package mouse
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	esc = 0x1b
+
+	// maxPending is the maximum length of an incomplete private mode sequence
+	// or mouse event held until the next chunk of output or input is
+	// received.
+	maxPending = 64
+)
+
+// modes are the private modes (DECSET/DECRST) controlling mouse reporting:
+// X10 (9), normal (1000), highlight (1001), button (1002) and any-event
+// (1003) tracking, and the UTF-8 (1005), SGR (1006) and URXVT (1015)
+// encodings.
+var modes = map[int]bool{
+	9: true, 1000: true, 1001: true, 1002: true, 1003: true,
+	1005: true, 1006: true, 1015: true,
+}
+
+// Tracker tracks the mouse reporting modes enabled by an application from
+// its output, optionally stripping the corresponding sequences so that the
+// terminal displaying the output does not report mouse events. It is
+// thread-safe.
+type Tracker struct {
+	enabled map[int]bool
+	// pending is an incomplete private mode sequence ending the last chunk
+	// of output processed.
+	pending []byte
+	mutex   *sync.Mutex
+}
+
+// NewTracker constructs a Tracker with no mouse reporting mode enabled.
+func NewTracker() *Tracker {
+	return &Tracker{
+		enabled: map[int]bool{},
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// Output processes a chunk of output of the application, tracking the mouse
+// reporting modes it sets or resets. If strip is true, these modes are
+// removed from the sequences returned. Sequences split across chunks are
+// held until completed by the next chunk.
+func (t *Tracker) Output(
+	data []byte,
+	strip bool,
+) []byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.pending) > 0 {
+		data = append(t.pending, data...)
+		t.pending = nil
+	}
+
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); {
+		if data[i] != esc {
+			out = append(out, data[i])
+			i++
+			continue
+		}
+		end, complete := privateMode(data[i:])
+		if !complete {
+			if end < 0 && len(data)-i <= maxPending {
+				// Possibly the start of a private mode sequence.
+				t.pending = append([]byte{}, data[i:]...)
+				break
+			}
+			out = append(out, data[i])
+			i++
+			continue
+		}
+		out = append(out, t.apply(data[i:i+end], strip)...)
+		i += end
+	}
+	return out
+}
+
+// privateMode returns the length of the DECSET or DECRST sequence (`ESC [ ?
+// <params> h|l`) starting data and true if data starts with one. It returns
+// -1 and false if data is a prefix of such a sequence, and 0 and false
+// otherwise.
+func privateMode(
+	data []byte,
+) (int, bool) {
+	prefix := []byte{esc, '[', '?'}
+	for i := 1; i < len(prefix); i++ {
+		if i >= len(data) {
+			return -1, false
+		}
+		if data[i] != prefix[i] {
+			return 0, false
+		}
+	}
+	for i := len(prefix); i < len(data); i++ {
+		switch c := data[i]; {
+		case c >= '0' && c <= '9' || c == ';':
+		case c == 'h' || c == 'l':
+			return i + 1, true
+		default:
+			return 0, false
+		}
+	}
+	return -1, false
+}
+
+// apply tracks the mouse reporting modes of a private mode sequence and
+// returns it, without its mouse reporting modes if strip is true (nothing is
+// returned if only mouse reporting modes were set or reset).
+func (t *Tracker) apply(
+	seq []byte,
+	strip bool,
+) []byte {
+	set := seq[len(seq)-1] == 'h'
+	params := strings.Split(string(seq[3:len(seq)-1]), ";")
+	kept := []string{}
+	for _, p := range params {
+		mode, err := strconv.Atoi(p)
+		if err != nil || !modes[mode] {
+			kept = append(kept, p)
+			continue
+		}
+		if set {
+			t.enabled[mode] = true
+		} else {
+			delete(t.enabled, mode)
+		}
+		if !strip {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == len(params) {
+		return seq
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return []byte(fmt.Sprintf(
+		"\033[?%s%c", strings.Join(kept, ";"), seq[len(seq)-1],
+	))
+}
+
+// Enable returns the sequence enabling the mouse reporting modes currently
+// enabled by the application, if any.
+func (t *Tracker) Enable() []byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	enabled := []int{}
+	for mode := range t.enabled {
+		enabled = append(enabled, mode)
+	}
+	return sequence(enabled, 'h')
+}
+
+// Disable returns the sequence disabling all mouse reporting modes.
+func Disable() []byte {
+	all := []int{}
+	for mode := range modes {
+		all = append(all, mode)
+	}
+	return sequence(all, 'l')
+}
+
+// sequence returns the private mode sequence setting (final h) or resetting
+// (final l) the specified modes.
+func sequence(
+	modes []int,
+	final byte,
+) []byte {
+	if len(modes) == 0 {
+		return nil
+	}
+	sort.Ints(modes)
+	params := []string{}
+	for _, mode := range modes {
+		params = append(params, strconv.Itoa(mode))
+	}
+	return []byte(fmt.Sprintf(
+		"\033[?%s%c", strings.Join(params, ";"), final,
+	))
+}
+
+// Stripper removes the mouse events reported by a terminal (X10 `ESC [ M`
+// followed by three bytes, and SGR `ESC [ < <params> M|m` encodings) from its
+// input. It is thread-safe.
+type Stripper struct {
+	// pending is an incomplete mouse event ending the last chunk of input
+	// processed.
+	pending []byte
+	mutex   *sync.Mutex
+}
+
+// NewStripper constructs a Stripper.
+func NewStripper() *Stripper {
+	return &Stripper{
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Strip removes the mouse events from a chunk of input. Events split across
+// chunks are held until completed by the next chunk.
+func (s *Stripper) Strip(
+	data []byte,
+) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.pending) > 0 {
+		data = append(s.pending, data...)
+		s.pending = nil
+	}
+	if bytes.IndexByte(data, esc) < 0 {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); {
+		n := event(data[i:])
+		if n > 0 {
+			i += n
+			continue
+		}
+		if n < 0 && len(data)-i <= maxPending {
+			// Possibly the start of a mouse event.
+			s.pending = append([]byte{}, data[i:]...)
+			break
+		}
+		out = append(out, data[i])
+		i++
+	}
+	return out
+}
+
+// event returns the length of the mouse event starting data. It returns -1 if
+// data is a prefix of a mouse event, and 0 if it does not start with one.
+func event(
+	data []byte,
+) int {
+	prefix := []byte{esc, '['}
+	for i := 0; i < len(prefix); i++ {
+		if i >= len(data) {
+			return -1
+		}
+		if data[i] != prefix[i] {
+			return 0
+		}
+	}
+	if len(data) < 3 {
+		return -1
+	}
+	switch data[2] {
+	case 'M':
+		if len(data) < 6 {
+			return -1
+		}
+		return 6
+	case '<':
+		for i := 3; i < len(data); i++ {
+			switch c := data[i]; {
+			case c >= '0' && c <= '9' || c == ';':
+			case c == 'M' || c == 'm':
+				return i + 1
+			default:
+				return 0
+			}
+		}
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package mouse
+
+import (
+	"strings"
+	"testing"
+)
+
+// splits returns data split in two chunks at every position.
+func splits(
+	data string,
+) [][]string {
+	out := [][]string{}
+	for i := 0; i <= len(data); i++ {
+		out = append(out, []string{data[:i], data[i:]})
+	}
+	return out
+}
+
+func TestTrackerOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		output string
+		strip  bool
+		want   string
+		enable string
+	}{
+		{"set", "\x1b[?1000;1006h", false,
+			"\x1b[?1000;1006h", "\x1b[?1000;1006h"},
+		{"set stripped", "a\x1b[?1000;1006hb", true,
+			"ab", "\x1b[?1000;1006h"},
+		{"other modes kept", "\x1b[?1049;1002;25h", true,
+			"\x1b[?1049;25h", "\x1b[?1002h"},
+		{"reset", "\x1b[?9;1003h\x1b[?9l", true,
+			"", "\x1b[?1003h"},
+		{"all modes", "\x1b[?9;1000;1001;1002;1003;1005;1006;1015h", true,
+			"", "\x1b[?9;1000;1001;1002;1003;1005;1006;1015h"},
+		{"other sequences", "\x1b[1;31mred\x1b[?25l\x1b]0;t\x07\x1b[1000h", true,
+			"\x1b[1;31mred\x1b[?25l\x1b]0;t\x07\x1b[1000h", ""},
+		{"unterminated", "\x1b[?1000x", true,
+			"\x1b[?1000x", ""},
+	} {
+		for _, chunks := range splits(tc.output) {
+			tr := NewTracker()
+			got := ""
+			for _, chunk := range chunks {
+				got += string(tr.Output([]byte(chunk), tc.strip))
+			}
+			if got != tc.want {
+				t.Errorf("%s %q: got %q, want %q", tc.name, chunks, got, tc.want)
+			}
+			if got := string(tr.Enable()); got != tc.enable {
+				t.Errorf("%s %q: enable: got %q, want %q",
+					tc.name, chunks, got, tc.enable)
+			}
+		}
+	}
+}
+
+func TestTrackerPendingBounded(t *testing.T) {
+	tr := NewTracker()
+	long := "\x1b[?" + strings.Repeat("1;", maxPending)
+	if got := string(tr.Output([]byte(long), true)); got != long {
+		t.Errorf("Overlong sequence held: got %q", got)
+	}
+	if got := string(tr.Output([]byte("1000h"), true)); got != "1000h" {
+		t.Errorf("Got %q, want %q", got, "1000h")
+	}
+	if enable := tr.Enable(); enable != nil {
+		t.Errorf("Enable: got %q", enable)
+	}
+}
+
+func TestDisable(t *testing.T) {
+	want := "\x1b[?9;1000;1001;1002;1003;1005;1006;1015l"
+	if got := string(Disable()); got != want {
+		t.Errorf("Disable: got %q, want %q", got, want)
+	}
+}
+
+func TestStripper(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"SGR press", "a\x1b[<0;10;5Mb", "ab"},
+		{"SGR release", "a\x1b[<0;10;5mb", "ab"},
+		{"SGR wheel and motion", "\x1b[<64;1;1M\x1b[<35;120;40M", ""},
+		{"X10", "a\x1b[M !!b", "ab"},
+		{"X10 high coordinates", "a\x1b[M`\xff\xc8b", "ab"},
+		{"X10 and SGR", "\x1b[M#!!\x1b[<0;1;1mq", "q"},
+		{"keys", "ls\r\x1b[A\x1b[3~\x1bx\x1bOP", "ls\r\x1b[A\x1b[3~\x1bx\x1bOP"},
+		{"malformed SGR", "\x1b[<0;1x", "\x1b[<0;1x"},
+	} {
+		for _, chunks := range splits(tc.input) {
+			s := NewStripper()
+			got := ""
+			for _, chunk := range chunks {
+				got += string(s.Strip([]byte(chunk)))
+			}
+			if got != tc.want {
+				t.Errorf("%s %q: got %q, want %q", tc.name, chunks, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestStripperPending(t *testing.T) {
+	s := NewStripper()
+	// The start of an event is held until the next chunk of input.
+	if got := string(s.Strip([]byte("a\x1b[<0;1"))); got != "a" {
+		t.Errorf("Got %q, want %q", got, "a")
+	}
+	if got := string(s.Strip([]byte("0;5Mb"))); got != "b" {
+		t.Errorf("Got %q, want %q", got, "b")
+	}
+	// A held ESC not followed by an event is released with the next chunk.
+	if got := string(s.Strip([]byte("\x1b"))); got != "" {
+		t.Errorf("Got %q, want none", got)
+	}
+	if got := string(s.Strip([]byte("x"))); got != "\x1bx" {
+		t.Errorf("Got %q, want %q", got, "\x1bx")
+	}
+	// Overlong events are not held.
+	long := "\x1b[<" + strings.Repeat("1;", maxPending)
+	if got := string(s.Strip([]byte(long))); got != long {
+		t.Errorf("Overlong event held: got %q", got)
+	}
+}
@@ -2,8 +2,12 @@ package out
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"sync"
 
 	"github.com/fatih/color"
+	isatty "github.com/mattn/go-isatty"
 )
 
 var white *color.Color
@@ -13,6 +17,16 @@ var yellow *color.Color
 var magenta *color.Color
 var redBold *color.Color
 
+// mutex protects the output writer and the color settings.
+var mutex = &sync.Mutex{}
+var writer io.Writer
+
+// noColor disables colors regardless of the writer (DisableColor).
+var noColor bool
+
+// colorEnabled is set if colors are enabled for the current writer.
+var colorEnabled bool
+
 func init() {
 	white = color.New(color.FgWhite)
 	bold = color.New(color.Bold)
@@ -20,34 +34,131 @@ func init() {
 	yellow = color.New(color.FgYellow)
 	magenta = color.New(color.FgMagenta)
 	redBold = color.New(color.FgRed, color.Bold)
+
+	SetWriter(os.Stdout)
+}
+
+// SetWriter sets the writer all messages are printed to (os.Stdout by
+// default). Colors are disabled if the writer is not a terminal, if the
+// NO_COLOR env variable is set, if TERM is `dumb` or if DisableColor was
+// called.
+func SetWriter(
+	w io.Writer,
+) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	writer = w
+	applyColor()
+}
+
+// DisableColor disables colors for all messages printed from now on (`warp
+// --no-color`).
+func DisableColor() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	noColor = true
+	applyColor()
+}
+
+// applyColor enables or disables colors for the current writer. It must be
+// called with the mutex held.
+func applyColor() {
+	enabled := !noColor && ColorSupported(writer)
+	colorEnabled = enabled
+	for _, c := range []*color.Color{
+		white, bold, cyan, yellow, magenta, redBold,
+	} {
+		if enabled {
+			c.EnableColor()
+		} else {
+			c.DisableColor()
+		}
+	}
+}
+
+// Writer returns the writer messages are currently printed to.
+func Writer() io.Writer {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return writer
+}
+
+// ColorSupported returns whether colors should be used when printing to w.
+func ColorSupported(
+	w io.Writer,
+) bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	if os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	// Writers wrapping a file (exposing its descriptor) are checked as well.
+	f, ok := w.(interface {
+		Fd() uintptr
+	})
+	if !ok {
+		return false
+	}
+	return isatty.IsTerminal(f.Fd())
+}
+
+// printf prints a message to the current writer with the given color.
+func printf(
+	c *color.Color,
+	format string,
+	v ...interface{},
+) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if c == nil {
+		fmt.Fprintf(writer, format, v...)
+	} else {
+		c.Fprintf(writer, format, v...)
+	}
 }
 
 // Normf prints a normal message.
 func Normf(format string, v ...interface{}) {
-	fmt.Printf(format, v...)
+	printf(nil, format, v...)
 }
 
 // Boldf prints a bold message.
 func Boldf(format string, v ...interface{}) {
-	bold.PrintfFunc()(format, v...)
+	printf(bold, format, v...)
 }
 
 // Valuf prints an example message.
 func Valuf(format string, v ...interface{}) {
-	cyan.PrintfFunc()(format, v...)
+	printf(cyan, format, v...)
 }
 
 // Warnf prints a warning message.
 func Warnf(format string, v ...interface{}) {
-	yellow.PrintfFunc()(format, v...)
+	printf(yellow, format, v...)
 }
 
 // Errof prints an error message.
 func Errof(format string, v ...interface{}) {
-	redBold.PrintfFunc()(format, v...)
+	printf(redBold, format, v...)
+}
+
+// Colorf prints a message with the given foreground color (SGR parameter,
+// 31 for red).
+func Colorf(sgr int, format string, v ...interface{}) {
+	c := color.New(color.Attribute(sgr))
+	mutex.Lock()
+	enabled := colorEnabled
+	mutex.Unlock()
+	if enabled {
+		c.EnableColor()
+	} else {
+		c.DisableColor()
+	}
+	printf(c, format, v...)
 }
 
 // Statf prints an error message.
 func Statf(format string, v ...interface{}) {
-	magenta.PrintfFunc()(format, v...)
+	printf(magenta, format, v...)
 }
@@ -0,0 +1,147 @@
+package out
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kr/pty"
+)
+
+// restore restores the default writer and colors at the end of a test.
+func restore(
+	t *testing.T,
+) {
+	t.Cleanup(func() {
+		mutex.Lock()
+		noColor = false
+		mutex.Unlock()
+		SetWriter(os.Stdout)
+	})
+}
+
+// printAll prints a message with each of the printing functions.
+func printAll() {
+	Normf("norm %d\n", 1)
+	Boldf("bold %d\n", 2)
+	Valuf("valu %d\n", 3)
+	Warnf("warn %d\n", 4)
+	Errof("erro %d\n", 5)
+	Colorf(31, "colo %d\n", 6)
+	Statf("stat %d\n", 7)
+}
+
+const printed = "norm 1\nbold 2\nvalu 3\nwarn 4\nerro 5\ncolo 6\nstat 7\n"
+
+// openTerminal opens a pseudo-terminal, returning its terminal end and a
+// function reading what was written to it.
+func openTerminal(
+	t *testing.T,
+) (*os.File, func() string) {
+	t.Helper()
+	p, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("No pseudo-terminal available: %v", err)
+	}
+	t.Cleanup(func() {
+		tty.Close()
+		p.Close()
+	})
+	return tty, func() string {
+		buf := make([]byte, 4096)
+		n, err := p.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		return string(buf[:n])
+	}
+}
+
+func TestWriterCapturesOutput(t *testing.T) {
+	restore(t)
+	var buf bytes.Buffer
+	SetWriter(&buf)
+	if Writer() != &buf {
+		t.Errorf("Writer not set")
+	}
+	printAll()
+	if got := buf.String(); got != printed {
+		t.Errorf("Output: got %q, want %q", got, printed)
+	}
+}
+
+func TestColorDisabledWhenNotTerminal(t *testing.T) {
+	restore(t)
+	f, err := os.Create(t.TempDir() + "/out")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer f.Close()
+	if ColorSupported(f) {
+		t.Errorf("Colors supported by a regular file")
+	}
+	SetWriter(f)
+	printAll()
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(data) != printed {
+		t.Errorf("Output: got %q, want %q", data, printed)
+	}
+}
+
+func TestColorEnabledOnTerminal(t *testing.T) {
+	restore(t)
+	t.Setenv("TERM", "xterm")
+	// Unset NO_COLOR, restored by Setenv at the end of the test.
+	t.Setenv("NO_COLOR", "")
+	os.Unsetenv("NO_COLOR")
+	tty, read := openTerminal(t)
+	if !ColorSupported(tty) {
+		t.Fatalf("Colors not supported by a terminal")
+	}
+	SetWriter(tty)
+	Boldf("bold")
+	if got := read(); !strings.Contains(got, "\x1b[") {
+		t.Errorf("Output not colored: %q", got)
+	}
+}
+
+func TestColorDisabledByEnv(t *testing.T) {
+	for _, env := range [][2]string{
+		{"NO_COLOR", "1"},
+		{"NO_COLOR", ""},
+		{"TERM", "dumb"},
+	} {
+		t.Run(env[0]+"="+env[1], func(t *testing.T) {
+			restore(t)
+			t.Setenv(env[0], env[1])
+			tty, read := openTerminal(t)
+			if ColorSupported(tty) {
+				t.Errorf("Colors supported")
+			}
+			SetWriter(tty)
+			Boldf("bold")
+			if got := read(); got != "bold" {
+				t.Errorf("Output: got %q, want %q", got, "bold")
+			}
+		})
+	}
+}
+
+func TestDisableColor(t *testing.T) {
+	restore(t)
+	t.Setenv("TERM", "xterm")
+	t.Setenv("NO_COLOR", "")
+	os.Unsetenv("NO_COLOR")
+	tty, read := openTerminal(t)
+	DisableColor()
+	SetWriter(tty)
+	Boldf("bold")
+	Colorf(31, "red")
+	if got := read(); got != "boldred" {
+		t.Errorf("Output: got %q, want %q", got, "boldred")
+	}
+}
@@ -3,6 +3,14 @@ package plex
 import (
 	"context"
 	"io"
+	"time"
+)
+
+const (
+	// minBuffer and maxBuffer bound the size of the read buffer of Run, which
+	// doubles while reads fill it and halves back as they don't.
+	minBuffer = 1024
+	maxBuffer = 64 * 1024
 )
 
 // Run pipes src to a funtion and aborts if the context gets canceled.
@@ -11,7 +19,7 @@ func Run(
 	dst func([]byte),
 	src io.Reader,
 ) {
-	buf := make([]byte, 1024)
+	buf := make([]byte, minBuffer)
 PLEXLOOP:
 	for {
 		nr, err := src.Read(buf)
@@ -28,5 +36,97 @@ PLEXLOOP:
 			break PLEXLOOP
 		default:
 		}
+		buf = resize(buf, nr)
+	}
+}
+
+// resize returns the buffer to use for the next read given the number of
+// bytes read into buf.
+func resize(
+	buf []byte,
+	nr int,
+) []byte {
+	switch {
+	case nr == len(buf) && len(buf) < maxBuffer:
+		return make([]byte, 2*len(buf))
+	case nr < len(buf)/4 && len(buf) > minBuffer:
+		return make([]byte, len(buf)/2)
+	}
+	return buf
+}
+
+// RunCoalesced pipes src to a function like Run but coalesces bursts of data,
+// reducing the number of calls to dst for large outputs (full screen
+// redraws): a large read (at least minBuffer bytes) is accumulated with the
+// reads following it within window, until a small read, maxBuffer bytes or the
+// end of the window. Small reads (interactive echoes) are passed to dst
+// immediately.
+func RunCoalesced(
+	ctx context.Context,
+	dst func([]byte),
+	src io.Reader,
+	window time.Duration,
+) {
+	dataC := make(chan []byte)
+	go func() {
+		defer close(dataC)
+		buf := make([]byte, maxBuffer)
+		for {
+			nr, err := src.Read(buf)
+			if nr > 0 {
+				cpy := make([]byte, nr)
+				copy(cpy, buf)
+				select {
+				case dataC <- cpy:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		var data []byte
+		select {
+		case <-ctx.Done():
+			return
+		case d, ok := <-dataC:
+			if !ok {
+				return
+			}
+			data = d
+		}
+
+		open := true
+		if len(data) >= minBuffer {
+			timer := time.NewTimer(window)
+		COALESCELOOP:
+			for len(data) < maxBuffer {
+				select {
+				case d, ok := <-dataC:
+					if !ok {
+						open = false
+						break COALESCELOOP
+					}
+					data = append(data, d...)
+					if len(d) < minBuffer {
+						break COALESCELOOP
+					}
+				case <-timer.C:
+					break COALESCELOOP
+				case <-ctx.Done():
+					break COALESCELOOP
+				}
+			}
+			timer.Stop()
+		}
+
+		dst(data)
+		if !open {
+			return
+		}
 	}
 }
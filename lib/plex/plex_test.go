@@ -0,0 +1,222 @@
+package plex
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kr/pty"
+)
+
+// window is the coalescing window used by the host (outputCoalesceWindow).
+const window = 5 * time.Millisecond
+
+// redraw returns the output of a full screen TUI redraw: every line of a
+// 200x60 screen is positioned and colored.
+func redraw() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\033[?25l\033[H\033[2J")
+	for row := 1; row <= 60; row++ {
+		fmt.Fprintf(&buf, "\033[%d;1H", row)
+		for col := 0; col < 200; col += 8 {
+			fmt.Fprintf(&buf, "\033[3%dm%-8d", (row+col)%8, row*col)
+		}
+	}
+	buf.WriteString("\033[0m\033[?25h")
+	return buf.Bytes()
+}
+
+// chunkReader returns data in chunks of at most size bytes, as a pty does.
+type chunkReader struct {
+	data []byte
+	size int
+}
+
+func (r *chunkReader) Read(
+	p []byte,
+) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := r.size
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// relay runs a plex function over src and returns the data passed to dst for
+// each call.
+func relay(
+	run func(context.Context, func([]byte), io.Reader),
+	src io.Reader,
+) [][]byte {
+	calls := [][]byte{}
+	run(context.Background(), func(data []byte) {
+		calls = append(calls, data)
+	}, src)
+	return calls
+}
+
+// coalesced is RunCoalesced with the host window.
+func coalesced(
+	ctx context.Context,
+	dst func([]byte),
+	src io.Reader,
+) {
+	RunCoalesced(ctx, dst, src, window)
+}
+
+func TestRunCoalescedRedraw(t *testing.T) {
+	frame := redraw()
+	plain := relay(Run, &chunkReader{data: frame, size: 4095})
+	calls := relay(coalesced, &chunkReader{data: frame, size: 4095})
+
+	if got := bytes.Join(calls, nil); !bytes.Equal(got, frame) {
+		t.Fatalf("Relayed data differs from the redraw")
+	}
+	// The redraw fits in maxBuffer and is relayed at once.
+	if len(calls) != 1 {
+		t.Errorf("Relay ops: got %d, want 1 (%d without coalescing)",
+			len(calls), len(plain))
+	}
+}
+
+func TestRunCoalescedKeystrokeEcho(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+
+	// A long window, small reads must not wait for it.
+	dataC := make(chan []byte, 1)
+	go RunCoalesced(context.Background(), func(data []byte) {
+		dataC <- data
+	}, r, time.Minute)
+
+	for _, key := range []string{"l", "s", "\r"} {
+		start := time.Now()
+		w.Write([]byte(key))
+		select {
+		case data := <-dataC:
+			if string(data) != key {
+				t.Errorf("Echo: got %q, want %q", data, key)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Echo of %q held by the coalescing window", key)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("Echo of %q delayed by %s", key, d)
+		}
+	}
+}
+
+func TestRunCoalescedEndsWithBurst(t *testing.T) {
+	r, w := io.Pipe()
+	frame := redraw()
+	go func() {
+		w.Write(frame[:minBuffer])
+		w.Close()
+	}()
+
+	// The data accumulated is relayed as the source ends within the window.
+	calls := relay(func(
+		ctx context.Context,
+		dst func([]byte),
+		src io.Reader,
+	) {
+		RunCoalesced(ctx, dst, src, time.Minute)
+	}, r)
+	if got := bytes.Join(calls, nil); !bytes.Equal(got, frame[:minBuffer]) {
+		t.Errorf("Relayed: got %d bytes, want %d", len(got), minBuffer)
+	}
+}
+
+// benchmarkRedraw measures the relay ops for a full screen redraw written to
+// a pty, as relayed by run.
+func benchmarkRedraw(
+	b *testing.B,
+	run func(context.Context, func([]byte), io.Reader),
+) {
+	p, tty, err := pty.Open()
+	if err != nil {
+		b.Skipf("No pseudo-terminal available: %v", err)
+	}
+	defer p.Close()
+	defer tty.Close()
+
+	frame := redraw()
+	b.SetBytes(int64(len(frame)))
+
+	// Each redraw is followed by a marker byte ending it.
+	mutex := &sync.Mutex{}
+	ops := 0
+	doneC := make(chan struct{})
+	go run(context.Background(), func(data []byte) {
+		mutex.Lock()
+		ops++
+		mutex.Unlock()
+		if data[len(data)-1] == '$' {
+			doneC <- struct{}{}
+		}
+	}, p)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tty.Write(frame)
+		tty.Write([]byte("$"))
+		<-doneC
+	}
+	b.StopTimer()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	b.ReportMetric(float64(ops)/float64(b.N), "relay-ops/redraw")
+}
+
+// BenchmarkRedrawRun measures the relay ops of a redraw without coalescing.
+func BenchmarkRedrawRun(b *testing.B) {
+	benchmarkRedraw(b, Run)
+}
+
+// BenchmarkRedrawCoalesced measures the relay ops of a redraw coalesced within
+// the host window.
+func BenchmarkRedrawCoalesced(b *testing.B) {
+	benchmarkRedraw(b, coalesced)
+}
+
+// BenchmarkKeystrokeCoalesced measures the latency of a keystroke echo
+// relayed through a pty, which must stay well under the window.
+func BenchmarkKeystrokeCoalesced(b *testing.B) {
+	p, tty, err := pty.Open()
+	if err != nil {
+		b.Skipf("No pseudo-terminal available: %v", err)
+	}
+	defer p.Close()
+	defer tty.Close()
+
+	doneC := make(chan struct{})
+	go coalesced(context.Background(), func(data []byte) {
+		doneC <- struct{}{}
+	}, p)
+
+	var latency time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		tty.Write([]byte("a"))
+		<-doneC
+		latency += time.Since(start)
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(latency.Microseconds())/float64(b.N), "us/echo")
+	b.ReportMetric(float64(window.Microseconds()), "us-window")
+}
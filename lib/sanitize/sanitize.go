@@ -0,0 +1,420 @@
+package sanitize
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// Class identifies a class of escape sequences that can be allowed through
+// the filter. Sequences not belonging to any class (plain CSI cursor, color
+// and mode sequences, simple ESC sequences) are always passed through.
+type Class string
+
+const (
+	// ClsTitle OSC 0, 1 and 2 window and icon title changes.
+	ClsTitle Class = "title"
+	// ClsHyperlink OSC 8 hyperlinks.
+	ClsHyperlink Class = "hyperlink"
+	// ClsClipboard OSC 52 clipboard reads and writes.
+	ClsClipboard Class = "clipboard"
+	// ClsOSC any other OSC sequence.
+	ClsOSC Class = "osc"
+	// ClsDCS device control strings.
+	ClsDCS Class = "dcs"
+	// ClsAPC application program commands.
+	ClsAPC Class = "apc"
+	// ClsPM privacy messages.
+	ClsPM Class = "pm"
+	// ClsSOS start of string sequences.
+	ClsSOS Class = "sos"
+	// ClsWindow CSI t window manipulations and reports.
+	ClsWindow Class = "window"
+	// ClsScrollback CSI 3 J scrollback erasure.
+	ClsScrollback Class = "scrollback"
+	// ClsReset ESC c full terminal reset.
+	ClsReset Class = "reset"
+)
+
+// Classes lists all the known classes.
+var Classes = []Class{
+	ClsTitle, ClsHyperlink, ClsClipboard, ClsOSC, ClsDCS, ClsAPC, ClsPM,
+	ClsSOS, ClsWindow, ClsScrollback, ClsReset,
+}
+
+// ParseClasses parses a comma-separated list of classes.
+func ParseClasses(
+	list string,
+) ([]Class, error) {
+	classes := []Class{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, c := range Classes {
+			if Class(name) == c {
+				classes = append(classes, c)
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.Trace(
+				errors.Newf("Unknown escape sequence class: %s", name),
+			)
+		}
+	}
+	return classes, nil
+}
+
+const (
+	esc = 0x1b
+	bel = 0x07
+	can = 0x18
+	sub = 0x1a
+
+	// c1Start and c1End delimit the 8-bit C1 controls, each equivalent to
+	// ESC followed by the control minus 0x40 (0x9b is ESC [, 0x9d ESC ]).
+	// They are sent as is or UTF-8 encoded (preceded by utf8C1).
+	c1Start = 0x80
+	c1End   = 0x9f
+	// st is the 8-bit C1 string terminator (ESC \).
+	st = 0x9c
+	// utf8C1 is the first byte of the UTF-8 encoding of the C1 controls.
+	utf8C1 = 0xc2
+
+	// maxCSI is the maximum length of a CSI sequence after which it is
+	// considered malformed and dropped.
+	maxCSI = 256
+	// maxOSCCode is the maximum length of an OSC code.
+	maxOSCCode = 16
+)
+
+type state int
+
+const (
+	stGround state = iota
+	stUTF8C1
+	stEsc
+	stEscInter
+	stCSI
+	stCSIDrop
+	stOSCCode
+	stString
+	stStringUTF8C1
+	stStringEsc
+)
+
+// Filter is a streaming filter stripping escape sequences that can be used by
+// an untrusted source to manipulate a terminal (clipboard access, title
+// changes, device control strings, ...). Sequences introduced by ESC or by
+// the equivalent 8-bit C1 controls (raw or UTF-8 encoded) are filtered alike
+// and sequences split across writes are handled. It is thread-safe.
+type Filter struct {
+	allow map[Class]bool
+
+	state state
+	// buf holds the sequence being parsed until its class is known.
+	buf []byte
+	// intro is the length of the introducer of the sequence in buf (2 for
+	// ESC [, 1 for the raw C1 CSI).
+	intro int
+	// cont is the number of UTF-8 continuation bytes expected, which are
+	// not C1 controls.
+	cont int
+	// pass indicates whether the current string sequence is passed through.
+	pass bool
+
+	mutex *sync.Mutex
+}
+
+// NewFilter constructs a Filter letting through the sequences of the allowed
+// classes.
+func NewFilter(
+	allow []Class,
+) *Filter {
+	f := &Filter{
+		allow: map[Class]bool{},
+		state: stGround,
+		mutex: &sync.Mutex{},
+	}
+	for _, c := range allow {
+		f.allow[c] = true
+	}
+	return f
+}
+
+// Filter returns the filtered version of data. Bytes belonging to a sequence
+// that is not complete yet are retained until the next call.
+func (f *Filter) Filter(
+	data []byte,
+) []byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		out = f.step(out, b)
+	}
+	return out
+}
+
+// step processes one byte, appending the output to out.
+func (f *Filter) step(
+	out []byte,
+	b byte,
+) []byte {
+	switch f.state {
+	case stGround:
+		switch {
+		case b == esc:
+			f.buf = append(f.buf[:0], b)
+			f.state = stEsc
+			f.cont = 0
+			return out
+		case b == utf8C1:
+			// Held until the next byte tells whether it encodes a C1.
+			f.state = stUTF8C1
+			return out
+		case b >= c1Start && b <= c1End && f.cont == 0:
+			f.buf = append(f.buf[:0], b)
+			return f.escape(out, b-0x40)
+		}
+		f.trackUTF8(b)
+		return append(out, b)
+
+	case stUTF8C1:
+		f.state = stGround
+		if b >= c1Start && b <= c1End {
+			f.buf = append(f.buf[:0], utf8C1, b)
+			return f.escape(out, b-0x40)
+		}
+		out = append(out, utf8C1)
+		f.cont = 1
+		return f.step(out, b)
+
+	case stEsc:
+		f.buf = append(f.buf, b)
+		return f.escape(out, b)
+
+	case stEscInter:
+		switch {
+		case b >= 0x20 && b <= 0x2f:
+			f.buf = append(f.buf, b)
+		case b >= 0x30 && b <= 0x7e:
+			out = append(out, append(f.buf, b)...)
+			f.state = stGround
+		default:
+			// Malformed sequence, drop it and process the byte again.
+			f.state = stGround
+			out = f.step(out, b)
+		}
+		return out
+
+	case stCSI:
+		switch {
+		case b >= 0x40 && b <= 0x7e:
+			f.buf = append(f.buf, b)
+			if f.allowCSI() {
+				out = append(out, f.buf...)
+			}
+			f.state = stGround
+		case b == esc:
+			f.state = stGround
+			out = f.step(out, b)
+		case b == can || b == sub:
+			f.state = stGround
+		default:
+			f.buf = append(f.buf, b)
+			if len(f.buf) > maxCSI {
+				f.state = stCSIDrop
+			}
+		}
+		return out
+
+	case stCSIDrop:
+		switch {
+		case b >= 0x40 && b <= 0x7e, b == can, b == sub:
+			f.state = stGround
+		case b == esc:
+			f.state = stGround
+			out = f.step(out, b)
+		}
+		return out
+
+	case stOSCCode:
+		switch {
+		case b >= '0' && b <= '9' && len(f.buf) < f.intro+maxOSCCode:
+			f.buf = append(f.buf, b)
+		case b == can || b == sub:
+			f.state = stGround
+		default:
+			out = f.startString(out, oscClass(string(f.buf[f.intro:])))
+			return f.step(out, b)
+		}
+		return out
+
+	case stString:
+		switch {
+		case b == bel:
+			if f.pass {
+				out = append(out, b)
+			}
+			f.state = stGround
+		case b == esc:
+			f.state = stStringEsc
+		case b == can || b == sub:
+			f.state = stGround
+		case b == utf8C1:
+			f.state = stStringUTF8C1
+		case b == st && f.cont == 0:
+			if f.pass {
+				out = append(out, b)
+			}
+			f.state = stGround
+		default:
+			f.trackUTF8(b)
+			if f.pass {
+				out = append(out, b)
+			}
+		}
+		return out
+
+	case stStringUTF8C1:
+		if b == st {
+			if f.pass {
+				out = append(out, utf8C1, b)
+			}
+			f.state = stGround
+			return out
+		}
+		if f.pass {
+			out = append(out, utf8C1)
+		}
+		f.cont = 1
+		f.state = stString
+		return f.step(out, b)
+
+	case stStringEsc:
+		if b == '\\' {
+			if f.pass {
+				out = append(out, esc, b)
+			}
+			f.state = stGround
+			return out
+		}
+		// An ESC not followed by `\` aborts the string and starts a new
+		// sequence.
+		if f.pass {
+			out = append(out, esc, '\\')
+		}
+		f.buf = append(f.buf[:0], esc)
+		f.state = stEsc
+		return f.step(out, b)
+	}
+
+	return out
+}
+
+// escape dispatches the sequence introduced by ESC followed by b, held in buf
+// along with its introducer (ESC b or the equivalent C1 control).
+func (f *Filter) escape(
+	out []byte,
+	b byte,
+) []byte {
+	f.intro = len(f.buf)
+	switch {
+	case b == '[':
+		f.state = stCSI
+	case b == ']':
+		f.state = stOSCCode
+	case b == 'P':
+		out = f.startString(out, ClsDCS)
+	case b == '_':
+		out = f.startString(out, ClsAPC)
+	case b == '^':
+		out = f.startString(out, ClsPM)
+	case b == 'X':
+		out = f.startString(out, ClsSOS)
+	case b == 'c':
+		if f.allow[ClsReset] {
+			out = append(out, f.buf...)
+		}
+		f.state = stGround
+	case b >= 0x20 && b <= 0x2f:
+		f.state = stEscInter
+	case b == esc:
+		// Restart the sequence, dropping the lone ESC.
+		f.buf = append(f.buf[:0], b)
+		f.state = stEsc
+	case b == can || b == sub:
+		f.state = stGround
+	default:
+		out = append(out, f.buf...)
+		f.state = stGround
+	}
+	return out
+}
+
+// trackUTF8 updates the number of UTF-8 continuation bytes expected after b.
+func (f *Filter) trackUTF8(
+	b byte,
+) {
+	switch {
+	case b >= 0x80 && b <= 0xbf && f.cont > 0:
+		f.cont--
+	case b >= 0xc2 && b <= 0xdf:
+		f.cont = 1
+	case b >= 0xe0 && b <= 0xef:
+		f.cont = 2
+	case b >= 0xf0 && b <= 0xf4:
+		f.cont = 3
+	default:
+		f.cont = 0
+	}
+}
+
+// startString transitions to the string state for a sequence of the given
+// class, emitting the introducer held in buf if the sequence is allowed.
+func (f *Filter) startString(
+	out []byte,
+	class Class,
+) []byte {
+	f.pass = f.allow[class]
+	f.state = stString
+	f.cont = 0
+	if f.pass {
+		out = append(out, f.buf...)
+	}
+	return out
+}
+
+// allowCSI returns whether the CSI sequence in buf is passed through.
+func (f *Filter) allowCSI() bool {
+	final := f.buf[len(f.buf)-1]
+	params := string(f.buf[f.intro : len(f.buf)-1])
+	switch {
+	case final == 't':
+		return f.allow[ClsWindow]
+	case final == 'J' && params == "3":
+		return f.allow[ClsScrollback]
+	}
+	return true
+}
+
+// oscClass returns the class of an OSC sequence given its code.
+func oscClass(
+	code string,
+) Class {
+	switch code {
+	case "0", "1", "2":
+		return ClsTitle
+	case "8":
+		return ClsHyperlink
+	case "52":
+		return ClsClipboard
+	}
+	return ClsOSC
+}
@@ -0,0 +1,187 @@
+package sanitize
+
+import (
+	"strings"
+	"testing"
+)
+
+// introducers are the forms of the introducer of a sequence, given the
+// character following ESC: ESC itself, the raw 8-bit C1 control and its UTF-8
+// encoding.
+var introducers = []struct {
+	name  string
+	intro func(byte) string
+}{
+	{"7-bit", func(b byte) string { return "\x1b" + string(b) }},
+	{"8-bit", func(b byte) string { return string([]byte{b + 0x40}) }},
+	{"UTF-8", func(b byte) string { return string([]byte{0xc2, b + 0x40}) }},
+}
+
+// terminators are the forms of the string terminator.
+var terminators = []struct {
+	name string
+	st   string
+}{
+	{"BEL", "\x07"},
+	{"ST", "\x1b\\"},
+	{"8-bit ST", "\x9c"},
+	{"UTF-8 ST", "\u009c"},
+}
+
+// filterSplit filters data with f, one byte per call.
+func filterSplit(
+	f *Filter,
+	data string,
+) string {
+	out := ""
+	for i := 0; i < len(data); i++ {
+		out += string(f.Filter([]byte{data[i]}))
+	}
+	return out
+}
+
+func TestFilterSequences(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		class Class
+		// seq returns the sequence given its introducer and the string
+		// terminator.
+		seq func(intro func(byte) string, st string) string
+		// text is the text of the sequence remaining once stripped.
+		text string
+	}{
+		{"title", ClsTitle, func(i func(byte) string, st string) string {
+			return i(']') + "0;pwned" + st
+		}, ""},
+		{"icon title", ClsTitle, func(i func(byte) string, st string) string {
+			return i(']') + "1;pwned" + st
+		}, ""},
+		{"hyperlink", ClsHyperlink, func(i func(byte) string, st string) string {
+			return i(']') + "8;;https://example.com" + st + "link" +
+				i(']') + "8;;" + st
+		}, "link"},
+		{"clipboard", ClsClipboard, func(i func(byte) string, st string) string {
+			return i(']') + "52;c;aGk=" + st
+		}, ""},
+		{"other osc", ClsOSC, func(i func(byte) string, st string) string {
+			return i(']') + "4;1;rgb:ff/00/00" + st
+		}, ""},
+		{"dcs", ClsDCS, func(i func(byte) string, st string) string {
+			return i('P') + "$q\"p" + st
+		}, ""},
+		{"apc", ClsAPC, func(i func(byte) string, st string) string {
+			return i('_') + "Gf=100;AAAA" + st
+		}, ""},
+		{"pm", ClsPM, func(i func(byte) string, st string) string {
+			return i('^') + "private" + st
+		}, ""},
+		{"sos", ClsSOS, func(i func(byte) string, st string) string {
+			return i('X') + "string" + st
+		}, ""},
+		{"window", ClsWindow, func(i func(byte) string, st string) string {
+			return i('[') + "8;100;100t"
+		}, ""},
+		{"scrollback", ClsScrollback, func(i func(byte) string, st string) string {
+			return i('[') + "3J"
+		}, ""},
+		{"reset", ClsReset, func(i func(byte) string, st string) string {
+			return "\x1bc"
+		}, ""},
+	} {
+		for _, in := range introducers {
+			for _, term := range terminators {
+				name := tc.name + "/" + in.name + "/" + term.name
+				seq := tc.seq(in.intro, term.st)
+				data := "a" + seq + "b"
+				stripped := "a" + tc.text + "b"
+
+				// Sequences not allowed are stripped.
+				if got := string(NewFilter(nil).Filter([]byte(data))); got != stripped {
+					t.Errorf("%s: got %q, want %q", name, got, stripped)
+				}
+				if got := filterSplit(NewFilter(nil), data); got != stripped {
+					t.Errorf("%s split: got %q, want %q", name, got, stripped)
+				}
+
+				// Allowed sequences are passed through as is.
+				allow := []Class{tc.class}
+				if got := string(NewFilter(allow).Filter([]byte(data))); got != data {
+					t.Errorf("%s allowed: got %q, want %q", name, got, data)
+				}
+				if got := filterSplit(NewFilter(allow), data); got != data {
+					t.Errorf("%s allowed split: got %q, want %q", name, got, data)
+				}
+			}
+		}
+	}
+}
+
+func TestFilterPassesThrough(t *testing.T) {
+	for _, data := range []string{
+		"plain text\r\n",
+		"\x1b[1;31mred\x1b[0m",
+		"\x9b1;31mred\x9b0m",
+		"\u009b1;31mred\u009b0m",
+		"\x1b[2J\x1b[H",
+		"\x1b[?1049h\x1b[?25l",
+		"\x1b7\x1b8\x1bM",
+		"\x1b(B",
+		// Text whose UTF-8 encoding contains bytes in the C1 range.
+		"café ✓ “quoted”  ¿ \U0001f680",
+	} {
+		if got := string(NewFilter(nil).Filter([]byte(data))); got != data {
+			t.Errorf("%q: got %q", data, got)
+		}
+		if got := filterSplit(NewFilter(nil), data); got != data {
+			t.Errorf("%q split: got %q", data, got)
+		}
+	}
+}
+
+func TestFilterUTF8InStrings(t *testing.T) {
+	// The UTF-8 encodings of ✓ and ❝ contain 0x9c and 0x9d, which must not
+	// end or start a sequence.
+	title := "\x1b]0;✓ ❝ done\x07"
+	data := title + "ok"
+	if got := string(NewFilter(nil).Filter([]byte(data))); got != "ok" {
+		t.Errorf("Stripped: got %q, want %q", got, "ok")
+	}
+	allow := []Class{ClsTitle}
+	if got := filterSplit(NewFilter(allow), data); got != data {
+		t.Errorf("Allowed: got %q, want %q", got, data)
+	}
+}
+
+func TestFilterAbortedSequences(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want string
+	}{
+		// CAN and SUB abort sequences.
+		{"\x1b]52;c;aGk=\x18ok", "ok"},
+		{"\x9d52;c;aGk=\x1aok", "ok"},
+		{"\x1b[31\x18ok", "ok"},
+		// An ESC in a string aborts it and starts a new sequence.
+		{"\x1b]0;title\x1b[1mok", "\x1b[1mok"},
+		// Overlong CSI sequences are dropped.
+		{"\x1b[" + strings.Repeat("1;", maxCSI) + "mok", "ok"},
+	} {
+		if got := filterSplit(NewFilter(nil), tc.data); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestParseClasses(t *testing.T) {
+	classes, err := ParseClasses("title, hyperlink,,clipboard")
+	if err != nil {
+		t.Fatalf("ParseClasses: %v", err)
+	}
+	if len(classes) != 3 || classes[0] != ClsTitle ||
+		classes[1] != ClsHyperlink || classes[2] != ClsClipboard {
+		t.Errorf("ParseClasses: got %v", classes)
+	}
+	if _, err := ParseClasses("title,bogus"); err == nil {
+		t.Errorf("Unknown class accepted")
+	}
+}
@@ -0,0 +1,89 @@
+package screen
+
+import (
+	"strconv"
+	"strings"
+)
+
+// pen is the graphic rendition applied to the characters written.
+type pen struct {
+	// attrs are the SGR attributes set (1 to 9).
+	attrs [10]bool
+	// fg and bg are the SGR parameters of the foreground and background
+	// colors, or "" for the default colors.
+	fg string
+	bg string
+}
+
+// apply applies the parameters of an SGR sequence.
+func (p *pen) apply(
+	args []int,
+) {
+	if len(args) == 0 {
+		*p = pen{}
+		return
+	}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a <= 0:
+			*p = pen{}
+		case a < 10:
+			p.attrs[a] = true
+		case a == 21 || a == 22:
+			p.attrs[1], p.attrs[2] = false, false
+		case a >= 23 && a <= 29:
+			p.attrs[a-20] = false
+		case a >= 30 && a <= 37 || a >= 90 && a <= 97:
+			p.fg = strconv.Itoa(a)
+		case a == 39:
+			p.fg = ""
+		case a >= 40 && a <= 47 || a >= 100 && a <= 107:
+			p.bg = strconv.Itoa(a)
+		case a == 49:
+			p.bg = ""
+		case a == 38 || a == 48:
+			// Extended colors: 38;5;<n> or 38;2;<r>;<g>;<b>.
+			n := 0
+			if i+1 < len(args) && args[i+1] == 5 {
+				n = 2
+			} else if i+1 < len(args) && args[i+1] == 2 {
+				n = 4
+			}
+			if n == 0 || i+n >= len(args) {
+				return
+			}
+			parts := []string{}
+			for _, v := range args[i : i+n+1] {
+				if v < 0 {
+					v = 0
+				}
+				parts = append(parts, strconv.Itoa(v))
+			}
+			if a == 38 {
+				p.fg = strings.Join(parts, ";")
+			} else {
+				p.bg = strings.Join(parts, ";")
+			}
+			i += n
+		}
+	}
+}
+
+// String returns the SGR parameters of the pen ("" for the default
+// rendition).
+func (p pen) String() string {
+	params := []string{}
+	for a, set := range p.attrs {
+		if set {
+			params = append(params, strconv.Itoa(a))
+		}
+	}
+	if p.fg != "" {
+		params = append(params, p.fg)
+	}
+	if p.bg != "" {
+		params = append(params, p.bg)
+	}
+	return strings.Join(params, ";")
+}
@@ -0,0 +1,736 @@
+package screen
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	esc = 0x1b
+
+	// maxParams is the maximum length of the parameters of a CSI sequence
+	// after which the sequence is ignored.
+	maxParams = 256
+)
+
+// Cell is a character of the screen along with its graphic rendition,
+// expressed as SGR parameters ("" for the default rendition).
+type Cell struct {
+	Rune rune
+	Pen  string
+}
+
+// blank is the cell of erased positions.
+var blank = Cell{Rune: ' '}
+
+// parser states.
+type state int
+
+const (
+	stGround state = iota
+	stEscape
+	stEscapeSkip
+	stCSI
+	stString
+	stStringEscape
+)
+
+// Screen is a minimal terminal emulator maintaining the screen of a terminal
+// and the lines scrolled off its top (the scrollback) from the output written
+// to it. It interprets the sequences needed to follow the output of shells
+// and full screen applications (cursor movement, erasure, scroll regions,
+// insertions and deletions, graphic rendition and the alternate screen);
+// other sequences are ignored. Characters are considered one column wide. It
+// is thread-safe.
+type Screen struct {
+	cols int
+	rows int
+
+	// main and alt are the lines of the main and alternate screens, lines
+	// being the active one (alt if altScreen is set).
+	main      [][]Cell
+	alt       [][]Cell
+	lines     [][]Cell
+	altScreen bool
+	// scrollback holds the lines scrolled off the top of the main screen,
+	// oldest first, up to max lines.
+	scrollback [][]Cell
+	max        int
+
+	x        int
+	y        int
+	wrapNext bool
+	hidden   bool
+	pen      pen
+	top      int
+	bottom   int
+
+	savedX   int
+	savedY   int
+	savedPen pen
+
+	state  state
+	params []byte
+	utf8   []byte
+
+	mutex *sync.Mutex
+}
+
+// New constructs a Screen of the specified size keeping up to max lines of
+// scrollback.
+func New(
+	cols int,
+	rows int,
+	max int,
+) *Screen {
+	s := &Screen{
+		max:   max,
+		mutex: &sync.Mutex{},
+	}
+	s.cols, s.rows = cols, rows
+	s.main = blankLines(cols, rows)
+	s.alt = blankLines(cols, rows)
+	s.lines = s.main
+	s.bottom = rows - 1
+	return s
+}
+
+// blankLines returns n blank lines of the specified width.
+func blankLines(
+	cols int,
+	n int,
+) [][]Cell {
+	lines := make([][]Cell, n)
+	for i := range lines {
+		lines[i] = blankLine(cols)
+	}
+	return lines
+}
+
+// blankLine returns a blank line of the specified width.
+func blankLine(
+	cols int,
+) []Cell {
+	line := make([]Cell, cols)
+	for i := range line {
+		line[i] = blank
+	}
+	return line
+}
+
+// Write interprets the output of an application. It returns the number of
+// lines added to the scrollback (possibly dropping older lines).
+func (s *Screen) Write(
+	data []byte,
+) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pushed := 0
+	for _, b := range data {
+		pushed += s.feed(b)
+	}
+	return pushed
+}
+
+// feed interprets a byte of output and returns the number of lines pushed to
+// the scrollback.
+func (s *Screen) feed(
+	b byte,
+) int {
+	switch s.state {
+	case stEscape:
+		return s.escape(b)
+	case stEscapeSkip:
+		s.state = stGround
+		return 0
+	case stCSI:
+		switch {
+		case b >= 0x40 && b <= 0x7e:
+			s.state = stGround
+			if len(s.params) <= maxParams {
+				return s.csi(b, string(s.params))
+			}
+		case b >= 0x30 && b <= 0x3f:
+			s.params = append(s.params, b)
+		case b >= 0x20 && b <= 0x2f:
+			// Intermediate bytes are ignored.
+		case b == esc:
+			s.state = stEscape
+		default:
+			return s.control(b)
+		}
+		return 0
+	case stString:
+		switch b {
+		case 0x07:
+			s.state = stGround
+		case esc:
+			s.state = stStringEscape
+		}
+		return 0
+	case stStringEscape:
+		// Strings are terminated by ST (ESC \).
+		if b == '\\' {
+			s.state = stGround
+		} else {
+			s.state = stString
+		}
+		return 0
+	}
+
+	if b < 0x20 || b == 0x7f {
+		s.utf8 = s.utf8[:0]
+		return s.control(b)
+	}
+	s.utf8 = append(s.utf8, b)
+	if !utf8.FullRune(s.utf8) {
+		return 0
+	}
+	r, _ := utf8.DecodeRune(s.utf8)
+	s.utf8 = s.utf8[:0]
+	return s.put(r)
+}
+
+// control interprets a control character.
+func (s *Screen) control(
+	b byte,
+) int {
+	switch b {
+	case '\r':
+		s.x = 0
+		s.wrapNext = false
+	case '\n', '\v', '\f':
+		s.wrapNext = false
+		return s.index()
+	case '\b':
+		if s.x > 0 {
+			s.x--
+		}
+		s.wrapNext = false
+	case '\t':
+		s.x = (s.x/8 + 1) * 8
+		if s.x >= s.cols {
+			s.x = s.cols - 1
+		}
+	case esc:
+		s.state = stEscape
+	}
+	return 0
+}
+
+// escape interprets the byte following an ESC.
+func (s *Screen) escape(
+	b byte,
+) int {
+	s.state = stGround
+	switch b {
+	case '[':
+		s.state = stCSI
+		s.params = s.params[:0]
+	case ']', 'P', 'X', '^', '_':
+		s.state = stString
+	case '(', ')', '*', '+', '#', '%':
+		s.state = stEscapeSkip
+	case '7':
+		s.save()
+	case '8':
+		s.restore()
+	case 'D':
+		return s.index()
+	case 'E':
+		s.x = 0
+		return s.index()
+	case 'M':
+		s.reverseIndex()
+	case 'c':
+		s.reset()
+	}
+	return 0
+}
+
+// put writes a character at the cursor position.
+func (s *Screen) put(
+	r rune,
+) int {
+	pushed := 0
+	if s.wrapNext {
+		s.x = 0
+		s.wrapNext = false
+		pushed = s.index()
+	}
+	s.lines[s.y][s.x] = Cell{Rune: r, Pen: s.pen.String()}
+	if s.x == s.cols-1 {
+		s.wrapNext = true
+	} else {
+		s.x++
+	}
+	return pushed
+}
+
+// index moves the cursor down, scrolling the scroll region up if the cursor
+// is on its last line.
+func (s *Screen) index() int {
+	if s.y == s.bottom {
+		return s.scrollUp(s.top, s.bottom, 1)
+	}
+	if s.y < s.rows-1 {
+		s.y++
+	}
+	return 0
+}
+
+// reverseIndex moves the cursor up, scrolling the scroll region down if the
+// cursor is on its first line.
+func (s *Screen) reverseIndex() {
+	if s.y == s.top {
+		s.scrollDown(s.top, s.bottom, 1)
+	} else if s.y > 0 {
+		s.y--
+	}
+	s.wrapNext = false
+}
+
+// scrollUp scrolls the lines between top and bottom up by n lines. Lines
+// scrolled off the top of the main screen are pushed to the scrollback.
+func (s *Screen) scrollUp(
+	top int,
+	bottom int,
+	n int,
+) int {
+	if n > bottom-top+1 {
+		n = bottom - top + 1
+	}
+	pushed := 0
+	if top == 0 && !s.altScreen {
+		for _, line := range s.lines[:n] {
+			s.push(line)
+			pushed++
+		}
+	}
+	copy(s.lines[top:bottom+1], s.lines[top+n:bottom+1])
+	for i := bottom - n + 1; i <= bottom; i++ {
+		s.lines[i] = blankLine(s.cols)
+	}
+	return pushed
+}
+
+// scrollDown scrolls the lines between top and bottom down by n lines.
+func (s *Screen) scrollDown(
+	top int,
+	bottom int,
+	n int,
+) {
+	if n > bottom-top+1 {
+		n = bottom - top + 1
+	}
+	copy(s.lines[top+n:bottom+1], s.lines[top:bottom+1-n])
+	for i := top; i < top+n; i++ {
+		s.lines[i] = blankLine(s.cols)
+	}
+}
+
+// push adds a line to the scrollback, dropping the oldest line if full.
+func (s *Screen) push(
+	line []Cell,
+) {
+	if s.max <= 0 {
+		return
+	}
+	s.scrollback = append(s.scrollback, line)
+	if len(s.scrollback) > s.max {
+		// The dropped lines are reclaimed as append reallocates.
+		s.scrollback = s.scrollback[1:]
+	}
+}
+
+// save saves the cursor position and graphic rendition.
+func (s *Screen) save() {
+	s.savedX, s.savedY, s.savedPen = s.x, s.y, s.pen
+}
+
+// restore restores the saved cursor position and graphic rendition.
+func (s *Screen) restore() {
+	s.x, s.y, s.pen = s.savedX, s.savedY, s.savedPen
+	s.clamp()
+}
+
+// reset resets the screen to its initial state, keeping the scrollback.
+func (s *Screen) reset() {
+	s.main = blankLines(s.cols, s.rows)
+	s.alt = blankLines(s.cols, s.rows)
+	s.lines = s.main
+	s.altScreen = false
+	s.x, s.y, s.wrapNext, s.hidden = 0, 0, false, false
+	s.pen = pen{}
+	s.top, s.bottom = 0, s.rows-1
+}
+
+// clamp keeps the cursor within the screen.
+func (s *Screen) clamp() {
+	if s.x >= s.cols {
+		s.x = s.cols - 1
+	}
+	if s.y >= s.rows {
+		s.y = s.rows - 1
+	}
+	if s.x < 0 {
+		s.x = 0
+	}
+	if s.y < 0 {
+		s.y = 0
+	}
+	s.wrapNext = false
+}
+
+// csi interprets a CSI sequence.
+func (s *Screen) csi(
+	final byte,
+	params string,
+) int {
+	if strings.HasPrefix(params, "?") {
+		if final == 'h' || final == 'l' {
+			s.privateMode(params[1:], final == 'h')
+		}
+		return 0
+	}
+	if len(params) > 0 && (params[0] < '0' || params[0] > ';') {
+		// Other private sequences (`CSI > ...`, `CSI = ...`) are ignored.
+		return 0
+	}
+
+	args := parseParams(params)
+	n := arg(args, 0, 1)
+	if n == 0 {
+		n = 1
+	}
+
+	switch final {
+	case 'A':
+		s.y -= n
+		if s.y < s.top && s.y+n >= s.top {
+			s.y = s.top
+		}
+		s.clamp()
+	case 'B', 'e':
+		s.y += n
+		if s.y > s.bottom && s.y-n <= s.bottom {
+			s.y = s.bottom
+		}
+		s.clamp()
+	case 'C', 'a':
+		s.x += n
+		s.clamp()
+	case 'D':
+		s.x -= n
+		s.clamp()
+	case 'E':
+		s.x, s.y = 0, s.y+n
+		s.clamp()
+	case 'F':
+		s.x, s.y = 0, s.y-n
+		s.clamp()
+	case 'G', '`':
+		s.x = n - 1
+		s.clamp()
+	case 'd':
+		s.y = n - 1
+		s.clamp()
+	case 'H', 'f':
+		s.y, s.x = arg(args, 0, 1)-1, arg(args, 1, 1)-1
+		s.clamp()
+	case 'J':
+		s.eraseDisplay(arg(args, 0, 0))
+	case 'K':
+		s.eraseLine(arg(args, 0, 0))
+	case 'X':
+		s.erase(s.y, s.x, s.x+n)
+	case '@':
+		line := s.lines[s.y]
+		if n > s.cols-s.x {
+			n = s.cols - s.x
+		}
+		copy(line[s.x+n:], line[s.x:s.cols-n])
+		s.erase(s.y, s.x, s.x+n)
+	case 'P':
+		line := s.lines[s.y]
+		if n > s.cols-s.x {
+			n = s.cols - s.x
+		}
+		copy(line[s.x:], line[s.x+n:])
+		s.erase(s.y, s.cols-n, s.cols)
+	case 'L':
+		if s.y >= s.top && s.y <= s.bottom {
+			s.scrollDown(s.y, s.bottom, n)
+		}
+	case 'M':
+		if s.y >= s.top && s.y <= s.bottom {
+			s.deleteLines(s.y, n)
+		}
+	case 'S':
+		return s.scrollUp(s.top, s.bottom, n)
+	case 'T':
+		s.scrollDown(s.top, s.bottom, n)
+	case 'm':
+		s.pen.apply(args)
+	case 'r':
+		top, bottom := arg(args, 0, 1)-1, arg(args, 1, s.rows)-1
+		if bottom < 0 || bottom >= s.rows {
+			bottom = s.rows - 1
+		}
+		if top < 0 {
+			top = 0
+		}
+		if top >= bottom {
+			// Invalid scroll regions are ignored.
+			return 0
+		}
+		s.top, s.bottom = top, bottom
+		s.x, s.y, s.wrapNext = 0, 0, false
+	case 's':
+		s.save()
+	case 'u':
+		s.restore()
+	}
+	return 0
+}
+
+// deleteLines deletes n lines at line y within the scroll region, without
+// pushing them to the scrollback.
+func (s *Screen) deleteLines(
+	y int,
+	n int,
+) {
+	if n > s.bottom-y+1 {
+		n = s.bottom - y + 1
+	}
+	copy(s.lines[y:s.bottom+1], s.lines[y+n:s.bottom+1])
+	for i := s.bottom - n + 1; i <= s.bottom; i++ {
+		s.lines[i] = blankLine(s.cols)
+	}
+}
+
+// privateMode sets or resets private modes (DECSET/DECRST), handling the
+// alternate screen (47, 1047, 1049) and cursor visibility (25).
+func (s *Screen) privateMode(
+	params string,
+	set bool,
+) {
+	for _, p := range strings.Split(params, ";") {
+		switch p {
+		case "25":
+			s.hidden = !set
+		case "47", "1047", "1049":
+			if set == s.altScreen {
+				continue
+			}
+			s.altScreen = set
+			if set {
+				if p == "1049" {
+					s.save()
+				}
+				s.alt = blankLines(s.cols, s.rows)
+				s.lines = s.alt
+			} else {
+				s.lines = s.main
+				if p == "1049" {
+					s.restore()
+				}
+			}
+		}
+	}
+}
+
+// eraseDisplay erases (part of) the display (ED).
+func (s *Screen) eraseDisplay(
+	mode int,
+) {
+	switch mode {
+	case 0:
+		s.erase(s.y, s.x, s.cols)
+		for y := s.y + 1; y < s.rows; y++ {
+			s.lines[y] = blankLine(s.cols)
+		}
+	case 1:
+		for y := 0; y < s.y; y++ {
+			s.lines[y] = blankLine(s.cols)
+		}
+		s.erase(s.y, 0, s.x+1)
+	case 2:
+		for y := 0; y < s.rows; y++ {
+			s.lines[y] = blankLine(s.cols)
+		}
+	case 3:
+		s.scrollback = nil
+	}
+}
+
+// eraseLine erases (part of) the cursor line (EL).
+func (s *Screen) eraseLine(
+	mode int,
+) {
+	switch mode {
+	case 0:
+		s.erase(s.y, s.x, s.cols)
+	case 1:
+		s.erase(s.y, 0, s.x+1)
+	case 2:
+		s.erase(s.y, 0, s.cols)
+	}
+}
+
+// erase erases the cells of line y from column from to column to (excluded).
+func (s *Screen) erase(
+	y int,
+	from int,
+	to int,
+) {
+	if to > s.cols {
+		to = s.cols
+	}
+	for x := from; x < to; x++ {
+		s.lines[y][x] = blank
+	}
+}
+
+// parseParams parses the numeric parameters of a CSI sequence. Missing
+// parameters are returned as -1.
+func parseParams(
+	params string,
+) []int {
+	if params == "" {
+		return nil
+	}
+	args := []int{}
+	for _, p := range strings.Split(params, ";") {
+		if p == "" {
+			args = append(args, -1)
+			continue
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			n = -1
+		}
+		args = append(args, n)
+	}
+	return args
+}
+
+// arg returns the parameter at index i or def if it is missing.
+func arg(
+	args []int,
+	i int,
+	def int,
+) int {
+	if i >= len(args) || args[i] < 0 {
+		return def
+	}
+	return args[i]
+}
+
+// Resize resizes the screen. When the screen shrinks, lines above the cursor
+// are pushed to the scrollback to keep the cursor line visible.
+func (s *Screen) Resize(
+	cols int,
+	rows int,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if cols <= 0 || rows <= 0 || (cols == s.cols && rows == s.rows) {
+		return
+	}
+
+	resize := func(lines [][]Cell, push bool) [][]Cell {
+		if excess := s.y + 1 - rows; excess > 0 {
+			for _, line := range lines[:excess] {
+				if push {
+					s.push(line)
+				}
+			}
+			lines = lines[excess:]
+		}
+		if len(lines) > rows {
+			lines = lines[:rows]
+		}
+		for len(lines) < rows {
+			lines = append(lines, blankLine(cols))
+		}
+		for i, line := range lines {
+			if len(line) > cols {
+				lines[i] = line[:cols]
+			} else if len(line) < cols {
+				lines[i] = append(line, blankLine(cols-len(line))...)
+			}
+		}
+		return lines
+	}
+	s.main = resize(s.main, true)
+	s.alt = resize(s.alt, false)
+	if excess := s.y + 1 - rows; excess > 0 {
+		s.y -= excess
+	}
+	s.lines = s.main
+	if s.altScreen {
+		s.lines = s.alt
+	}
+	s.cols, s.rows = cols, rows
+	s.top, s.bottom = 0, rows-1
+	s.clamp()
+}
+
+// Size returns the size of the screen.
+func (s *Screen) Size() (int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cols, s.rows
+}
+
+// Scrollback returns the number of lines of the scrollback.
+func (s *Screen) Scrollback() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.scrollback)
+}
+
+// View returns n lines ending offset lines above the last line of the screen
+// (an offset of 0 shows the bottom of the screen), lines of the scrollback
+// preceding the lines of the screen. Fewer lines are returned if there are
+// not enough.
+func (s *Screen) View(
+	offset int,
+	n int,
+) [][]Cell {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	total := len(s.scrollback) + len(s.lines)
+	end := total - offset
+	if end > total {
+		end = total
+	}
+	start := end - n
+	if start < 0 {
+		start = 0
+	}
+	view := [][]Cell{}
+	for i := start; i < end; i++ {
+		var line []Cell
+		if i < len(s.scrollback) {
+			line = s.scrollback[i]
+		} else {
+			line = s.lines[i-len(s.scrollback)]
+		}
+		view = append(view, append([]Cell{}, line...))
+	}
+	return view
+}
+
+// Cursor returns the position of the cursor on the screen and whether it is
+// visible.
+func (s *Screen) Cursor() (int, int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.x, s.y, !s.hidden
+}
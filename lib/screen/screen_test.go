@@ -0,0 +1,292 @@
+package screen
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// text returns the text of lines, trailing blanks trimmed.
+func text(
+	lines [][]Cell,
+) []string {
+	out := []string{}
+	for _, line := range lines {
+		runes := []rune{}
+		for _, c := range line {
+			runes = append(runes, c.Rune)
+		}
+		out = append(out, strings.TrimRight(string(runes), " "))
+	}
+	return out
+}
+
+// screenText returns the text of the lines of the screen.
+func screenText(
+	s *Screen,
+) []string {
+	_, rows := s.Size()
+	return text(s.View(0, rows))
+}
+
+// scrollbackText returns the text of the lines of the scrollback.
+func scrollbackText(
+	s *Screen,
+) []string {
+	_, rows := s.Size()
+	return text(s.View(rows, s.Scrollback()))
+}
+
+// lines returns the output writing the specified lines from the top of the
+// screen, the cursor left at the end of the last line.
+func lines(
+	l ...string,
+) string {
+	return "\x1b[H" + strings.Join(l, "\r\n")
+}
+
+func TestWrite(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		output     string
+		screen     []string
+		scrollback []string
+		x          int
+		y          int
+	}{
+		{"text", "ab\r\ncd",
+			[]string{"ab", "cd", "", "", ""}, []string{}, 2, 1},
+		{"backspace and tab", "abc\b\bX\tY",
+			[]string{"aXc     Y", "", "", "", ""}, []string{}, 9, 0},
+		{"tab at the last column", "\t\t\tZ",
+			[]string{"         Z", "", "", "", ""}, []string{}, 9, 0},
+		{"utf-8", "café ✓",
+			[]string{"café ✓", "", "", "", ""}, []string{}, 6, 0},
+
+		// Wrapping.
+		{"wrap", "abcdefghijklm",
+			[]string{"abcdefghij", "klm", "", "", ""}, []string{}, 3, 1},
+		{"pending wrap", "abcdefghij",
+			[]string{"abcdefghij", "", "", "", ""}, []string{}, 9, 0},
+		{"pending wrap cleared by CR", "abcdefghij\r\nk",
+			[]string{"abcdefghij", "k", "", "", ""}, []string{}, 1, 1},
+		{"pending wrap cleared by cursor movement", "abcdefghij\x1b[1DX",
+			[]string{"abcdefghXj", "", "", "", ""}, []string{}, 9, 0},
+		{"wrap at the bottom", lines("1", "2", "3", "4", "abcdefghijk"),
+			[]string{"2", "3", "4", "abcdefghij", "k"}, []string{"1"}, 1, 4},
+
+		// Cursor movement.
+		{"cursor position", "\x1b[2;3Hx",
+			[]string{"", "  x", "", "", ""}, []string{}, 3, 1},
+		{"cursor position defaults", "\x1b[3;4H\x1b[Hx",
+			[]string{"x", "", "", "", ""}, []string{}, 1, 0},
+		{"cursor position clamped", "\x1b[99;99Hx",
+			[]string{"", "", "", "", "         x"}, []string{}, 9, 4},
+		{"relative movement", "\x1b[3;3H\x1b[A\x1b[2C\x1b[2Bx\x1b[4Dy",
+			[]string{"", "", "", " y  x", ""}, []string{}, 2, 3},
+		{"relative movement clamped", "\x1b[9A\x1b[9Dx\x1b[9B\x1b[20Cy",
+			[]string{"x", "", "", "", "         y"}, []string{}, 9, 4},
+		{"column and line", "\x1b[4Gx\x1b[3dy",
+			[]string{"   x", "", "    y", "", ""}, []string{}, 5, 2},
+		{"next and previous line", "ab\x1b[2Ec\x1b[Fd",
+			[]string{"ab", "d", "c", "", ""}, []string{}, 1, 1},
+		{"save and restore", "\x1b[2;2H\x1b7\x1b[5;5Hx\x1b8y",
+			[]string{"", " y", "", "", "    x"}, []string{}, 2, 1},
+		{"CSI save and restore", "\x1b[2;2H\x1b[s\x1b[5;5Hx\x1b[uy",
+			[]string{"", " y", "", "", "    x"}, []string{}, 2, 1},
+
+		// Erasure and insertion.
+		{"erase line", "abcdef\x1b[3G\x1b[K",
+			[]string{"ab", "", "", "", ""}, []string{}, 2, 0},
+		{"erase line start", "abcdef\x1b[3G\x1b[1K",
+			[]string{"   def", "", "", "", ""}, []string{}, 2, 0},
+		{"erase display", lines("1", "2", "3") + "\x1b[2;1H\x1b[J",
+			[]string{"1", "", "", "", ""}, []string{}, 0, 1},
+		{"erase characters", "abcdef\x1b[2G\x1b[3X",
+			[]string{"a   ef", "", "", "", ""}, []string{}, 1, 0},
+		{"insert characters", "abcdef\x1b[2G\x1b[2@",
+			[]string{"a  bcdef", "", "", "", ""}, []string{}, 1, 0},
+		{"delete characters", "abcdef\x1b[2G\x1b[2P",
+			[]string{"adef", "", "", "", ""}, []string{}, 1, 0},
+
+		// Scrolling.
+		{"scroll", lines("1", "2", "3", "4", "5") + "\r\n6\r\n7",
+			[]string{"3", "4", "5", "6", "7"}, []string{"1", "2"}, 1, 4},
+		{"scroll up and down", lines("1", "2", "3", "4", "5") + "\x1b[2S\x1b[T",
+			[]string{"", "3", "4", "5", ""}, []string{"1", "2"}, 1, 4},
+		{"scroll region", lines("1", "2", "3", "4", "5") +
+			"\x1b[2;4r\x1b[4;1H\n\n",
+			[]string{"1", "4", "", "", "5"}, []string{}, 0, 3},
+		{"scroll region from the top", lines("1", "2", "3", "4", "5") +
+			"\x1b[1;3r\x1b[3;1H\n",
+			[]string{"2", "3", "", "4", "5"}, []string{"1"}, 0, 2},
+		{"scroll region homes the cursor", "abc\x1b[2;4rx",
+			[]string{"xbc", "", "", "", ""}, []string{}, 1, 0},
+		{"invalid scroll region", lines("1", "2", "3", "4", "5") +
+			"\x1b[4;2r\x1b[5;1H\n",
+			[]string{"2", "3", "4", "5", ""}, []string{"1"}, 0, 4},
+		{"reverse index", lines("1", "2", "3", "4", "5") +
+			"\x1b[2;4r\x1b[2;1H\x1bM",
+			[]string{"1", "", "2", "3", "5"}, []string{}, 0, 1},
+		{"cursor up stops at the scroll region", lines("1", "2", "3", "4", "5") +
+			"\x1b[2;4r\x1b[3;1H\x1b[9Ax",
+			[]string{"1", "x", "3", "4", "5"}, []string{}, 1, 1},
+		{"insert lines", lines("1", "2", "3", "4", "5") +
+			"\x1b[2;4r\x1b[2;1H\x1b[L",
+			[]string{"1", "", "2", "3", "5"}, []string{}, 0, 1},
+		{"delete lines", lines("1", "2", "3", "4", "5") +
+			"\x1b[2;1H\x1b[2M",
+			[]string{"1", "4", "5", "", ""}, []string{}, 0, 1},
+		{"lines outside the scroll region", lines("1", "2", "3", "4", "5") +
+			"\x1b[2;3r\x1b[5;1H\x1b[L\n\n",
+			[]string{"1", "2", "3", "4", "5"}, []string{}, 0, 4},
+
+		// Alternate screen.
+		{"alternate screen", lines("1", "2") + "\x1b[?1049h\x1b[Hvim\r\n\n\n\n\n\n",
+			[]string{"", "", "", "", ""}, []string{}, 0, 4},
+		{"alternate screen left", lines("1", "2") +
+			"\x1b[?1049h\x1b[Hvim\x1b[?1049lx",
+			[]string{"1", "2x", "", "", ""}, []string{}, 2, 1},
+		{"reset", lines("1", "2", "3", "4", "5", "6") + "\x1b[1mx\x1bcy",
+			[]string{"y", "", "", "", ""}, []string{"1"}, 1, 0},
+		{"clear scrollback", lines("1", "2", "3", "4", "5", "6") + "\x1b[3J",
+			[]string{"2", "3", "4", "5", "6"}, []string{}, 1, 4},
+
+		// Sequences ignored.
+		{"strings", "a\x1b]0;title\x07b\x1bPdata\x1b\\c",
+			[]string{"abc", "", "", "", ""}, []string{}, 3, 0},
+		{"charset", "a\x1b(Bb",
+			[]string{"ab", "", "", "", ""}, []string{}, 2, 0},
+		{"private sequences", "a\x1b[>4;1mb\x1b[?2004hc",
+			[]string{"abc", "", "", "", ""}, []string{}, 3, 0},
+	} {
+		for _, split := range []bool{false, true} {
+			s := New(10, 5, 100)
+			if split {
+				for i := 0; i < len(tc.output); i++ {
+					s.Write([]byte{tc.output[i]})
+				}
+			} else {
+				s.Write([]byte(tc.output))
+			}
+			name := tc.name
+			if split {
+				name += " (split)"
+			}
+			if got := screenText(s); !reflect.DeepEqual(got, tc.screen) {
+				t.Errorf("%s: screen: got %q, want %q", name, got, tc.screen)
+			}
+			if got := scrollbackText(s); !reflect.DeepEqual(got, tc.scrollback) {
+				t.Errorf("%s: scrollback: got %q, want %q",
+					name, got, tc.scrollback)
+			}
+			if x, y, _ := s.Cursor(); x != tc.x || y != tc.y {
+				t.Errorf("%s: cursor: got (%d, %d), want (%d, %d)",
+					name, x, y, tc.x, tc.y)
+			}
+		}
+	}
+}
+
+func TestWritePushed(t *testing.T) {
+	s := New(10, 3, 4)
+	if n := s.Write([]byte("1\r\n2\r\n3")); n != 0 {
+		t.Errorf("Pushed: got %d, want 0", n)
+	}
+	if n := s.Write([]byte("\r\n4\r\n5")); n != 2 {
+		t.Errorf("Pushed: got %d, want 2", n)
+	}
+	// The oldest lines are dropped once the scrollback is full.
+	if n := s.Write([]byte("\r\n6\r\n7\r\n8")); n != 3 {
+		t.Errorf("Pushed: got %d, want 3", n)
+	}
+	if got, want := scrollbackText(s), []string{"2", "3", "4", "5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scrollback: got %q, want %q", got, want)
+	}
+	if got, want := text(s.View(2, 3)), []string{"4", "5", "6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("View: got %q, want %q", got, want)
+	}
+
+	// Lines scrolled off the alternate screen are not kept.
+	if n := s.Write([]byte("\x1b[?1049h\r\n\r\n\r\n")); n != 0 {
+		t.Errorf("Pushed from the alternate screen: got %d, want 0", n)
+	}
+}
+
+func TestPen(t *testing.T) {
+	s := New(10, 1, 0)
+	s.Write([]byte("a\x1b[1;31mb\x1b[4;38;5;208mc\x1b[22;39;44md\x1b[me"))
+	want := []string{"", "1;31", "1;4;38;5;208", "4;44", ""}
+	line := s.View(0, 1)[0]
+	for i, pen := range want {
+		if line[i].Pen != pen {
+			t.Errorf("Cell %d (%c): got %q, want %q", i, line[i].Rune, line[i].Pen, pen)
+		}
+	}
+	s.Write([]byte("\x1b[?25l"))
+	if _, _, visible := s.Cursor(); visible {
+		t.Errorf("Cursor visible")
+	}
+}
+
+func TestResize(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		output     string
+		cols       int
+		rows       int
+		screen     []string
+		scrollback []string
+		x          int
+		y          int
+	}{
+		{"grow", lines("1", "2", "3"), 12, 6,
+			[]string{"1", "2", "3", "", "", ""}, []string{}, 1, 2},
+		{"shrink below the cursor", lines("1", "2", "3"), 10, 3,
+			[]string{"1", "2", "3"}, []string{}, 1, 2},
+		{"shrink above the cursor", lines("1", "2", "3", "4", "5"), 10, 2,
+			[]string{"4", "5"}, []string{"1", "2", "3"}, 1, 1},
+		{"narrow", lines("abcdefghij", "klm"), 4, 5,
+			[]string{"abcd", "klm", "", "", ""}, []string{}, 3, 1},
+		{"narrow past the cursor", "abcdefgh", 4, 5,
+			[]string{"abcd", "", "", "", ""}, []string{}, 3, 0},
+		{"alternate screen", lines("1", "2", "3", "4", "5") +
+			"\x1b[?1049h" + lines("a", "b", "c", "d", "e"), 10, 3,
+			[]string{"c", "d", "e"}, []string{"1", "2"}, 1, 2},
+	} {
+		s := New(10, 5, 100)
+		s.Write([]byte(tc.output))
+		s.Resize(tc.cols, tc.rows)
+		if cols, rows := s.Size(); cols != tc.cols || rows != tc.rows {
+			t.Errorf("%s: size: got %dx%d", tc.name, cols, rows)
+		}
+		if got := screenText(s); !reflect.DeepEqual(got, tc.screen) {
+			t.Errorf("%s: screen: got %q, want %q", tc.name, got, tc.screen)
+		}
+		if got := scrollbackText(s); !reflect.DeepEqual(got, tc.scrollback) {
+			t.Errorf("%s: scrollback: got %q, want %q",
+				tc.name, got, tc.scrollback)
+		}
+		if x, y, _ := s.Cursor(); x != tc.x || y != tc.y {
+			t.Errorf("%s: cursor: got (%d, %d), want (%d, %d)",
+				tc.name, x, y, tc.x, tc.y)
+		}
+	}
+
+	// Output keeps being interpreted at the new size, the scroll region
+	// being reset.
+	s := New(10, 5, 100)
+	s.Write([]byte("\x1b[2;3r" + lines("1", "2", "3", "4", "5")))
+	if got, want := screenText(s), []string{"1", "4", "5", "", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Screen: got %q, want %q", got, want)
+	}
+	s.Resize(4, 2)
+	s.Resize(0, 2)
+	s.Write([]byte("\r\nabcdef"))
+	if got, want := screenText(s), []string{"abcd", "ef"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Screen: got %q, want %q", got, want)
+	}
+	if got, want := scrollbackText(s), []string{"1", "4", "5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scrollback: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,82 @@
+package tee
+
+import (
+	"bufio"
+	"io"
+	"sync"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// Writer writes to an underlying writer asynchronously so that a slow
+// destination (a file on a busy disk) does not add latency to the caller.
+// Writes are buffered and flushed as soon as no more data is pending.
+type Writer struct {
+	w     *bufio.Writer
+	dataC chan []byte
+	doneC chan struct{}
+	err   error
+
+	closed bool
+	mutex  *sync.Mutex
+}
+
+// NewWriter constructs a Writer and starts its writing goroutine.
+func NewWriter(
+	w io.Writer,
+) *Writer {
+	t := &Writer{
+		w:     bufio.NewWriter(w),
+		dataC: make(chan []byte, 256),
+		doneC: make(chan struct{}),
+		mutex: &sync.Mutex{},
+	}
+
+	go func() {
+		for data := range t.dataC {
+			if _, err := t.w.Write(data); err != nil && t.err == nil {
+				t.err = err
+			}
+			if len(t.dataC) == 0 {
+				if err := t.w.Flush(); err != nil && t.err == nil {
+					t.err = err
+				}
+			}
+		}
+		if err := t.w.Flush(); err != nil && t.err == nil {
+			t.err = err
+		}
+		close(t.doneC)
+	}()
+
+	return t
+}
+
+// Write queues a copy of data to be written. It only blocks if the queue is
+// full.
+func (t *Writer) Write(
+	data []byte,
+) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return 0, errors.Trace(errors.Newf("Write on closed tee"))
+	}
+	cpy := make([]byte, len(data))
+	copy(cpy, data)
+	t.dataC <- cpy
+	return len(data), nil
+}
+
+// Close waits for all queued data to be written and flushed. It returns the
+// first error encountered while writing, if any.
+func (t *Writer) Close() error {
+	t.mutex.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.dataC)
+	}
+	t.mutex.Unlock()
+	<-t.doneC
+	return errors.Trace(t.err)
+}
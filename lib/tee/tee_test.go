@@ -0,0 +1,131 @@
+package tee
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingWriter accepts n bytes then fails.
+type failingWriter struct {
+	buf bytes.Buffer
+	n   int
+}
+
+func (w *failingWriter) Write(
+	p []byte,
+) (int, error) {
+	if w.buf.Len()+len(p) > w.n {
+		return 0, fmt.Errorf("no space left on device")
+	}
+	return w.buf.Write(p)
+}
+
+// blockingWriter blocks writes until unblocked.
+type blockingWriter struct {
+	unblockC chan struct{}
+	buf      bytes.Buffer
+}
+
+func (w *blockingWriter) Write(
+	p []byte,
+) (int, error) {
+	<-w.unblockC
+	return w.buf.Write(p)
+}
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tee.log")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer f.Close()
+
+	w := NewWriter(f)
+	data := []byte("\x1b[1mbold\x1b[0m\r\n")
+	for i := 0; i < 1000; i++ {
+		if n, err := w.Write(data); err != nil || n != len(data) {
+			t.Fatalf("Write: %d, %v", n, err)
+		}
+	}
+	// The data written is copied before being queued.
+	data[0] = 'X'
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if want := strings.Repeat("\x1b[1mbold\x1b[0m\r\n", 1000); string(raw) != want {
+		t.Errorf("Written %d bytes, want %d", len(raw), len(want))
+	}
+
+	if _, err := w.Write([]byte("late")); err == nil {
+		t.Errorf("Write after Close succeeded")
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Second Close: %v", err)
+	}
+}
+
+func TestWriteClosedFile(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "tee.log"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	f.Close()
+
+	// Writes don't fail: the error is reported when closing the tee.
+	w := NewWriter(f)
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Errorf("Close: got %v, want the closed file error", err)
+	}
+}
+
+func TestWriteFailingFile(t *testing.T) {
+	fw := &failingWriter{n: 10}
+	w := NewWriter(fw)
+	for _, chunk := range []string{"12345", "67890", "abcde", "fghij"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	err := w.Close()
+	if err == nil || !strings.Contains(err.Error(), "no space left") {
+		t.Errorf("Close: got %v, want the first write error", err)
+	}
+	// Depending on how the chunks were buffered, only the ones preceding the
+	// error were written.
+	if got := fw.buf.String(); got != "" && got != "12345" && got != "1234567890" {
+		t.Errorf("Written: got %q, want the chunks preceding the error", got)
+	}
+}
+
+func TestWriteDoesNotBlock(t *testing.T) {
+	bw := &blockingWriter{unblockC: make(chan struct{})}
+	w := NewWriter(bw)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		w.Write([]byte("x"))
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Writes blocked by the destination for %s", d)
+	}
+
+	close(bw.unblockC)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := bw.buf.String(); got != strings.Repeat("x", 100) {
+		t.Errorf("Written: got %q", got)
+	}
+}
@@ -6,13 +6,25 @@ import (
 	"encoding/base64"
 	"io"
 	"log"
+	"math/big"
 )
 
 // Tokens
 
 const (
 	tokenLength = 16
-	a62         = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789__"
+	// a64 is the alphabet tokens are encoded with. `-` and `_` are stripped
+	// by the fountain so that tokens only contain the remaining 62
+	// alphanumeric characters.
+	a64 = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+	// readableLength is the length of readable tokens. With
+	// len(readable) = 57 characters it preserves the entropy of tokens of
+	// tokenLength out of 62 characters (~95 bits).
+	readableLength = 17
+	// readable is the alphabet of readable tokens, which leaves out the
+	// characters easily mistaken for one another (0/O, 1/l/I).
+	readable = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
 )
 
 var tokens = make(tokenFountain, 512)
@@ -25,7 +37,7 @@ func (f tokenFountain) Write(
 	var token [tokenLength]byte
 	var i int
 	for _, b := range buf {
-		if b != '_' {
+		if b != '-' && b != '_' {
 			token[i] = b
 			i++
 		}
@@ -40,7 +52,7 @@ func (f tokenFountain) Write(
 
 func init() {
 	buf := bufio.NewWriterSize(tokens, 1024)
-	enc := base64.NewEncoder(base64.NewEncoding(a62), buf)
+	enc := base64.NewEncoder(base64.NewEncoding(a64), buf)
 
 	go func() {
 		_, err := io.Copy(enc, rand.Reader)
@@ -61,3 +73,26 @@ func New(
 func RandStr() string {
 	return <-tokens
 }
+
+// NewReadable generates a random readable token prefixed by prefix, for the
+// tokens users read and type (see ReadableStr). Secrets should use New.
+func NewReadable(
+	name string,
+) string {
+	return name + "_" + ReadableStr()
+}
+
+// ReadableStr generates a random string out of an alphabet free of ambiguous
+// characters, as entropic as the strings generated by RandStr.
+func ReadableStr() string {
+	max := big.NewInt(int64(len(readable)))
+	var s [readableLength]byte
+	for i := range s {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			log.Panicln("utils.rand: token creation ran out of entropy", err)
+		}
+		s[i] = readable[n.Int64()]
+	}
+	return string(s[:])
+}
@@ -0,0 +1,110 @@
+package token
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// alphanumeric are the characters of the tokens generated by RandStr.
+const alphanumeric = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// ambiguous are the characters easily mistaken for one another.
+const ambiguous = "0O1lI"
+
+// assertAlphabet checks that s has length n and only contains characters of
+// alphabet.
+func assertAlphabet(
+	t *testing.T,
+	s string,
+	n int,
+	alphabet string,
+) {
+	t.Helper()
+	if len(s) != n {
+		t.Errorf("Length of %q: got %d, want %d", s, len(s), n)
+	}
+	for _, c := range s {
+		if !strings.ContainsRune(alphabet, c) {
+			t.Errorf("Character %q of %q not in the alphabet", c, s)
+		}
+	}
+}
+
+func TestAlphabets(t *testing.T) {
+	if got := strings.TrimRight(a64, "-_"); got != alphanumeric {
+		t.Errorf("Token alphabet: got %q, want %q", got, alphanumeric)
+	}
+	seen := map[rune]bool{}
+	for _, c := range readable {
+		if seen[c] {
+			t.Errorf("Duplicate %q in the readable alphabet", c)
+		}
+		seen[c] = true
+		if strings.ContainsRune(ambiguous, c) {
+			t.Errorf("Ambiguous %q in the readable alphabet", c)
+		}
+		if !strings.ContainsRune(alphanumeric, c) {
+			t.Errorf("Non alphanumeric %q in the readable alphabet", c)
+		}
+	}
+	if want := len(alphanumeric) - len(ambiguous); len(readable) != want {
+		t.Errorf("Readable alphabet: got %d characters, want %d",
+			len(readable), want)
+	}
+}
+
+func TestReadableEntropy(t *testing.T) {
+	bits := float64(tokenLength) * math.Log2(float64(len(alphanumeric)))
+	got := float64(readableLength) * math.Log2(float64(len(readable)))
+	if got < bits {
+		t.Errorf("Readable tokens entropy: got %.1f bits, want %.1f", got, bits)
+	}
+}
+
+func TestRandStr(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		s := RandStr()
+		assertAlphabet(t, s, tokenLength, alphanumeric)
+		if seen[s] {
+			t.Fatalf("Duplicate token %q", s)
+		}
+		seen[s] = true
+	}
+}
+
+func TestReadableStr(t *testing.T) {
+	// 1000 strings of 17 characters draw each of the 57 characters about
+	// 300 times, all of them are expected.
+	seen := map[string]bool{}
+	used := map[rune]bool{}
+	for i := 0; i < 1000; i++ {
+		s := ReadableStr()
+		assertAlphabet(t, s, readableLength, readable)
+		if seen[s] {
+			t.Fatalf("Duplicate token %q", s)
+		}
+		seen[s] = true
+		for _, c := range s {
+			used[c] = true
+		}
+	}
+	if len(used) != len(readable) {
+		t.Errorf("Characters used: got %d, want %d", len(used), len(readable))
+	}
+}
+
+func TestPrefixes(t *testing.T) {
+	s := New("session")
+	if !strings.HasPrefix(s, "session_") {
+		t.Errorf("New: got %q", s)
+	}
+	assertAlphabet(t, strings.TrimPrefix(s, "session_"), tokenLength, alphanumeric)
+
+	s = NewReadable("user")
+	if !strings.HasPrefix(s, "user_") {
+		t.Errorf("NewReadable: got %q", s)
+	}
+	assertAlphabet(t, strings.TrimPrefix(s, "user_"), readableLength, readable)
+}
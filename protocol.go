@@ -1,17 +1,223 @@
 package warp
 
-import "regexp"
+import (
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hashicorp/yamux"
+	"github.com/spolu/warp/lib/errors"
+)
 
 //
 // Remote Warpd Protocol
 //
 
-// Version is the current warp version.
-var Version = "0.0.3"
+// Version is the current warp version. Version 0.0.4 introduced the
+// connection preamble and can't interoperate with previous versions.
+var Version = "0.0.4"
+
+// PreambleMagic is the magic starting the preamble exchanged over new
+// connections to warpd.
+const PreambleMagic = "WARP"
+
+// ProtocolVersion is the version of the protocol sent as part of the
+// preamble. It is bumped on incompatible protocol changes. warpd serves peers
+// down to MinProtocolVersion, replying with the version negotiated for the
+// connection (the lowest of the two):
+//   - Version 1 sessions open their 4 channels in order (state, update,
+//     error, data).
+//   - Version 2 sessions tag each channel with its ChannelType (see
+//     WriteChannelTag) so that channels are accepted by type, in any order,
+//     and optional channels can be opened along the required ones (see
+//     SessionHello.Channels).
+//   - Version 3 sessions may compress their data channel (see
+//     SessionHello.Compress).
+//   - Version 4 warpds send the state of idle warps to their clients every
+//     HeartbeatInterval (see State.HostIdle).
+//   - Version 5 warpds stage the modes requested by shell clients
+//     (SessionHello.Mode, ClientUpdate.Request) for their host to grant or
+//     decline (HostUpdate.Declines). Older warpds drop these fields so
+//     clients refuse to request modes from them.
+const ProtocolVersion byte = 5
+
+// MinProtocolVersion is the oldest protocol version served by warpd.
+const MinProtocolVersion byte = 1
+
+// MinClientProtocolVersion is the oldest protocol version spoken by clients
+// (which tag their channels), warpds negotiating an older version being
+// rejected.
+const MinClientProtocolVersion byte = 2
+
+// SchemaVersion is the version of the schema of the structs exchanged over
+// sessions (SessionHello, ClientUpdate, HostUpdate, State, Error, ...), sent
+// as part of the SessionHello. warpd rejects sessions whose schema differs
+// from its own with ErrCodeSchemaMismatch.
+//
+// These structs are gob-encoded and gob matches fields by name, dropping
+// fields unknown to the receiver and leaving missing ones to their zero value,
+// so that incompatible changes go unnoticed rather than failing. The policy
+// is therefore:
+//   - Adding a field whose zero value preserves the previous behavior (as
+//     received from or sent to an older peer) is compatible.
+//   - Renaming or removing a field, changing its type or meaning, or adding a
+//     field older peers must honor requires bumping SchemaVersion.
+//   - Wire structs must not contain interface fields (which would require
+//     gob.Register).
+const SchemaVersion = 1
+
+// ErrCodeSchemaMismatch is the code of the error sent by warpd to sessions
+// whose SessionHello.Schema differs from SchemaVersion.
+const ErrCodeSchemaMismatch = "schema_mismatch"
+
+// PreambleTimeout is the time allowed to exchange preambles.
+const PreambleTimeout = 10 * time.Second
+
+// WritePreamble writes the preamble (PreambleMagic followed by the protocol
+// version byte). Clients send their preamble first (with ProtocolVersion) and
+// warpd replies with its own (with the negotiated version) before the session
+// is set up, so that connections not speaking the warp protocol are rejected
+// early.
+func WritePreamble(
+	w io.Writer,
+	version byte,
+) error {
+	_, err := w.Write(append([]byte(PreambleMagic), version))
+	return errors.Trace(err)
+}
+
+// ReadPreamble reads a preamble and returns the protocol version it carries.
+// It errors if the magic does not match.
+func ReadPreamble(
+	r io.Reader,
+) (byte, error) {
+	buf := make([]byte, len(PreambleMagic)+1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, errors.Trace(errors.Newf("Preamble read error: %v", err))
+	}
+	if string(buf[:len(PreambleMagic)]) != PreambleMagic {
+		return 0, errors.Trace(errors.Newf("Invalid preamble magic: %q", buf))
+	}
+	return buf[len(PreambleMagic)], nil
+}
+
+// MuxAcceptBacklog is the number of channels opened by the peer that are
+// buffered until accepted. Each session opens 4 required channels (state,
+// update, error and data) and at most MaxSessionChannels in total.
+const MuxAcceptBacklog = 256
+
+// MuxWriteTimeout is the time allowed to write to the connection (as when
+// opening a channel) before the multiplexer gives up with
+// yamux.ErrConnectionWriteTimeout.
+var MuxWriteTimeout = 10 * time.Second
+
+// ChannelType is the purpose of a channel of a session, sent as its first
+// frame by version 2 peers.
+type ChannelType string
+
+const (
+	// ChannelState carries the states sent by warpd (or resolutions).
+	ChannelState ChannelType = "state"
+	// ChannelUpdate carries the SessionHello and updates sent by the peer.
+	ChannelUpdate ChannelType = "update"
+	// ChannelError carries the error sent by warpd before closing the
+	// session.
+	ChannelError ChannelType = "error"
+	// ChannelData carries the data of the warp.
+	ChannelData ChannelType = "data"
+	// ChannelChat carries the ChatMessages of chat client sessions. It is
+	// optional.
+	ChannelChat ChannelType = "chat"
+)
+
+// RequiredChannels are the channels opened by all sessions, in the order
+// version 1 peers open them.
+var RequiredChannels = []ChannelType{
+	ChannelState, ChannelUpdate, ChannelError, ChannelData,
+}
+
+// MaxSessionChannels is the maximum number of channels of a session, required
+// and optional ones. warpd rejects sessions announcing more.
+var MaxSessionChannels = 16
+
+// maxChannelTag is the maximum length of a channel tag.
+const maxChannelTag = 255
+
+// WriteChannelTag writes the first frame of a channel, tagging it with its
+// type: its length (one byte) followed by the type itself.
+func WriteChannelTag(
+	w io.Writer,
+	t ChannelType,
+) error {
+	if len(t) == 0 || len(t) > maxChannelTag {
+		return errors.Trace(errors.Newf("Invalid channel type: %q", t))
+	}
+	_, err := w.Write(append([]byte{byte(len(t))}, t...))
+	return errors.Trace(err)
+}
+
+// ReadChannelTag reads the first frame of a channel and returns its type.
+func ReadChannelTag(
+	r io.Reader,
+) (ChannelType, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", errors.Trace(err)
+	}
+	if n[0] == 0 {
+		return "", errors.Trace(errors.Newf("Empty channel tag"))
+	}
+	buf := make([]byte, n[0])
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", errors.Trace(err)
+	}
+	return ChannelType(buf), nil
+}
+
+// MuxConfig returns the configuration of the multiplexer used by both warpd
+// and clients over each connection so that their limits and timeouts match.
+// Only the keep alive interval and the log output differ between peers.
+func MuxConfig(
+	keepAlive time.Duration,
+	logOutput io.Writer,
+) *yamux.Config {
+	return &yamux.Config{
+		AcceptBacklog:          MuxAcceptBacklog,
+		EnableKeepAlive:        true,
+		KeepAliveInterval:      keepAlive,
+		ConnectionWriteTimeout: MuxWriteTimeout,
+		MaxStreamWindowSize:    256 * 1024,
+		LogOutput:              logOutput,
+	}
+}
 
 // DefaultAddress to connect to
 var DefaultAddress = "warp.link:4242"
 
+// UnixAddressPrefix prefixes the warpd addresses designating a Unix socket by
+// its path (`unix:/var/run/warpd.sock`) rather than a TCP address, for warpd
+// instances local to their users (tests, reverse proxies).
+const UnixAddressPrefix = "unix:"
+
+// AddressNetwork returns the network (`tcp` or `unix`) and address to listen
+// on or dial for a warpd address.
+func AddressNetwork(
+	address string,
+) (string, string) {
+	if strings.HasPrefix(address, UnixAddressPrefix) {
+		return "unix", strings.TrimPrefix(address, UnixAddressPrefix)
+	}
+	return "tcp", address
+}
+
 // WarpRegexp warp token regular expression.
 var WarpRegexp = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9-_.]{0,255}$")
 
@@ -21,14 +227,76 @@ type Mode uint64
 const (
 	ModeShellRead  Mode = 1
 	ModeShellWrite Mode = 1 << 1
+	ModeSpeakRead  Mode = 1 << 2
+	ModeSpeakWrite Mode = 1 << 3
+	ModeSpeakMuted Mode = 1 << 4
 	// Future usecases:
-	//   ModeVoicekRead|ModeVoicekWrite|ModeVoicekMuted
 	//   ModeVerified
 
 	DefaultHostMode = ModeShellRead | ModeShellWrite
 	DefaultUserMode = ModeShellRead
 )
 
+// modeFlags lists the known mode bits in display order along with the letter
+// used to render them and the name used to target them from the command line.
+var modeFlags = []struct {
+	mode   Mode
+	letter byte
+	name   string
+}{
+	{ModeShellRead, 'r', "read"},
+	{ModeShellWrite, 'w', "write"},
+	{ModeSpeakRead, 's', "speak-read"},
+	{ModeSpeakWrite, 't', "speak-write"},
+	{ModeSpeakMuted, 'm', "speak-muted"},
+}
+
+// String renders the mode symbolically (`rw---` for the default host mode).
+// Bits that are unknown to this version are appended in hexadecimal so that
+// they are displayed rather than silently dropped.
+func (m Mode) String() string {
+	var b strings.Builder
+	known := Mode(0)
+	for _, f := range modeFlags {
+		known |= f.mode
+		if m&f.mode != 0 {
+			b.WriteByte(f.letter)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	if unknown := m &^ known; unknown != 0 {
+		b.WriteString(fmt.Sprintf("+%#x", uint64(unknown)))
+	}
+	return b.String()
+}
+
+// ParseMode returns the mode bit associated with a mode name (`write`,
+// `speak-read`, ...).
+func ParseMode(
+	name string,
+) (Mode, error) {
+	for _, f := range modeFlags {
+		if f.name == name {
+			return f.mode, nil
+		}
+	}
+	return 0, errors.Trace(errors.Newf("Unknown mode: %s", name))
+}
+
+// ModeName returns the name of a single mode bit or its symbolic
+// representation if it is not a known bit.
+func ModeName(
+	mode Mode,
+) string {
+	for _, f := range modeFlags {
+		if f.mode == mode {
+			return f.name
+		}
+	}
+	return mode.String()
+}
+
 // SessionType encodes the type of the session:
 type SessionType string
 
@@ -39,6 +307,8 @@ const (
 	SsTpShellClient SessionType = "shell"
 	// SsTpChatClient chat client session (`warp chat`)
 	SsTpChatClient SessionType = "chat"
+	// SsTpResolve session resolving a warp ID prefix (`warp connect --prefix`)
+	SsTpResolve SessionType = "resolve"
 )
 
 // User represents a user of a warp.
@@ -48,6 +318,9 @@ type User struct {
 
 	Mode    Mode
 	Hosting bool
+	// Requested is the mode the user requested when connecting (`warp
+	// connect --write`) and that the host didn't grant nor decline yet.
+	Requested Mode
 }
 
 // Session identifies a user's session.
@@ -61,6 +334,163 @@ type Session struct {
 type Error struct {
 	Code    string
 	Message string
+	// Redirect is the address of the warpd to reconnect to for errors with
+	// the ErrCodeRedirect code.
+	Redirect string
+}
+
+// ErrCodeRedirect is the code of the error sent by warpd to redirect a session
+// to another warpd instead of serving it.
+const ErrCodeRedirect = "redirect"
+
+// Codes of the other errors sent by warpd before closing a session.
+const (
+	// ErrCodeInternal is sent when warpd failed to serve the session. The
+	// warp may be gone: hosts rehost it and clients can reconnect.
+	ErrCodeInternal = "internal_error"
+	// ErrCodeWarpInUse is sent to hosts opening a warp that is already
+	// hosted.
+	ErrCodeWarpInUse = "warp_in_use"
+	// ErrCodeCapacity is sent to hosts opening a warp when warpd already
+	// serves its maximum number of warps.
+	ErrCodeCapacity = "capacity"
+	// ErrCodeWarpUnknown is sent to clients connecting to a warp that does
+	// not exist.
+	ErrCodeWarpUnknown = "warp_unknown"
+	// ErrCodeResolveDisabled is sent to clients resolving a warp ID prefix
+	// on a warpd that doesn't allow it.
+	ErrCodeResolveDisabled = "resolve_disabled"
+	// ErrCodeHostDisconnected is sent to clients when the host of their warp
+	// disconnected.
+	ErrCodeHostDisconnected = "host_disconnected"
+	// ErrCodeHostClosed is sent to clients when the host of their warp closed
+	// it (see HostUpdate.Closing) rather than disconnecting.
+	ErrCodeHostClosed = "host_closed"
+	// ErrCodeAuthorizationFailed is sent when the secret of a session does
+	// not match the one its user connected with first.
+	ErrCodeAuthorizationFailed = "authorization_failed"
+	// ErrCodeIdleTimeout is sent to the host and clients of a warp closed by
+	// warpd as its host produced no output for too long (`warpd
+	// -idle-timeout`).
+	ErrCodeIdleTimeout = "warp_idle_timeout"
+	// ErrCodeWarpClosed is sent to the host and clients of a warp closed by
+	// the warpd operator through the admin API.
+	ErrCodeWarpClosed = "warp_closed"
+)
+
+// MaxRedirects is the maximum number of consecutive redirects followed by
+// clients before giving up.
+const MaxRedirects = 3
+
+// DataFrameHeaderSize is the size of the header of sequenced data frames: the
+// sequence number (8 bytes) followed by the payload length (4 bytes), both big
+// endian.
+//
+// Sequenced data frames are used instead of the raw stream over the data
+// channel of shell client sessions that request it (SessionHello.Sequenced),
+// so that they can detect data dropped by warpd. warpd numbers the chunks of
+// data received from the host. As measured on the wire over the yamux data
+// channel by BenchmarkDataFrameOverhead, the header adds 12 bytes per chunk:
+// 92% to a single-byte keystroke echo (sent in a 13 bytes yamux frame), 13%
+// to an 80 bytes line, 1.2% to a 1024 bytes chunk and 0.02% to a full
+// MaxDataFrameSize chunk of bulk output.
+const DataFrameHeaderSize = 12
+
+// MaxDataFrameSize is the maximum payload size of a sequenced data frame.
+const MaxDataFrameSize = 64 * 1024
+
+// WriteDataFrame writes a sequenced data frame in a single write.
+func WriteDataFrame(
+	w io.Writer,
+	seq uint64,
+	data []byte,
+) error {
+	if len(data) > MaxDataFrameSize {
+		return errors.Trace(
+			errors.Newf("Data frame too large: %d", len(data)),
+		)
+	}
+	buf := make([]byte, DataFrameHeaderSize+len(data))
+	binary.BigEndian.PutUint64(buf[0:8], seq)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(data)))
+	copy(buf[DataFrameHeaderSize:], data)
+	_, err := w.Write(buf)
+	return errors.Trace(err)
+}
+
+// ReadDataFrame reads a sequenced data frame, returning its sequence number
+// and payload.
+func ReadDataFrame(
+	r io.Reader,
+) (uint64, []byte, error) {
+	header := make([]byte, DataFrameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	seq := binary.BigEndian.Uint64(header[0:8])
+	size := binary.BigEndian.Uint32(header[8:12])
+	if size > MaxDataFrameSize {
+		return 0, nil, errors.Trace(
+			errors.Newf("Data frame too large: %d", size),
+		)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	return seq, data, nil
+}
+
+// CompressedConn wraps the data channel of sessions compressing it
+// (SessionHello.Compress) with a flate compressor and decompressor. Each write
+// is flushed so that interactive output is not held back by the compressor,
+// the decompressor returning what it has decompressed as soon as a write is
+// received, for partial reads to reach plex.Run as they would uncompressed.
+// Compression is applied to each hop (host to warpd, warpd to clients)
+// independently.
+type CompressedConn struct {
+	net.Conn
+	r io.ReadCloser
+	w *flate.Writer
+
+	mutex *sync.Mutex
+}
+
+// NewCompressedConn wraps c with a flate compressor and decompressor.
+func NewCompressedConn(
+	c net.Conn,
+) *CompressedConn {
+	// flate.NewWriter only errors on invalid levels.
+	w, _ := flate.NewWriter(c, flate.DefaultCompression)
+	return &CompressedConn{
+		Conn:  c,
+		r:     flate.NewReader(c),
+		w:     w,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Read reads and decompresses data from the underlying connection.
+func (c *CompressedConn) Read(
+	b []byte,
+) (int, error) {
+	return c.r.Read(b)
+}
+
+// Write compresses and writes data to the underlying connection, flushing it
+// before returning. It is safe to call concurrently.
+func (c *CompressedConn) Write(
+	b []byte,
+) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, err := c.w.Write(b); err != nil {
+		return 0, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
 }
 
 // Size reprensents a window size.
@@ -69,11 +499,164 @@ type Size struct {
 	Cols int
 }
 
+const (
+	// MinWindowSize is the minimum number of rows or columns of a window.
+	MinWindowSize = 1
+	// MaxWindowSize is the maximum number of rows or columns of a window.
+	MaxWindowSize = 1000
+)
+
+// Valid returns whether the size is within the supported bounds. Sizes out of
+// bounds are ignored by both warpd and clients.
+func (s Size) Valid() bool {
+	return s.Rows >= MinWindowSize && s.Rows <= MaxWindowSize &&
+		s.Cols >= MinWindowSize && s.Cols <= MaxWindowSize
+}
+
+// MaxTitleLength is the maximum length (in characters) of the title of a
+// warp (`warp open --title`).
+const MaxTitleLength = 80
+
+// SanitizeTitle returns a warp title safe for display: control characters
+// (which could start escape sequences in the terminals displaying it) are
+// removed, whitespace is collapsed and the title is truncated to
+// MaxTitleLength characters.
+func SanitizeTitle(
+	title string,
+) string {
+	title = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return ' '
+		}
+		return r
+	}, title)
+	runes := []rune(strings.Join(strings.Fields(title), " "))
+	if len(runes) > MaxTitleLength {
+		runes = runes[:MaxTitleLength]
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// TermRegexp terminal type (`TERM`) regular expression.
+var TermRegexp = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9-_.+]{0,63}$")
+
+// PaneRegexp pane name regular expression.
+var PaneRegexp = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9-_]{0,31}$")
+
+// PaneOSC is the OSC code used to frame pane switches on the data channel.
+const PaneOSC = 7700
+
+// PaneFrame returns the sequence marking the start of the output of the named
+// pane on the data channel.
+//
+// A host opened with `warp open --layout` runs multiple named panes. Only the
+// output of the active pane is sent over the data channel and each switch of
+// the active pane is framed in-band by `ESC ] 7700 ; <name> BEL`, immediately
+// followed by the output of the new pane. Being an OSC sequence, the frame is
+// ignored by terminals that don't know about it. The list of panes and the
+// active pane are also part of the State, so that sessions joining mid-stream
+// know which pane they are receiving.
+func PaneFrame(
+	name string,
+) []byte {
+	return []byte(fmt.Sprintf("\033]%d;%s\007", PaneOSC, name))
+}
+
 // State is the struct sent over the network to update sessions state.
 type State struct {
 	Warp       string
 	WindowSize Size
 	Users      map[string]User
+
+	// Panes is the list of panes of the warp (empty for warps with a single
+	// shell) and Pane the active one.
+	Panes []string
+	Pane  string
+
+	// SingleWriter and Writer are set by the host (see HostUpdate).
+	SingleWriter bool
+	Writer       string
+	// Title, Term and ReadOnly are set by the host (see HostUpdate).
+	Title    string
+	Term     string
+	ReadOnly bool
+	// Typing lists the usernames of the users who typed simultaneously
+	// within the last TypingWindow. It is only set while at least two users
+	// are typing.
+	Typing []string
+	// Writing lists the tokens of the users who wrote to the warp within the
+	// last WritingWindow, sorted, for viewers to tell who is doing what (the
+	// host typing in its own terminal is not seen by warpd).
+	Writing []string
+	// HostSessions is the number of shell client sessions of the host user
+	// (the host connected to its own warp with `warp connect`), through which
+	// the host writes to the warp via warpd.
+	HostSessions int
+	// HostReconnecting is set while warpd keeps the warp open after its host
+	// disconnected unexpectedly, waiting for it to reconnect (`warpd
+	// -host-grace`). The input of the clients is dropped meanwhile.
+	HostReconnecting bool
+	// HostIdle is the time elapsed since the host last produced output when
+	// warpd sent the state. It is relative as the clocks of warpd and the
+	// clients may differ. warpd sends the state to the clients every
+	// HeartbeatInterval while the host is idle.
+	HostIdle time.Duration
+
+	// Refresh is only set on states sent to the host, when a client
+	// requested the screen of the warp to be redrawn (see ClientUpdate).
+	Refresh bool
+
+	// MaxClients is the maximum number of clients of the warp, the lowest of
+	// the limits set by the host (see HostUpdate) and warpd (`warpd
+	// -max-clients`), 0 if unlimited.
+	MaxClients int
+
+	// SizePolicy is set by the host (see HostUpdate) and ClientsSize is the
+	// smallest window size (rows and columns independently) reported by the
+	// clients of the warp, zero if none did.
+	SizePolicy  SizePolicy
+	ClientsSize Size
+}
+
+// SizePolicy determines the window size of a warp.
+type SizePolicy string
+
+const (
+	// SizePolicyHost sizes the warp to the host terminal (default).
+	SizePolicyHost SizePolicy = "host"
+	// SizePolicyMin sizes the warp to the smallest of the host terminal and
+	// the clients terminals, so that no client sees a truncated screen.
+	// Clients don't resize their terminal to the warp size under this
+	// policy.
+	SizePolicyMin SizePolicy = "min"
+	// SizePolicyFixed sizes the warp to a fixed size set by the host.
+	SizePolicyFixed SizePolicy = "fixed"
+)
+
+// TypingWindow is the period within which input received by warpd from
+// different users is considered simultaneous.
+const TypingWindow = 1 * time.Second
+
+// WritingWindow is the period after which users who stopped writing to a
+// warp are removed from State.Writing.
+const WritingWindow = 3 * time.Second
+
+// HeartbeatInterval is the interval at which warpd sends the state of a warp
+// to its clients while its host produces no output, for the clients to tell
+// an idle host from a dead connection.
+const HeartbeatInterval = 5 * time.Second
+
+// MaxResolution is the maximum number of matching warps returned by warpd
+// when resolving a warp ID prefix.
+const MaxResolution = 8
+
+// Resolution is the struct sent over the state channel of resolve sessions.
+// Warps lists the IDs of the warps matching Prefix, sorted, and Truncated
+// indicates that more than MaxResolution warps matched.
+type Resolution struct {
+	Prefix    string
+	Warps     []string
+	Truncated bool
 }
 
 // SessionHello is the initial message sent over a session update channel to
@@ -82,11 +665,72 @@ type SessionHello struct {
 	Warp    string
 	From    Session
 	Version string
+	// Schema is the SchemaVersion of the peer, 0 for peers predating it.
+	Schema int
 
 	Type     SessionType
 	Username string
+
+	// Sequenced requests the data sent to a shell client session to be
+	// framed with sequence numbers (see DataFrameHeaderSize).
+	Sequenced bool
+
+	// Mode is the mode requested by a shell client (`warp connect --write`
+	// requests ModeShellWrite). warpd never grants it but stages it as
+	// User.Requested for the host to grant or decline. Clients only set it
+	// over sessions negotiating version 5 or later.
+	Mode Mode
+
+	// Channels are the optional channels opened by the peer along the
+	// required ones (version 2 sessions only). warpd closes the ones it
+	// doesn't support, which peers must tolerate.
+	Channels []ChannelType
+
+	// Auth is the authentication token of the peer, required by warpds
+	// restricting who can open and connect to warps (`warpd -auth-tokens`).
+	// Sessions not presenting one of their tokens are rejected with
+	// ErrCodeUnauthorized.
+	Auth string
+
+	// Compress requests the data channel of the session to be compressed
+	// both ways (see CompressedConn). Clients only set it over sessions
+	// negotiating version 3 or later, older warpds ignoring it.
+	Compress bool
+
+	// Replay is the number of bytes of the scrollback of the warp replayed to
+	// a shell client joining it (`warp connect --since-scrollback`), capped
+	// by the scrollback kept by warpd: 0 (as sent by older clients) for the
+	// full scrollback, ReplayNone for none. Older warpds ignore it, replaying
+	// their full scrollback.
+	Replay int
 }
 
+// ReplayNone is the SessionHello.Replay of shell clients requesting no
+// scrollback, to jump straight to the live output of the warp.
+const ReplayNone = -1
+
+// ClientUpdate represents an update sent by a shell client over its update
+// channel after its SessionHello.
+type ClientUpdate struct {
+	// Refresh requests the current state of the warp to be sent again to the
+	// client and the host to redraw the screen of the warp (clearing it and
+	// signaling the active pane), so that a corrupted screen can be rebuilt.
+	Refresh bool
+	// WindowSize, if valid, is the size of the client terminal, used to
+	// compute State.ClientsSize.
+	WindowSize Size
+	// Request is a mode requested by the client while connected (see
+	// SessionHello.Mode), staged by warpd as User.Requested for the host to
+	// grant or decline. Clients only send it over sessions negotiating
+	// version 5 or later.
+	Request Mode
+}
+
+// HostUpdateDebounce is the delay within which the host coalesces its updates
+// (as a terminal resize produces a burst of them) so that warpd broadcasts
+// its state once instead of once per update.
+const HostUpdateDebounce = 50 * time.Millisecond
+
 // HostUpdate represents an update to the warp state from its host.
 type HostUpdate struct {
 	Warp string
@@ -95,6 +739,114 @@ type HostUpdate struct {
 	WindowSize Size
 	// Modes is a map from user token to mode.
 	Modes map[string]Mode
+
+	// Panes and Pane are ignored if Panes is empty.
+	Panes []string
+	Pane  string
+
+	// SingleWriter restricts writes to the user holding the write token
+	// (`warp open --single-writer`): Writer is the token of that user, empty
+	// if the host kept it. The host's own sessions can always write.
+	SingleWriter bool
+	Writer       string
+
+	// MaxClients is the maximum number of users (other than the host) that
+	// can connect to the warp, 0 if unlimited (`warp open --max-clients`).
+	// warpd refuses users beyond it and the host kicks the newest users if
+	// it is exceeded nonetheless.
+	MaxClients int
+	// Kicks lists the users to disconnect from the warp.
+	Kicks []Kick
+	// Declines lists the users whose requested mode (User.Requested) the
+	// host declined.
+	Declines []string
+	// SizePolicy is the size policy of the warp (`warp open --size-policy`).
+	// The host applies it, WindowSize being the resulting size.
+	SizePolicy SizePolicy
+	// Title is the human description of the warp (`warp open --title`),
+	// sanitized by warpd (see SanitizeTitle).
+	Title string
+	// Term is the terminal type (`TERM`) the programs of the warp run with
+	// (`warp open --term`), for clients to detect terminals that may not
+	// render their output correctly. warpd ignores it if it doesn't match
+	// TermRegexp.
+	Term string
+	// ReadOnly indicates that the host never writes the input of the warp
+	// to its panes, whatever the modes of its users (`warp open
+	// --read-only-enforced`). It is informational.
+	ReadOnly bool
+	// Closing is set on the last update sent by a host closing its warp, for
+	// warpd to close it right away instead of waiting for the host to
+	// reconnect (see State.HostReconnecting).
+	Closing bool
+}
+
+// Kick is a request from the host to disconnect a user (all of its sessions)
+// from the warp.
+type Kick struct {
+	User string
+	// Code is the code of the error sent to the user (ErrCodeWarpFull,
+	// ErrCodeKicked).
+	Code string
+}
+
+// ErrCodeWarpFull is the code of the error sent to users refused or kicked
+// as the warp reached its maximum number of clients.
+const ErrCodeWarpFull = "warp_full"
+
+// ErrCodeKicked is the code of the error sent to users kicked by the host
+// (`warp revoke --kick`).
+const ErrCodeKicked = "kicked"
+
+// ErrCodeUnauthorized is the code of the error sent by warpd to sessions
+// that didn't present a valid authentication token (see SessionHello.Auth).
+const ErrCodeUnauthorized = "unauthorized"
+
+// ErrCodeChatUnsupported is the code of the error sent to chat client
+// sessions without a chat channel (version 1 sessions).
+const ErrCodeChatUnsupported = "chat_unsupported"
+
+// MaxChatMessageLength is the maximum length of the text of a chat message,
+// in characters. warpd truncates longer messages.
+const MaxChatMessageLength = 1024
+
+// ChatMessage is a message exchanged by the chat client sessions of a warp
+// (`warp chat`) over their chat channel. Chat clients only send Text, the
+// other fields being set by warpd before fanning the message out to all the
+// chat sessions of the warp, the sender's included.
+type ChatMessage struct {
+	Time time.Time
+	// From is the token of the sender, empty for the notices sent by warpd
+	// (users joining and leaving the chat, a session receiving the notice of
+	// its own joining first).
+	From     string
+	Username string
+	// Host indicates that the sender is the host of the warp.
+	Host bool
+	Text string
+}
+
+// SanitizeChatMessage returns the text of a chat message safe for display:
+// control characters (which could start escape sequences in the terminals
+// displaying it) are removed and the text is truncated to
+// MaxChatMessageLength characters.
+func SanitizeChatMessage(
+	text string,
+) string {
+	text = strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return ' '
+		}
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, text)
+	runes := []rune(text)
+	if len(runes) > MaxChatMessageLength {
+		runes = runes[:MaxChatMessageLength]
+	}
+	return strings.TrimSpace(string(runes))
 }
 
 //
@@ -104,6 +856,10 @@ type HostUpdate struct {
 // EnvWarp the env variable where the warp token is stored.
 var EnvWarp = "__WARP"
 
+// EnvWarpStatus the env variable where the path of the warp status file is
+// stored.
+var EnvWarpStatus = "__WARP_STATUS"
+
 // CommandType encodes the type of the session:
 type CommandType string
 
@@ -114,12 +870,38 @@ const (
 	CmdTpAuthorize CommandType = "authorize"
 	// CmdTpRevoke a (or all) user(s) authorization to write.
 	CmdTpRevoke CommandType = "revoke"
+	// CmdTpSubscribe subscribes to the state of the warp. A CommandResult is
+	// sent immediately and then each time the state changes, until the
+	// connection is closed.
+	CmdTpSubscribe CommandType = "subscribe"
+	// CmdTpClose closes the warp, disconnecting its clients, once the result
+	// is sent.
+	CmdTpClose CommandType = "close"
+	// CmdTpLimit sets the maximum number of clients of the warp to Args[0]
+	// (unlimited if 0), the newest clients being disconnected if exceeded.
+	CmdTpLimit CommandType = "limit"
 )
 
 // Command is used to send command to the local host.
 type Command struct {
 	Type CommandType
 	Args []string
+	// Mode is the mode bit targeted by authorize and revoke commands. It
+	// defaults to ModeShellWrite if not set.
+	Mode Mode
+	// TTL, if set, makes an authorization expire (be revoked) after the
+	// specified duration.
+	TTL time.Duration
+	// Kick, for revoke commands, also disconnects the users once the mode is
+	// revoked, within the same host update (`warp revoke --kick`).
+	Kick bool
+}
+
+// Grant is a time-limited mode granted to a user (`warp authorize --ttl`).
+type Grant struct {
+	User    string
+	Mode    Mode
+	Expires time.Time
 }
 
 // CommandResult is used to send command result to the local client.
@@ -127,5 +909,6 @@ type CommandResult struct {
 	Type         CommandType
 	Disconnected bool
 	SessionState State
+	Grants       []Grant
 	Error        Error
 }
@@ -0,0 +1,387 @@
+package warp_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/daemon"
+)
+
+// roundTrip gob encodes in and decodes it into out, failing the test if out
+// doesn't match in.
+func roundTrip(
+	t *testing.T,
+	in interface{},
+	out interface{},
+) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(in); err != nil {
+		t.Fatalf("Encode %T: %v", in, err)
+	}
+	if err := gob.NewDecoder(&buf).Decode(out); err != nil {
+		t.Fatalf("Decode %T: %v", in, err)
+	}
+	got := reflect.ValueOf(out).Elem().Interface()
+	if !reflect.DeepEqual(in, got) {
+		t.Errorf("Round trip of %T:\n got %+v\nwant %+v", in, got, in)
+	}
+}
+
+var testSession = warp.Session{
+	Token:  "tok",
+	User:   "usr",
+	Secret: "sec",
+}
+
+var testState = warp.State{
+	Warp:       "goofy-dev",
+	WindowSize: warp.Size{Rows: 24, Cols: 80},
+	Users: map[string]warp.User{
+		"usr": {
+			Token:     "usr",
+			Username:  "stan",
+			Mode:      warp.DefaultHostMode,
+			Hosting:   true,
+			Requested: warp.ModeSpeakWrite,
+		},
+	},
+	Panes:            []string{"edit", "logs"},
+	Pane:             "logs",
+	SingleWriter:     true,
+	Writer:           "usr",
+	Title:            "pairing",
+	Term:             "xterm-256color",
+	ReadOnly:         true,
+	Typing:           []string{"stan", "ada"},
+	Writing:          []string{"usr"},
+	HostSessions:     2,
+	HostReconnecting: true,
+	HostIdle:         3 * time.Second,
+	Refresh:          true,
+	MaxClients:       4,
+	SizePolicy:       warp.SizePolicyMin,
+	ClientsSize:      warp.Size{Rows: 20, Cols: 70},
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	roundTrip(t, testState, &warp.State{})
+}
+
+func TestHostUpdateRoundTrip(t *testing.T) {
+	roundTrip(t, warp.HostUpdate{
+		Warp:         "goofy-dev",
+		From:         testSession,
+		WindowSize:   warp.Size{Rows: 24, Cols: 80},
+		Modes:        map[string]warp.Mode{"usr": warp.ModeShellRead},
+		Panes:        []string{"edit", "logs"},
+		Pane:         "edit",
+		SingleWriter: true,
+		Writer:       "usr",
+		MaxClients:   2,
+		Kicks:        []warp.Kick{{User: "usr", Code: warp.ErrCodeKicked}},
+		Declines:     []string{"usr"},
+		SizePolicy:   warp.SizePolicyFixed,
+		Title:        "pairing",
+		Term:         "xterm",
+		ReadOnly:     true,
+		Closing:      true,
+	}, &warp.HostUpdate{})
+}
+
+func TestClientUpdateRoundTrip(t *testing.T) {
+	roundTrip(t, warp.ClientUpdate{
+		Refresh:    true,
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+		Request:    warp.ModeShellWrite,
+	}, &warp.ClientUpdate{})
+}
+
+func TestSessionHelloRoundTrip(t *testing.T) {
+	roundTrip(t, warp.SessionHello{
+		Warp:      "goofy-dev",
+		From:      testSession,
+		Version:   warp.Version,
+		Schema:    warp.SchemaVersion,
+		Type:      warp.SsTpShellClient,
+		Username:  "stan",
+		Sequenced: true,
+		Mode:      warp.ModeShellWrite,
+		Channels:  []warp.ChannelType{warp.ChannelChat},
+		Auth:      "secret-token",
+		Compress:  true,
+		Replay:    4096,
+	}, &warp.SessionHello{})
+}
+
+func TestErrorRoundTrip(t *testing.T) {
+	roundTrip(t, warp.Error{
+		Code:     warp.ErrCodeRedirect,
+		Message:  "Warp served elsewhere.",
+		Redirect: "warpd2.example.com:4242",
+	}, &warp.Error{})
+}
+
+func TestCommandRoundTrip(t *testing.T) {
+	roundTrip(t, warp.Command{
+		Type: warp.CmdTpRevoke,
+		Args: []string{"stan"},
+		Mode: warp.ModeSpeakWrite,
+		TTL:  10 * time.Minute,
+		Kick: true,
+	}, &warp.Command{})
+}
+
+func TestCommandResultRoundTrip(t *testing.T) {
+	roundTrip(t, warp.CommandResult{
+		Type:         warp.CmdTpState,
+		Disconnected: true,
+		SessionState: testState,
+		Grants: []warp.Grant{{
+			User:    "usr",
+			Mode:    warp.ModeShellWrite,
+			Expires: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC),
+		}},
+		Error: warp.Error{Code: warp.ErrCodeInternal, Message: "oops"},
+	}, &warp.CommandResult{})
+}
+
+func TestSchemaMismatchRejected(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errC := make(chan error, 1)
+	go func() {
+		_, err := daemon.NewSession(ctx, cancel, server)
+		errC <- err
+	}()
+
+	if err := warp.WritePreamble(client, warp.ProtocolVersion); err != nil {
+		t.Fatalf("WritePreamble: %v", err)
+	}
+	if _, err := warp.ReadPreamble(client); err != nil {
+		t.Fatalf("ReadPreamble: %v", err)
+	}
+	mux, err := yamux.Client(client, warp.MuxConfig(
+		time.Second, ioutil.Discard,
+	))
+	if err != nil {
+		t.Fatalf("yamux.Client: %v", err)
+	}
+	defer mux.Close()
+
+	channels := map[warp.ChannelType]net.Conn{}
+	for _, ct := range warp.RequiredChannels {
+		c, err := mux.Open()
+		if err != nil {
+			t.Fatalf("Open %s channel: %v", ct, err)
+		}
+		if err := warp.WriteChannelTag(c, ct); err != nil {
+			t.Fatalf("WriteChannelTag %s: %v", ct, err)
+		}
+		channels[ct] = c
+		if ct != warp.ChannelUpdate {
+			continue
+		}
+		if err := gob.NewEncoder(c).Encode(warp.SessionHello{
+			Warp:    "goofy-dev",
+			From:    testSession,
+			Version: warp.Version,
+			Schema:  warp.SchemaVersion + 1,
+			Type:    warp.SsTpShellClient,
+		}); err != nil {
+			t.Fatalf("Encode hello: %v", err)
+		}
+	}
+
+	var e warp.Error
+	if err := gob.NewDecoder(channels[warp.ChannelError]).Decode(&e); err != nil {
+		t.Fatalf("Decode error: %v", err)
+	}
+	if e.Code != warp.ErrCodeSchemaMismatch {
+		t.Errorf("Error code: got %q, want %q", e.Code, warp.ErrCodeSchemaMismatch)
+	}
+	if err := <-errC; err == nil {
+		t.Errorf("NewSession accepted a session with a mismatched schema")
+	}
+}
+
+func TestSizeValid(t *testing.T) {
+	for _, tc := range []struct {
+		size  warp.Size
+		valid bool
+	}{
+		{warp.Size{Rows: 24, Cols: 80}, true},
+		{warp.Size{Rows: 1, Cols: 1}, true},
+		{warp.Size{Rows: warp.MaxWindowSize, Cols: warp.MaxWindowSize}, true},
+		{warp.Size{}, false},
+		{warp.Size{Rows: 0, Cols: 80}, false},
+		{warp.Size{Rows: 24, Cols: 0}, false},
+		{warp.Size{Rows: -24, Cols: 80}, false},
+		{warp.Size{Rows: warp.MaxWindowSize + 1, Cols: 80}, false},
+		{warp.Size{Rows: 24, Cols: 1 << 30}, false},
+	} {
+		if got := tc.size.Valid(); got != tc.valid {
+			t.Errorf("%+v.Valid(): got %t, want %t", tc.size, got, tc.valid)
+		}
+	}
+}
+
+func TestDataFrameRoundTrip(t *testing.T) {
+	frames := []struct {
+		seq  uint64
+		data []byte
+	}{
+		{1, []byte("a")},
+		{2, []byte{}},
+		{3, bytes.Repeat([]byte("ls -la\r\n"), 128)},
+		{1 << 40, bytes.Repeat([]byte{0xff}, warp.MaxDataFrameSize)},
+	}
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := warp.WriteDataFrame(&buf, f.seq, f.data); err != nil {
+			t.Fatalf("WriteDataFrame %d: %v", f.seq, err)
+		}
+	}
+	for _, f := range frames {
+		seq, data, err := warp.ReadDataFrame(&buf)
+		if err != nil {
+			t.Fatalf("ReadDataFrame %d: %v", f.seq, err)
+		}
+		if seq != f.seq || !bytes.Equal(data, f.data) {
+			t.Errorf("Frame %d: got %d with %d bytes, want %d bytes",
+				f.seq, seq, len(data), len(f.data))
+		}
+	}
+	if _, _, err := warp.ReadDataFrame(&buf); err == nil {
+		t.Errorf("ReadDataFrame succeeded past the last frame")
+	}
+}
+
+func TestDataFrameErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := warp.WriteDataFrame(
+		&buf, 1, make([]byte, warp.MaxDataFrameSize+1),
+	); err == nil {
+		t.Errorf("WriteDataFrame accepted an oversized payload")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Oversized frame partially written: %d bytes", buf.Len())
+	}
+
+	// A header announcing an oversized payload is rejected before reading it.
+	header := make([]byte, warp.DataFrameHeaderSize)
+	header[8] = 0xff
+	if _, _, err := warp.ReadDataFrame(bytes.NewReader(header)); err == nil {
+		t.Errorf("ReadDataFrame accepted an oversized payload")
+	}
+
+	// Truncated headers and payloads.
+	warp.WriteDataFrame(&buf, 1, []byte("hello"))
+	frame := buf.Bytes()
+	for _, n := range []int{4, warp.DataFrameHeaderSize, len(frame) - 1} {
+		if _, _, err := warp.ReadDataFrame(
+			bytes.NewReader(frame[:n]),
+		); err == nil {
+			t.Errorf("ReadDataFrame accepted a frame truncated to %d bytes", n)
+		}
+	}
+}
+
+// countingConn counts the bytes written to a connection.
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(
+	p []byte,
+) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// wireBytes returns the bytes written to the connection per chunk of size
+// bytes relayed n times over a data channel, raw or in sequenced frames.
+func wireBytes(
+	b *testing.B,
+	size int,
+	n int,
+	sequenced bool,
+) float64 {
+	client, server := net.Pipe()
+	conn := &countingConn{Conn: client}
+	mux, err := yamux.Client(conn, warp.MuxConfig(
+		time.Minute, ioutil.Discard,
+	))
+	if err != nil {
+		b.Fatalf("yamux.Client: %v", err)
+	}
+	defer mux.Close()
+	peer, err := yamux.Server(server, warp.MuxConfig(
+		time.Minute, ioutil.Discard,
+	))
+	if err != nil {
+		b.Fatalf("yamux.Server: %v", err)
+	}
+	defer peer.Close()
+	go func() {
+		c, err := peer.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, c)
+	}()
+
+	dataC, err := mux.Open()
+	if err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+	// Opening the channel is not accounted for.
+	dataC.Write([]byte{0})
+	start := atomic.LoadInt64(&conn.written)
+
+	chunk := bytes.Repeat([]byte("x"), size)
+	for i := 0; i < n; i++ {
+		if sequenced {
+			err = warp.WriteDataFrame(dataC, uint64(i+1), chunk)
+		} else {
+			_, err = dataC.Write(chunk)
+		}
+		if err != nil {
+			b.Fatalf("Write: %v", err)
+		}
+	}
+	return float64(atomic.LoadInt64(&conn.written)-start) / float64(n)
+}
+
+// BenchmarkDataFrameOverhead measures the bytes added on the wire by sequenced
+// data frames to keystroke echos, lines and bulk output chunks, relayed over
+// a yamux data channel as warpd does.
+func BenchmarkDataFrameOverhead(b *testing.B) {
+	for _, size := range []int{1, 80, 1024, warp.MaxDataFrameSize} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			sequenced := wireBytes(b, size, b.N, true)
+			b.StopTimer()
+			raw := wireBytes(b, size, b.N, false)
+			b.ReportMetric(sequenced-raw, "frame-B/chunk")
+			b.ReportMetric(100*(sequenced-raw)/raw, "%overhead")
+		})
+	}
+}